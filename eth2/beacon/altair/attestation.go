@@ -14,14 +14,14 @@ func ProcessAttestations(ctx context.Context, spec *common.Spec, epc *common.Epo
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if err := ProcessAttestation(spec, epc, state, &ops[i]); err != nil {
+		if err := ProcessAttestation(ctx, spec, epc, state, &ops[i]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func ProcessAttestation(spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, attestation *phase0.Attestation) error {
+func ProcessAttestation(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, attestation *phase0.Attestation) error {
 	data := &attestation.Data
 
 	currentSlot, err := state.Slot()
@@ -72,7 +72,7 @@ func ProcessAttestation(spec *common.Spec, epc *common.EpochsContext, state *Bea
 	indexedAtt, err := attestation.ConvertToIndexed(spec, committee)
 	if err != nil {
 		return fmt.Errorf("attestation could not be converted to an indexed attestation: %v", err)
-	} else if err := phase0.ValidateIndexedAttestation(spec, epc, state, indexedAtt); err != nil {
+	} else if err := phase0.ValidateIndexedAttestation(ctx, spec, epc, state, indexedAtt); err != nil {
 		return fmt.Errorf("attestation could not be verified in its indexed form: %v", err)
 	}
 
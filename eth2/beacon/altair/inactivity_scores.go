@@ -2,6 +2,7 @@ package altair
 
 import (
 	"context"
+	"encoding/binary"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/ztyp/codec"
 	"github.com/protolambda/ztyp/tree"
@@ -61,6 +62,20 @@ func (v *InactivityScoresView) SetScore(index common.ValidatorIndex, score uint6
 	return v.Set(uint64(index), Uint64View(score))
 }
 
+func (v *InactivityScoresView) FillZeroes(length uint64) error {
+	// 4 scores (uint64) per node (bytes32)
+	nodesLen := (length + 3) / 4
+	depth := tree.CoverDepth(v.BottomNodeLimit())
+	zero := &tree.Root{}
+	contents, err := tree.SubtreeFillToLength(zero, depth, nodesLen)
+	if err != nil {
+		return err
+	}
+	lengthNode := &tree.Root{}
+	binary.LittleEndian.PutUint64(lengthNode[:8], length)
+	return v.SetBacking(tree.NewPairNode(contents, lengthNode))
+}
+
 func ProcessInactivityUpdates(ctx context.Context, spec *common.Spec, attesterData *EpochAttesterData, state *BeaconStateView) error {
 	if err := ctx.Err(); err != nil {
 		return err
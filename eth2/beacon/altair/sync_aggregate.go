@@ -177,7 +177,12 @@ func ProcessSyncAggregate(ctx context.Context, spec *common.Spec, epc *common.Ep
 		return err
 	}
 	signingRoot := common.ComputeSigningRoot(blockRoot, domain)
-	if !bls.Eth2FastAggregateVerify(participantPubkeys, signingRoot, agg.SyncCommitteeSignature) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     participantPubkeys,
+		Message:     signingRoot,
+		Signature:   agg.SyncCommitteeSignature,
+		Description: fmt.Sprintf("sync aggregate (slot %d)", prevSlot),
+	}) {
 		return errors.New("invalid sync committee signature")
 	}
 
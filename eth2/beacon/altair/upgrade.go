@@ -0,0 +1,199 @@
+package altair
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+// Fields of the BeaconState that did not change between phase0 and altair, neither in type nor in position.
+// These are transferred as-is during the upgrade: the subtrees are shared with the pre-state, no data is copied.
+var unchangedPhase0Fields = []uint64{
+	_stateGenesisTime,
+	_stateGenesisValidatorsRoot,
+	_stateSlot,
+	_stateFork,
+	_stateLatestBlockHeader,
+	_stateBlockRoots,
+	_stateStateRoots,
+	_stateHistoricalRoots,
+	_stateEth1Data,
+	_stateEth1DataVotes,
+	_stateDepositIndex,
+	_stateValidators,
+	_stateBalances,
+	_stateRandaoMixes,
+	_stateSlashings,
+	_stateJustificationBits,
+	_statePreviousJustifiedCheckpoint,
+	_stateCurrentJustifiedCheckpoint,
+	_stateFinalizedCheckpoint,
+}
+
+// UpgradeToAltair translates a phase0 state at the altair fork boundary into an altair state.
+// The previous-epoch participation is translated from the pending attestations of the pre-state,
+// and the sync committees are initialized. The sync committees of the EpochsContext are updated as well.
+// The pre-state is not modified.
+func UpgradeToAltair(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, pre *phase0.BeaconStateView) (*BeaconStateView, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slot, err := pre.Slot()
+	if err != nil {
+		return nil, err
+	}
+	epoch := spec.SlotToEpoch(slot)
+	preFork, err := pre.Fork()
+	if err != nil {
+		return nil, err
+	}
+	vals, err := pre.Validators()
+	if err != nil {
+		return nil, err
+	}
+	valCount, err := vals.ValidatorCount()
+	if err != nil {
+		return nil, err
+	}
+
+	post := NewBeaconStateView(spec)
+	for _, i := range unchangedPhase0Fields {
+		v, err := pre.Get(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get phase0 state field %d: %v", i, err)
+		}
+		if err := post.Set(i, v); err != nil {
+			return nil, fmt.Errorf("failed to set altair state field %d: %v", i, err)
+		}
+	}
+
+	if err := post.SetFork(common.Fork{
+		PreviousVersion: preFork.CurrentVersion,
+		CurrentVersion:  spec.ALTAIR_FORK_VERSION,
+		Epoch:           epoch,
+	}); err != nil {
+		return nil, err
+	}
+
+	prevPart, err := post.PreviousEpochParticipation()
+	if err != nil {
+		return nil, err
+	}
+	if err := prevPart.FillZeroes(valCount); err != nil {
+		return nil, err
+	}
+	currPart, err := post.CurrentEpochParticipation()
+	if err != nil {
+		return nil, err
+	}
+	if err := currPart.FillZeroes(valCount); err != nil {
+		return nil, err
+	}
+	inactivityScores, err := post.InactivityScores()
+	if err != nil {
+		return nil, err
+	}
+	if err := inactivityScores.FillZeroes(valCount); err != nil {
+		return nil, err
+	}
+
+	// Fill in previous epoch participation from the pre state's pending attestations
+	prevAtts, err := pre.PreviousEpochAttestations()
+	if err != nil {
+		return nil, err
+	}
+	if err := TranslateParticipation(ctx, spec, epc, post, prevAtts); err != nil {
+		return nil, fmt.Errorf("failed to translate participation: %v", err)
+	}
+
+	// Fill in sync committees
+	// Note: A duplicate committee is assigned for the current and next committee at the fork boundary
+	syncCommittee, err := common.ComputeNextSyncCommittee(spec, epc, post)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute sync committee: %v", err)
+	}
+	currSyncView, err := syncCommittee.View(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := post.SetCurrentSyncCommittee(currSyncView); err != nil {
+		return nil, err
+	}
+	nextSyncView, err := syncCommittee.View(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := post.SetNextSyncCommittee(nextSyncView); err != nil {
+		return nil, err
+	}
+	if err := epc.LoadSyncCommittees(post); err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// TranslateParticipation applies the participation flags of the given phase0 pending attestations
+// to the previous-epoch participation of the altair state.
+func TranslateParticipation(ctx context.Context, spec *common.Spec, epc *common.EpochsContext,
+	state *BeaconStateView, pendingAtts *phase0.PendingAttestationsView) error {
+
+	epochParticipation, err := state.PreviousEpochParticipation()
+	if err != nil {
+		return err
+	}
+	participants := make([]common.ValidatorIndex, 0, spec.MAX_VALIDATORS_PER_COMMITTEE)
+	attIter := pendingAtts.ReadonlyIter()
+	i := 0
+	for {
+		// every 32 attestations, check if the context is done.
+		if i&((1<<5)-1) == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		el, ok, err := attIter.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		attView, err := phase0.AsPendingAttestation(el, nil)
+		if err != nil {
+			return err
+		}
+		att, err := attView.Raw()
+		if err != nil {
+			return err
+		}
+		// Translate attestation inclusion info to flag indices
+		applyFlags, err := GetApplicableAttestationParticipationFlags(spec, state, &att.Data, att.InclusionDelay)
+		if err != nil {
+			return err
+		}
+		committee, err := epc.GetBeaconCommittee(att.Data.Slot, att.Data.Index)
+		if err != nil {
+			return err
+		}
+		if att.AggregationBits.BitLen() != uint64(len(committee)) {
+			return fmt.Errorf("pending attestation %d aggregation bits length does not match committee size %d", i, len(committee))
+		}
+		participants = participants[:0]                                     // reset old slice (re-used in for loop)
+		participants = append(participants, committee...)                   // add committee indices
+		participants = att.AggregationBits.FilterParticipants(participants) // only keep the participants
+
+		// Apply flags to all attesting validators
+		for _, vi := range participants {
+			existingFlags, err := epochParticipation.GetFlags(vi)
+			if err != nil {
+				return err
+			}
+			if err := epochParticipation.SetFlags(vi, existingFlags|applyFlags); err != nil {
+				return err
+			}
+		}
+		i += 1
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package common
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"github.com/protolambda/zrnt/eth2/util/bls"
 )
 
@@ -31,6 +33,11 @@ func (b *BeaconBlockEnvelope) VerifySignature(spec *Spec, genesisValidatorsRoot
 
 // deprecated: to verify with explicit version
 func (b *BeaconBlockEnvelope) VerifySignatureVersioned(spec *Spec, version Version, genesisValidatorsRoot Root, proposer ValidatorIndex, pub *CachedPubkey) bool {
+	return b.verifySignature(context.Background(), version, genesisValidatorsRoot, proposer, pub)
+}
+
+// verifySignature verifies the block signature, or defers it to the signature batch of the context, if any.
+func (b *BeaconBlockEnvelope) verifySignature(ctx context.Context, version Version, genesisValidatorsRoot Root, proposer ValidatorIndex, pub *CachedPubkey) bool {
 	if b.ProposerIndex != proposer {
 		return false
 	}
@@ -39,8 +46,18 @@ func (b *BeaconBlockEnvelope) VerifySignatureVersioned(spec *Spec, version Versi
 	if !bytes.Equal(forkRoot[0:4], b.ForkDigest[:]) {
 		return false
 	}
+	return bls.VerifySet(ctx, b.SignatureSet(version, genesisValidatorsRoot, pub))
+}
+
+// SignatureSet returns the proposer signature of the block, to verify with the pubkey of the proposer.
+func (b *BeaconBlockEnvelope) SignatureSet(version Version, genesisValidatorsRoot Root, pub *CachedPubkey) bls.SignatureSet {
 	dom := ComputeDomain(DOMAIN_BEACON_PROPOSER, version, genesisValidatorsRoot)
-	return bls.Verify(pub, ComputeSigningRoot(b.BlockRoot, dom), b.Signature)
+	return bls.SignatureSet{
+		Pubkeys:     []*CachedPubkey{pub},
+		Message:     ComputeSigningRoot(b.BlockRoot, dom),
+		Signature:   b.Signature,
+		Description: fmt.Sprintf("block %s (slot %d, proposer %d)", b.BlockRoot, b.Slot, b.ProposerIndex),
+	}
 }
 
 type EnvelopeBuilder interface {
@@ -13,6 +13,8 @@ type BatchRoots interface {
 }
 
 type HistoricalRoots interface {
+	Length() (uint64, error)
+	GetRoot(i uint64) (Root, error)
 	Append(root Root) error
 }
 
@@ -4,7 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	hbls "github.com/herumi/bls-eth-go-binary/bls"
+	"github.com/protolambda/zrnt/eth2/util/bls"
 	"github.com/protolambda/zrnt/eth2/util/hashing"
 	"github.com/protolambda/ztyp/codec"
 	"github.com/protolambda/ztyp/tree"
@@ -144,21 +144,19 @@ func ComputeNextSyncCommittee(spec *Spec, epc *EpochsContext, state BeaconState)
 
 func IndicesToSyncCommittee(indices []ValidatorIndex, pubCache *PubkeyCache) (*SyncCommittee, error) {
 	var pubs []BLSPubkey
-	var blsAggregate hbls.PublicKey
+	cached := make([]*CachedPubkey, 0, len(indices))
 	for _, idx := range indices {
 		pub, ok := pubCache.Pubkey(idx)
 		if !ok {
 			return nil, fmt.Errorf("failed to get sync committee data, pubkey cache is missing pubkey for index %d", idx)
 		}
-		blsPub, err := pub.Pubkey()
-		if err != nil {
-			return nil, fmt.Errorf("pubkey cache contains invalid pubkey at index %d: %v", idx, err)
-		}
-		blsAggregate.Add(blsPub)
+		cached = append(cached, pub)
 		pubs = append(pubs, pub.Compressed)
 	}
-	var aggregate BLSPubkey
-	copy(aggregate[:], blsAggregate.Serialize())
+	aggregate, err := bls.AggregatePubkeys(cached)
+	if err != nil {
+		return nil, fmt.Errorf("pubkey cache contains invalid pubkey: %v", err)
+	}
 	return &SyncCommittee{
 		Pubkeys:         pubs,
 		AggregatePubkey: aggregate,
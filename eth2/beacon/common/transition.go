@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/protolambda/zrnt/eth2/util/bls"
 	"github.com/protolambda/ztyp/tree"
 )
 
@@ -108,6 +109,10 @@ func StateTransition(ctx context.Context, spec *Spec, epc *EpochsContext, state
 }
 
 // PostSlotTransition finishes a state transition after applying ProcessSlots(..., block.Slot).
+//
+// The signatures of the block are collected while processing, and verified at once in a single batch,
+// before verifying the state root. If the context already has a signature batch (see bls.WithSignatureBatch),
+// the signatures are added to that batch instead, and the caller is responsible for verifying it.
 func PostSlotTransition(ctx context.Context, spec *Spec, epc *EpochsContext, state BeaconState, benv *BeaconBlockEnvelope, validateResult bool) error {
 	slot, err := state.Slot()
 	if err != nil {
@@ -116,6 +121,12 @@ func PostSlotTransition(ctx context.Context, spec *Spec, epc *EpochsContext, sta
 	if slot != benv.Slot {
 		return fmt.Errorf("transition of block, post-slot-processing, must run on state with same slot")
 	}
+	sigBatch := bls.SignatureBatchFromContext(ctx)
+	ownBatch := sigBatch == nil
+	if ownBatch {
+		sigBatch = bls.NewSignatureBatch()
+		ctx = bls.WithSignatureBatch(ctx, sigBatch)
+	}
 	if validateResult {
 		// TODO: tests have invalid fork version in state
 		fork, err := state.Fork()
@@ -139,13 +150,18 @@ func PostSlotTransition(ctx context.Context, spec *Spec, epc *EpochsContext, sta
 		if !ok {
 			return fmt.Errorf("unknown pubkey for proposer %d", proposer)
 		}
-		if !benv.VerifySignatureVersioned(spec, fork.CurrentVersion, genValRoot, proposer, pub) {
+		if !benv.verifySignature(ctx, fork.CurrentVersion, genValRoot, proposer, pub) {
 			return errors.New("block has invalid signature")
 		}
 	}
 	if err := state.ProcessBlock(ctx, spec, epc, benv); err != nil {
 		return err
 	}
+	if ownBatch {
+		if err := sigBatch.Verify(); err != nil {
+			return fmt.Errorf("block has invalid signatures: %v", err)
+		}
+	}
 
 	// State root verification
 	if validateResult && benv.StateRoot != state.HashTreeRoot(tree.GetHashFn()) {
@@ -1,6 +1,7 @@
 package beacon
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/altair"
@@ -9,55 +10,276 @@ import (
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"github.com/protolambda/zrnt/eth2/beacon/sharding"
 	"github.com/protolambda/ztyp/codec"
+	"github.com/protolambda/ztyp/tree"
 	"io"
+	"reflect"
+	"sort"
 )
 
+// ForkBlock is a signed beacon block of a specific fork.
+type ForkBlock interface {
+	common.EnvelopeBuilder
+	common.SpecObj
+}
+
+// ForkScheduleEntry describes a fork: from Epoch onwards Version is the current fork version,
+// and blocks and states are of the types of this fork.
+type ForkScheduleEntry struct {
+	Name    string
+	Epoch   common.Epoch
+	Version common.Version
+	// Digest is computed by the ForkDecoder, and does not have to be set in the schedule input.
+	Digest common.ForkDigest
+	// NewBlock allocates an empty signed block of this fork, to decode into.
+	NewBlock func() ForkBlock
+	// DecodeState decodes a beacon state of this fork.
+	DecodeState func(spec *common.Spec, dr *codec.DecodingReader) (common.BeaconState, error)
+	// StateFromBacking wraps the backing tree of a beacon state of this fork in a state view.
+	StateFromBacking func(spec *common.Spec, backing tree.Node) (common.BeaconState, error)
+}
+
+// ForkSchedule lists the forks, ordered by activation epoch.
+// Forks with the same activation epoch are ordered by precedence, the last one is active.
+type ForkSchedule []ForkScheduleEntry
+
+// StandardForkSchedule builds the schedule of the forks implemented in this package, with the fork epochs of the spec.
+func StandardForkSchedule(spec *common.Spec) ForkSchedule {
+	return ForkSchedule{
+		{
+			Name:     "phase0",
+			Epoch:    common.GENESIS_EPOCH,
+			Version:  spec.GENESIS_FORK_VERSION,
+			NewBlock: func() ForkBlock { return new(phase0.SignedBeaconBlock) },
+			DecodeState: func(spec *common.Spec, dr *codec.DecodingReader) (common.BeaconState, error) {
+				state, err := phase0.AsBeaconStateView(phase0.BeaconStateType(spec).Deserialize(dr))
+				if err != nil {
+					return nil, err
+				}
+				return state, nil
+			},
+			StateFromBacking: func(spec *common.Spec, backing tree.Node) (common.BeaconState, error) {
+				state, err := phase0.AsBeaconStateView(phase0.BeaconStateType(spec).ViewFromBacking(backing, nil))
+				if err != nil {
+					return nil, err
+				}
+				return state, nil
+			},
+		},
+		{
+			Name:     "altair",
+			Epoch:    spec.ALTAIR_FORK_EPOCH,
+			Version:  spec.ALTAIR_FORK_VERSION,
+			NewBlock: func() ForkBlock { return new(altair.SignedBeaconBlock) },
+			DecodeState: func(spec *common.Spec, dr *codec.DecodingReader) (common.BeaconState, error) {
+				state, err := altair.AsBeaconStateView(altair.BeaconStateType(spec).Deserialize(dr))
+				if err != nil {
+					return nil, err
+				}
+				return state, nil
+			},
+			StateFromBacking: func(spec *common.Spec, backing tree.Node) (common.BeaconState, error) {
+				state, err := altair.AsBeaconStateView(altair.BeaconStateType(spec).ViewFromBacking(backing, nil))
+				if err != nil {
+					return nil, err
+				}
+				return state, nil
+			},
+		},
+		{
+			Name:     "merge",
+			Epoch:    spec.MERGE_FORK_EPOCH,
+			Version:  spec.MERGE_FORK_VERSION,
+			NewBlock: func() ForkBlock { return new(merge.SignedBeaconBlock) },
+			DecodeState: func(spec *common.Spec, dr *codec.DecodingReader) (common.BeaconState, error) {
+				state, err := merge.AsBeaconStateView(merge.BeaconStateType(spec).Deserialize(dr))
+				if err != nil {
+					return nil, err
+				}
+				return state, nil
+			},
+			StateFromBacking: func(spec *common.Spec, backing tree.Node) (common.BeaconState, error) {
+				state, err := merge.AsBeaconStateView(merge.BeaconStateType(spec).ViewFromBacking(backing, nil))
+				if err != nil {
+					return nil, err
+				}
+				return state, nil
+			},
+		},
+		{
+			Name:     "sharding",
+			Epoch:    spec.SHARDING_FORK_EPOCH,
+			Version:  spec.SHARDING_FORK_VERSION,
+			NewBlock: func() ForkBlock { return new(sharding.SignedBeaconBlock) },
+			DecodeState: func(spec *common.Spec, dr *codec.DecodingReader) (common.BeaconState, error) {
+				state, err := sharding.AsBeaconStateView(sharding.BeaconStateType(spec).Deserialize(dr))
+				if err != nil {
+					return nil, err
+				}
+				return state, nil
+			},
+			StateFromBacking: func(spec *common.Spec, backing tree.Node) (common.BeaconState, error) {
+				state, err := sharding.AsBeaconStateView(sharding.BeaconStateType(spec).ViewFromBacking(backing, nil))
+				if err != nil {
+					return nil, err
+				}
+				return state, nil
+			},
+		},
+	}
+}
+
 type ForkDecoder struct {
-	Spec     *common.Spec
+	Spec *common.Spec
+	// Schedule with computed fork digests, ordered by activation epoch.
+	Schedule ForkSchedule
+
+	// Deprecated: use Schedule, ForkByDigest or ForkDigestAtEpoch instead.
+	// The digests of the standard forks, filled from the schedule entries with the same name, if any.
 	Genesis  common.ForkDigest
 	Altair   common.ForkDigest
 	Merge    common.ForkDigest
 	Sharding common.ForkDigest
-	// TODO more forks
 }
 
 func NewForkDecoder(spec *common.Spec, genesisValRoot common.Root) *ForkDecoder {
-	return &ForkDecoder{
+	return NewForkDecoderWithSchedule(spec, genesisValRoot, StandardForkSchedule(spec))
+}
+
+// NewForkDecoderWithSchedule creates a decoder for a custom fork schedule, e.g. with additional devnet forks.
+// The schedule is copied and sorted by activation epoch, the input is not modified.
+func NewForkDecoderWithSchedule(spec *common.Spec, genesisValRoot common.Root, schedule ForkSchedule) *ForkDecoder {
+	sched := make(ForkSchedule, len(schedule), len(schedule))
+	copy(sched, schedule)
+	sort.SliceStable(sched, func(i, j int) bool {
+		return sched[i].Epoch < sched[j].Epoch
+	})
+	d := &ForkDecoder{
 		Spec:     spec,
-		Genesis:  common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genesisValRoot),
-		Altair:   common.ComputeForkDigest(spec.ALTAIR_FORK_VERSION, genesisValRoot),
-		Merge:    common.ComputeForkDigest(spec.MERGE_FORK_VERSION, genesisValRoot),
-		Sharding: common.ComputeForkDigest(spec.SHARDING_FORK_VERSION, genesisValRoot),
+		Schedule: sched,
 	}
+	for i := range sched {
+		sched[i].Digest = common.ComputeForkDigest(sched[i].Version, genesisValRoot)
+		switch sched[i].Name {
+		case "phase0":
+			d.Genesis = sched[i].Digest
+		case "altair":
+			d.Altair = sched[i].Digest
+		case "merge":
+			d.Merge = sched[i].Digest
+		case "sharding":
+			d.Sharding = sched[i].Digest
+		}
+	}
+	return d
 }
 
-func (d *ForkDecoder) DecodeBlock(digest common.ForkDigest,
-	length uint64, r io.Reader) (*common.BeaconBlockEnvelope, error) {
+// ForkAtEpoch returns the fork that is active at the given epoch, or nil if the schedule has no fork active yet.
+func (d *ForkDecoder) ForkAtEpoch(epoch common.Epoch) *ForkScheduleEntry {
+	var out *ForkScheduleEntry
+	for i := range d.Schedule {
+		if d.Schedule[i].Epoch > epoch {
+			break
+		}
+		out = &d.Schedule[i]
+	}
+	return out
+}
 
-	var block interface {
-		common.EnvelopeBuilder
-		common.SpecObj
+// ForkAtSlot returns the fork that is active at the given slot, or nil if the schedule has no fork active yet.
+func (d *ForkDecoder) ForkAtSlot(slot common.Slot) *ForkScheduleEntry {
+	return d.ForkAtEpoch(d.Spec.SlotToEpoch(slot))
+}
+
+// ForkByDigest returns the fork with the given digest.
+func (d *ForkDecoder) ForkByDigest(digest common.ForkDigest) (*ForkScheduleEntry, bool) {
+	for i := range d.Schedule {
+		if d.Schedule[i].Digest == digest {
+			return &d.Schedule[i], true
+		}
 	}
+	return nil, false
+}
 
-	switch digest {
-	case d.Genesis:
-		block = new(phase0.SignedBeaconBlock)
-	case d.Altair:
-		block = new(altair.SignedBeaconBlock)
-	case d.Merge:
-		block = new(merge.SignedBeaconBlock)
-	case d.Sharding:
-		block = new(sharding.SignedBeaconBlock)
-	default:
-		return nil, fmt.Errorf("unrecognized fork digest: %s", digest)
+func (d *ForkDecoder) ForkDigestAtEpoch(epoch common.Epoch) (common.ForkDigest, error) {
+	fork := d.ForkAtEpoch(epoch)
+	if fork == nil {
+		return common.ForkDigest{}, fmt.Errorf("no fork active at epoch %d", epoch)
 	}
+	return fork.Digest, nil
+}
 
+func (d *ForkDecoder) ForkDigestAtSlot(slot common.Slot) (common.ForkDigest, error) {
+	return d.ForkDigestAtEpoch(d.Spec.SlotToEpoch(slot))
+}
+
+func (d *ForkDecoder) ForkVersionAtEpoch(epoch common.Epoch) (common.Version, error) {
+	fork := d.ForkAtEpoch(epoch)
+	if fork == nil {
+		return common.Version{}, fmt.Errorf("no fork active at epoch %d", epoch)
+	}
+	return fork.Version, nil
+}
+
+func (d *ForkDecoder) ForkVersionAtSlot(slot common.Slot) (common.Version, error) {
+	return d.ForkVersionAtEpoch(d.Spec.SlotToEpoch(slot))
+}
+
+func (d *ForkDecoder) DecodeBlock(digest common.ForkDigest,
+	length uint64, r io.Reader) (*common.BeaconBlockEnvelope, error) {
+
+	fork, ok := d.ForkByDigest(digest)
+	if !ok {
+		return nil, fmt.Errorf("unrecognized fork digest: %s", digest)
+	}
+	block := fork.NewBlock()
 	if err := block.Deserialize(d.Spec, codec.NewDecodingReader(r, length)); err != nil {
 		return nil, err
 	}
 	return block.Envelope(d.Spec, digest), nil
 }
 
+// WriteBlock writes the fork digest of the block, followed by the serialized signed block.
+// An error is returned if the digest is unknown, or does not match the type of the block.
+func (d *ForkDecoder) WriteBlock(w io.Writer, benv *common.BeaconBlockEnvelope) error {
+	fork, ok := d.ForkByDigest(benv.ForkDigest)
+	if !ok {
+		return fmt.Errorf("unrecognized fork digest: %s", benv.ForkDigest)
+	}
+	if expected := reflect.TypeOf(fork.NewBlock()); reflect.TypeOf(benv.SignedBlock) != expected {
+		return fmt.Errorf("block of type %T does not match type %s of fork %s", benv.SignedBlock, expected, fork.Name)
+	}
+	if _, err := w.Write(benv.ForkDigest[:]); err != nil {
+		return err
+	}
+	return benv.SignedBlock.Serialize(d.Spec, codec.NewEncodingWriter(w))
+}
+
+// EncodeBlock encodes the block as fork digest, followed by the serialized signed block.
+func (d *ForkDecoder) EncodeBlock(benv *common.BeaconBlockEnvelope) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := d.WriteBlock(&buf, benv); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *ForkDecoder) DecodeState(digest common.ForkDigest, length uint64, r io.Reader) (common.BeaconState, error) {
+	fork, ok := d.ForkByDigest(digest)
+	if !ok {
+		return nil, fmt.Errorf("unrecognized fork digest: %s", digest)
+	}
+	return fork.DecodeState(d.Spec, codec.NewDecodingReader(r, length))
+}
+
+// StateFromBacking wraps the backing tree of a beacon state in a state view of the fork with the given digest.
+func (d *ForkDecoder) StateFromBacking(digest common.ForkDigest, backing tree.Node) (common.BeaconState, error) {
+	fork, ok := d.ForkByDigest(digest)
+	if !ok {
+		return nil, fmt.Errorf("unrecognized fork digest: %s", digest)
+	}
+	return fork.StateFromBacking(d.Spec, backing)
+}
+
 type StandardUpgradeableBeaconState struct {
 	common.BeaconState
 }
@@ -68,20 +290,32 @@ func (s *StandardUpgradeableBeaconState) UpgradeMaybe(ctx context.Context, spec
 	if err != nil {
 		return err
 	}
-	switch pre.(type) {
+	switch pre := pre.(type) {
 	case *phase0.BeaconStateView:
 		if slot == common.Slot(spec.ALTAIR_FORK_EPOCH)*spec.SLOTS_PER_EPOCH {
-			// TODO: upgrade
+			post, err := altair.UpgradeToAltair(ctx, spec, epc, pre)
+			if err != nil {
+				return fmt.Errorf("failed to upgrade phase0 to altair state: %v", err)
+			}
+			s.BeaconState = post
 		}
 		return nil
 	case *altair.BeaconStateView:
 		if slot == common.Slot(spec.MERGE_FORK_EPOCH)*spec.SLOTS_PER_EPOCH {
-			// TODO: upgrade
+			post, err := merge.UpgradeToMerge(ctx, spec, epc, pre)
+			if err != nil {
+				return fmt.Errorf("failed to upgrade altair to merge state: %v", err)
+			}
+			s.BeaconState = post
 		}
 		return nil
 	case *merge.BeaconStateView:
 		if slot == common.Slot(spec.SHARDING_FORK_EPOCH)*spec.SLOTS_PER_EPOCH {
-			// TODO: upgrade
+			post, err := sharding.UpgradeToSharding(ctx, spec, epc, pre)
+			if err != nil {
+				return fmt.Errorf("failed to upgrade merge to sharding state: %v", err)
+			}
+			s.BeaconState = post
 		}
 		return nil
 	default:
@@ -0,0 +1,235 @@
+package beacon
+
+import (
+	"bytes"
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/beacon/sharding"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"github.com/protolambda/ztyp/codec"
+	"github.com/protolambda/ztyp/tree"
+	"testing"
+)
+
+func TestUpgradeToAltair(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 2
+	pre, epc := kickstarttest.State(t, &spec, 64)
+
+	state := &StandardUpgradeableBeaconState{BeaconState: pre}
+	forkSlot := common.Slot(spec.ALTAIR_FORK_EPOCH) * spec.SLOTS_PER_EPOCH
+	if err := common.ProcessSlots(context.Background(), &spec, epc, state, forkSlot-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.BeaconState.(*phase0.BeaconStateView); !ok {
+		t.Fatalf("expected phase0 state before fork, got %T", state.BeaconState)
+	}
+	if err := common.ProcessSlots(context.Background(), &spec, epc, state, forkSlot+1); err != nil {
+		t.Fatal(err)
+	}
+	post, ok := state.BeaconState.(*altair.BeaconStateView)
+	if !ok {
+		t.Fatalf("expected altair state after fork, got %T", state.BeaconState)
+	}
+	fork, err := post.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork.CurrentVersion != spec.ALTAIR_FORK_VERSION || fork.PreviousVersion != spec.GENESIS_FORK_VERSION ||
+		fork.Epoch != spec.ALTAIR_FORK_EPOCH {
+		t.Fatalf("unexpected fork data: %v", fork)
+	}
+	scores, err := post.InactivityScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := scores.Length(); err != nil {
+		t.Fatal(err)
+	} else if n != 64 {
+		t.Fatalf("expected 64 inactivity scores, got %d", n)
+	}
+	raw, err := post.Raw(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.HashTreeRoot(&spec, tree.GetHashFn()) != post.HashTreeRoot(tree.GetHashFn()) {
+		t.Fatal("upgraded state tree is inconsistent with its serialized form")
+	}
+	if epc.CurrentSyncCommittee == nil || epc.NextSyncCommittee == nil {
+		t.Fatal("expected sync committees to be loaded into the epochs context")
+	}
+	if uint64(len(epc.CurrentSyncCommittee.Indices)) != spec.SYNC_COMMITTEE_SIZE {
+		t.Fatalf("unexpected sync committee size: %d", len(epc.CurrentSyncCommittee.Indices))
+	}
+}
+
+func TestUpgradeThroughAllForks(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	spec.MERGE_FORK_EPOCH = 2
+	spec.SHARDING_FORK_EPOCH = 3
+	pre, epc := kickstarttest.State(t, &spec, 64)
+
+	state := &StandardUpgradeableBeaconState{BeaconState: pre}
+	target := common.Slot(spec.SHARDING_FORK_EPOCH)*spec.SLOTS_PER_EPOCH + 1
+	if err := common.ProcessSlots(context.Background(), &spec, epc, state, target); err != nil {
+		t.Fatal(err)
+	}
+	post, ok := state.BeaconState.(*sharding.BeaconStateView)
+	if !ok {
+		t.Fatalf("expected sharding state after all forks, got %T", state.BeaconState)
+	}
+	fork, err := post.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork.CurrentVersion != spec.SHARDING_FORK_VERSION || fork.PreviousVersion != spec.MERGE_FORK_VERSION ||
+		fork.Epoch != spec.SHARDING_FORK_EPOCH {
+		t.Fatalf("unexpected fork data: %v", fork)
+	}
+	gasPrice, err := post.ShardGasPrice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gasPrice != spec.MIN_GASPRICE {
+		t.Fatalf("expected shard gasprice %d, got %d", spec.MIN_GASPRICE, gasPrice)
+	}
+	header, err := post.LatestExecutionPayloadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.HashTreeRoot(tree.GetHashFn()) != common.ExecutionPayloadHeaderType.DefaultNode().MerkleRoot(tree.GetHashFn()) {
+		t.Fatal("expected empty execution payload header")
+	}
+	buffer, err := post.ShardBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	column, err := buffer.Column(uint64(target % spec.SHARD_STATE_MEMORY_SLOTS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := column.Length(); err != nil {
+		t.Fatal(err)
+	} else if n != spec.ActiveShardCount(spec.SHARDING_FORK_EPOCH) {
+		t.Fatalf("expected shard work for %d active shards, got %d", spec.ActiveShardCount(spec.SHARDING_FORK_EPOCH), n)
+	}
+	if epc.CurrentSyncCommittee != nil || epc.NextSyncCommittee != nil {
+		t.Fatal("expected sync committees to be cleared from the epochs context after the merge")
+	}
+}
+
+func TestForkDecoderSchedule(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 2
+	spec.MERGE_FORK_EPOCH = 4
+	dec := NewForkDecoder(&spec, common.Root{0x42})
+	for _, c := range []struct {
+		epoch   common.Epoch
+		version common.Version
+	}{
+		{0, spec.GENESIS_FORK_VERSION},
+		{1, spec.GENESIS_FORK_VERSION},
+		{2, spec.ALTAIR_FORK_VERSION},
+		{3, spec.ALTAIR_FORK_VERSION},
+		{4, spec.MERGE_FORK_VERSION},
+		{1000, spec.MERGE_FORK_VERSION},
+	} {
+		version, err := dec.ForkVersionAtSlot(common.Slot(c.epoch) * spec.SLOTS_PER_EPOCH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != c.version {
+			t.Fatalf("epoch %d: expected version %s, got %s", c.epoch, c.version, version)
+		}
+		digest, err := dec.ForkDigestAtEpoch(c.epoch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := common.ComputeForkDigest(c.version, common.Root{0x42}); digest != expected {
+			t.Fatalf("epoch %d: expected digest %s, got %s", c.epoch, expected, digest)
+		}
+	}
+
+	// the deprecated digest fields are still filled in
+	if expected := common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, common.Root{0x42}); dec.Genesis != expected {
+		t.Fatalf("expected genesis digest %s, got %s", expected, dec.Genesis)
+	}
+	if expected := common.ComputeForkDigest(spec.ALTAIR_FORK_VERSION, common.Root{0x42}); dec.Altair != expected {
+		t.Fatalf("expected altair digest %s, got %s", expected, dec.Altair)
+	}
+	if expected := common.ComputeForkDigest(spec.MERGE_FORK_VERSION, common.Root{0x42}); dec.Merge != expected {
+		t.Fatalf("expected merge digest %s, got %s", expected, dec.Merge)
+	}
+	if expected := common.ComputeForkDigest(spec.SHARDING_FORK_VERSION, common.Root{0x42}); dec.Sharding != expected {
+		t.Fatalf("expected sharding digest %s, got %s", expected, dec.Sharding)
+	}
+
+	// a devnet fork can be added to the schedule, without changes to the decoder
+	schedule := StandardForkSchedule(&spec)
+	devnet := schedule[0]
+	devnet.Name = "devnet"
+	devnet.Epoch = 3
+	devnet.Version = common.Version{0xde, 0xf0, 0x00, 0x01}
+	schedule = append(schedule, devnet)
+	dec = NewForkDecoderWithSchedule(&spec, common.Root{0x42}, schedule)
+	if fork := dec.ForkAtEpoch(3); fork == nil || fork.Name != "devnet" {
+		t.Fatalf("expected devnet fork at epoch 3, got %v", fork)
+	}
+	if fork := dec.ForkAtEpoch(4); fork == nil || fork.Name != "merge" {
+		t.Fatalf("expected merge fork at epoch 4, got %v", fork)
+	}
+}
+
+func TestForkDecoderEncoding(t *testing.T) {
+	spec := *configs.Minimal
+	dec := NewForkDecoder(&spec, common.Root{0x42})
+	genesisDigest, err := dec.ForkDigestAtEpoch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &phase0.SignedBeaconBlock{}
+	block.Message.Slot = 123
+	block.Message.ProposerIndex = 4
+	benv := block.Envelope(&spec, genesisDigest)
+	data, err := dec.EncodeBlock(benv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digest common.ForkDigest
+	copy(digest[:], data[:4])
+	if digest != genesisDigest {
+		t.Fatalf("expected digest prefix %s, got %s", genesisDigest, digest)
+	}
+	decoded, err := dec.DecodeBlock(digest, uint64(len(data)-4), bytes.NewReader(data[4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BlockRoot != benv.BlockRoot || decoded.Slot != 123 || decoded.ProposerIndex != 4 {
+		t.Fatal("decoded block does not match encoded block")
+	}
+
+	altairDigest := common.ComputeForkDigest(spec.ALTAIR_FORK_VERSION, common.Root{0x42})
+	if _, err := dec.EncodeBlock(block.Envelope(&spec, altairDigest)); err == nil {
+		t.Fatal("expected phase0 block with altair digest to be rejected")
+	}
+
+	state, _ := kickstarttest.State(t, &spec, 8)
+	var buf bytes.Buffer
+	if err := state.Serialize(codec.NewEncodingWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	decodedState, err := dec.DecodeState(genesisDigest, uint64(buf.Len()), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decodedState.(*phase0.BeaconStateView); !ok {
+		t.Fatalf("expected phase0 state, got %T", decodedState)
+	}
+	if decodedState.HashTreeRoot(tree.GetHashFn()) != state.HashTreeRoot(tree.GetHashFn()) {
+		t.Fatal("decoded state does not match encoded state")
+	}
+}
@@ -0,0 +1,78 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// Fields of the BeaconState that are shared between altair and the merge, in both type and position.
+// These are transferred as-is during the upgrade: the subtrees are shared with the pre-state, no data is copied.
+var unchangedAltairFields = []uint64{
+	_stateGenesisTime,
+	_stateGenesisValidatorsRoot,
+	_stateSlot,
+	_stateFork,
+	_stateLatestBlockHeader,
+	_stateBlockRoots,
+	_stateStateRoots,
+	_stateHistoricalRoots,
+	_stateEth1Data,
+	_stateEth1DataVotes,
+	_stateDepositIndex,
+	_stateValidators,
+	_stateBalances,
+	_stateRandaoMixes,
+	_stateSlashings,
+	_stateJustificationBits,
+	_statePreviousJustifiedCheckpoint,
+	_stateCurrentJustifiedCheckpoint,
+	_stateFinalizedCheckpoint,
+}
+
+// UpgradeToMerge translates an altair state at the merge fork boundary into a merge state.
+// The merge state builds on the phase0 layout: the altair participation flags cannot be expressed as
+// pending attestations, so the merge state starts with empty pending-attestation lists.
+// The execution payload header starts empty. The merge state has no sync committees,
+// and these are cleared from the EpochsContext. The pre-state is not modified.
+func UpgradeToMerge(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, pre *altair.BeaconStateView) (*BeaconStateView, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slot, err := pre.Slot()
+	if err != nil {
+		return nil, err
+	}
+	epoch := spec.SlotToEpoch(slot)
+	preFork, err := pre.Fork()
+	if err != nil {
+		return nil, err
+	}
+
+	post := NewBeaconStateView(spec)
+	for _, i := range unchangedAltairFields {
+		v, err := pre.Get(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get altair state field %d: %v", i, err)
+		}
+		if err := post.Set(i, v); err != nil {
+			return nil, fmt.Errorf("failed to set merge state field %d: %v", i, err)
+		}
+	}
+
+	if err := post.SetFork(common.Fork{
+		PreviousVersion: preFork.CurrentVersion,
+		CurrentVersion:  spec.MERGE_FORK_VERSION,
+		Epoch:           epoch,
+	}); err != nil {
+		return nil, err
+	}
+	if err := post.SetLatestExecutionPayloadHeader(&common.ExecutionPayloadHeader{}); err != nil {
+		return nil, err
+	}
+
+	epc.CurrentSyncCommittee = nil
+	epc.NextSyncCommittee = nil
+	return post, nil
+}
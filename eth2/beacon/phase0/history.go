@@ -148,6 +148,10 @@ func AsHistoricalRoots(v View, err error) (*HistoricalRootsView, error) {
 	return &HistoricalRootsView{c}, err
 }
 
+func (h *HistoricalRootsView) GetRoot(i uint64) (common.Root, error) {
+	return AsRoot(h.Get(i))
+}
+
 func (h *HistoricalRootsView) Append(root common.Root) error {
 	v := RootView(root)
 	return h.ComplexListView.Append(&v)
@@ -2,8 +2,8 @@ package phase0
 
 import (
 	"errors"
-	hbls "github.com/herumi/bls-eth-go-binary/bls"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/util/bls"
 )
 
 type KickstartValidatorData struct {
@@ -50,19 +50,21 @@ func KickStartStateWithSignatures(spec *common.Spec, eth1BlockHash common.Root,
 			Amount:                v.Balance,
 			Signature:             common.BLSSignature{},
 		}
-		var secKey hbls.SecretKey
-		if err := secKey.Deserialize(keys[i][:]); err != nil {
-			return nil, nil, err
-		}
+		secKey := bls.BLSSecretKey(keys[i])
 		dom := common.ComputeDomain(common.DOMAIN_DEPOSIT, spec.GENESIS_FORK_VERSION, common.Root{})
 		msg := common.ComputeSigningRoot(d.Data.MessageRoot(), dom)
-		sig := secKey.SignHash(msg[:])
-		var p common.BLSPubkey
-		copy(p[:], secKey.GetPublicKey().Serialize())
+		p, err := bls.Pubkey(&secKey)
+		if err != nil {
+			return nil, nil, err
+		}
 		if p != d.Data.Pubkey {
 			return nil, nil, errors.New("privkey invalid, expected different pubkey")
 		}
-		copy(d.Data.Signature[:], sig.Serialize())
+		sig, err := bls.Sign(&secKey, msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.Data.Signature = sig
 	}
 
 	state, epc, err := GenesisFromEth1(spec, eth1BlockHash, 0, deps, true)
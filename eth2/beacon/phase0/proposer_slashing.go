@@ -86,7 +86,7 @@ func ProcessProposerSlashings(ctx context.Context, spec *common.Spec, epc *commo
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if err := ProcessProposerSlashing(spec, epc, state, &ops[i]); err != nil {
+		if err := ProcessProposerSlashing(ctx, spec, epc, state, &ops[i]); err != nil {
 			return err
 		}
 	}
@@ -109,7 +109,7 @@ func ValidateProposerSlashingNoSignature(spec *common.Spec, ps *ProposerSlashing
 	return nil
 }
 
-func ValidateProposerSlashing(spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, ps *ProposerSlashing) error {
+func ValidateProposerSlashing(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, ps *ProposerSlashing) error {
 	if err := ValidateProposerSlashingNoSignature(spec, ps); err != nil {
 		return err
 	}
@@ -148,23 +148,27 @@ func ValidateProposerSlashing(spec *common.Spec, epc *common.EpochsContext, stat
 		return errors.New("could not find pubkey of proposer")
 	}
 	// Verify signatures
-	if !bls.Verify(
-		pubkey,
-		common.ComputeSigningRoot(ps.SignedHeader1.Message.HashTreeRoot(tree.GetHashFn()), domain),
-		ps.SignedHeader1.Signature) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     []*common.CachedPubkey{pubkey},
+		Message:     common.ComputeSigningRoot(ps.SignedHeader1.Message.HashTreeRoot(tree.GetHashFn()), domain),
+		Signature:   ps.SignedHeader1.Signature,
+		Description: fmt.Sprintf("proposer slashing header 1 (proposer %d)", proposerIndex),
+	}) {
 		return errors.New("proposer slashing header 1 has invalid BLS signature")
 	}
-	if !bls.Verify(
-		pubkey,
-		common.ComputeSigningRoot(ps.SignedHeader2.Message.HashTreeRoot(tree.GetHashFn()), domain),
-		ps.SignedHeader2.Signature) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     []*common.CachedPubkey{pubkey},
+		Message:     common.ComputeSigningRoot(ps.SignedHeader2.Message.HashTreeRoot(tree.GetHashFn()), domain),
+		Signature:   ps.SignedHeader2.Signature,
+		Description: fmt.Sprintf("proposer slashing header 2 (proposer %d)", proposerIndex),
+	}) {
 		return errors.New("proposer slashing header 2 has invalid BLS signature")
 	}
 	return nil
 }
 
-func ProcessProposerSlashing(spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, ps *ProposerSlashing) error {
-	if err := ValidateProposerSlashing(spec, epc, state, ps); err != nil {
+func ProcessProposerSlashing(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, ps *ProposerSlashing) error {
+	if err := ValidateProposerSlashing(ctx, spec, epc, state, ps); err != nil {
 		return err
 	}
 	return SlashValidator(spec, epc, state, ps.SignedHeader1.Message.ProposerIndex, nil)
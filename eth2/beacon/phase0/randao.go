@@ -3,6 +3,7 @@ package phase0
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/util/bls"
@@ -107,13 +108,12 @@ func ProcessRandaoReveal(ctx context.Context, spec *common.Spec, epc *common.Epo
 		return err
 	}
 	// Verify RANDAO reveal
-	if !bls.Verify(
-		proposerPubkey,
-		common.ComputeSigningRoot(
-			epoch.HashTreeRoot(tree.GetHashFn()),
-			domain),
-		reveal,
-	) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     []*common.CachedPubkey{proposerPubkey},
+		Message:     common.ComputeSigningRoot(epoch.HashTreeRoot(tree.GetHashFn()), domain),
+		Signature:   reveal,
+		Description: fmt.Sprintf("randao reveal (proposer %d)", propIndex),
+	}) {
 		return errors.New("randao invalid")
 	}
 	mixes, err := state.RandaoMixes()
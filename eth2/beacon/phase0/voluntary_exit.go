@@ -3,6 +3,7 @@ package phase0
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/util/bls"
 	"github.com/protolambda/ztyp/codec"
@@ -53,7 +54,7 @@ func ProcessVoluntaryExits(ctx context.Context, spec *common.Spec, epc *common.E
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if err := ProcessVoluntaryExit(spec, epc, state, &ops[i]); err != nil {
+		if err := ProcessVoluntaryExit(ctx, spec, epc, state, &ops[i]); err != nil {
 			return err
 		}
 	}
@@ -121,7 +122,7 @@ var SignedVoluntaryExitType = ContainerType("SignedVoluntaryExit", []FieldDef{
 	{"signature", common.BLSSignatureType},
 })
 
-func ValidateVoluntaryExit(spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, signedExit *SignedVoluntaryExit) error {
+func ValidateVoluntaryExit(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, signedExit *SignedVoluntaryExit) error {
 	exit := &signedExit.Message
 	currentEpoch := epc.CurrentEpoch.Epoch
 	vals, err := state.Validators()
@@ -172,17 +173,19 @@ func ValidateVoluntaryExit(spec *common.Spec, epc *common.EpochsContext, state c
 		return err
 	}
 	// Verify signature
-	if !bls.Verify(
-		pubkey,
-		common.ComputeSigningRoot(signedExit.Message.HashTreeRoot(tree.GetHashFn()), domain),
-		signedExit.Signature) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     []*common.CachedPubkey{pubkey},
+		Message:     common.ComputeSigningRoot(signedExit.Message.HashTreeRoot(tree.GetHashFn()), domain),
+		Signature:   signedExit.Signature,
+		Description: fmt.Sprintf("voluntary exit (validator %d)", exit.ValidatorIndex),
+	}) {
 		return errors.New("voluntary exit signature could not be verified")
 	}
 	return nil
 }
 
-func ProcessVoluntaryExit(spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, signedExit *SignedVoluntaryExit) error {
-	if err := ValidateVoluntaryExit(spec, epc, state, signedExit); err != nil {
+func ProcessVoluntaryExit(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, signedExit *SignedVoluntaryExit) error {
+	if err := ValidateVoluntaryExit(ctx, spec, epc, state, signedExit); err != nil {
 		return err
 	}
 	return InitiateValidatorExit(spec, epc, state, signedExit.Message.ValidatorIndex)
@@ -92,21 +92,21 @@ func ProcessAttestations(ctx context.Context, spec *common.Spec, epc *common.Epo
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if err := ProcessAttestation(spec, epc, state, &ops[i]); err != nil {
+		if err := ProcessAttestation(ctx, spec, epc, state, &ops[i]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func ProcessAttestation(spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, attestation *Attestation) error {
-	if err := ClassicProcessAttestation(spec, epc, state, attestation); err != nil {
+func ProcessAttestation(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, attestation *Attestation) error {
+	if err := ClassicProcessAttestation(ctx, spec, epc, state, attestation); err != nil {
 		return err
 	}
 	return UpdatePendingShardWork(spec, epc, state, attestation)
 }
 
-func ClassicProcessAttestation(spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, attestation *Attestation) error {
+func ClassicProcessAttestation(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, attestation *Attestation) error {
 	data := &attestation.Data
 
 	// Check slot
@@ -169,7 +169,7 @@ func ClassicProcessAttestation(spec *common.Spec, epc *common.EpochsContext, sta
 	}
 	if indexedAtt, err := attestation.ConvertToIndexed(spec, committee); err != nil {
 		return fmt.Errorf("attestation could not be converted to an indexed attestation: %v", err)
-	} else if err := ValidateIndexedAttestation(spec, epc, state, indexedAtt); err != nil {
+	} else if err := ValidateIndexedAttestation(ctx, spec, epc, state, indexedAtt); err != nil {
 		return fmt.Errorf("attestation could not be verified in its indexed form: %v", err)
 	}
 
@@ -1,6 +1,7 @@
 package sharding
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
@@ -95,7 +96,7 @@ func ValidateIndexedAttestationNoSignature(spec *common.Spec, state common.Beaco
 	return nil
 }
 
-func ValidateIndexedAttestationSignature(spec *common.Spec, dom common.BLSDomain, pubCache *common.PubkeyCache, indexedAttestation *IndexedAttestation) error {
+func ValidateIndexedAttestationSignature(ctx context.Context, spec *common.Spec, dom common.BLSDomain, pubCache *common.PubkeyCache, indexedAttestation *IndexedAttestation) error {
 	pubkeys := make([]*common.CachedPubkey, 0, len(indexedAttestation.AttestingIndices))
 	for _, i := range indexedAttestation.AttestingIndices {
 		pub, ok := pubCache.Pubkey(i)
@@ -109,17 +110,19 @@ func ValidateIndexedAttestationSignature(spec *common.Spec, dom common.BLSDomain
 		return errors.New("in phase 0 no empty attestation signatures are allowed")
 	}
 
-	if !bls.Eth2FastAggregateVerify(pubkeys,
-		common.ComputeSigningRoot(indexedAttestation.Data.HashTreeRoot(tree.GetHashFn()), dom),
-		indexedAttestation.Signature,
-	) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     pubkeys,
+		Message:     common.ComputeSigningRoot(indexedAttestation.Data.HashTreeRoot(tree.GetHashFn()), dom),
+		Signature:   indexedAttestation.Signature,
+		Description: fmt.Sprintf("indexed attestation (slot %d, index %d)", indexedAttestation.Data.Slot, indexedAttestation.Data.Index),
+	}) {
 		return errors.New("could not verify BLS signature for indexed attestation")
 	}
 	return nil
 }
 
 // Verify validity of slashable_attestation fields.
-func ValidateIndexedAttestation(spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, indexedAttestation *IndexedAttestation) error {
+func ValidateIndexedAttestation(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, indexedAttestation *IndexedAttestation) error {
 	if err := ValidateIndexedAttestationNoSignature(spec, state, indexedAttestation); err != nil {
 		return err
 	}
@@ -127,5 +130,5 @@ func ValidateIndexedAttestation(spec *common.Spec, epc *common.EpochsContext, st
 	if err != nil {
 		return err
 	}
-	return ValidateIndexedAttestationSignature(spec, dom, epc.PubkeyCache, indexedAttestation)
+	return ValidateIndexedAttestationSignature(ctx, spec, dom, epc.PubkeyCache, indexedAttestation)
 }
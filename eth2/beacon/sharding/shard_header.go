@@ -125,14 +125,14 @@ func ProcessShardHeaders(ctx context.Context, spec *common.Spec, epc *common.Epo
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if err := ProcessShardHeader(spec, epc, state, &ops[i]); err != nil {
+		if err := ProcessShardHeader(ctx, spec, epc, state, &ops[i]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func ProcessShardHeader(spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, signedHeader *SignedShardBlobHeader) error {
+func ProcessShardHeader(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, signedHeader *SignedShardBlobHeader) error {
 	header := &signedHeader.Message
 	// Verify the header is not 0, and not from the future.
 	if header.Slot == 0 {
@@ -236,7 +236,12 @@ func ProcessShardHeader(spec *common.Spec, epc *common.EpochsContext, state *Bea
 		return fmt.Errorf("could not find pubkey of shard blob proposer %d", header.ProposerIndex)
 	}
 	signingRoot := common.ComputeSigningRoot(header.HashTreeRoot(tree.GetHashFn()), dom)
-	if !bls.Verify(pubkey, signingRoot, signedHeader.Signature) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     []*common.CachedPubkey{pubkey},
+		Message:     signingRoot,
+		Signature:   signedHeader.Signature,
+		Description: fmt.Sprintf("shard blob header (slot %d, shard %d)", header.Slot, header.Shard),
+	}) {
 		return errors.New("shard blob header has invalid signature")
 	}
 
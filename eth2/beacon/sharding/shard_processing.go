@@ -208,23 +208,25 @@ func ResetPendingShardWork(ctx context.Context, spec *common.Spec, epc *common.E
 		return err
 	}
 
-	currentEpoch := spec.SlotToEpoch(slot)
-	nextEpoch := currentEpoch + 1
-	nextEpochStartSlot, _ := spec.EpochStartSlot(nextEpoch)
-
 	buffer, err := state.ShardBuffer()
 	if err != nil {
 		return err
 	}
+	return initPendingShardWork(spec, epc, buffer, spec.SlotToEpoch(slot)+1)
+}
 
-	committeesPerSlot, err := epc.GetCommitteeCountPerSlot(nextEpoch)
+// initPendingShardWork resets the shard buffer columns of the given epoch,
+// with a pending shard-header list for every shard that has a committee assigned to it.
+func initPendingShardWork(spec *common.Spec, epc *common.EpochsContext, buffer *ShardBufferView, epoch common.Epoch) error {
+	epochStartSlot, _ := spec.EpochStartSlot(epoch)
+	committeesPerSlot, err := epc.GetCommitteeCountPerSlot(epoch)
 	if err != nil {
 		return err
 	}
-	activeShards := spec.ActiveShardCount(nextEpoch)
+	activeShards := spec.ActiveShardCount(epoch)
 
-	end := nextEpochStartSlot + spec.SLOTS_PER_EPOCH
-	for slot := nextEpochStartSlot; slot < end; slot++ {
+	end := epochStartSlot + spec.SLOTS_PER_EPOCH
+	for slot := epochStartSlot; slot < end; slot++ {
 		bufferIndex := uint64(slot % spec.SHARD_STATE_MEMORY_SLOTS)
 
 		startShard, err := epc.StartShard(slot)
@@ -246,7 +248,7 @@ func ResetPendingShardWork(ctx context.Context, spec *common.Spec, epc *common.E
 
 			column[shard] = ShardWork{Status: ShardWorkStatus{
 				Selector: SHARD_WORK_PENDING,
-				Value: PendingShardHeaders{
+				Value: &PendingShardHeaders{
 					PendingShardHeader{
 						Commitment: DataCommitment{},
 						Root:       common.Root{},
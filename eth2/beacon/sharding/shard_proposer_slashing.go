@@ -85,14 +85,14 @@ func ProcessShardProposerSlashings(ctx context.Context, spec *common.Spec, epc *
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if err := ProcessShardProposerSlashing(spec, epc, state, &ops[i]); err != nil {
+		if err := ProcessShardProposerSlashing(ctx, spec, epc, state, &ops[i]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func ProcessShardProposerSlashing(spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, proposerSlashing *ShardProposerSlashing) error {
+func ProcessShardProposerSlashing(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state common.BeaconState, proposerSlashing *ShardProposerSlashing) error {
 	ref1 := &proposerSlashing.SignedReference1.Message
 	ref2 := &proposerSlashing.SignedReference2.Message
 
@@ -135,16 +135,20 @@ func ProcessShardProposerSlashing(spec *common.Spec, epc *common.EpochsContext,
 		return fmt.Errorf("could not find pubkey of proposer %d", ref1.ProposerIndex)
 	}
 	// Verify signatures
-	if !bls.Verify(
-		pubkey,
-		common.ComputeSigningRoot(ref1.HashTreeRoot(tree.GetHashFn()), domain),
-		proposerSlashing.SignedReference1.Signature) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     []*common.CachedPubkey{pubkey},
+		Message:     common.ComputeSigningRoot(ref1.HashTreeRoot(tree.GetHashFn()), domain),
+		Signature:   proposerSlashing.SignedReference1.Signature,
+		Description: fmt.Sprintf("shard proposer slashing header 1 (proposer %d)", ref1.ProposerIndex),
+	}) {
 		return errors.New("shard proposer slashing header 1 has invalid BLS signature")
 	}
-	if !bls.Verify(
-		pubkey,
-		common.ComputeSigningRoot(ref2.HashTreeRoot(tree.GetHashFn()), domain),
-		proposerSlashing.SignedReference2.Signature) {
+	if !bls.VerifySet(ctx, bls.SignatureSet{
+		Pubkeys:     []*common.CachedPubkey{pubkey},
+		Message:     common.ComputeSigningRoot(ref2.HashTreeRoot(tree.GetHashFn()), domain),
+		Signature:   proposerSlashing.SignedReference2.Signature,
+		Description: fmt.Sprintf("shard proposer slashing header 2 (proposer %d)", ref1.ProposerIndex),
+	}) {
 		return errors.New("shard proposer slashing header 2 has invalid BLS signature")
 	}
 	return nil
@@ -0,0 +1,163 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+// Fields of the BeaconState that are shared between the merge and sharding, in both type and position.
+// These are transferred as-is during the upgrade: the subtrees are shared with the pre-state, no data is copied.
+var unchangedMergeFields = []uint64{
+	_stateGenesisTime,
+	_stateGenesisValidatorsRoot,
+	_stateSlot,
+	_stateFork,
+	_stateLatestBlockHeader,
+	_stateBlockRoots,
+	_stateStateRoots,
+	_stateHistoricalRoots,
+	_stateEth1Data,
+	_stateEth1DataVotes,
+	_stateDepositIndex,
+	_stateValidators,
+	_stateBalances,
+	_stateRandaoMixes,
+	_stateSlashings,
+	_stateJustificationBits,
+	_statePreviousJustifiedCheckpoint,
+	_stateCurrentJustifiedCheckpoint,
+	_stateFinalizedCheckpoint,
+	_latestExecutionPayloadHeader,
+}
+
+// UpgradeToSharding translates a merge state at the sharding fork boundary into a sharding state.
+// Pending attestations are carried over, without shard header root.
+// The shard gasprice starts at MIN_GASPRICE, and the shard buffer is initialized
+// with pending shard work for the fork epoch. The pre-state is not modified.
+func UpgradeToSharding(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, pre *merge.BeaconStateView) (*BeaconStateView, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slot, err := pre.Slot()
+	if err != nil {
+		return nil, err
+	}
+	epoch := spec.SlotToEpoch(slot)
+	preFork, err := pre.Fork()
+	if err != nil {
+		return nil, err
+	}
+
+	post := NewBeaconStateView(spec)
+	for _, i := range unchangedMergeFields {
+		v, err := pre.Get(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get merge state field %d: %v", i, err)
+		}
+		if err := post.Set(i, v); err != nil {
+			return nil, fmt.Errorf("failed to set sharding state field %d: %v", i, err)
+		}
+	}
+
+	if err := post.SetFork(common.Fork{
+		PreviousVersion: preFork.CurrentVersion,
+		CurrentVersion:  spec.SHARDING_FORK_VERSION,
+		Epoch:           epoch,
+	}); err != nil {
+		return nil, err
+	}
+
+	prePrevAtts, err := pre.PreviousEpochAttestations()
+	if err != nil {
+		return nil, err
+	}
+	postPrevAtts, err := post.PreviousEpochAttestations()
+	if err != nil {
+		return nil, err
+	}
+	if err := translatePendingAttestations(ctx, spec, prePrevAtts, postPrevAtts); err != nil {
+		return nil, fmt.Errorf("failed to translate previous epoch attestations: %v", err)
+	}
+	preCurrAtts, err := pre.CurrentEpochAttestations()
+	if err != nil {
+		return nil, err
+	}
+	postCurrAtts, err := post.CurrentEpochAttestations()
+	if err != nil {
+		return nil, err
+	}
+	if err := translatePendingAttestations(ctx, spec, preCurrAtts, postCurrAtts); err != nil {
+		return nil, fmt.Errorf("failed to translate current epoch attestations: %v", err)
+	}
+
+	if err := post.SetShardGasPrice(spec.MIN_GASPRICE); err != nil {
+		return nil, err
+	}
+	startShard, err := epc.StartShard(slot)
+	if err != nil {
+		return nil, err
+	}
+	if err := post.SetCurrentEpochStartShard(startShard); err != nil {
+		return nil, err
+	}
+	buffer, err := post.ShardBuffer()
+	if err != nil {
+		return nil, err
+	}
+	if err := initPendingShardWork(spec, epc, buffer, epoch); err != nil {
+		return nil, fmt.Errorf("failed to initialize shard buffer: %v", err)
+	}
+	return post, nil
+}
+
+// translatePendingAttestations appends the phase0-style pending attestations to the sharding pending attestations.
+// The shard header root of the translated attestation data is left empty.
+func translatePendingAttestations(ctx context.Context, spec *common.Spec,
+	src *phase0.PendingAttestationsView, dst *PendingAttestationsView) error {
+
+	attIter := src.ReadonlyIter()
+	i := 0
+	for {
+		// every 32 attestations, check if the context is done.
+		if i&((1<<5)-1) == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		el, ok, err := attIter.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		attView, err := phase0.AsPendingAttestation(el, nil)
+		if err != nil {
+			return err
+		}
+		att, err := attView.Raw()
+		if err != nil {
+			return err
+		}
+		shardAtt := PendingAttestation{
+			AggregationBits: att.AggregationBits,
+			Data: AttestationData{
+				Slot:            att.Data.Slot,
+				Index:           att.Data.Index,
+				BeaconBlockRoot: att.Data.BeaconBlockRoot,
+				Source:          att.Data.Source,
+				Target:          att.Data.Target,
+			},
+			InclusionDelay: att.InclusionDelay,
+			ProposerIndex:  att.ProposerIndex,
+		}
+		if err := dst.Append(shardAtt.View(spec)); err != nil {
+			return err
+		}
+		i += 1
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package chain
+
+// AncestorIter iterates over the ancestors of a block, in descending slot order, starting with the block itself.
+type AncestorIter interface {
+	// Next returns the next ancestor block entry. Ok is false when there are no more ancestors.
+	Next() (entry ChainEntry, ok bool)
+}
+
+// parentsIter follows the parent roots of the block entries of a chain, down to a slot (incl.).
+type parentsIter struct {
+	byBlock    func(root Root) (entry ChainEntry, ok bool)
+	next       Root
+	downToSlot Slot
+	done       bool
+}
+
+func newParentsIter(byBlock func(root Root) (entry ChainEntry, ok bool), root Root, downToSlot Slot) (*parentsIter, bool) {
+	if _, ok := byBlock(root); !ok {
+		return nil, false
+	}
+	return &parentsIter{byBlock: byBlock, next: root, downToSlot: downToSlot}, true
+}
+
+func (it *parentsIter) Next() (entry ChainEntry, ok bool) {
+	if it.done {
+		return nil, false
+	}
+	entry, ok = it.byBlock(it.next)
+	if !ok || entry.Step().Slot() < it.downToSlot {
+		it.done = true
+		return nil, false
+	}
+	// the parent root may be zeroed if unknown, or repeat the root itself for an anchor of a gap slot.
+	if parent := entry.ParentRoot(); parent == (Root{}) || parent == it.next {
+		it.done = true
+	} else {
+		it.next = parent
+	}
+	return entry, true
+}
+
+// commonAncestor walks the ancestors of both blocks, always stepping back the one with the highest slot,
+// until the ancestors meet.
+func commonAncestor(byBlock func(root Root) (entry ChainEntry, ok bool), a Root, b Root) (entry ChainEntry, ok bool) {
+	itA, ok := newParentsIter(byBlock, a, 0)
+	if !ok {
+		return nil, false
+	}
+	itB, ok := newParentsIter(byBlock, b, 0)
+	if !ok {
+		return nil, false
+	}
+	entryA, okA := itA.Next()
+	entryB, okB := itB.Next()
+	for okA && okB {
+		if entryA.BlockRoot() == entryB.BlockRoot() {
+			return entryA, true
+		}
+		if entryA.Step().Slot() >= entryB.Step().Slot() {
+			entryA, okA = itA.Next()
+		} else {
+			entryB, okB = itB.Next()
+		}
+	}
+	return nil, false
+}
+
+// reorgDepth computes the number of slots of the old head after the common ancestor, zero if there are none.
+func reorgDepth(oldSlot Slot, ancestor ChainEntry) uint64 {
+	if slot := ancestor.Step().Slot(); slot < oldSlot {
+		return uint64(oldSlot - slot)
+	}
+	return 0
+}
+
+// reorgDepthByRoots computes the reorg depth between two head blocks with the given byBlock lookup.
+func reorgDepthByRoots(byBlock func(root Root) (entry ChainEntry, ok bool), oldHead Root, newHead Root) (depth uint64, ok bool) {
+	old, ok := byBlock(oldHead)
+	if !ok {
+		return 0, false
+	}
+	ancestor, ok := commonAncestor(byBlock, oldHead, newHead)
+	if !ok {
+		return 0, false
+	}
+	return reorgDepth(old.Step().Slot(), ancestor), true
+}
+
+func (uc *UnfinalizedChain) Ancestors(root Root, downToSlot Slot) (it AncestorIter, ok bool) {
+	return newParentsIter(uc.ByBlock, root, downToSlot)
+}
+
+func (uc *UnfinalizedChain) CommonAncestor(a Root, b Root) (entry ChainEntry, ok bool) {
+	return commonAncestor(uc.ByBlock, a, b)
+}
+
+func (uc *UnfinalizedChain) ReorgDepth(oldHead Root, newHead Root) (depth uint64, ok bool) {
+	return reorgDepthByRoots(uc.ByBlock, oldHead, newHead)
+}
+
+func (f *FinalizedChain) Ancestors(root Root, downToSlot Slot) (it AncestorIter, ok bool) {
+	return newParentsIter(f.ByBlock, root, downToSlot)
+}
+
+// CommonAncestor of the finalized chain is simply the earliest of the two blocks, the chain has no forks.
+func (f *FinalizedChain) CommonAncestor(a Root, b Root) (entry ChainEntry, ok bool) {
+	entryA, ok := f.ByBlock(a)
+	if !ok {
+		return nil, false
+	}
+	entryB, ok := f.ByBlock(b)
+	if !ok {
+		return nil, false
+	}
+	if entryA.Step() <= entryB.Step() {
+		return entryA, true
+	}
+	return entryB, true
+}
+
+func (f *FinalizedChain) ReorgDepth(oldHead Root, newHead Root) (depth uint64, ok bool) {
+	old, ok := f.ByBlock(oldHead)
+	if !ok {
+		return 0, false
+	}
+	ancestor, ok := f.CommonAncestor(oldHead, newHead)
+	if !ok {
+		return 0, false
+	}
+	return reorgDepth(old.Step().Slot(), ancestor), true
+}
+
+// byBlock looks up the block in the hot chain first, and then the cold chain. The chain must be locked.
+func (hc *HotColdChain) byBlock(root Root) (entry ChainEntry, ok bool) {
+	entry, ok = hc.HotChain.ByBlock(root)
+	if ok {
+		return entry, ok
+	}
+	return hc.ColdChain.ByBlock(root)
+}
+
+// Ancestors iterates over the ancestors in the hot chain, and continues in the cold chain.
+// The hot-cold chain is locked for every step of the iteration, not for the iteration as a whole.
+func (hc *HotColdChain) Ancestors(root Root, downToSlot Slot) (it AncestorIter, ok bool) {
+	return newParentsIter(hc.ByBlock, root, downToSlot)
+}
+
+func (hc *HotColdChain) CommonAncestor(a Root, b Root) (entry ChainEntry, ok bool) {
+	hc.Lock()
+	defer hc.Unlock()
+	return commonAncestor(hc.byBlock, a, b)
+}
+
+func (hc *HotColdChain) ReorgDepth(oldHead Root, newHead Root) (depth uint64, ok bool) {
+	hc.Lock()
+	defer hc.Unlock()
+	return reorgDepthByRoots(hc.byBlock, oldHead, newHead)
+}
@@ -0,0 +1,81 @@
+package chain
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"testing"
+)
+
+func TestAncestors(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ctx := context.Background()
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := ch.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	b2 := buildTestBlock(t, ch, &spec, keys, b1.BlockRoot, 2)
+	if err := ch.AddBlock(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	fork := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 3)
+	if err := ch.AddBlock(ctx, fork); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		downTo   Slot
+		expected []Root
+	}{
+		{0, []Root{b2.BlockRoot, b1.BlockRoot, genesis.BlockRoot()}},
+		{1, []Root{b2.BlockRoot, b1.BlockRoot}},
+		{3, nil},
+	} {
+		it, ok := ch.Ancestors(b2.BlockRoot, c.downTo)
+		if !ok {
+			t.Fatal("expected known block")
+		}
+		var got []Root
+		for entry, ok := it.Next(); ok; entry, ok = it.Next() {
+			got = append(got, entry.BlockRoot())
+		}
+		if len(got) != len(c.expected) {
+			t.Fatalf("down to %d: expected %d ancestors, got %d", c.downTo, len(c.expected), len(got))
+		}
+		for i := range got {
+			if got[i] != c.expected[i] {
+				t.Fatalf("down to %d: unexpected ancestor %d: %s", c.downTo, i, got[i])
+			}
+		}
+	}
+	if _, ok := ch.Ancestors(Root{0xaa}, 0); ok {
+		t.Fatal("expected unknown block")
+	}
+
+	if entry, ok := ch.CommonAncestor(b2.BlockRoot, fork.BlockRoot); !ok || entry.BlockRoot() != genesis.BlockRoot() {
+		t.Fatal("expected genesis to be the common ancestor of the forks")
+	}
+	if entry, ok := ch.CommonAncestor(b1.BlockRoot, b2.BlockRoot); !ok || entry.BlockRoot() != b1.BlockRoot {
+		t.Fatal("expected b1 to be the common ancestor of itself and its child")
+	}
+	if _, ok := ch.CommonAncestor(b1.BlockRoot, Root{0xaa}); ok {
+		t.Fatal("expected no common ancestor with an unknown block")
+	}
+
+	if depth, ok := ch.ReorgDepth(b2.BlockRoot, fork.BlockRoot); !ok || depth != 2 {
+		t.Fatalf("unexpected reorg depth: %d", depth)
+	}
+	if depth, ok := ch.ReorgDepth(b1.BlockRoot, b2.BlockRoot); !ok || depth != 0 {
+		t.Fatalf("unexpected reorg depth when extending the head: %d", depth)
+	}
+}
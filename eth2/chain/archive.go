@@ -0,0 +1,248 @@
+package chain
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/ztyp/tree"
+	"sort"
+	"sync"
+)
+
+// ArchiveConfig configures the archive mode of a FinalizedChain.
+//
+// In archive mode only a snapshot of the finalized state is persisted every SnapshotInterval epochs.
+// The states in between are regenerated on request, by replaying the stored blocks on top of the closest
+// preceding snapshot. The shuffling and proposer data is cached per epoch.
+type ArchiveConfig struct {
+	// SnapshotInterval is the minimum distance, in epochs, between state snapshots. Must be non-zero.
+	// The snapshots are derived from the chain index, the interval must not change between restarts.
+	SnapshotInterval Epoch
+	// BlockDB provides the finalized blocks to regenerate states with.
+	BlockDB blocks.DB
+	// RegenCacheSize is the maximum number of regenerated states to keep in memory. Zero disables the cache.
+	RegenCacheSize int
+	// EpochCacheSize is the maximum number of epochs to keep the shuffling and proposer data of. Zero disables the cache.
+	EpochCacheSize int
+}
+
+func (ac *ArchiveConfig) check() error {
+	if ac.SnapshotInterval == 0 {
+		return errors.New("archive snapshot interval must be non-zero")
+	}
+	if ac.BlockDB == nil {
+		return errors.New("archive mode requires a blocks DB to regenerate states with")
+	}
+	return nil
+}
+
+// NewArchiveFinalizedChain creates an empty FinalizedChain in archive mode.
+func NewArchiveFinalizedChain(spec *common.Spec, stateDB states.DB, archive ArchiveConfig) (*FinalizedChain, error) {
+	if err := archive.check(); err != nil {
+		return nil, err
+	}
+	f := NewFinalizedChain(spec, stateDB)
+	f.Archive = &archive
+	f.regenStates = newLRUCache(archive.RegenCacheSize)
+	f.epochContexts = newLRUCache(archive.EpochCacheSize)
+	return f, nil
+}
+
+// LoadArchiveFinalizedChain restores a FinalizedChain in archive mode from the index persisted in the MetaDB.
+// The snapshot states are expected to be available in the stateDB, and the blocks in the archive blocks DB.
+func LoadArchiveFinalizedChain(spec *common.Spec, stateDB states.DB, metaDB MetaDB, archive ArchiveConfig) (*FinalizedChain, error) {
+	f, err := NewArchiveFinalizedChain(spec, stateDB, archive)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.loadIndex(metaDB); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// snapshotDue checks if the state of the next entry should be persisted as snapshot, in archive mode.
+func (f *FinalizedChain) snapshotDue(next Step) bool {
+	if len(f.snapshots) == 0 {
+		return true
+	}
+	last := f.snapshots[len(f.snapshots)-1]
+	return f.Spec.SlotToEpoch(next.Slot()) >= f.Spec.SlotToEpoch(last.Slot())+f.Archive.SnapshotInterval
+}
+
+// regenState regenerates the state of the given step from the closest preceding snapshot.
+func (f *FinalizedChain) regenState(ctx context.Context, step Step) (common.BeaconState, error) {
+	root := f.stateRoot(step)
+	if cached, ok := f.regenStates.get(root); ok {
+		return cached.(common.BeaconState).CopyState()
+	}
+	// Empty steps repeat the state of an earlier step, regenerate that step instead.
+	target, ok := f.StateRootsMap[root]
+	if !ok {
+		return nil, fmt.Errorf("unknown state root %s for step %s", root, step)
+	}
+	i := sort.Search(len(f.snapshots), func(i int) bool {
+		return f.snapshots[i] > target
+	}) - 1
+	if i < 0 {
+		return nil, fmt.Errorf("no snapshot available to regenerate step %s", target)
+	}
+	snapshot := f.snapshots[i]
+	snapshotRoot := f.stateRoot(snapshot)
+	state, err := f.StateDB.Get(ctx, snapshotRoot)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, fmt.Errorf("snapshot state %s (step %s) does not exist", snapshotRoot, snapshot)
+	}
+	if snapshot == target {
+		return state, nil
+	}
+	epc, err := f.epochsContext(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load epochs context of snapshot %s: %v", snapshot, err)
+	}
+	upState := &beacon.StandardUpgradeableBeaconState{BeaconState: state}
+	start := f.start()
+	for s := snapshot + 1; s <= target; s++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !s.Block() {
+			continue
+		}
+		// Empty slots repeat the previous block root.
+		blockRoot := f.BlockRoots[s-start]
+		if blockRoot == f.BlockRoots[s-start-1] {
+			continue
+		}
+		benv, err := f.Archive.BlockDB.Get(ctx, blockRoot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load block %s (step %s): %v", blockRoot, s, err)
+		}
+		if benv == nil {
+			return nil, fmt.Errorf("missing block %s (step %s) to regenerate state with", blockRoot, s)
+		}
+		slot, err := upState.Slot()
+		if err != nil {
+			return nil, err
+		}
+		if slot < benv.Slot {
+			if err := common.ProcessSlots(ctx, f.Spec, epc, upState, benv.Slot); err != nil {
+				return nil, err
+			}
+		}
+		// The blocks are finalized, no need to verify them again.
+		if err := common.PostSlotTransition(ctx, f.Spec, epc, upState, benv, false); err != nil {
+			return nil, fmt.Errorf("failed to replay block %s (step %s): %v", blockRoot, s, err)
+		}
+	}
+	slot, err := upState.Slot()
+	if err != nil {
+		return nil, err
+	}
+	if slot < target.Slot() {
+		if err := common.ProcessSlots(ctx, f.Spec, epc, upState, target.Slot()); err != nil {
+			return nil, err
+		}
+	}
+	if got := upState.HashTreeRoot(tree.GetHashFn()); got != root {
+		return nil, fmt.Errorf("regenerated state %s of step %s does not match expected state root %s", got, target, root)
+	}
+	f.epochContexts.add(f.Spec.SlotToEpoch(target.Slot()), epc)
+	f.regenStates.add(root, upState.BeaconState)
+	return upState.BeaconState.CopyState()
+}
+
+// epochsContext returns the (cached) epochs context for the epoch of the given state.
+// The returned context is a copy, and safe to modify.
+func (f *FinalizedChain) epochsContext(state common.BeaconState) (*common.EpochsContext, error) {
+	slot, err := state.Slot()
+	if err != nil {
+		return nil, err
+	}
+	epoch := f.Spec.SlotToEpoch(slot)
+	if cached, ok := f.epochContexts.get(epoch); ok {
+		epc := cached.(*common.EpochsContext).Clone()
+		epc.PubkeyCache = f.PubkeyCache
+		return epc, nil
+	}
+	epc := &common.EpochsContext{
+		Spec:        f.Spec,
+		PubkeyCache: f.PubkeyCache,
+	}
+	if err := epc.LoadShuffling(state); err != nil {
+		return nil, err
+	}
+	if err := epc.LoadProposers(state); err != nil {
+		return nil, err
+	}
+	if syncState, ok := state.(common.SyncCommitteeBeaconState); ok {
+		if err := epc.LoadSyncCommittees(syncState); err != nil {
+			return nil, err
+		}
+	}
+	f.epochContexts.add(epoch, epc)
+	return epc.Clone(), nil
+}
+
+// lruCache is a size-bounded cache, evicting the least recently used entries first.
+// A nil cache, or a cache with zero size, does not keep anything.
+type lruCache struct {
+	sync.Mutex
+	size  int
+	order *list.List
+	items map[interface{}]*list.Element
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[interface{}]*list.Element),
+	}
+}
+
+func (c *lruCache) get(key interface{}) (value interface{}, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) add(key interface{}, value interface{}) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
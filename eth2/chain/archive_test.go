@@ -0,0 +1,130 @@
+package chain
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"github.com/protolambda/ztyp/tree"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestArchiveFinalizedChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	genValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockDB := blocks.NewFileDB(&spec, beacon.NewForkDecoder(&spec, genValRoot), dir)
+	ctx := context.Background()
+
+	// build a chain of 3 epochs, with some empty slots, to finalize into the archive
+	hot, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := hot.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []ChainEntry{genesis}
+	var added []*common.BeaconBlockEnvelope
+	parent := genesis.BlockRoot()
+	for slot := Slot(1); slot < 3*spec.SLOTS_PER_EPOCH; slot++ {
+		if slot == 6 || slot == 13 {
+			continue
+		}
+		benv := buildTestBlock(t, hot, &spec, keys, parent, slot)
+		if err := hot.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := blockDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := hot.ByBlock(benv.BlockRoot)
+		if !ok {
+			t.Fatalf("missing block %d", slot)
+		}
+		entries = append(entries, entry)
+		added = append(added, benv)
+		parent = benv.BlockRoot
+	}
+
+	stateDB := states.NewMemDB(&spec)
+	conf := ArchiveConfig{SnapshotInterval: 1, BlockDB: blockDB, RegenCacheSize: 2, EpochCacheSize: 2}
+	archive, err := NewArchiveFinalizedChain(&spec, stateDB, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.MetaDB = NewMemMetaDB()
+	for _, entry := range entries {
+		if err := archive.OnFinalizedEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// genesis, and the first block of each following epoch
+	if len(archive.snapshots) != 3 {
+		t.Fatalf("expected 3 snapshots, got %d", len(archive.snapshots))
+	}
+	if state, err := stateDB.Get(ctx, added[2].StateRoot); err != nil {
+		t.Fatal(err)
+	} else if state != nil {
+		t.Fatal("expected only snapshots to be stored in archive mode")
+	}
+
+	check := func(f *FinalizedChain) {
+		for _, benv := range added {
+			entry, ok := f.ByBlock(benv.BlockRoot)
+			if !ok {
+				t.Fatalf("missing block %s at slot %d", benv.BlockRoot, benv.Slot)
+			}
+			state, err := entry.State(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.HashTreeRoot(tree.GetHashFn()) != benv.StateRoot {
+				t.Fatalf("unexpected regenerated state at slot %d", benv.Slot)
+			}
+			epc, err := entry.EpochsContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proposer, err := epc.GetBeaconProposer(benv.Slot); err != nil {
+				t.Fatal(err)
+			} else if proposer != benv.ProposerIndex {
+				t.Fatalf("unexpected proposer at slot %d: %d <> %d", benv.Slot, proposer, benv.ProposerIndex)
+			}
+		}
+		// the empty slot repeats the state of the block before it
+		empty, ok := f.ByCanonStep(AsStep(13, true))
+		if !ok {
+			t.Fatal("missing empty slot")
+		}
+		if _, err := empty.State(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(archive)
+
+	loaded, err := LoadArchiveFinalizedChain(&spec, stateDB, archive.MetaDB, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.snapshots) != len(archive.snapshots) {
+		t.Fatalf("expected %d snapshots after reload, got %d", len(archive.snapshots), len(loaded.snapshots))
+	}
+	loaded.PubkeyCache = archive.PubkeyCache
+	check(loaded)
+}
@@ -2,10 +2,14 @@ package chain
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
 	"github.com/protolambda/zrnt/eth2/db/states"
+	"math"
 	"sync"
 )
 
@@ -94,6 +98,15 @@ type Chain interface {
 	// Get the canonical entry at the given slot. Return nil if there is no block but the slot node exists.
 	ByCanonStep(step Step) (entry ChainEntry, ok bool)
 	Iter() (ChainIter, error)
+	// Iterate over the block with the given root, and its ancestors, down to the given slot (incl.).
+	// Not ok if the block is unknown.
+	Ancestors(root Root, downToSlot Slot) (it AncestorIter, ok bool)
+	// Get the latest block that both blocks build on, or that is one of the blocks itself.
+	// Not ok if either block is unknown, or if the ancestors do not meet in the known part of the chain.
+	CommonAncestor(a Root, b Root) (entry ChainEntry, ok bool)
+	// Get the number of slots of the old head that are abandoned when switching to the new head,
+	// counted from the common ancestor. Zero if the new head builds on the old head.
+	ReorgDepth(oldHead Root, newHead Root) (depth uint64, ok bool)
 }
 
 type ChainIter interface {
@@ -135,46 +148,386 @@ type HotColdChain struct {
 	ColdChain
 	Spec *common.Spec
 	GenesisInfo
+
+	// Storage to persist the chain in, to restart it with LoadHotColdChain.
+	// The Blocks and Meta databases are optional.
+	Storage ChainStorage
+	// The last persisted hot chain anchor
+	anchor HotAnchor
+
+	// Orphans keeps the blocks that were pruned from the hot chain without being finalized.
+	Orphans OrphanStore
+	// The finalized epoch that the orphans were last pruned for
+	orphansPruned Epoch
+
+	// Subscribers to the chain events, and the last emitted status to detect changes with.
+	events EventFeed
+	status chainStatus
 }
 
 var _ FullChain = (*HotColdChain)(nil)
 
-func NewHotColdChain(anchorState *phase0.BeaconStateView, spec *common.Spec, stateDB states.DB) (*HotColdChain, error) {
-	time, err := anchorState.GenesisTime()
+// NewHotColdChain creates a chain, starting from the given anchor state.
+// Only the finalized states are persisted, in the stateDB, the chain cannot be restarted.
+func NewHotColdChain(anchorState common.BeaconState, spec *common.Spec, stateDB states.DB) (*HotColdChain, error) {
+	return newHotColdChain(anchorState, spec, ChainStorage{States: stateDB}, NewFinalizedChain(spec, stateDB))
+}
+
+// NewPersistentHotColdChain creates a chain, starting from the given anchor state,
+// and persists it in the storage, to restart it later with LoadHotColdChain.
+// The storage must not contain a chain already.
+func NewPersistentHotColdChain(ctx context.Context, anchorState common.BeaconState,
+	spec *common.Spec, storage ChainStorage) (*HotColdChain, error) {
+	if storage.Blocks == nil || storage.States == nil || storage.Meta == nil {
+		return nil, errors.New("incomplete chain storage")
+	}
+	if _, ok, err := storage.Meta.Anchor(); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, errors.New("storage already contains a chain, it should be loaded instead")
+	}
+	cold, err := storage.newColdChain(spec)
 	if err != nil {
 		return nil, err
 	}
-	valRoot, err := anchorState.GenesisValidatorsRoot()
+	cold.MetaDB = storage.Meta
+	c, err := newHotColdChain(anchorState, spec, storage, cold)
 	if err != nil {
 		return nil, err
 	}
+	hotAnchor, err := c.HotChain.Head()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.persistAnchor(ctx, hotAnchor, c.HotChain.FinalizedCheckpoint(), c.HotChain.JustifiedCheckpoint()); err != nil {
+		return nil, fmt.Errorf("failed to persist anchor: %v", err)
+	}
+	return c, nil
+}
+
+// LoadHotColdChain restarts a chain that was persisted in the storage.
+// The cold chain is restored from its persisted index, the hot chain is rebuilt from the persisted anchor state,
+// by re-processing the blocks in the blocks DB that build on the anchor.
+func LoadHotColdChain(ctx context.Context, spec *common.Spec, storage ChainStorage) (*HotColdChain, error) {
+	if storage.Blocks == nil || storage.States == nil || storage.Meta == nil {
+		return nil, errors.New("incomplete chain storage")
+	}
+	anchor, ok, err := storage.Meta.Anchor()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load anchor: %v", err)
+	}
+	if !ok {
+		return nil, errors.New("storage does not contain a chain")
+	}
+	anchorState, err := storage.States.Get(ctx, anchor.StateRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load anchor state: %v", err)
+	}
+	if anchorState == nil {
+		return nil, fmt.Errorf("anchor state %s is missing", anchor.StateRoot)
+	}
 	c := &HotColdChain{
-		HotChain:    nil,
-		ColdChain:   NewFinalizedChain(spec, stateDB),
-		Spec:        spec,
-		GenesisInfo: GenesisInfo{ValidatorsRoot: valRoot, Time: time},
+		Spec:    spec,
+		Storage: storage,
+		anchor:  anchor,
 	}
-	hotCh, err := NewUnfinalizedChain(anchorState, BlockSinkFn(c.hotToCold), spec)
+	if err := c.initGenesisInfo(anchorState); err != nil {
+		return nil, err
+	}
+	c.initOrphans()
+	hotCh, err := newUnfinalizedChain(anchorState, anchor.Finalized, anchor.Justified, BlockSinkFn(c.hotToCold), spec)
 	if err != nil {
 		return nil, err
 	}
 	c.HotChain = hotCh
+	anchorEntry, err := hotCh.Head()
+	if err != nil {
+		return nil, err
+	}
+	// The cold entries are persisted before the new anchor. After a crash in between,
+	// the cold index runs past the anchor: drop those entries, the hot chain re-processes them.
+	if err := storage.Meta.TruncateCold(anchorEntry.Step()); err != nil {
+		return nil, fmt.Errorf("failed to truncate cold chain index to anchor: %v", err)
+	}
+	cold, err := storage.loadColdChain(spec)
+	if err != nil {
+		return nil, err
+	}
+	c.ColdChain = cold
+	if err := cold.sharePubkeyCache(ctx, anchorEntry); err != nil {
+		return nil, err
+	}
+	if err := c.replayHotBlocks(ctx, hotCh, anchorEntry.Step().Slot()); err != nil {
+		return nil, fmt.Errorf("failed to rebuild hot chain: %v", err)
+	}
+	if err := c.initStatus(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
+func newHotColdChain(anchorState common.BeaconState, spec *common.Spec,
+	storage ChainStorage, cold *FinalizedChain) (*HotColdChain, error) {
+	c := &HotColdChain{
+		HotChain:  nil,
+		ColdChain: cold,
+		Spec:      spec,
+		Storage:   storage,
+	}
+	if err := c.initGenesisInfo(anchorState); err != nil {
+		return nil, err
+	}
+	c.initOrphans()
+	hotCh, err := NewUnfinalizedChain(anchorState, BlockSinkFn(c.hotToCold), spec)
+	if err != nil {
+		return nil, err
+	}
+	c.HotChain = hotCh
+	anchorEntry, err := hotCh.Head()
+	if err != nil {
+		return nil, err
+	}
+	if err := cold.sharePubkeyCache(context.Background(), anchorEntry); err != nil {
+		return nil, err
+	}
+	if err := c.initStatus(); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
+func (hc *HotColdChain) initGenesisInfo(anchorState common.BeaconState) error {
+	time, err := anchorState.GenesisTime()
+	if err != nil {
+		return err
+	}
+	valRoot, err := anchorState.GenesisValidatorsRoot()
+	if err != nil {
+		return err
+	}
+	hc.GenesisInfo = GenesisInfo{ValidatorsRoot: valRoot, Time: time}
+	return nil
+}
+
+// initOrphans uses the orphan store of the storage, or keeps the orphans in memory if there is none.
+// The in-memory orphans are kept for DefaultOrphanRetentionEpochs before the finalized epoch.
+func (hc *HotColdChain) initOrphans() {
+	hc.Orphans = hc.Storage.Orphans
+	if hc.Orphans == nil {
+		dec := beacon.NewForkDecoder(hc.Spec, hc.GenesisInfo.ValidatorsRoot)
+		store := NewBlocksOrphanStore(blocks.NewMemDB(hc.Spec, dec))
+		store.Retention = DefaultOrphanRetentionEpochs * hc.Spec.SLOTS_PER_EPOCH
+		hc.Orphans = store
+	}
+}
+
+// pruneOrphansMaybe prunes the orphan store, if the finalized checkpoint changed.
+func (hc *HotColdChain) pruneOrphansMaybe(ctx context.Context) error {
+	fin := hc.HotChain.FinalizedCheckpoint()
+	if fin.Epoch <= hc.orphansPruned {
+		return nil
+	}
+	finSlot, err := hc.Spec.EpochStartSlot(fin.Epoch)
+	if err != nil {
+		return err
+	}
+	if err := hc.Orphans.PruneOrphans(ctx, finSlot); err != nil {
+		return fmt.Errorf("failed to prune orphans: %v", err)
+	}
+	hc.orphansPruned = fin.Epoch
+	return nil
+}
+
+// replayHotBlocks re-processes the stored blocks that build on the anchor of the hot chain, in slot order.
+// Blocks that are part of the cold chain, or do not build on the anchor, are skipped.
+func (hc *HotColdChain) replayHotBlocks(ctx context.Context, hot *UnfinalizedChain, anchorSlot Slot) error {
+	var replayErr error
+	// the slot index lists the blocks after the anchor in slot order, parents before children
+	if err := hc.Storage.Blocks.Range(ctx, anchorSlot+1, math.MaxUint64, func(slot Slot, root Root) bool {
+		if _, ok := hc.ColdChain.ByBlock(root); ok {
+			return true
+		}
+		if _, ok := hot.ByBlock(root); ok {
+			return true
+		}
+		benv, err := hc.Storage.Blocks.Get(ctx, root)
+		if err != nil {
+			replayErr = fmt.Errorf("failed to load block %s: %v", root, err)
+			return false
+		}
+		if benv == nil {
+			return true
+		}
+		if _, ok := hot.ByBlock(benv.ParentRoot); !ok {
+			return true
+		}
+		if err := hot.AddBlock(ctx, benv); err != nil {
+			replayErr = fmt.Errorf("failed to re-process block %s at slot %d: %v", benv.BlockRoot, benv.Slot, err)
+			return false
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	return replayErr
+}
+
+// persistAnchor persists the state of the anchor entry of the hot chain, and the anchor itself.
+func (hc *HotColdChain) persistAnchor(ctx context.Context, entry ChainEntry, finalized Checkpoint, justified Checkpoint) error {
+	state, err := entry.State(ctx)
+	if err != nil {
+		return err
+	}
+	if err := hc.Storage.States.Store(ctx, state); err != nil {
+		return err
+	}
+	anchor := HotAnchor{Finalized: finalized, Justified: justified, StateRoot: entry.StateRoot()}
+	if err := hc.Storage.Meta.StoreAnchor(anchor); err != nil {
+		return err
+	}
+	hc.anchor = anchor
+	return nil
+}
+
+// persistAnchorMaybe persists the new anchor of the hot chain, if the finalized checkpoint changed.
+func (hc *HotColdChain) persistAnchorMaybe(ctx context.Context) error {
+	if hc.Storage.Meta == nil {
+		return nil
+	}
+	fin := hc.HotChain.FinalizedCheckpoint()
+	if fin == hc.anchor.Finalized {
+		return nil
+	}
+	entry, err := hc.HotChain.Finalized()
+	if err != nil {
+		return err
+	}
+	return hc.persistAnchor(ctx, entry, fin, hc.HotChain.JustifiedCheckpoint())
+}
+
+// AddBlock processes the block in the hot chain, and persists it if the chain has a blocks DB.
+// The arrival time of the block is not known, see AddBlockAt for blocks that arrive live.
+func (hc *HotColdChain) AddBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error {
+	return hc.addBlock(ctx, benv, func() error {
+		return hc.HotChain.AddBlock(ctx, benv)
+	})
+}
+
+// AddBlockAt processes the block like AddBlock, for a block that arrived at the given time.
+func (hc *HotColdChain) AddBlockAt(ctx context.Context, benv *common.BeaconBlockEnvelope, arrival common.Timestamp) error {
+	return hc.addBlock(ctx, benv, func() error {
+		return hc.HotChain.AddBlockAt(ctx, benv, arrival)
+	})
+}
+
+func (hc *HotColdChain) addBlock(ctx context.Context, benv *common.BeaconBlockEnvelope, add func() error) error {
+	hc.Lock()
+	defer hc.Unlock()
+	if err := add(); err != nil {
+		return err
+	}
+	hc.events.Send(&BlockImportedEvent{
+		Slot:       benv.Slot,
+		BlockRoot:  benv.BlockRoot,
+		ParentRoot: benv.ParentRoot,
+		StateRoot:  benv.StateRoot,
+	})
+	if hc.Storage.Blocks != nil {
+		if _, _, err := hc.Storage.Blocks.Store(ctx, benv); err != nil {
+			return fmt.Errorf("failed to persist block %s: %v", benv.BlockRoot, err)
+		}
+	}
+	if err := hc.persistAnchorMaybe(ctx); err != nil {
+		return fmt.Errorf("failed to persist new hot chain anchor: %v", err)
+	}
+	if err := hc.pruneOrphansMaybe(ctx); err != nil {
+		return err
+	}
+	return hc.emitStatusChanges()
+}
+
+func (hc *HotColdChain) Towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error) {
+	hc.Lock()
+	defer hc.Unlock()
+	entry, err := hc.HotChain.Towards(ctx, fromBlockRoot, toSlot)
+	if err != nil {
+		return nil, err
+	}
+	if err := hc.persistAnchorMaybe(ctx); err != nil {
+		return nil, fmt.Errorf("failed to persist new hot chain anchor: %v", err)
+	}
+	if err := hc.pruneOrphansMaybe(ctx); err != nil {
+		return nil, err
+	}
+	if err := hc.emitStatusChanges(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (hc *HotColdChain) OnTick(ctx context.Context, time common.Timestamp) error {
+	hc.Lock()
+	defer hc.Unlock()
+	if err := hc.HotChain.OnTick(ctx, time); err != nil {
+		return err
+	}
+	return hc.emitStatusChanges()
+}
+
+// AddAttestation updates the forkchoice with the given attestation.
+// A head change due to attestations is emitted with the next block, tick or Head call.
+func (hc *HotColdChain) AddAttestation(att *phase0.Attestation) error {
+	hc.Lock()
+	defer hc.Unlock()
+	return hc.HotChain.AddAttestation(att)
+}
+
+// Head gets the head of the chain, and emits a HeadChangedEvent if it changed since the last event.
+func (hc *HotColdChain) Head() (ChainEntry, error) {
+	hc.Lock()
+	defer hc.Unlock()
+	if err := hc.emitStatusChanges(); err != nil {
+		return nil, err
+	}
+	return hc.status.head, nil
+}
+
+// Subscribe creates a subscription to the events of the chain:
+// imported blocks, head changes, checkpoint updates, and entries that moved to the cold chain.
+// Events are dropped if the subscriber does not keep up with the buffer.
+func (hc *HotColdChain) Subscribe(buffer int) *Subscription {
+	return hc.events.Subscribe(buffer)
+}
+
 func (hc *HotColdChain) Genesis() GenesisInfo {
 	return hc.GenesisInfo
 }
 
 func (hc *HotColdChain) hotToCold(ctx context.Context, entry ChainEntry, canonical bool) error {
 	if canonical {
-		return hc.ColdChain.OnFinalizedEntry(ctx, entry)
+		if err := hc.ColdChain.OnFinalizedEntry(ctx, entry); err != nil {
+			return err
+		}
+		hc.events.Send(&MovedToColdEvent{Step: entry.Step(), BlockRoot: entry.BlockRoot(), StateRoot: entry.StateRoot()})
+		return nil
+	}
+	// Keep track of pruned non-finalized blocks. Empty slots are not worth keeping.
+	if hotEntry, ok := entry.(*HotEntry); ok && hotEntry.block != nil {
+		return hc.Orphans.StoreOrphan(ctx, hotEntry.block)
 	}
-	// TODO keep track of pruned non-finalized blocks?
 	return nil
 }
 
+// OrphansBySlot lists the pruned non-finalized blocks in the slot range [start, end), ordered by slot.
+func (hc *HotColdChain) OrphansBySlot(ctx context.Context, start Slot, end Slot) ([]*common.BeaconBlockEnvelope, error) {
+	return hc.Orphans.OrphansBySlot(ctx, start, end)
+}
+
+// OrphansByProposer lists the pruned non-finalized blocks of the given proposer, ordered by slot.
+func (hc *HotColdChain) OrphansByProposer(ctx context.Context, proposer ValidatorIndex) ([]*common.BeaconBlockEnvelope, error) {
+	return hc.Orphans.OrphansByProposer(ctx, proposer)
+}
+
 func (hc *HotColdChain) ByStateRoot(root Root) (entry ChainEntry, ok bool) {
 	hc.Lock()
 	defer hc.Unlock()
@@ -307,5 +660,3 @@ func (fi *FullChainIter) Entry(step Step) (entry ChainEntry, err error) {
 		return fi.HotIter.Entry(step)
 	}
 }
-
-// TODO: chain copy
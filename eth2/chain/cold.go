@@ -71,10 +71,25 @@ type FinalizedChain struct {
 	// StateRootsMaps maps roots of StateRoots back to steps
 	StateRootsMap map[Root]Step
 
+	// If the maps of the index are shared with a copy of the chain, and must be copied before modifying them.
+	sharedIndex bool
+
 	// Spec is holds configuration information for the parameters and types of the chain
 	Spec *common.Spec
 
 	StateDB states.DB
+
+	// MetaDB persists the index of the chain, optional.
+	MetaDB MetaDB
+
+	// Archive configures the archive mode, nil if disabled. See NewArchiveFinalizedChain.
+	Archive *ArchiveConfig
+	// Steps of the snapshot states in the StateDB, in archive mode.
+	snapshots []Step
+	// Recently regenerated states, by state root
+	regenStates *lruCache
+	// Epochs contexts, by epoch
+	epochContexts *lruCache
 }
 
 var _ ColdChain = (*FinalizedChain)(nil)
@@ -92,6 +107,31 @@ func NewFinalizedChain(spec *common.Spec, stateDB states.DB) *FinalizedChain {
 	}
 }
 
+// LoadFinalizedChain restores a FinalizedChain from the index persisted in the MetaDB.
+// The states of the index are expected to be available in the stateDB.
+// New finalized entries are persisted in the MetaDB as well.
+func LoadFinalizedChain(spec *common.Spec, stateDB states.DB, metaDB MetaDB) (*FinalizedChain, error) {
+	f := NewFinalizedChain(spec, stateDB)
+	if err := f.loadIndex(metaDB); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FinalizedChain) loadIndex(metaDB MetaDB) error {
+	entries, err := metaDB.ColdEntries()
+	if err != nil {
+		return fmt.Errorf("failed to load cold chain index: %v", err)
+	}
+	for _, entry := range entries {
+		if err := f.appendEntry(entry.Step, entry.BlockRoot, entry.StateRoot); err != nil {
+			return fmt.Errorf("invalid cold chain index: %v", err)
+		}
+	}
+	f.MetaDB = metaDB
+	return nil
+}
+
 type ColdChainIter struct {
 	Chain              Chain
 	StartStep, EndStep Step
@@ -249,7 +289,7 @@ func (f *FinalizedChain) Search(parentRoot *Root, slot *Slot) ([]SearchEntry, er
 	defer f.RUnlock()
 	// Searching the cold chain is a lot easier: there is at most 1 entry to retrieve.
 	if slot != nil {
-		entry, ok := f.ByCanonStep(AsStep(*slot, true))
+		entry, ok := f.byCanonStep(AsStep(*slot, true))
 		if !ok {
 			return nil, nil
 		}
@@ -305,10 +345,10 @@ func (f *FinalizedChain) ByCanonStep(step Step) (entry ChainEntry, ok bool) {
 }
 
 func (f *FinalizedChain) byCanonStep(step Step) (entry ChainEntry, ok bool) {
-	if start := f.ColdStart(); step < start {
+	if start := f.start(); step < start {
 		return nil, false
 	}
-	if end := f.ColdEnd(); step >= end {
+	if end := f.end(); step >= end {
 		return nil, false
 	}
 	return &FinalizedEntryView{
@@ -325,14 +365,8 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 
 	// If the chain is not empty, we need to verify consistency with what we add.
 	if len(f.StateRoots) != 0 {
-		end := f.ColdEnd()
-		if end > next {
-			return fmt.Errorf("received finalized entry %s at %s, but already finalized up to later step %s", blockRoot, next, end)
-		}
-		// Any direct follow-up (block after slot, slot after block),
-		// or if the end is a gap slot, it may be left empty.
-		if !(end+1 == next || (!end.Block() && end+2 == next)) {
-			return fmt.Errorf("consistency issue, got %s and cannot append to %s", next, end)
+		if err := f.checkNext(next, blockRoot); err != nil {
+			return err
 		}
 		// check parent root
 		parent := entry.ParentRoot()
@@ -346,8 +380,65 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve state of new finalized entry %s: %v", next, err)
 	}
-	if err := f.StateDB.Store(ctx, state); err != nil {
-		return fmt.Errorf("failed to store state of new finalized entry %s: %v", next, err)
+	stateRoot := entry.StateRoot()
+	// In archive mode only the snapshots are stored, other states are regenerated when necessary.
+	if f.Archive == nil || f.snapshotDue(next) {
+		if err := f.StateDB.Store(ctx, state); err != nil {
+			return fmt.Errorf("failed to store state of new finalized entry %s: %v", next, err)
+		}
+	} else {
+		f.regenStates.add(stateRoot, state)
+	}
+	if f.MetaDB != nil {
+		if err := f.MetaDB.AppendColdEntry(ColdIndexEntry{Step: next, BlockRoot: blockRoot, StateRoot: stateRoot}); err != nil {
+			return fmt.Errorf("failed to persist new finalized entry %s: %v", next, err)
+		}
+	}
+	if err := f.sharePubkeyCache(ctx, entry); err != nil {
+		return fmt.Errorf("failed to get pubkey cache of new finalized entry %s: %v", next, err)
+	}
+	return f.appendEntry(next, blockRoot, stateRoot)
+}
+
+// sharePubkeyCache makes the finalized chain use the pubkey cache of the given entry.
+// Finalized entries only add validators, the newest pubkey cache covers all previous entries.
+func (f *FinalizedChain) sharePubkeyCache(ctx context.Context, entry ChainEntry) error {
+	epc, err := entry.EpochsContext(ctx)
+	if err != nil {
+		return err
+	}
+	if epc.PubkeyCache != nil {
+		f.PubkeyCache = epc.PubkeyCache
+	}
+	return nil
+}
+
+// checkNext checks if the step can be appended to the (non-empty) chain.
+func (f *FinalizedChain) checkNext(next Step, blockRoot Root) error {
+	end := f.end()
+	if end > next {
+		return fmt.Errorf("received finalized entry %s at %s, but already finalized up to later step %s", blockRoot, next, end)
+	}
+	// Steps may be left empty: pre-block steps, and the slots without block.
+	// The parent root of the entry is what links it to the chain.
+	return nil
+}
+
+// appendEntry adds the entry to the index of the chain.
+func (f *FinalizedChain) appendEntry(next Step, blockRoot Root, stateRoot Root) error {
+	f.ownIndex()
+	if len(f.StateRoots) != 0 {
+		if err := f.checkNext(next, blockRoot); err != nil {
+			return err
+		}
+		// The roots are indexed by step: repeat the last entry for the steps that are left empty.
+		for end := f.end(); end < next; end++ {
+			f.BlockRoots = append(f.BlockRoots, f.BlockRoots[len(f.BlockRoots)-1])
+			f.StateRoots = append(f.StateRoots, f.StateRoots[len(f.StateRoots)-1])
+		}
+	}
+	if f.Archive != nil && f.snapshotDue(next) {
+		f.snapshots = append(f.snapshots, next)
 	}
 
 	// Add block (may be a repeat of last)
@@ -358,14 +449,19 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 	}
 
 	// Add new state
-	stateRoot := entry.StateRoot()
 	f.StateRoots = append(f.StateRoots, stateRoot)
 	f.StateRootsMap[stateRoot] = next
 	return nil
 }
 
+// entryParentRoot returns the block root before the block of the slot, or zero if that is before the start of the chain.
 func (f *FinalizedChain) entryParentRoot(slot Slot) (root Root) {
-	return f.entryBlockRoot(AsStep(slot, false))
+	f.RLock()
+	defer f.RUnlock()
+	if step := AsStep(slot, false); step >= f.start() && step < f.end() {
+		return f.BlockRoots[step-f.start()]
+	}
+	return Root{}
 }
 
 func (f *FinalizedChain) entryBlockRoot(step Step) (root Root) {
@@ -373,7 +469,7 @@ func (f *FinalizedChain) entryBlockRoot(step Step) (root Root) {
 	defer f.RUnlock()
 	start := f.start()
 	end := f.end()
-	if start < step || step >= end {
+	if step < start || step >= end {
 		panic("out of bounds internal usage error")
 	}
 	return f.BlockRoots[step-start]
@@ -388,7 +484,7 @@ func (f *FinalizedChain) entryStateRoot(step Step) Root {
 func (f *FinalizedChain) stateRoot(step Step) Root {
 	start := f.start()
 	end := f.end()
-	if start < step || step >= end {
+	if step < start || step >= end {
 		panic("out of bounds internal usage error")
 	}
 	return f.StateRoots[step-start]
@@ -397,22 +493,20 @@ func (f *FinalizedChain) stateRoot(step Step) Root {
 func (f *FinalizedChain) entryGetEpochsContext(ctx context.Context, step Step) (*common.EpochsContext, error) {
 	f.RLock()
 	defer f.RUnlock()
-	epc := &common.EpochsContext{
-		PubkeyCache: f.PubkeyCache,
+	// Empty steps repeat the state of an earlier step, the epoch of that state is what matters.
+	if target, ok := f.StateRootsMap[f.stateRoot(step)]; ok {
+		if cached, ok := f.epochContexts.get(f.Spec.SlotToEpoch(target.Slot())); ok {
+			epc := cached.(*common.EpochsContext).Clone()
+			epc.PubkeyCache = f.PubkeyCache
+			return epc, nil
+		}
 	}
-	// We do not store shuffling for older epochs
-	// TODO: maybe store it after all, for archive node functionality?
+	// Without archive mode, the shuffling for older epochs is not cached
 	state, err := f.getState(ctx, step)
 	if err != nil {
 		return nil, err
 	}
-	if err := epc.LoadShuffling(state); err != nil {
-		return nil, err
-	}
-	if err := epc.LoadProposers(state); err != nil {
-		return nil, err
-	}
-	return epc, nil
+	return f.epochsContext(state)
 }
 
 func (f *FinalizedChain) entryGetState(ctx context.Context, step Step) (common.BeaconState, error) {
@@ -426,6 +520,9 @@ func (f *FinalizedChain) getState(ctx context.Context, step Step) (common.Beacon
 	if root == (common.Root{}) {
 		return nil, fmt.Errorf("unknown state, step out of range: %s", step)
 	}
+	if f.Archive != nil {
+		return f.regenState(ctx, step)
+	}
 	state, err := f.StateDB.Get(ctx, root)
 	if err != nil {
 		return nil, err
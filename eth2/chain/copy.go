@@ -0,0 +1,114 @@
+package chain
+
+import (
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/forkchoice/proto"
+)
+
+// Copy copies the hot chain, to modify independently of the original. Pruned entries of the copy go to the given sink.
+// The entries themselves are immutable, and shared between the chains.
+func (uc *UnfinalizedChain) Copy(sink BlockSink) (*UnfinalizedChain, error) {
+	uc.RLock()
+	defer uc.RUnlock()
+	out := &UnfinalizedChain{
+		Entries:   make(map[BlockSlotKey]*HotEntry, len(uc.Entries)),
+		State2Key: make(map[Root]BlockSlotKey, len(uc.State2Key)),
+		BlockSink: sink,
+		Spec:      uc.Spec,
+	}
+	for key, entry := range uc.Entries {
+		out.Entries[key] = entry
+	}
+	for root, key := range uc.State2Key {
+		out.State2Key[root] = key
+	}
+	fc, err := proto.CopyProtoForkChoice(uc.ForkChoice, proto.NodeSinkFn(out.onPrunedNode))
+	if err != nil {
+		return nil, err
+	}
+	out.ForkChoice = fc
+	return out, nil
+}
+
+// Copy copies the finalized chain, to modify independently of the original.
+// The index is shared copy-on-write: copied by whichever of the two chains appends to it first.
+// The copy does not persist its index, and stores the states of new finalized entries in memory,
+// reading through to the states DB of the original for the existing entries.
+func (f *FinalizedChain) Copy() *FinalizedChain {
+	f.Lock()
+	defer f.Unlock()
+	out := &FinalizedChain{
+		PubkeyCache: f.PubkeyCache,
+		// appending to the capped slices allocates, the shared roots are not modified.
+		BlockRoots:    f.BlockRoots[:len(f.BlockRoots):len(f.BlockRoots)],
+		StateRoots:    f.StateRoots[:len(f.StateRoots):len(f.StateRoots)],
+		BlockRootsMap: f.BlockRootsMap,
+		StateRootsMap: f.StateRootsMap,
+		sharedIndex:   true,
+		Spec:          f.Spec,
+		StateDB:       states.NewOverlayDB(f.Spec, f.StateDB),
+		Archive:       f.Archive,
+		snapshots:     f.snapshots[:len(f.snapshots):len(f.snapshots)],
+		// regenerated states are identified by state root, and can be shared.
+		regenStates: f.regenStates,
+	}
+	if f.Archive != nil {
+		out.epochContexts = newLRUCache(f.Archive.EpochCacheSize)
+	}
+	f.sharedIndex = true
+	return out
+}
+
+// ownIndex copies the index maps before they are modified, if they are shared with a copy of the chain.
+func (f *FinalizedChain) ownIndex() {
+	if !f.sharedIndex {
+		return
+	}
+	blockRoots := make(map[Root]Slot, len(f.BlockRootsMap))
+	for root, slot := range f.BlockRootsMap {
+		blockRoots[root] = slot
+	}
+	stateRoots := make(map[Root]Step, len(f.StateRootsMap))
+	for root, step := range f.StateRootsMap {
+		stateRoots[root] = step
+	}
+	f.BlockRootsMap = blockRoots
+	f.StateRootsMap = stateRoots
+	f.sharedIndex = false
+}
+
+// Copy copies the chain, to simulate blocks and attestations with, without modifying the original chain.
+// The forkchoice, hot entries and cold index are copied, or shared copy-on-write.
+// The copy does not persist any blocks, anchor or index, and keeps its orphans in memory.
+// The states of entries that are finalized in the copy are kept in memory,
+// on top of the states DB of the original, which is not modified by the copy.
+// The copy has no event subscribers.
+func (hc *HotColdChain) Copy() (*HotColdChain, error) {
+	hc.Lock()
+	defer hc.Unlock()
+	hot, ok := hc.HotChain.(*UnfinalizedChain)
+	if !ok {
+		return nil, fmt.Errorf("cannot copy hot chain of type %T", hc.HotChain)
+	}
+	cold, ok := hc.ColdChain.(*FinalizedChain)
+	if !ok {
+		return nil, fmt.Errorf("cannot copy cold chain of type %T", hc.ColdChain)
+	}
+	coldCopy := cold.Copy()
+	c := &HotColdChain{
+		ColdChain:   coldCopy,
+		Spec:        hc.Spec,
+		GenesisInfo: hc.GenesisInfo,
+		Storage:     ChainStorage{States: coldCopy.StateDB},
+		anchor:      hc.anchor,
+		status:      hc.status,
+	}
+	c.initOrphans()
+	hotCopy, err := hot.Copy(BlockSinkFn(c.hotToCold))
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy hot chain: %v", err)
+	}
+	c.HotChain = hotCopy
+	return c, nil
+}
@@ -0,0 +1,92 @@
+package chain
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"testing"
+)
+
+func TestHotColdChainCopy(t *testing.T) {
+	spec := *configs.Minimal
+	ctx := context.Background()
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := addTimelyTestBlock(t, ch, b1); err != nil {
+		t.Fatal(err)
+	}
+	sub := ch.Subscribe(10)
+	defer sub.Unsubscribe()
+
+	cp, err := ch.Copy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a block that only the copy processes
+	b2 := buildTestBlock(t, cp, &spec, keys, b1.BlockRoot, 2)
+	if err := addTimelyTestBlock(t, cp, b2); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := cp.Head(); err != nil {
+		t.Fatal(err)
+	} else if head.BlockRoot() != b2.BlockRoot {
+		t.Fatalf("unexpected head of copy: %s", head.BlockRoot())
+	}
+	if _, ok := ch.ByBlock(b2.BlockRoot); ok {
+		t.Fatal("block of copy was added to the original")
+	}
+	if head, err := ch.Head(); err != nil {
+		t.Fatal(err)
+	} else if head.BlockRoot() != b1.BlockRoot {
+		t.Fatalf("copy changed head of original: %s", head.BlockRoot())
+	}
+	if evs := drainEvents(sub); len(evs) != 0 {
+		t.Fatalf("copy emitted %d events to the original subscribers", len(evs))
+	}
+
+	// and a competing block that only the original processes
+	fork := buildTestBlock(t, ch, &spec, keys, b1.BlockRoot, 3)
+	if err := addTimelyTestBlock(t, ch, fork); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cp.ByBlock(fork.BlockRoot); ok {
+		t.Fatal("block of original was added to the copy")
+	}
+
+	// the copy stores states on top of the states DB of the original, without modifying it
+	state, err := genesis.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Storage.States.Store(ctx, state); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cp.Storage.States.Get(ctx, genesis.StateRoot()); err != nil || got == nil {
+		t.Fatalf("expected the copy to read the states of the original: %v", err)
+	}
+	b2Entry, ok := cp.ByBlock(b2.BlockRoot)
+	if !ok {
+		t.Fatal("missing block of copy")
+	}
+	b2State, err := b2Entry.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Storage.States.Store(ctx, b2State); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ch.Storage.States.Get(ctx, b2.StateRoot); err != nil {
+		t.Fatal(err)
+	} else if got != nil {
+		t.Fatal("state stored by the copy was added to the states DB of the original")
+	}
+}
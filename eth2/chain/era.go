@@ -0,0 +1,748 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/util/bls"
+	"github.com/protolambda/ztyp/codec"
+	"github.com/protolambda/ztyp/tree"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Era files archive the finalized chain per SLOTS_PER_HISTORICAL_ROOT slots (8192 on mainnet).
+// Era N contains the blocks of the slots [(N-1) * SLOTS_PER_HISTORICAL_ROOT, N * SLOTS_PER_HISTORICAL_ROOT),
+// followed by the boundary state at slot N * SLOTS_PER_HISTORICAL_ROOT, and a slot index for both.
+// The block roots and state roots of the boundary state cover every slot of the era, to verify the blocks with.
+// Era 0 only contains the genesis state. The genesis block is never included, there is no signed genesis block.
+//
+// The file is a sequence of entries, each with a type, a length and the data:
+// a version entry, the snappy-framed SSZ blocks, the snappy-framed SSZ state,
+// the block slot index (omitted in era 0), and the state slot index.
+// A slot index has the start slot, the offset of the entry of every slot relative to the index entry
+// (zero for slots without block), and the number of slots.
+
+type eraEntryType [2]byte
+
+var (
+	eraTypeVersion   = eraEntryType{0x65, 0x32}
+	eraTypeBlock     = eraEntryType{0x01, 0x00}
+	eraTypeState     = eraEntryType{0x02, 0x00}
+	eraTypeSlotIndex = eraEntryType{0x69, 0x32}
+)
+
+type eraEntryHeader struct {
+	Type     eraEntryType
+	Length   uint32
+	Reserved uint16
+}
+
+const eraEntryHeaderSize = 8
+
+const eraFileSuffix = ".era"
+
+// eraSignatureBatchSize is the number of block signatures to verify at once when importing an era.
+const eraSignatureBatchSize = 64
+
+// EraFileName is the name of the archive file of the given era.
+func EraFileName(era uint64) string {
+	return fmt.Sprintf("%05d%s", era, eraFileSuffix)
+}
+
+// eraSlots returns the slot range [start, end) of the blocks of the era. The boundary state is at the end slot.
+func eraSlots(spec *common.Spec, era uint64) (start Slot, end Slot) {
+	end = Slot(era) * spec.SLOTS_PER_HISTORICAL_ROOT
+	if era == 0 {
+		return 0, 0
+	}
+	return end - spec.SLOTS_PER_HISTORICAL_ROOT, end
+}
+
+// eraSteps returns the first step of the chain needed to export the era, and the step of the boundary state.
+// The genesis has no pre-block step, its post-block state is the state at slot 0.
+func eraSteps(spec *common.Spec, era uint64) (first Step, boundary Step) {
+	start, end := eraSlots(spec, era)
+	if end == 0 {
+		return AsStep(0, true), AsStep(0, true)
+	}
+	if start == 0 {
+		return AsStep(0, true), AsStep(end, false)
+	}
+	return AsStep(start, false), AsStep(end, false)
+}
+
+type eraWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (ew *eraWriter) writeEntry(typ eraEntryType, data []byte) error {
+	header := make([]byte, eraEntryHeaderSize)
+	copy(header[:2], typ[:])
+	binary.LittleEndian.PutUint32(header[2:6], uint32(len(data)))
+	if _, err := ew.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := ew.w.Write(data); err != nil {
+		return err
+	}
+	ew.offset += eraEntryHeaderSize + int64(len(data))
+	return nil
+}
+
+// writeIndex writes a slot index entry, for the entries at the given absolute offsets (zero if none).
+func (ew *eraWriter) writeIndex(start Slot, offsets []int64) error {
+	data := make([]byte, 8+8*len(offsets)+8)
+	binary.LittleEndian.PutUint64(data[:8], uint64(start))
+	for i, offset := range offsets {
+		if offset != 0 {
+			offset -= ew.offset
+		}
+		binary.LittleEndian.PutUint64(data[8+8*i:], uint64(offset))
+	}
+	binary.LittleEndian.PutUint64(data[len(data)-8:], uint64(len(offsets)))
+	return ew.writeEntry(eraTypeSlotIndex, data)
+}
+
+// snappyFramed compresses the serialized SSZ of the object with the snappy framing format.
+func snappyFramed(serialize func(w *codec.EncodingWriter) error) ([]byte, error) {
+	var buf bytes.Buffer
+	sw := snappy.NewBufferedWriter(&buf)
+	if err := serialize(codec.NewEncodingWriter(sw)); err != nil {
+		return nil, err
+	}
+	if err := sw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EraExporter writes the finalized chain to era files.
+type EraExporter struct {
+	Chain *FinalizedChain
+	// Blocks provides the finalized blocks.
+	Blocks  blocks.DB
+	Decoder *beacon.ForkDecoder
+}
+
+// Eras returns the range [first, end) of eras that are fully covered by the finalized chain.
+func (ex *EraExporter) Eras() (first uint64, end uint64) {
+	spec := ex.Chain.Spec
+	start, stop := ex.Chain.ColdStart(), ex.Chain.ColdEnd()
+	if start == stop {
+		return 0, 0
+	}
+	for first = 0; ; first++ {
+		if step, _ := eraSteps(spec, first); step >= start {
+			break
+		}
+	}
+	for end = first; ; end++ {
+		if _, boundary := eraSteps(spec, end); boundary >= stop {
+			break
+		}
+	}
+	return first, end
+}
+
+// ExportEra writes the blocks and boundary state of the era.
+func (ex *EraExporter) ExportEra(ctx context.Context, era uint64, w io.Writer) error {
+	f := ex.Chain
+	spec := f.Spec
+	first, boundary := eraSteps(spec, era)
+	if first < f.ColdStart() || boundary >= f.ColdEnd() {
+		return fmt.Errorf("era %d is not covered by the finalized chain %s - %s", era, f.ColdStart(), f.ColdEnd())
+	}
+	ew := &eraWriter{w: w}
+	if err := ew.writeEntry(eraTypeVersion, nil); err != nil {
+		return err
+	}
+	start, end := eraSlots(spec, era)
+	offsets := make([]int64, 0, end-start)
+	for slot := start; slot < end; slot++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		offset, err := ex.exportBlock(ctx, ew, slot)
+		if err != nil {
+			return fmt.Errorf("failed to export block of slot %d: %v", slot, err)
+		}
+		offsets = append(offsets, offset)
+	}
+	stateOffset := ew.offset
+	if err := ex.exportState(ctx, ew, boundary, end); err != nil {
+		return fmt.Errorf("failed to export boundary state of era %d: %v", era, err)
+	}
+	if era != 0 {
+		if err := ew.writeIndex(start, offsets); err != nil {
+			return err
+		}
+	}
+	return ew.writeIndex(end, []int64{stateOffset})
+}
+
+// exportBlock writes the block of the slot, and returns its offset, or zero if the slot has no block.
+func (ex *EraExporter) exportBlock(ctx context.Context, ew *eraWriter, slot Slot) (int64, error) {
+	if slot == 0 {
+		return 0, nil
+	}
+	entry, ok := ex.Chain.ByCanonStep(AsStep(slot, true))
+	if !ok {
+		return 0, errors.New("missing chain entry")
+	}
+	// empty slots repeat the block root before them
+	root := entry.BlockRoot()
+	if root == entry.ParentRoot() {
+		return 0, nil
+	}
+	benv, err := ex.Blocks.Get(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+	if benv == nil {
+		return 0, fmt.Errorf("missing block %s", root)
+	}
+	if benv.Slot != slot {
+		return 0, fmt.Errorf("block %s has slot %d", root, benv.Slot)
+	}
+	if digest, err := ex.Decoder.ForkDigestAtSlot(slot); err != nil {
+		return 0, err
+	} else if digest != benv.ForkDigest {
+		return 0, fmt.Errorf("block %s has fork digest %s, expected %s", root, benv.ForkDigest, digest)
+	}
+	data, err := snappyFramed(func(w *codec.EncodingWriter) error {
+		return benv.SignedBlock.Serialize(ex.Chain.Spec, w)
+	})
+	if err != nil {
+		return 0, err
+	}
+	offset := ew.offset
+	return offset, ew.writeEntry(eraTypeBlock, data)
+}
+
+// exportState writes the state of the boundary step, with the empty slots processed up to the boundary slot.
+func (ex *EraExporter) exportState(ctx context.Context, ew *eraWriter, boundary Step, slot Slot) error {
+	entry, ok := ex.Chain.ByCanonStep(boundary)
+	if !ok {
+		return errors.New("missing chain entry")
+	}
+	state, err := entry.State(ctx)
+	if err != nil {
+		return err
+	}
+	stateSlot, err := state.Slot()
+	if err != nil {
+		return err
+	}
+	if stateSlot < slot {
+		epc, err := entry.EpochsContext(ctx)
+		if err != nil {
+			return err
+		}
+		upState := &beacon.StandardUpgradeableBeaconState{BeaconState: state}
+		if err := common.ProcessSlots(ctx, ex.Chain.Spec, epc, upState, slot); err != nil {
+			return err
+		}
+		state = upState.BeaconState
+	}
+	data, err := snappyFramed(state.Serialize)
+	if err != nil {
+		return err
+	}
+	return ew.writeEntry(eraTypeState, data)
+}
+
+// ExportDir writes the era files of all eras that are covered by the finalized chain, and not already in the dir.
+// Files are written to a temporary file first, and then renamed.
+func (ex *EraExporter) ExportDir(ctx context.Context, dir string) (count int, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	first, end := ex.Eras()
+	for era := first; era < end; era++ {
+		p := path.Join(dir, EraFileName(era))
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		if err := ex.exportFile(ctx, era, p); err != nil {
+			return count, fmt.Errorf("failed to export era %d: %v", era, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (ex *EraExporter) exportFile(ctx context.Context, era uint64, p string) error {
+	tmpPath := p + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := ex.ExportEra(ctx, era, f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, p)
+}
+
+type eraEntry struct {
+	Type   eraEntryType
+	Offset int64
+	Length int64
+}
+
+type eraSlotIndex struct {
+	Start   Slot
+	Offsets []int64
+}
+
+// EraImporter loads era files into a blocks DB and states DB.
+//
+// The eras are verified against a trusted state: the historical roots of the trusted state commit to the
+// block roots and state roots of the boundary state of every era before it. Every block is then verified against
+// these roots, and linked to the previous block, also across consecutively imported eras.
+// The block roots do not commit to the block signatures: the proposer signatures are verified in batches,
+// with the validators of the boundary state, before the blocks are stored.
+//
+// The boundary state itself is only committed to by the next era: it is kept until the next era is imported,
+// and then stored if it matches the state root of the next era at its slot. A boundary state at the slot of the
+// trusted state is compared with the trusted state directly.
+type EraImporter struct {
+	Decoder *beacon.ForkDecoder
+	Blocks  blocks.DB
+	States  states.DB
+
+	// Trusted is a trusted state at or after the end of the imported eras,
+	// e.g. a finalized state of the FinalizedChain, or a weak subjectivity state. Required.
+	Trusted common.BeaconState
+
+	// The last block root and era that was imported, to link the next era with.
+	last     Root
+	lastEra  uint64
+	imported bool
+	// The boundary state of the last imported era, if not confirmed yet
+	pending common.BeaconState
+}
+
+// verifyHistory checks the boundary state of the era against the trusted state.
+// The returned bool is true if the boundary state matches the trusted state.
+func (im *EraImporter) verifyHistory(era uint64, state common.BeaconState) (trusted bool, err error) {
+	if im.Trusted == nil {
+		return false, errors.New("no trusted state to verify the era with")
+	}
+	spec := im.Decoder.Spec
+	trustedSlot, err := im.Trusted.Slot()
+	if err != nil {
+		return false, err
+	}
+	_, end := eraSlots(spec, era)
+	if trustedSlot < end {
+		return false, fmt.Errorf("era %d ends after the trusted state at slot %d", era, trustedSlot)
+	}
+	if trustedSlot == end {
+		if root, trustedRoot := state.HashTreeRoot(tree.GetHashFn()), im.Trusted.HashTreeRoot(tree.GetHashFn()); root != trustedRoot {
+			return false, fmt.Errorf("boundary state %s does not match trusted state %s", root, trustedRoot)
+		}
+		return true, nil
+	}
+	// the genesis state is only committed to by the state roots of the next era
+	if era == 0 {
+		return false, nil
+	}
+	histRoots, err := im.Trusted.HistoricalRoots()
+	if err != nil {
+		return false, err
+	}
+	expected, err := histRoots.GetRoot(era - 1)
+	if err != nil {
+		return false, fmt.Errorf("trusted state has no historical root for era %d: %v", era, err)
+	}
+	blockRoots, err := state.BlockRoots()
+	if err != nil {
+		return false, err
+	}
+	stateRoots, err := state.StateRoots()
+	if err != nil {
+		return false, err
+	}
+	hFn := tree.GetHashFn()
+	if got := tree.Hash(blockRoots.HashTreeRoot(hFn), stateRoots.HashTreeRoot(hFn)); got != expected {
+		return false, fmt.Errorf("historical batch %s of era %d does not match trusted historical root %s", got, era, expected)
+	}
+	return false, nil
+}
+
+// ImportEra verifies and loads the era file, and returns its era number.
+func (im *EraImporter) ImportEra(ctx context.Context, r io.ReaderAt, size int64) (era uint64, err error) {
+	spec := im.Decoder.Spec
+	entries, err := readEraEntries(r, size)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) < 3 || entries[0].Type != eraTypeVersion {
+		return 0, errors.New("not an era file")
+	}
+	stateIndex, err := readEraIndex(r, entries[len(entries)-1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid state index: %v", err)
+	}
+	if len(stateIndex.Offsets) != 1 || stateIndex.Start%spec.SLOTS_PER_HISTORICAL_ROOT != 0 {
+		return 0, errors.New("invalid state index")
+	}
+	era = uint64(stateIndex.Start / spec.SLOTS_PER_HISTORICAL_ROOT)
+	start, end := eraSlots(spec, era)
+
+	byOffset := make(map[int64]eraEntry, len(entries))
+	for _, e := range entries {
+		byOffset[e.Offset] = e
+	}
+	stateEntry, ok := byOffset[stateIndex.Offsets[0]]
+	if !ok || stateEntry.Type != eraTypeState {
+		return era, errors.New("state index does not point to a state")
+	}
+	var blockIndex eraSlotIndex
+	if era != 0 {
+		if len(entries) < 4 {
+			return era, errors.New("missing block index")
+		}
+		blockIndex, err = readEraIndex(r, entries[len(entries)-2])
+		if err != nil {
+			return era, fmt.Errorf("invalid block index: %v", err)
+		}
+		if blockIndex.Start != start || Slot(len(blockIndex.Offsets)) != end-start {
+			return era, fmt.Errorf("block index of slots %d - %d does not match era %d", blockIndex.Start,
+				blockIndex.Start+Slot(len(blockIndex.Offsets)), era)
+		}
+	}
+
+	stateDigest, err := im.Decoder.ForkDigestAtSlot(end)
+	if err != nil {
+		return era, err
+	}
+	data, err := readEraEntryData(r, stateEntry)
+	if err != nil {
+		return era, fmt.Errorf("failed to read state: %v", err)
+	}
+	state, err := im.Decoder.DecodeState(stateDigest, uint64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return era, fmt.Errorf("failed to decode state: %v", err)
+	}
+	if slot, err := state.Slot(); err != nil {
+		return era, err
+	} else if slot != end {
+		return era, fmt.Errorf("boundary state has slot %d, expected %d", slot, end)
+	}
+	trusted, err := im.verifyHistory(era, state)
+	if err != nil {
+		return era, err
+	}
+	// validators are never removed, the boundary state has the pubkeys of all proposers of the era
+	vals, err := state.Validators()
+	if err != nil {
+		return era, err
+	}
+	pubkeys, err := common.NewPubkeyCache(vals)
+	if err != nil {
+		return era, err
+	}
+	genValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		return era, err
+	}
+	sigBatch := bls.NewSignatureBatch()
+	var unverified []*common.BeaconBlockEnvelope
+	blockRoots, err := state.BlockRoots()
+	if err != nil {
+		return era, err
+	}
+	stateRoots, err := state.StateRoots()
+	if err != nil {
+		return era, err
+	}
+
+	// The previous block is only known if the previous era was imported.
+	sequential := im.imported && im.lastEra+1 == era
+	var prev Root
+	known := sequential
+	if known {
+		prev = im.last
+	}
+	// the block at the boundary slot of the previous era, to confirm the previous boundary state with
+	var boundaryBlock *common.BeaconBlockEnvelope
+	for i, offset := range blockIndex.Offsets {
+		if err := ctx.Err(); err != nil {
+			return era, err
+		}
+		slot := start + Slot(i)
+		expected, err := blockRoots.GetRoot(slot % spec.SLOTS_PER_HISTORICAL_ROOT)
+		if err != nil {
+			return era, err
+		}
+		if offset == 0 {
+			if known && expected != prev {
+				return era, fmt.Errorf("slot %d without block does not repeat the previous block root %s, but has %s", slot, prev, expected)
+			}
+		} else {
+			blockEntry, ok := byOffset[blockIndex.Offsets[i]]
+			if !ok || blockEntry.Type != eraTypeBlock {
+				return era, fmt.Errorf("block index of slot %d does not point to a block", slot)
+			}
+			expectedState, err := stateRoots.GetRoot(slot % spec.SLOTS_PER_HISTORICAL_ROOT)
+			if err != nil {
+				return era, err
+			}
+			benv, err := im.importBlock(r, blockEntry, slot, expected, expectedState, prev, known)
+			if err != nil {
+				return era, fmt.Errorf("failed to import block of slot %d: %v", slot, err)
+			}
+			pub, ok := pubkeys.Pubkey(benv.ProposerIndex)
+			if !ok {
+				return era, fmt.Errorf("block of slot %d has unknown proposer %d", slot, benv.ProposerIndex)
+			}
+			version, err := im.Decoder.ForkVersionAtSlot(slot)
+			if err != nil {
+				return era, err
+			}
+			sigBatch.Add(benv.SignatureSet(version, genValRoot, pub))
+			unverified = append(unverified, benv)
+			if len(unverified) >= eraSignatureBatchSize {
+				if err := im.storeBlocks(ctx, sigBatch, unverified); err != nil {
+					return era, err
+				}
+				unverified = unverified[:0]
+			}
+			if i == 0 {
+				boundaryBlock = benv
+			}
+		}
+		prev, known = expected, true
+	}
+	if err := im.storeBlocks(ctx, sigBatch, unverified); err != nil {
+		return era, err
+	}
+
+	if era != 0 {
+		// the latest header of the boundary state is the last block of the era
+		header, err := state.LatestBlockHeader()
+		if err != nil {
+			return era, err
+		}
+		if header.StateRoot == (Root{}) {
+			header.StateRoot = state.HashTreeRoot(tree.GetHashFn())
+		}
+		if root := header.HashTreeRoot(tree.GetHashFn()); root != prev {
+			return era, fmt.Errorf("latest header %s of boundary state does not match last block %s", root, prev)
+		}
+	}
+	if sequential && im.pending != nil {
+		if err := im.confirmPending(ctx, stateRoots, start, boundaryBlock); err != nil {
+			return era, fmt.Errorf("failed to confirm boundary state of era %d: %v", era-1, err)
+		}
+	}
+	im.pending = nil
+	if trusted {
+		if err := im.States.Store(ctx, state); err != nil {
+			return era, fmt.Errorf("failed to store boundary state: %v", err)
+		}
+	} else {
+		im.pending = state
+	}
+	if era != 0 {
+		im.last = prev
+	} else {
+		header, err := state.LatestBlockHeader()
+		if err != nil {
+			return era, err
+		}
+		// the genesis header does not have the state root filled in yet
+		if header.StateRoot == (Root{}) {
+			header.StateRoot = state.HashTreeRoot(tree.GetHashFn())
+		}
+		im.last = header.HashTreeRoot(tree.GetHashFn())
+	}
+	im.lastEra = era
+	im.imported = true
+	return era, nil
+}
+
+// confirmPending checks the pending boundary state of the previous era against the verified state root
+// of its slot in the current era, and stores it. If there is a block at the slot,
+// the state root is that of the state after the block, and the block is applied to the boundary state first.
+func (im *EraImporter) confirmPending(ctx context.Context, stateRoots common.BatchRoots, slot Slot, block *common.BeaconBlockEnvelope) error {
+	spec := im.Decoder.Spec
+	expected, err := stateRoots.GetRoot(slot % spec.SLOTS_PER_HISTORICAL_ROOT)
+	if err != nil {
+		return err
+	}
+	post := im.pending
+	if block != nil {
+		post, err = im.pending.CopyState()
+		if err != nil {
+			return err
+		}
+		epc, err := common.NewEpochsContext(spec, post)
+		if err != nil {
+			return err
+		}
+		upState := &beacon.StandardUpgradeableBeaconState{BeaconState: post}
+		// The block is verified by its root already, no need to verify the signatures.
+		if err := common.PostSlotTransition(ctx, spec, epc, upState, block, false); err != nil {
+			return fmt.Errorf("failed to apply block %s: %v", block.BlockRoot, err)
+		}
+		post = upState.BeaconState
+	}
+	if root := post.HashTreeRoot(tree.GetHashFn()); root != expected {
+		return fmt.Errorf("state %s does not match state root %s at slot %d", root, expected, slot)
+	}
+	return im.States.Store(ctx, im.pending)
+}
+
+// importBlock reads the block of the slot, and verifies it against the roots of the boundary state.
+// The signature of the block is not verified yet.
+func (im *EraImporter) importBlock(r io.ReaderAt, e eraEntry, slot Slot,
+	expectedRoot Root, expectedState Root, parent Root, checkParent bool) (*common.BeaconBlockEnvelope, error) {
+	digest, err := im.Decoder.ForkDigestAtSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readEraEntryData(r, e)
+	if err != nil {
+		return nil, err
+	}
+	benv, err := im.Decoder.DecodeBlock(digest, uint64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if benv.Slot != slot {
+		return nil, fmt.Errorf("block %s has slot %d", benv.BlockRoot, benv.Slot)
+	}
+	if benv.BlockRoot != expectedRoot {
+		return nil, fmt.Errorf("block %s does not match block root %s of the boundary state", benv.BlockRoot, expectedRoot)
+	}
+	if benv.StateRoot != expectedState {
+		return nil, fmt.Errorf("block %s has state root %s, but boundary state has %s", benv.BlockRoot, benv.StateRoot, expectedState)
+	}
+	if checkParent && benv.ParentRoot != parent {
+		return nil, fmt.Errorf("block %s has parent %s, expected %s", benv.BlockRoot, benv.ParentRoot, parent)
+	}
+	return benv, nil
+}
+
+// storeBlocks verifies the batch of signatures of the blocks, and then stores the blocks.
+func (im *EraImporter) storeBlocks(ctx context.Context, sigBatch *bls.SignatureBatch, benvs []*common.BeaconBlockEnvelope) error {
+	if err := sigBatch.Verify(); err != nil {
+		return err
+	}
+	for _, benv := range benvs {
+		if _, _, err := im.Blocks.Store(ctx, benv); err != nil {
+			return fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+		}
+	}
+	return nil
+}
+
+// ImportDir imports the era files in the dir, in order of era.
+func (im *EraImporter) ImportDir(ctx context.Context, dir string) (count int, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), eraFileSuffix) {
+			names = append(names, f.Name())
+		}
+	}
+	// era file names are zero-padded
+	sort.Strings(names)
+	for _, name := range names {
+		if err := im.importFile(ctx, path.Join(dir, name)); err != nil {
+			return count, fmt.Errorf("failed to import %s: %v", name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (im *EraImporter) importFile(ctx context.Context, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = im.ImportEra(ctx, f, info.Size())
+	return err
+}
+
+// readEraEntries reads the headers of all entries in the era file.
+func readEraEntries(r io.ReaderAt, size int64) ([]eraEntry, error) {
+	var entries []eraEntry
+	for offset := int64(0); offset < size; {
+		if offset+eraEntryHeaderSize > size {
+			return nil, fmt.Errorf("incomplete entry header at offset %d", offset)
+		}
+		var header eraEntryHeader
+		if err := binary.Read(io.NewSectionReader(r, offset, eraEntryHeaderSize), binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+		length := int64(header.Length)
+		if offset+eraEntryHeaderSize+length > size {
+			return nil, fmt.Errorf("incomplete entry at offset %d", offset)
+		}
+		entries = append(entries, eraEntry{Type: header.Type, Offset: offset, Length: length})
+		offset += eraEntryHeaderSize + length
+	}
+	return entries, nil
+}
+
+// readEraEntryData reads and decompresses the snappy-framed data of the entry.
+func readEraEntryData(r io.ReaderAt, e eraEntry) ([]byte, error) {
+	return ioutil.ReadAll(snappy.NewReader(io.NewSectionReader(r, e.Offset+eraEntryHeaderSize, e.Length)))
+}
+
+// readEraIndex reads a slot index entry. The offsets are made absolute, zero offsets are kept.
+func readEraIndex(r io.ReaderAt, e eraEntry) (out eraSlotIndex, err error) {
+	if e.Type != eraTypeSlotIndex || e.Length < 16 || e.Length%8 != 0 {
+		return eraSlotIndex{}, errors.New("not a slot index")
+	}
+	data := make([]byte, e.Length)
+	if _, err := r.ReadAt(data, e.Offset+eraEntryHeaderSize); err != nil {
+		return eraSlotIndex{}, err
+	}
+	count := binary.LittleEndian.Uint64(data[len(data)-8:])
+	if count != uint64(e.Length-16)/8 {
+		return eraSlotIndex{}, fmt.Errorf("slot index has %d offsets, but a count of %d", (e.Length-16)/8, count)
+	}
+	out.Start = Slot(binary.LittleEndian.Uint64(data[:8]))
+	out.Offsets = make([]int64, count)
+	for i := range out.Offsets {
+		if offset := int64(binary.LittleEndian.Uint64(data[8+8*i:])); offset != 0 {
+			out.Offsets[i] = e.Offset + offset
+		}
+	}
+	return out, nil
+}
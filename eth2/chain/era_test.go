@@ -0,0 +1,308 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"github.com/protolambda/ztyp/tree"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEraExportImport(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	genValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(&spec, genValRoot)
+	blockDB := blocks.NewMemDB(&spec, dec)
+	ctx := context.Background()
+
+	// a chain just past the end of era 1, the last slot of era 1 is empty
+	hot, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := hot.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []ChainEntry{genesis}
+	var added []*common.BeaconBlockEnvelope
+	parent := genesis.BlockRoot()
+	for slot := Slot(1); slot <= spec.SLOTS_PER_HISTORICAL_ROOT+1; slot++ {
+		if slot == 10 || slot == spec.SLOTS_PER_HISTORICAL_ROOT-1 {
+			continue
+		}
+		benv := buildTestBlock(t, hot, &spec, keys, parent, slot)
+		if err := hot.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := blockDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := hot.ByBlock(benv.BlockRoot)
+		if !ok {
+			t.Fatalf("missing block %d", slot)
+		}
+		entries = append(entries, entry)
+		added = append(added, benv)
+		parent = benv.BlockRoot
+	}
+	fin := NewFinalizedChain(&spec, states.NewMemDB(&spec))
+	for _, entry := range entries {
+		if err := fin.OnFinalizedEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ex := &EraExporter{Chain: fin, Blocks: blockDB, Decoder: dec}
+	if first, end := ex.Eras(); first != 0 || end != 2 {
+		t.Fatalf("expected eras 0 and 1, got %d - %d", first, end)
+	}
+	if err := ex.ExportEra(ctx, 2, ioutil.Discard); err == nil {
+		t.Fatal("expected error for era past the finalized chain")
+	}
+	dir, err := ioutil.TempDir("", "era")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if count, err := ex.ExportDir(ctx, dir); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("expected 2 era files, got %d", count)
+	}
+
+	// the eras are verified against the finalized state after the last era
+	trustedEntry, ok := fin.ByCanonStep(AsStep(spec.SLOTS_PER_HISTORICAL_ROOT+1, true))
+	if !ok {
+		t.Fatal("missing trusted entry")
+	}
+	trusted, err := trustedEntry.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&EraImporter{Decoder: dec, Blocks: blocks.NewMemDB(&spec, dec), States: states.NewMemDB(&spec)}).ImportDir(ctx, dir); err == nil {
+		t.Fatal("expected error for an import without trusted state")
+	}
+
+	importBlocks := blocks.NewMemDB(&spec, dec)
+	importStates := states.NewMemDB(&spec)
+	im := &EraImporter{Decoder: dec, Blocks: importBlocks, States: importStates, Trusted: trusted}
+	if count, err := im.ImportDir(ctx, dir); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("expected 2 imported era files, got %d", count)
+	}
+	var eraBlocks []*common.BeaconBlockEnvelope
+	for _, benv := range added {
+		if benv.Slot < spec.SLOTS_PER_HISTORICAL_ROOT {
+			eraBlocks = append(eraBlocks, benv)
+		}
+	}
+	for _, benv := range eraBlocks {
+		got, err := importBlocks.Get(ctx, benv.BlockRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil {
+			t.Fatalf("missing imported block of slot %d", benv.Slot)
+		}
+	}
+	// the blocks from the boundary slot onwards are in the next era
+	if count := importBlocks.Stats().Count; count != int64(len(eraBlocks)) {
+		t.Fatalf("expected %d imported blocks, got %d", len(eraBlocks), count)
+	}
+	if im.last != eraBlocks[len(eraBlocks)-1].BlockRoot {
+		t.Fatal("expected the last imported block to be the last block of era 1")
+	}
+	if state, err := importStates.Get(ctx, genesis.StateRoot()); err != nil || state == nil {
+		t.Fatalf("missing genesis state: %v", err)
+	}
+
+	era1, err := ioutil.ReadFile(path.Join(dir, EraFileName(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without the previous era, the era is verified against the trusted state only
+	fresh := &EraImporter{Decoder: dec, Blocks: blocks.NewMemDB(&spec, dec), States: states.NewMemDB(&spec), Trusted: trusted}
+	if era, err := fresh.ImportEra(ctx, bytes.NewReader(era1), int64(len(era1))); err != nil {
+		t.Fatal(err)
+	} else if era != 1 {
+		t.Fatalf("unexpected era %d", era)
+	}
+	// era 1 does not link to a different previous era
+	broken := &EraImporter{Decoder: dec, Blocks: blocks.NewMemDB(&spec, dec), States: states.NewMemDB(&spec),
+		Trusted: trusted, last: Root{0xaa}, lastEra: 0, imported: true}
+	if _, err := broken.ImportEra(ctx, bytes.NewReader(era1), int64(len(era1))); err == nil {
+		t.Fatal("expected error for an era that does not link to the previous era")
+	}
+	// a corrupted file is rejected
+	corrupt := append([]byte{}, era1...)
+	corrupt[eraEntryHeaderSize+20] ^= 0xff
+	if _, err := fresh.ImportEra(ctx, bytes.NewReader(corrupt), int64(len(corrupt))); err == nil {
+		t.Fatal("expected error for a corrupted era file")
+	}
+
+	// a block with an invalid signature still matches the block roots, but is rejected, and nothing is stored
+	forgedDB := blocks.NewMemDB(&spec, dec)
+	for _, benv := range added {
+		if benv.Slot == 5 {
+			signed := *benv.SignedBlock.(*phase0.SignedBeaconBlock)
+			signed.Signature[10] ^= 0xff
+			benv = signed.Envelope(&spec, benv.ForkDigest)
+		}
+		if _, _, err := forgedDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var forged bytes.Buffer
+	if err := (&EraExporter{Chain: fin, Blocks: forgedDB, Decoder: dec}).ExportEra(ctx, 1, &forged); err != nil {
+		t.Fatal(err)
+	}
+	forgedBlocks := blocks.NewMemDB(&spec, dec)
+	unsigned := &EraImporter{Decoder: dec, Blocks: forgedBlocks, States: states.NewMemDB(&spec), Trusted: trusted}
+	if _, err := unsigned.ImportEra(ctx, bytes.NewReader(forged.Bytes()), int64(forged.Len())); err == nil {
+		t.Fatal("expected error for a block with an invalid signature")
+	}
+	if count := forgedBlocks.Stats().Count; count != 0 {
+		t.Fatalf("expected no blocks of the batch with the invalid signature to be stored, got %d", count)
+	}
+
+	// a tampered boundary state keeps the history roots, and is not stored without confirmation
+	tamper := func(state common.BeaconState) {
+		bals, err := state.Balances()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bals.SetBalance(0, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tampered1 := replaceEraState(t, dec, era1, tamper)
+	pendingStates := states.NewMemDB(&spec)
+	unconfirmed := &EraImporter{Decoder: dec, Blocks: blocks.NewMemDB(&spec, dec), States: pendingStates, Trusted: trusted}
+	if _, err := unconfirmed.ImportEra(ctx, bytes.NewReader(tampered1), int64(len(tampered1))); err != nil {
+		t.Fatal(err)
+	}
+	tamperedRoot := readEraState(t, dec, tampered1).HashTreeRoot(tree.GetHashFn())
+	if state, err := pendingStates.Get(ctx, tamperedRoot); err != nil || state != nil {
+		t.Fatalf("expected the unconfirmed boundary state not to be stored: %v", err)
+	}
+	// a boundary state at the trusted slot is compared with the trusted state
+	boundary := readEraState(t, dec, era1)
+	againstBoundary := &EraImporter{Decoder: dec, Blocks: blocks.NewMemDB(&spec, dec), States: states.NewMemDB(&spec), Trusted: boundary}
+	if _, err := againstBoundary.ImportEra(ctx, bytes.NewReader(tampered1), int64(len(tampered1))); err == nil {
+		t.Fatal("expected error for a tampered boundary state at the trusted slot")
+	}
+	boundaryStates := states.NewMemDB(&spec)
+	againstBoundary = &EraImporter{Decoder: dec, Blocks: blocks.NewMemDB(&spec, dec), States: boundaryStates, Trusted: boundary}
+	if _, err := againstBoundary.ImportEra(ctx, bytes.NewReader(era1), int64(len(era1))); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := boundaryStates.Get(ctx, boundary.HashTreeRoot(tree.GetHashFn())); err != nil || state == nil {
+		t.Fatalf("expected the trusted boundary state to be stored: %v", err)
+	}
+
+	// a tampered state of the previous era is rejected by the state roots of the next era
+	era0, err := ioutil.ReadFile(path.Join(dir, EraFileName(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered0 := replaceEraState(t, dec, era0, tamper)
+	sequentialStates := states.NewMemDB(&spec)
+	sequential := &EraImporter{Decoder: dec, Blocks: blocks.NewMemDB(&spec, dec), States: sequentialStates, Trusted: trusted}
+	if _, err := sequential.ImportEra(ctx, bytes.NewReader(tampered0), int64(len(tampered0))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sequential.ImportEra(ctx, bytes.NewReader(era1), int64(len(era1))); err == nil {
+		t.Fatal("expected error for a tampered boundary state of the previous era")
+	}
+	tamperedRoot = readEraState(t, dec, tampered0).HashTreeRoot(tree.GetHashFn())
+	if state, err := sequentialStates.Get(ctx, tamperedRoot); err != nil || state != nil {
+		t.Fatalf("expected the tampered state not to be stored: %v", err)
+	}
+}
+
+// readEraState decodes the boundary state of the era file.
+func readEraState(t *testing.T, dec *beacon.ForkDecoder, data []byte) common.BeaconState {
+	r := bytes.NewReader(data)
+	entries, err := readEraEntries(r, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateIndex, err := readEraIndex(r, entries[len(entries)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Offset != stateIndex.Offsets[0] {
+			continue
+		}
+		raw, err := readEraEntryData(r, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := dec.ForkDigestAtSlot(stateIndex.Start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := dec.DecodeState(digest, uint64(len(raw)), bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+	t.Fatal("missing state entry")
+	return nil
+}
+
+// replaceEraState rewrites the era file with a modified boundary state, and the indices updated to match.
+func replaceEraState(t *testing.T, dec *beacon.ForkDecoder, data []byte, modify func(state common.BeaconState)) []byte {
+	state := readEraState(t, dec, data)
+	modify(state)
+	r := bytes.NewReader(data)
+	entries, err := readEraEntries(r, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateIndex, err := readEraIndex(r, entries[len(entries)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	// the state comes after the blocks, only the indices after it change
+	buf.Write(data[:stateIndex.Offsets[0]])
+	ew := &eraWriter{w: &buf, offset: stateIndex.Offsets[0]}
+	stateData, err := snappyFramed(state.Serialize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.writeEntry(eraTypeState, stateData); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 3 {
+		blockIndex, err := readEraIndex(r, entries[len(entries)-2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ew.writeIndex(blockIndex.Start, blockIndex.Offsets); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ew.writeIndex(stateIndex.Start, stateIndex.Offsets); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
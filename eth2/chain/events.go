@@ -0,0 +1,180 @@
+package chain
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ChainEvent is an event of the chain, one of the *Event types of this package.
+type ChainEvent interface {
+	chainEvent()
+}
+
+// BlockImportedEvent is emitted when a block is added to the hot chain.
+type BlockImportedEvent struct {
+	Slot       Slot
+	BlockRoot  Root
+	ParentRoot Root
+	StateRoot  Root
+}
+
+// HeadChangedEvent is emitted when the head of the chain changes.
+// The head may be an empty slot, in which case the block root is that of the last block.
+type HeadChangedEvent struct {
+	OldSlot Slot
+	OldHead Root
+	NewSlot Slot
+	NewHead Root
+	// Number of slots from the common ancestor to the old head that were abandoned. Zero if the new head builds on the old head.
+	ReorgDepth uint64
+}
+
+// JustifiedUpdatedEvent is emitted when the justified checkpoint of the forkchoice changes.
+type JustifiedUpdatedEvent struct {
+	Old Checkpoint
+	New Checkpoint
+}
+
+// FinalizedUpdatedEvent is emitted when the finalized checkpoint of the forkchoice changes.
+type FinalizedUpdatedEvent struct {
+	Old Checkpoint
+	New Checkpoint
+}
+
+// MovedToColdEvent is emitted when a finalized entry moves from the hot chain to the cold chain.
+type MovedToColdEvent struct {
+	Step      Step
+	BlockRoot Root
+	StateRoot Root
+}
+
+func (*BlockImportedEvent) chainEvent()    {}
+func (*HeadChangedEvent) chainEvent()      {}
+func (*JustifiedUpdatedEvent) chainEvent() {}
+func (*FinalizedUpdatedEvent) chainEvent() {}
+func (*MovedToColdEvent) chainEvent()      {}
+
+// EventFeed sends chain events to its subscribers. The zero value is ready to use.
+// Sending never blocks: events are dropped for subscribers with a full buffer.
+type EventFeed struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscription receives the events of an EventFeed, until it unsubscribes.
+type Subscription struct {
+	feed    *EventFeed
+	ch      chan ChainEvent
+	dropped uint64
+}
+
+// Subscribe creates a subscription with the given buffer size.
+// Events that do not fit in the buffer are dropped, and counted, see Subscription.Dropped.
+func (f *EventFeed) Subscribe(buffer int) *Subscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs == nil {
+		f.subs = make(map[*Subscription]struct{})
+	}
+	sub := &Subscription{feed: f, ch: make(chan ChainEvent, buffer)}
+	f.subs[sub] = struct{}{}
+	return sub
+}
+
+// Send sends the event to all subscribers, without blocking.
+func (f *EventFeed) Send(ev ChainEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Events returns the channel to receive the events with. The channel is closed when unsubscribing.
+func (s *Subscription) Events() <-chan ChainEvent {
+	return s.ch
+}
+
+// Dropped returns the number of events that were dropped because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops the subscription, and closes the events channel. It is safe to unsubscribe more than once.
+func (s *Subscription) Unsubscribe() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	if _, ok := s.feed.subs[s]; ok {
+		delete(s.feed.subs, s)
+		close(s.ch)
+	}
+}
+
+// chainStatus is the last status of the hot chain that was emitted as events, to detect changes with.
+type chainStatus struct {
+	head      ChainEntry
+	justified Checkpoint
+	finalized Checkpoint
+}
+
+// initStatus remembers the current status of the hot chain, to emit later changes as events.
+func (hc *HotColdChain) initStatus() error {
+	head, err := hc.HotChain.Head()
+	if err != nil {
+		return err
+	}
+	hc.status = chainStatus{
+		head:      head,
+		justified: hc.HotChain.JustifiedCheckpoint(),
+		finalized: hc.HotChain.FinalizedCheckpoint(),
+	}
+	return nil
+}
+
+// emitStatusChanges emits events for the changes of the head and checkpoints since the last call.
+// The hot-cold chain must be locked.
+func (hc *HotColdChain) emitStatusChanges() error {
+	if just := hc.HotChain.JustifiedCheckpoint(); just != hc.status.justified {
+		hc.events.Send(&JustifiedUpdatedEvent{Old: hc.status.justified, New: just})
+		hc.status.justified = just
+	}
+	if fin := hc.HotChain.FinalizedCheckpoint(); fin != hc.status.finalized {
+		hc.events.Send(&FinalizedUpdatedEvent{Old: hc.status.finalized, New: fin})
+		hc.status.finalized = fin
+	}
+	head, err := hc.HotChain.Head()
+	if err != nil {
+		return err
+	}
+	old := hc.status.head
+	if head.BlockRoot() != old.BlockRoot() || head.Step() != old.Step() {
+		hc.events.Send(&HeadChangedEvent{
+			OldSlot:    old.Step().Slot(),
+			OldHead:    old.BlockRoot(),
+			NewSlot:    head.Step().Slot(),
+			NewHead:    head.BlockRoot(),
+			ReorgDepth: hc.headReorgDepth(old, head),
+		})
+		hc.status.head = head
+	}
+	return nil
+}
+
+// headReorgDepth computes the number of slots from the common ancestor of the heads up to the old head.
+// If the old head was pruned from the hot chain already, the depth is counted from the finalized slot.
+// The hot-cold chain must be locked.
+func (hc *HotColdChain) headReorgDepth(oldHead ChainEntry, newHead ChainEntry) uint64 {
+	oldSlot := oldHead.Step().Slot()
+	if ancestor, ok := commonAncestor(hc.byBlock, oldHead.BlockRoot(), newHead.BlockRoot()); ok {
+		return reorgDepth(oldSlot, ancestor)
+	}
+	finSlot, _ := hc.Spec.EpochStartSlot(hc.HotChain.FinalizedCheckpoint().Epoch)
+	if finSlot < oldSlot {
+		return uint64(oldSlot - finSlot)
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package chain
+
+import (
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"testing"
+)
+
+func drainEvents(sub *Subscription) (out []ChainEvent) {
+	for {
+		select {
+		case ev := <-sub.Events():
+			out = append(out, ev)
+		default:
+			return out
+		}
+	}
+}
+
+func TestChainEvents(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := ch.Subscribe(10)
+	b1 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := addTimelyTestBlock(t, ch, b1); err != nil {
+		t.Fatal(err)
+	}
+	evs := drainEvents(sub)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	if imported, ok := evs[0].(*BlockImportedEvent); !ok || imported.BlockRoot != b1.BlockRoot || imported.Slot != 1 {
+		t.Fatalf("unexpected first event: %#v", evs[0])
+	}
+	if head, ok := evs[1].(*HeadChangedEvent); !ok || head.OldHead != genesis.BlockRoot() ||
+		head.NewHead != b1.BlockRoot || head.ReorgDepth != 0 {
+		t.Fatalf("unexpected second event: %#v", evs[1])
+	}
+
+	b2 := buildTestBlock(t, ch, &spec, keys, b1.BlockRoot, 2)
+	if err := addTimelyTestBlock(t, ch, b2); err != nil {
+		t.Fatal(err)
+	}
+	drainEvents(sub)
+
+	// a competing block, boosted by the proposer score, reorgs the chain back to genesis
+	fork := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 3)
+	if err := addTimelyTestBlock(t, ch, fork); err != nil {
+		t.Fatal(err)
+	}
+	evs = drainEvents(sub)
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	if head, ok := evs[1].(*HeadChangedEvent); !ok || head.OldHead != b2.BlockRoot ||
+		head.NewHead != fork.BlockRoot || head.ReorgDepth != 2 {
+		t.Fatalf("unexpected reorg event: %#v", evs[1])
+	}
+
+	// a full buffer drops events instead of blocking the chain
+	small := ch.Subscribe(1)
+	b4 := buildTestBlock(t, ch, &spec, keys, fork.BlockRoot, 4)
+	if err := addTimelyTestBlock(t, ch, b4); err != nil {
+		t.Fatal(err)
+	}
+	if small.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped event, got %d", small.Dropped())
+	}
+	small.Unsubscribe()
+	small.Unsubscribe()
+	if _, ok := <-small.Events(); !ok {
+		t.Fatal("expected the buffered event to be received")
+	}
+	if _, ok := <-small.Events(); ok {
+		t.Fatal("expected the events channel to be closed")
+	}
+	sub.Unsubscribe()
+}
@@ -5,11 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/beacon/sharding"
 	"github.com/protolambda/zrnt/eth2/forkchoice"
 	"github.com/protolambda/zrnt/eth2/forkchoice/proto"
 	"github.com/protolambda/ztyp/tree"
+	"io"
 	"sync"
 )
 
@@ -18,6 +22,8 @@ type HotEntry struct {
 	parent Root
 	epc    *common.EpochsContext
 	state  common.BeaconState
+	// nil if the entry is an empty slot, or the anchor
+	block *common.BeaconBlockEnvelope
 }
 
 func NewHotEntry(self BlockSlotKey, parent Root,
@@ -55,6 +61,12 @@ func (e *HotEntry) State(context.Context) (common.BeaconState, error) {
 	return e.state.CopyState()
 }
 
+// Block returns the block that was processed to create this entry.
+// Nil if the entry is an empty slot, or the anchor of the chain.
+func (e *HotEntry) Block() *common.BeaconBlockEnvelope {
+	return e.block
+}
+
 type HotChain interface {
 	Chain
 	JustifiedCheckpoint() Checkpoint
@@ -68,9 +80,17 @@ type HotChain interface {
 	// An error is also returned if the fromBlockRoot is past the requested toSlot.
 	Towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error)
 	// Process a block. If there is an error, the chain is not mutated, and can be continued to use.
+	// The arrival time of the block is not known, e.g. when syncing or replaying blocks:
+	// the block is considered to arrive at the end of its slot, and does not receive the proposer score boost.
 	AddBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error
+	// AddBlockAt processes a block like AddBlock, for a block that arrived at the given time, e.g. on gossip.
+	// A timely block receives the proposer score boost, see forkchoice.Forkchoice.ProcessBlock.
+	AddBlockAt(ctx context.Context, benv *common.BeaconBlockEnvelope, arrival common.Timestamp) error
 	// Process an attestation. If there is an error, the chain is not mutated, and can be continued to use.
 	AddAttestation(att *phase0.Attestation) error
+	// OnTick updates the time of the forkchoice, to apply delayed justification updates.
+	// The forkchoice time also follows the slots that are processed.
+	OnTick(ctx context.Context, time common.Timestamp) error
 }
 
 type UnfinalizedChain struct {
@@ -175,7 +195,13 @@ func (fn BlockSinkFn) Sink(ctx context.Context, entry ChainEntry, canonical bool
 	return fn(ctx, entry, canonical)
 }
 
-func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, spec *common.Spec) (*UnfinalizedChain, error) {
+// NewUnfinalizedChain creates a hot chain, starting from the given anchor state.
+// The anchor state may be of any fork, but must match the fork version that the spec schedules for its slot.
+func NewUnfinalizedChain(anchorState common.BeaconState, sink BlockSink, spec *common.Spec) (*UnfinalizedChain, error) {
+	// The hot chain tracks the plain fork-specific states, and handles upgrades itself.
+	if upgradeable, ok := anchorState.(*beacon.StandardUpgradeableBeaconState); ok {
+		anchorState = upgradeable.BeaconState
+	}
 	fin, err := anchorState.FinalizedCheckpoint()
 	if err != nil {
 		return nil, err
@@ -184,6 +210,15 @@ func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, sp
 	if err != nil {
 		return nil, err
 	}
+	return newUnfinalizedChain(anchorState, fin, just, sink, spec)
+}
+
+// newUnfinalizedChain creates a hot chain from the anchor state, with the given forkchoice checkpoints.
+func newUnfinalizedChain(anchorState common.BeaconState, fin Checkpoint, just Checkpoint,
+	sink BlockSink, spec *common.Spec) (*UnfinalizedChain, error) {
+	if err := checkAnchorFork(spec, anchorState); err != nil {
+		return nil, err
+	}
 
 	latestHeader, err := anchorState.LatestBlockHeader()
 	if err != nil {
@@ -225,8 +260,13 @@ func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, sp
 	if err != nil {
 		return nil, err
 	}
+	genesisTime, err := anchorState.GenesisTime()
+	if err != nil {
+		return nil, err
+	}
 	fc, err := proto.NewProtoForkChoice(
 		spec,
+		genesisTime,
 		fin,
 		just,
 		anchorBlockRoot, slot,
@@ -241,6 +281,23 @@ func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, sp
 	return uc, nil
 }
 
+// checkAnchorFork checks if the fork of the anchor state matches the fork scheduled for its slot.
+// An anchor state of the wrong fork cannot be upgraded later on, as the fork boundary is already behind it.
+func checkAnchorFork(spec *common.Spec, anchorState common.BeaconState) error {
+	slot, err := anchorState.Slot()
+	if err != nil {
+		return err
+	}
+	fork, err := anchorState.Fork()
+	if err != nil {
+		return err
+	}
+	if expected := spec.ForkVersion(slot); fork.CurrentVersion != expected {
+		return fmt.Errorf("anchor state at slot %d has fork version %s, but expected %s", slot, fork.CurrentVersion, expected)
+	}
+	return nil
+}
+
 // onPrunedNode handles when nodes leave the forkchoice, and thus get removed from the hot view of the chain.
 // Includes empty slots and nodes of the slot pre-block processing (even if the block exists)
 func (uc *UnfinalizedChain) onPrunedNode(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
@@ -345,6 +402,10 @@ func stateJustFin(state common.BeaconState) (justified Checkpoint, finalized Che
 func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error) {
 	uc.Lock()
 	defer uc.Unlock()
+	return uc.towards(ctx, fromBlockRoot, toSlot)
+}
+
+func (uc *UnfinalizedChain) towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error) {
 	closest, ok := uc.closest(fromBlockRoot, toSlot)
 	if !ok {
 		return nil, fmt.Errorf("failed to find starting point to root %s to go towards slot %d", fromBlockRoot, toSlot)
@@ -363,6 +424,11 @@ func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toS
 		return nil, err
 	}
 
+	genesisTime, err := state.GenesisTime()
+	if err != nil {
+		return nil, err
+	}
+
 	var last *HotEntry
 	// Process empty slots
 	for slot := closest.Step().Slot(); slot < toSlot; {
@@ -381,14 +447,14 @@ func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toS
 		if err := state.SetSlot(slot); err != nil {
 			return nil, err
 		}
-		// TODO: check for fork boundary, and execute state upgrade if necessary.
 		if isEpochEnd {
 			if err := epc.RotateEpochs(state); err != nil {
 				return nil, err
 			}
 		}
 
-		// Check for state upgrades
+		// Check for state upgrades. The entry of the fork slot holds the upgraded state,
+		// and the states of later empty slots build on it.
 		upgradeable := beacon.StandardUpgradeableBeaconState{BeaconState: state}
 		if err := upgradeable.UpgradeMaybe(ctx, uc.Spec, epc); err != nil {
 			return nil, fmt.Errorf("failed BeaconState upgrade-check/process: %v", err)
@@ -401,10 +467,20 @@ func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toS
 		}
 		// Make the forkchoice aware of this new slot
 		uc.ForkChoice.ProcessSlot(fromBlockRoot, slot, justified.Epoch, finalized.Epoch)
+		// The forkchoice time is at least that of the processed slot.
+		slotTime, err := uc.Spec.TimeAtSlot(slot, genesisTime)
+		if err != nil {
+			return nil, err
+		}
+		if err := uc.ForkChoice.OnTick(ctx, slotTime); err != nil {
+			return nil, fmt.Errorf("failed to update forkchoice time: %v", err)
+		}
 		// Make the forkchoice aware of latest justified/finalized data. Lazy-fetch the balances if necessary.
-		if err := uc.ForkChoice.UpdateJustified(ctx, fromBlockRoot, finalized, justified,
+		// The forkchoice may keep the balances for later, so bind the state of this slot.
+		justifiedState := state
+		if err := uc.ForkChoice.UpdateJustified(ctx, fromBlockRoot, justified, finalized,
 			func() ([]forkchoice.Gwei, error) {
-				balancesView, err := state.Balances()
+				balancesView, err := justifiedState.Balances()
 				if err != nil {
 					return nil, err
 				}
@@ -505,10 +581,19 @@ func (uc *UnfinalizedChain) Head() (ChainEntry, error) {
 }
 
 func (uc *UnfinalizedChain) AddBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error {
+	return uc.addBlock(ctx, benv, nil)
+}
+
+func (uc *UnfinalizedChain) AddBlockAt(ctx context.Context, benv *common.BeaconBlockEnvelope, arrival common.Timestamp) error {
+	return uc.addBlock(ctx, benv, &arrival)
+}
+
+// addBlock processes the block, arriving at the given time, or at the end of its slot if the time is nil.
+func (uc *UnfinalizedChain) addBlock(ctx context.Context, benv *common.BeaconBlockEnvelope, arrival *common.Timestamp) error {
 	uc.Lock()
 	defer uc.Unlock()
 
-	pre, err := uc.Towards(ctx, benv.ParentRoot, benv.Slot)
+	pre, err := uc.towards(ctx, benv.ParentRoot, benv.Slot)
 	if err != nil {
 		return fmt.Errorf("failed to prepare for block, towards-slot failed: %v", err)
 	}
@@ -517,6 +602,19 @@ func (uc *UnfinalizedChain) AddBlock(ctx context.Context, benv *common.BeaconBlo
 	if err != nil {
 		return err
 	}
+	// The pre-state is already upgraded if the block is at or after a fork boundary, the block must match it.
+	fork, err := state.Fork()
+	if err != nil {
+		return err
+	}
+	genValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		return err
+	}
+	if digest := common.ComputeForkDigest(fork.CurrentVersion, genValRoot); digest != benv.ForkDigest {
+		return fmt.Errorf("block fork digest %s does not match pre-state fork digest %s (slot %d)",
+			benv.ForkDigest, digest, benv.Slot)
+	}
 	epc, err := pre.EpochsContext(ctx)
 	if err != nil {
 		return err
@@ -532,8 +630,25 @@ func (uc *UnfinalizedChain) AddBlock(ctx context.Context, benv *common.BeaconBlo
 		return err
 	}
 
-	// Make the forkchoice aware of the new block
-	uc.ForkChoice.ProcessBlock(benv.ParentRoot, benv.BlockRoot, benv.Slot, justified.Epoch, finalized.Epoch)
+	// The validators slashed by the block equivocated, their votes do not count anymore.
+	if slashed := attesterSlashingIndices(benv); len(slashed) > 0 {
+		uc.ForkChoice.ProcessEquivocation(slashed)
+	}
+
+	if arrival == nil {
+		genesisTime, err := state.GenesisTime()
+		if err != nil {
+			return err
+		}
+		slotEnd, err := uc.Spec.TimeAtSlot(benv.Slot+1, genesisTime)
+		if err != nil {
+			return err
+		}
+		arrival = &slotEnd
+	}
+
+	// Make the forkchoice aware of the new block.
+	uc.ForkChoice.ProcessBlock(benv.ParentRoot, benv.BlockRoot, benv.Slot, justified.Epoch, finalized.Epoch, *arrival)
 
 	key := BlockSlotKey{Slot: benv.Slot, Root: benv.BlockRoot}
 	uc.Entries[key] = &HotEntry{
@@ -541,12 +656,56 @@ func (uc *UnfinalizedChain) AddBlock(ctx context.Context, benv *common.BeaconBlo
 		parent: benv.ParentRoot,
 		epc:    epc,
 		state:  state,
+		block:  benv,
 	}
 	uc.State2Key[benv.StateRoot] = key
 
 	return nil
 }
 
+// SnapshotForkChoice writes a snapshot of the forkchoice, to restore with RestoreForkChoice after a restart.
+func (uc *UnfinalizedChain) SnapshotForkChoice(w io.Writer) error {
+	uc.RLock()
+	defer uc.RUnlock()
+	return uc.ForkChoice.Snapshot(w)
+}
+
+// RestoreForkChoice replaces the forkchoice with the forkchoice of the snapshot.
+// The snapshot must have the same nodes as the hot chain, e.g. by replaying the unfinalized blocks first,
+// and the same finalized checkpoint.
+func (uc *UnfinalizedChain) RestoreForkChoice(r io.Reader) error {
+	uc.Lock()
+	defer uc.Unlock()
+	fc, err := proto.RestoreProtoForkChoice(uc.Spec, r, proto.NodeSinkFn(uc.onPrunedNode),
+		func(nodes map[forkchoice.NodeRef]forkchoice.NodeIndex) error {
+			for ref := range nodes {
+				if _, ok := uc.Entries[BlockSlotKey{Slot: ref.Slot, Root: ref.Root}]; !ok {
+					return fmt.Errorf("snapshot contains unknown node %s", ref)
+				}
+			}
+			for key := range uc.Entries {
+				if _, ok := nodes[forkchoice.NodeRef{Slot: key.Slot, Root: key.Root}]; !ok {
+					return fmt.Errorf("snapshot is missing block %s at slot %d", key.Root, key.Slot)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return fmt.Errorf("failed to restore forkchoice: %v", err)
+	}
+	if fin, current := fc.Finalized(), uc.ForkChoice.Finalized(); fin.Epoch != current.Epoch {
+		return fmt.Errorf("snapshot has finalized epoch %d, but hot chain has finalized epoch %d", fin.Epoch, current.Epoch)
+	}
+	uc.ForkChoice = fc
+	return nil
+}
+
+func (uc *UnfinalizedChain) OnTick(ctx context.Context, time common.Timestamp) error {
+	uc.Lock()
+	defer uc.Unlock()
+	return uc.ForkChoice.OnTick(ctx, time)
+}
+
 // AddAttestation updates the forkchoice with the given attestation.
 // Warning: the attestation signature is not verified, it is up to the caller to verify.
 func (uc *UnfinalizedChain) AddAttestation(att *phase0.Attestation) error {
@@ -554,8 +713,8 @@ func (uc *UnfinalizedChain) AddAttestation(att *phase0.Attestation) error {
 	defer uc.Unlock()
 
 	data := &att.Data
-	node, ok := uc.ByBlockSlot(data.BeaconBlockRoot, data.Slot)
-	if ok {
+	node, ok := uc.byBlockSlot(BlockSlotKey{Slot: data.Slot, Root: data.BeaconBlockRoot})
+	if !ok {
 		return fmt.Errorf("unknown block and slot pair: %s, %d", data.BeaconBlockRoot, data.Slot)
 	}
 	epc, err := node.EpochsContext(context.Background())
@@ -570,9 +729,37 @@ func (uc *UnfinalizedChain) AddAttestation(att *phase0.Attestation) error {
 	if err != nil {
 		return err
 	}
-	for _, index := range indexedAtt.AttestingIndices {
-		// the node should exist, unless pruned during attestation processing, fine to ignore.
-		_ = uc.ForkChoice.ProcessAttestation(index, data.BeaconBlockRoot, data.Slot)
-	}
+	// the node should exist, unless pruned during attestation processing, fine to ignore.
+	// The attestation is kept with the votes, to build an attester slashing with if the votes conflict.
+	_ = uc.ForkChoice.ProcessIndexedAttestation(indexedAtt)
 	return nil
 }
+
+// attesterSlashingIndices returns the indices of the validators in both attestations of each attester slashing
+// of the block. The block must be valid, the attesting indices are sorted.
+func attesterSlashingIndices(benv *common.BeaconBlockEnvelope) (out []ValidatorIndex) {
+	collect := func(a, b common.CommitteeIndices) {
+		common.ValidatorSet(a).ZigZagJoin(common.ValidatorSet(b), func(i ValidatorIndex) {
+			out = append(out, i)
+		}, nil)
+	}
+	switch block := benv.SignedBlock.(type) {
+	case *phase0.SignedBeaconBlock:
+		for _, s := range block.Message.Body.AttesterSlashings {
+			collect(s.Attestation1.AttestingIndices, s.Attestation2.AttestingIndices)
+		}
+	case *altair.SignedBeaconBlock:
+		for _, s := range block.Message.Body.AttesterSlashings {
+			collect(s.Attestation1.AttestingIndices, s.Attestation2.AttestingIndices)
+		}
+	case *merge.SignedBeaconBlock:
+		for _, s := range block.Message.Body.AttesterSlashings {
+			collect(s.Attestation1.AttestingIndices, s.Attestation2.AttestingIndices)
+		}
+	case *sharding.SignedBeaconBlock:
+		for _, s := range block.Message.Body.AttesterSlashings {
+			collect(s.Attestation1.AttestingIndices, s.Attestation2.AttestingIndices)
+		}
+	}
+	return out
+}
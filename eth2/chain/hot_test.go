@@ -0,0 +1,367 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"github.com/protolambda/ztyp/tree"
+	"testing"
+)
+
+func TestTowardsForkBoundary(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	anchor, _ := kickstarttest.State(t, &spec, 64)
+
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forkSlot := common.Slot(spec.ALTAIR_FORK_EPOCH) * spec.SLOTS_PER_EPOCH
+	last, err := ch.Towards(context.Background(), genesis.BlockRoot(), forkSlot+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Step().Slot() != forkSlot+1 {
+		t.Fatalf("unexpected slot: %d", last.Step().Slot())
+	}
+	beforeFork, ok := ch.ByBlockSlot(genesis.BlockRoot(), forkSlot-1)
+	if !ok {
+		t.Fatal("missing entry before fork")
+	}
+	if state, err := beforeFork.State(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if _, ok := state.(*phase0.BeaconStateView); !ok {
+		t.Fatalf("expected phase0 state before fork, got %T", state)
+	}
+	for _, slot := range []common.Slot{forkSlot, forkSlot + 1} {
+		entry, ok := ch.ByBlockSlot(genesis.BlockRoot(), slot)
+		if !ok {
+			t.Fatalf("missing entry at slot %d", slot)
+		}
+		state, err := entry.State(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := state.(*altair.BeaconStateView); !ok {
+			t.Fatalf("expected altair state at slot %d, got %T", slot, state)
+		}
+		if byRoot, ok := ch.ByStateRoot(entry.StateRoot()); !ok || byRoot.Step() != entry.Step() {
+			t.Fatalf("entry at slot %d is not indexed by state root", slot)
+		}
+	}
+}
+
+func TestPostForkAnchor(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	pre, epc := kickstarttest.State(t, &spec, 64)
+	forkSlot := common.Slot(spec.ALTAIR_FORK_EPOCH) * spec.SLOTS_PER_EPOCH
+	state := &beacon.StandardUpgradeableBeaconState{BeaconState: pre}
+	if err := common.ProcessSlots(context.Background(), &spec, epc, state, forkSlot+2); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := NewHotColdChain(state, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Step().Slot() != forkSlot+2 {
+		t.Fatalf("unexpected anchor slot: %d", head.Step().Slot())
+	}
+	next, err := ch.Towards(context.Background(), head.BlockRoot(), forkSlot+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextState, err := next.State(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if _, ok := nextState.(*altair.BeaconStateView); !ok {
+		t.Fatalf("expected altair state, got %T", nextState)
+	}
+}
+
+func TestAnchorForkMismatch(t *testing.T) {
+	spec := *configs.Minimal
+	pre, epc := kickstarttest.State(t, &spec, 64)
+	// Without a scheduled altair fork, the state stays phase0
+	if err := common.ProcessSlots(context.Background(), &spec, epc,
+		&beacon.StandardUpgradeableBeaconState{BeaconState: pre}, 2*spec.SLOTS_PER_EPOCH); err != nil {
+		t.Fatal(err)
+	}
+	spec.ALTAIR_FORK_EPOCH = 1
+	if _, err := NewHotColdChain(pre, &spec, states.NewMemDB(&spec)); err == nil {
+		t.Fatal("expected phase0 anchor past the altair fork to be rejected")
+	}
+}
+
+func TestHotChainForkChoiceSnapshot(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ctx := context.Background()
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := addTimelyTestBlock(t, ch, b1); err != nil {
+		t.Fatal(err)
+	}
+	b2 := buildTestBlock(t, ch, &spec, keys, b1.BlockRoot, 2)
+	if err := addTimelyTestBlock(t, ch, b2); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ch.HotChain.(*UnfinalizedChain).SnapshotForkChoice(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted hot chain, without the blocks, cannot restore the forkchoice
+	restartAnchor, _ := kickstarttest.State(t, &spec, 64)
+	restarted, err := NewUnfinalizedChain(restartAnchor, BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}), &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.RestoreForkChoice(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("expected forkchoice restore to fail without the blocks")
+	}
+	// after replaying the blocks it can
+	for _, benv := range []*common.BeaconBlockEnvelope{b1, b2} {
+		if err := restarted.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := restarted.RestoreForkChoice(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	head, err := restarted.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.BlockRoot() != b2.BlockRoot {
+		t.Fatalf("unexpected head after restore: %s", head.BlockRoot())
+	}
+
+	// a stale snapshot, without the blocks that were added since, is rejected
+	b3 := buildTestBlock(t, ch, &spec, keys, b2.BlockRoot, 3)
+	if err := restarted.AddBlock(ctx, b3); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.RestoreForkChoice(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("expected stale snapshot to be rejected")
+	}
+
+	// a snapshot with another finalized checkpoint is rejected
+	sink := BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	})
+	fin := Checkpoint{Epoch: 1, Root: genesis.BlockRoot()}
+	other, err := newUnfinalizedChain(restartAnchor, fin, fin, sink, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := other.SnapshotForkChoice(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := NewUnfinalizedChain(restartAnchor, sink, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.RestoreForkChoice(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("expected snapshot with another finalized epoch to be rejected")
+	}
+}
+
+func TestHotChainAttesterSlashingEquivocation(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ctx := context.Background()
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slashed := ValidatorIndex(5)
+	b1 := buildTestBlockWith(t, ch, &spec, keys, genesis.BlockRoot(), 1, func(pre common.BeaconState, body *phase0.BeaconBlockBody) {
+		domain, err := common.GetDomain(pre, common.DOMAIN_BEACON_ATTESTER, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a double vote: two different votes for the same target epoch
+		var atts [2]phase0.IndexedAttestation
+		for i := range atts {
+			data := phase0.AttestationData{Slot: 0, BeaconBlockRoot: Root{byte(i + 1)}}
+			atts[i] = phase0.IndexedAttestation{
+				AttestingIndices: common.CommitteeIndices{slashed},
+				Data:             data,
+				Signature: signTestRoot(t, &keys[slashed],
+					common.ComputeSigningRoot(data.HashTreeRoot(tree.GetHashFn()), domain)),
+			}
+		}
+		body.AttesterSlashings = phase0.AttesterSlashings{{Attestation1: atts[0], Attestation2: atts[1]}}
+	})
+	if err := ch.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the slashed validator is equivocating: its votes are ignored, and do not conflict anymore
+	fc := ch.HotChain.(*UnfinalizedChain).ForkChoice
+	for _, index := range []ValidatorIndex{slashed, slashed + 1} {
+		fc.ProcessAttestation(index, genesis.BlockRoot(), 0)
+		fc.ProcessAttestation(index, b1.BlockRoot, 1)
+	}
+	conflicts := fc.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Index != slashed+1 {
+		t.Fatalf("expected only the conflict of the validator that was not slashed, got %v", conflicts)
+	}
+}
+
+func TestHotChainProposerBoostArrival(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ctx := context.Background()
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisTime, err := anchor.GenesisTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slotTime := func(slot Slot) common.Timestamp {
+		t.Helper()
+		out, err := spec.TimeAtSlot(slot, genesisTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	fc := ch.HotChain.(*UnfinalizedChain).ForkChoice
+	if err := ch.OnTick(ctx, slotTime(1)+spec.SECONDS_PER_SLOT/2); err != nil {
+		t.Fatal(err)
+	}
+	// a block that arrives after the first third of its slot is late, and not boosted
+	late := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := ch.AddBlockAt(ctx, late, slotTime(1)+spec.SECONDS_PER_SLOT/3); err != nil {
+		t.Fatal(err)
+	}
+	if root := fc.ProposerBoostRoot(); root != (Root{}) {
+		t.Fatalf("expected no proposer boost for a late block, got %s", root)
+	}
+	// a timely competing block is boosted
+	timely := buildTestBlockWith(t, ch, &spec, keys, genesis.BlockRoot(), 1, func(pre common.BeaconState, body *phase0.BeaconBlockBody) {
+		body.Graffiti = Root{0x01}
+	})
+	if err := ch.AddBlockAt(ctx, timely, slotTime(1)+1); err != nil {
+		t.Fatal(err)
+	}
+	if root := fc.ProposerBoostRoot(); root != timely.BlockRoot {
+		t.Fatalf("expected the timely block to be boosted, got %s", root)
+	}
+
+	// a block without arrival time, e.g. from sync, is not boosted
+	if err := ch.OnTick(ctx, slotTime(2)); err != nil {
+		t.Fatal(err)
+	}
+	synced := buildTestBlock(t, ch, &spec, keys, timely.BlockRoot, 2)
+	if err := ch.AddBlock(ctx, synced); err != nil {
+		t.Fatal(err)
+	}
+	if root := fc.ProposerBoostRoot(); root != (Root{}) {
+		t.Fatalf("expected no proposer boost for a block without arrival time, got %s", root)
+	}
+}
+
+func TestHotChainAttestationConflicts(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ctx := context.Background()
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := ch.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	fork := buildTestBlockWith(t, ch, &spec, keys, genesis.BlockRoot(), 1, func(pre common.BeaconState, body *phase0.BeaconBlockBody) {
+		body.Graffiti = Root{0x01}
+	})
+	if err := ch.AddBlock(ctx, fork); err != nil {
+		t.Fatal(err)
+	}
+	uc := ch.HotChain.(*UnfinalizedChain)
+	entry, ok := uc.ByBlockSlot(b1.BlockRoot, 1)
+	if !ok {
+		t.Fatal("missing block entry")
+	}
+	epc, err := entry.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := epc.GetBeaconCommittee(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first member of the committee votes for both blocks of the slot
+	vote := func(head Root) *phase0.Attestation {
+		bits := make(phase0.AttestationBits, (len(committee)/8)+1)
+		bits[len(bits)-1] = 1 << (uint8(len(committee)) & 7)
+		bits.SetBit(0, true)
+		return &phase0.Attestation{
+			AggregationBits: bits,
+			Data:            phase0.AttestationData{Slot: 1, Index: 0, BeaconBlockRoot: head},
+		}
+	}
+	if err := uc.AddAttestation(vote(b1.BlockRoot)); err != nil {
+		t.Fatal(err)
+	}
+	if err := uc.AddAttestation(vote(fork.BlockRoot)); err != nil {
+		t.Fatal(err)
+	}
+	if err := uc.AddAttestation(vote(Root{0xff})); err == nil {
+		t.Fatal("expected error for an attestation of an unknown block")
+	}
+	conflicts := uc.ForkChoice.Conflicts()
+	if len(conflicts) != 1 {
+		t.Fatalf("expected a single conflict, got %d", len(conflicts))
+	}
+	c := conflicts[0]
+	if c.Index != committee[0] || c.First.Root != b1.BlockRoot || c.Second.Root != fork.BlockRoot {
+		t.Fatalf("unexpected conflict: %v", c)
+	}
+	if c.FirstAttestation == nil || c.SecondAttestation == nil ||
+		c.FirstAttestation.Data.BeaconBlockRoot != b1.BlockRoot || c.SecondAttestation.Data.BeaconBlockRoot != fork.BlockRoot {
+		t.Fatal("expected the attestations of the conflicting votes")
+	}
+}
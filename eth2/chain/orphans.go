@@ -0,0 +1,107 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+)
+
+// OrphanStore keeps the blocks that were pruned from the hot chain without becoming part of the finalized chain.
+// The envelopes of the blocks include the parent root, slot and proposer index to analyze the orphans with.
+type OrphanStore interface {
+	// StoreOrphan stores a pruned non-finalized block.
+	StoreOrphan(ctx context.Context, benv *common.BeaconBlockEnvelope) error
+	// OrphansBySlot lists the orphaned blocks in the slot range [start, end), ordered by slot.
+	OrphansBySlot(ctx context.Context, start Slot, end Slot) ([]*common.BeaconBlockEnvelope, error)
+	// OrphansByProposer lists the orphaned blocks of the given proposer, ordered by slot.
+	OrphansByProposer(ctx context.Context, proposer ValidatorIndex) ([]*common.BeaconBlockEnvelope, error)
+	// PruneOrphans is called when the finalized slot changes,
+	// to remove the orphaned blocks that are older than the store retains.
+	PruneOrphans(ctx context.Context, finalizedSlot Slot) error
+}
+
+// DefaultOrphanRetentionEpochs is the number of epochs before the finalized epoch
+// that the in-memory orphan store of a HotColdChain without Storage.Orphans keeps orphaned blocks for.
+const DefaultOrphanRetentionEpochs = 8
+
+// BlocksOrphanStore is an OrphanStore that keeps the orphaned blocks in a blocks.DB.
+// Queries use the indices of the DB, the DB should only be used for orphaned blocks.
+type BlocksOrphanStore struct {
+	DB blocks.DB
+	// Retention is the number of slots before the finalized slot to keep orphaned blocks for.
+	// Older orphans are removed from the DB. Zero keeps all orphaned blocks.
+	Retention Slot
+}
+
+var _ OrphanStore = (*BlocksOrphanStore)(nil)
+
+// NewBlocksOrphanStore creates an orphan store that keeps all orphaned blocks in the DB, see Retention.
+func NewBlocksOrphanStore(db blocks.DB) *BlocksOrphanStore {
+	return &BlocksOrphanStore{DB: db}
+}
+
+func (s *BlocksOrphanStore) StoreOrphan(ctx context.Context, benv *common.BeaconBlockEnvelope) error {
+	if _, _, err := s.DB.Store(ctx, benv); err != nil {
+		return fmt.Errorf("failed to store orphaned block %s: %v", benv.BlockRoot, err)
+	}
+	return nil
+}
+
+func (s *BlocksOrphanStore) OrphansBySlot(ctx context.Context, start Slot, end Slot) ([]*common.BeaconBlockEnvelope, error) {
+	var roots []Root
+	if err := s.DB.Range(ctx, start, end, func(slot Slot, root Root) bool {
+		roots = append(roots, root)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return s.get(ctx, roots)
+}
+
+func (s *BlocksOrphanStore) OrphansByProposer(ctx context.Context, proposer ValidatorIndex) ([]*common.BeaconBlockEnvelope, error) {
+	roots, err := s.DB.ByProposer(ctx, proposer)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(ctx, roots)
+}
+
+func (s *BlocksOrphanStore) PruneOrphans(ctx context.Context, finalizedSlot Slot) error {
+	if s.Retention == 0 || finalizedSlot <= s.Retention {
+		return nil
+	}
+	var roots []Root
+	if err := s.DB.Range(ctx, 0, finalizedSlot-s.Retention, func(slot Slot, root Root) bool {
+		roots = append(roots, root)
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if _, err := s.DB.Remove(root); err != nil {
+			return fmt.Errorf("failed to remove orphaned block %s: %v", root, err)
+		}
+	}
+	return nil
+}
+
+// get loads the blocks, the order of the roots is kept.
+func (s *BlocksOrphanStore) get(ctx context.Context, roots []Root) ([]*common.BeaconBlockEnvelope, error) {
+	out := make([]*common.BeaconBlockEnvelope, 0, len(roots))
+	for _, root := range roots {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		benv, err := s.DB.Get(ctx, root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load orphaned block %s: %v", root, err)
+		}
+		// may have been removed in the meantime
+		if benv == nil {
+			continue
+		}
+		out = append(out, benv)
+	}
+	return out, nil
+}
@@ -0,0 +1,139 @@
+package chain
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"testing"
+)
+
+func TestHotColdChainOrphans(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ctx := context.Background()
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := ch.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	b2 := buildTestBlock(t, ch, &spec, keys, b1.BlockRoot, 2)
+	if err := ch.AddBlock(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	fork2 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 2)
+	if err := ch.AddBlock(ctx, fork2); err != nil {
+		t.Fatal(err)
+	}
+	fork3 := buildTestBlock(t, ch, &spec, keys, fork2.BlockRoot, 3)
+	if err := ch.AddBlock(ctx, fork3); err != nil {
+		t.Fatal(err)
+	}
+
+	// prune the fork, as the hot chain does when the fork conflicts with finality
+	for _, benv := range []*common.BeaconBlockEnvelope{fork3, fork2} {
+		entry, ok := ch.HotChain.ByBlock(benv.BlockRoot)
+		if !ok {
+			t.Fatalf("missing block %s", benv.BlockRoot)
+		}
+		if err := ch.hotToCold(ctx, entry, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// empty slots are not kept
+	if empty, ok := ch.HotChain.ByBlockSlot(genesis.BlockRoot(), 1); ok {
+		if err := ch.hotToCold(ctx, empty, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orphans, err := ch.OrphansBySlot(ctx, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 2 || orphans[0].BlockRoot != fork2.BlockRoot || orphans[1].BlockRoot != fork3.BlockRoot {
+		t.Fatalf("unexpected orphans: %v", orphans)
+	}
+	if orphans[1].ParentRoot != fork2.BlockRoot || orphans[1].Slot != 3 {
+		t.Fatal("orphan does not include parent root and slot")
+	}
+	if orphans, err := ch.OrphansBySlot(ctx, 3, 4); err != nil {
+		t.Fatal(err)
+	} else if len(orphans) != 1 || orphans[0].BlockRoot != fork3.BlockRoot {
+		t.Fatalf("unexpected orphans in slot range: %v", orphans)
+	}
+	byProposer, err := ch.OrphansByProposer(ctx, fork2.ProposerIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, benv := range byProposer {
+		if benv.ProposerIndex != fork2.ProposerIndex {
+			t.Fatalf("unexpected proposer %d", benv.ProposerIndex)
+		}
+		found = found || benv.BlockRoot == fork2.BlockRoot
+	}
+	if !found {
+		t.Fatal("missing orphan of proposer")
+	}
+}
+
+func TestBlocksOrphanStorePrune(t *testing.T) {
+	spec := *configs.Minimal
+	dec := beacon.NewForkDecoder(&spec, Root{})
+	ctx := context.Background()
+	store := NewBlocksOrphanStore(blocks.NewMemDB(&spec, dec))
+	store.Retention = spec.SLOTS_PER_EPOCH
+	var orphans []*common.BeaconBlockEnvelope
+	for slot := Slot(1); slot <= 3*spec.SLOTS_PER_EPOCH; slot += spec.SLOTS_PER_EPOCH {
+		block := &phase0.SignedBeaconBlock{Message: phase0.BeaconBlock{Slot: slot}}
+		benv := block.Envelope(&spec, dec.Schedule[0].Digest)
+		if err := store.StoreOrphan(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		orphans = append(orphans, benv)
+	}
+	// orphans within the retention before the finalized slot are kept
+	if err := store.PruneOrphans(ctx, 2*spec.SLOTS_PER_EPOCH); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := store.OrphansBySlot(ctx, 0, 4*spec.SLOTS_PER_EPOCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 || kept[0].BlockRoot != orphans[1].BlockRoot || kept[1].BlockRoot != orphans[2].BlockRoot {
+		t.Fatalf("expected the oldest orphan to be pruned, got %v", kept)
+	}
+
+	// without retention, all orphans are kept
+	store.Retention = 0
+	if err := store.PruneOrphans(ctx, 10*spec.SLOTS_PER_EPOCH); err != nil {
+		t.Fatal(err)
+	}
+	if kept, err := store.OrphansBySlot(ctx, 0, 4*spec.SLOTS_PER_EPOCH); err != nil {
+		t.Fatal(err)
+	} else if len(kept) != 2 {
+		t.Fatalf("expected all orphans to be kept, got %d", len(kept))
+	}
+
+	// the default in-memory orphan store of the chain is bounded
+	anchor, _ := kickstarttest.State(t, &spec, 64)
+	ch, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mem, ok := ch.Orphans.(*BlocksOrphanStore); !ok || mem.Retention != DefaultOrphanRetentionEpochs*spec.SLOTS_PER_EPOCH {
+		t.Fatal("expected the in-memory orphan store to have the default retention")
+	}
+}
@@ -0,0 +1,210 @@
+package chain
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"sort"
+	"sync"
+)
+
+// PendingBlocks keeps blocks of which the parent is not known yet, e.g. blocks that arrive out of order on gossip,
+// until the parent is imported and the blocks can be added to the chain.
+// The number of blocks is bounded, the blocks that were added first are evicted first.
+type PendingBlocks struct {
+	sync.Mutex
+	limit int
+	// Pending block envelopes, in order of addition
+	order    *list.List
+	byRoot   map[Root]*list.Element
+	byParent map[Root][]Root
+}
+
+// NewPendingBlocks creates an empty pending block store, keeping up to limit blocks.
+func NewPendingBlocks(limit int) *PendingBlocks {
+	return &PendingBlocks{
+		limit:    limit,
+		order:    list.New(),
+		byRoot:   make(map[Root]*list.Element),
+		byParent: make(map[Root][]Root),
+	}
+}
+
+// Add keeps the block until its parent is imported. Returns false if the block was already pending,
+// or if the store does not keep any blocks. If the store is full, the oldest pending block is evicted.
+func (p *PendingBlocks) Add(benv *common.BeaconBlockEnvelope) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.limit <= 0 {
+		return false
+	}
+	if _, ok := p.byRoot[benv.BlockRoot]; ok {
+		return false
+	}
+	for p.order.Len() >= p.limit {
+		p.remove(p.order.Front())
+	}
+	p.byRoot[benv.BlockRoot] = p.order.PushBack(benv)
+	p.byParent[benv.ParentRoot] = append(p.byParent[benv.ParentRoot], benv.BlockRoot)
+	return true
+}
+
+// remove removes the pending block of the element. The store must be locked.
+func (p *PendingBlocks) remove(el *list.Element) *common.BeaconBlockEnvelope {
+	benv := p.order.Remove(el).(*common.BeaconBlockEnvelope)
+	delete(p.byRoot, benv.BlockRoot)
+	siblings := p.byParent[benv.ParentRoot]
+	for i, root := range siblings {
+		if root == benv.BlockRoot {
+			siblings = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.byParent, benv.ParentRoot)
+	} else {
+		p.byParent[benv.ParentRoot] = siblings
+	}
+	return benv
+}
+
+// Has checks if the block is pending.
+func (p *PendingBlocks) Has(root Root) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.byRoot[root]
+	return ok
+}
+
+// Len returns the number of pending blocks.
+func (p *PendingBlocks) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.order.Len()
+}
+
+// MissingRoots lists the parent roots that pending blocks are waiting for, and that are not pending themselves.
+// These are the blocks to request from peers. The roots are ordered by the oldest pending block that needs them.
+func (p *PendingBlocks) MissingRoots() []Root {
+	p.Lock()
+	defer p.Unlock()
+	var out []Root
+	seen := make(map[Root]struct{})
+	for el := p.order.Front(); el != nil; el = el.Next() {
+		parent := el.Value.(*common.BeaconBlockEnvelope).ParentRoot
+		if _, ok := p.byRoot[parent]; ok {
+			continue
+		}
+		if _, ok := seen[parent]; ok {
+			continue
+		}
+		seen[parent] = struct{}{}
+		out = append(out, parent)
+	}
+	return out
+}
+
+// PruneFinalized evicts the blocks at or before the finalized slot, these can not be imported anymore.
+// Returns the number of evicted blocks.
+func (p *PendingBlocks) PruneFinalized(finalizedSlot Slot) int {
+	p.Lock()
+	defer p.Unlock()
+	count := 0
+	for el := p.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*common.BeaconBlockEnvelope).Slot <= finalizedSlot {
+			p.remove(el)
+			count++
+		}
+		el = next
+	}
+	return count
+}
+
+// takeChildren removes and returns the pending children of the parent, ordered by slot.
+func (p *PendingBlocks) takeChildren(parent Root) []*common.BeaconBlockEnvelope {
+	p.Lock()
+	defer p.Unlock()
+	roots := p.byParent[parent]
+	out := make([]*common.BeaconBlockEnvelope, 0, len(roots))
+	for _, root := range roots {
+		out = append(out, p.remove(p.byRoot[root]))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Slot < out[j].Slot
+	})
+	return out
+}
+
+// ImportChildren adds the pending children of the imported parent block to the chain,
+// and then their pending children, and so on. Blocks that fail to import are dropped,
+// the error of the first failure is returned after trying the other blocks.
+func (p *PendingBlocks) ImportChildren(ctx context.Context, ch HotChain, parent Root) (imported int, err error) {
+	queue := []Root{parent}
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return imported, err
+		}
+		children := p.takeChildren(queue[0])
+		queue = queue[1:]
+		for _, benv := range children {
+			if addErr := ch.AddBlock(ctx, benv); addErr != nil {
+				if err == nil {
+					err = fmt.Errorf("failed to import pending block %s: %v", benv.BlockRoot, addErr)
+				}
+				continue
+			}
+			imported++
+			queue = append(queue, benv.BlockRoot)
+		}
+	}
+	return imported, err
+}
+
+// ImportReady adds all pending blocks of which the parent is known in the chain by now, and their pending children.
+// This catches up with parents that were imported before their children were added.
+func (p *PendingBlocks) ImportReady(ctx context.Context, ch HotChain) (imported int, err error) {
+	p.Lock()
+	parents := make([]Root, 0, len(p.byParent))
+	for parent := range p.byParent {
+		parents = append(parents, parent)
+	}
+	p.Unlock()
+	for _, parent := range parents {
+		if _, ok := ch.ByBlock(parent); !ok {
+			continue
+		}
+		n, importErr := p.ImportChildren(ctx, ch, parent)
+		imported += n
+		if importErr != nil && err == nil {
+			err = importErr
+		}
+	}
+	return imported, err
+}
+
+// Run follows the events of the chain until the context is done: pending blocks are imported
+// when their parent is, and evicted when they are finalized. Import errors are ignored, the blocks are dropped.
+func (p *PendingBlocks) Run(ctx context.Context, hc *HotColdChain, buffer int) {
+	sub := hc.Subscribe(buffer)
+	defer sub.Unsubscribe()
+	// catch up with the parents that were imported before subscribing
+	_, _ = p.ImportReady(ctx, hc)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-sub.Events():
+			switch ev := ev.(type) {
+			case *BlockImportedEvent:
+				// Import events may have been dropped, or their children added late, so check all pending parents.
+				_, _ = p.ImportReady(ctx, hc)
+			case *FinalizedUpdatedEvent:
+				if slot, err := hc.Spec.EpochStartSlot(ev.New.Epoch); err == nil {
+					p.PruneFinalized(slot)
+				}
+			}
+		}
+	}
+}
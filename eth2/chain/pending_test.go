@@ -0,0 +1,163 @@
+package chain
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"testing"
+	"time"
+)
+
+func TestPendingBlocks(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ctx := context.Background()
+
+	// build the blocks on one chain, and import them out of order into another
+	src, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := buildTestBlock(t, src, &spec, keys, genesis.BlockRoot(), 1)
+	if err := src.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	b2 := buildTestBlock(t, src, &spec, keys, b1.BlockRoot, 2)
+	if err := src.AddBlock(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	b3 := buildTestBlock(t, src, &spec, keys, b2.BlockRoot, 3)
+	if err := src.AddBlock(ctx, b3); err != nil {
+		t.Fatal(err)
+	}
+	fork := buildTestBlock(t, src, &spec, keys, b1.BlockRoot, 4)
+
+	dst, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := NewPendingBlocks(10)
+	for _, benv := range []*common.BeaconBlockEnvelope{b3, fork, b2} {
+		if !pending.Add(benv) {
+			t.Fatalf("failed to add pending block %d", benv.Slot)
+		}
+	}
+	if pending.Add(b3) {
+		t.Fatal("expected the block to be pending already")
+	}
+	if missing := pending.MissingRoots(); len(missing) != 1 || missing[0] != b1.BlockRoot {
+		t.Fatalf("expected b1 to be missing, got %v", missing)
+	}
+
+	// the parent arrives before its children are added
+	if err := dst.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := pending.ImportChildren(ctx, dst, b1.BlockRoot); err != nil {
+		t.Fatal(err)
+	} else if imported != 3 {
+		t.Fatalf("expected 3 imported blocks, got %d", imported)
+	}
+	for _, benv := range []*common.BeaconBlockEnvelope{b2, b3, fork} {
+		if _, ok := dst.ByBlock(benv.BlockRoot); !ok {
+			t.Fatalf("expected pending block %d to be imported", benv.Slot)
+		}
+	}
+	if pending.Len() != 0 || len(pending.MissingRoots()) != 0 {
+		t.Fatal("expected no pending blocks")
+	}
+
+	// a child of an already imported parent is picked up by ImportReady
+	b5 := buildTestBlock(t, src, &spec, keys, b3.BlockRoot, 5)
+	pending.Add(b5)
+	if imported, err := pending.ImportReady(ctx, dst); err != nil {
+		t.Fatal(err)
+	} else if imported != 1 {
+		t.Fatalf("expected 1 imported block, got %d", imported)
+	}
+
+	// bounded, and pruned by finality
+	small := NewPendingBlocks(2)
+	blocks := make([]*common.BeaconBlockEnvelope, 3)
+	for i := range blocks {
+		blocks[i] = &common.BeaconBlockEnvelope{Slot: Slot(10 + i), BlockRoot: Root{byte(i + 1)}, ParentRoot: Root{0xaa}}
+		small.Add(blocks[i])
+	}
+	if small.Has(blocks[0].BlockRoot) || !small.Has(blocks[1].BlockRoot) || !small.Has(blocks[2].BlockRoot) {
+		t.Fatal("expected the oldest block to be evicted")
+	}
+	if n := small.PruneFinalized(11); n != 1 || small.Has(blocks[1].BlockRoot) {
+		t.Fatalf("expected the finalized block to be evicted, got %d", n)
+	}
+	if missing := small.MissingRoots(); len(missing) != 1 || missing[0] != (Root{0xaa}) {
+		t.Fatalf("unexpected missing roots: %v", missing)
+	}
+}
+
+func TestPendingBlocksRun(t *testing.T) {
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := buildTestBlock(t, src, &spec, keys, genesis.BlockRoot(), 1)
+	if err := src.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	b2 := buildTestBlock(t, src, &spec, keys, b1.BlockRoot, 2)
+	if err := src.AddBlock(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	b3 := buildTestBlock(t, src, &spec, keys, b2.BlockRoot, 3)
+
+	dst, err := NewHotColdChain(anchor, &spec, states.NewMemDB(&spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := NewPendingBlocks(10)
+	pending.Add(b3)
+	pending.Add(b2)
+	done := make(chan struct{})
+	go func() {
+		pending.Run(ctx, dst, 10)
+		close(done)
+	}()
+
+	// importing the parent imports the pending blocks that build on it
+	if err := dst.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pending.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the pending blocks to be imported, %d are left", pending.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, benv := range []*common.BeaconBlockEnvelope{b2, b3} {
+		if _, ok := dst.ByBlock(benv.BlockRoot); !ok {
+			t.Fatalf("expected pending block %d to be imported", benv.Slot)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to stop when the context is done")
+	}
+}
@@ -0,0 +1,342 @@
+package chain
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// ColdIndexEntry is the persisted form of an entry in the cold chain index.
+type ColdIndexEntry struct {
+	Step      Step
+	BlockRoot Root
+	StateRoot Root
+}
+
+// HotAnchor is the persisted anchor of the hot chain.
+// The anchor state itself is persisted in the states.DB, the anchor refers to it by state root.
+type HotAnchor struct {
+	Finalized Checkpoint
+	Justified Checkpoint
+	StateRoot Root
+}
+
+// MetaDB persists the chain metadata that is not covered by the blocks.DB and states.DB:
+// the cold chain index and the anchor of the hot chain.
+type MetaDB interface {
+	// AppendColdEntry persists the next entry of the cold chain index.
+	AppendColdEntry(entry ColdIndexEntry) error
+	// ColdEntries returns all persisted entries of the cold chain index, in order.
+	ColdEntries() ([]ColdIndexEntry, error)
+	// TruncateCold drops the persisted entries of the cold chain index at or after the given step.
+	TruncateCold(end Step) error
+	// StoreAnchor persists the anchor of the hot chain, replacing any previous anchor.
+	StoreAnchor(anchor HotAnchor) error
+	// Anchor returns the persisted anchor of the hot chain, ok=false if there is none.
+	Anchor() (anchor HotAnchor, ok bool, err error)
+	io.Closer
+}
+
+// ChainStorage groups the databases that a restartable HotColdChain persists its data in.
+type ChainStorage struct {
+	// Blocks persists every block that is added to the chain.
+	Blocks blocks.DB
+	// States persists the finalized states (only the snapshots in archive mode), and the anchor state of the hot chain.
+	States states.DB
+	// Meta persists the cold chain index and the hot chain anchor.
+	Meta MetaDB
+	// Orphans keeps the pruned non-finalized blocks, optional. It is pruned whenever the finalized slot changes,
+	// e.g. a BlocksOrphanStore with a Retention, or with a zero retention to keep the orphans indefinitely.
+	// If nil, the orphaned blocks are kept in memory, for DefaultOrphanRetentionEpochs before the finalized epoch.
+	Orphans OrphanStore
+	// Archive enables the archive mode of the cold chain, optional.
+	// If the archive BlockDB is nil, the Blocks DB is used.
+	Archive *ArchiveConfig
+}
+
+// newColdChain creates the cold chain, in archive mode if configured.
+func (s *ChainStorage) newColdChain(spec *common.Spec) (*FinalizedChain, error) {
+	if s.Archive == nil {
+		return NewFinalizedChain(spec, s.States), nil
+	}
+	return NewArchiveFinalizedChain(spec, s.States, s.archiveConfig())
+}
+
+// loadColdChain restores the cold chain, in archive mode if configured.
+func (s *ChainStorage) loadColdChain(spec *common.Spec) (*FinalizedChain, error) {
+	if s.Archive == nil {
+		return LoadFinalizedChain(spec, s.States, s.Meta)
+	}
+	return LoadArchiveFinalizedChain(spec, s.States, s.Meta, s.archiveConfig())
+}
+
+func (s *ChainStorage) archiveConfig() ArchiveConfig {
+	conf := *s.Archive
+	if conf.BlockDB == nil {
+		conf.BlockDB = s.Blocks
+	}
+	return conf
+}
+
+type MemMetaDB struct {
+	sync.Mutex
+	cold   []ColdIndexEntry
+	anchor *HotAnchor
+}
+
+var _ MetaDB = (*MemMetaDB)(nil)
+
+func NewMemMetaDB() *MemMetaDB {
+	return &MemMetaDB{}
+}
+
+func (db *MemMetaDB) AppendColdEntry(entry ColdIndexEntry) error {
+	db.Lock()
+	defer db.Unlock()
+	db.cold = append(db.cold, entry)
+	return nil
+}
+
+func (db *MemMetaDB) ColdEntries() ([]ColdIndexEntry, error) {
+	db.Lock()
+	defer db.Unlock()
+	out := make([]ColdIndexEntry, len(db.cold), len(db.cold))
+	copy(out, db.cold)
+	return out, nil
+}
+
+func (db *MemMetaDB) TruncateCold(end Step) error {
+	db.Lock()
+	defer db.Unlock()
+	for i, entry := range db.cold {
+		if entry.Step >= end {
+			db.cold = db.cold[:i]
+			break
+		}
+	}
+	return nil
+}
+
+func (db *MemMetaDB) StoreAnchor(anchor HotAnchor) error {
+	db.Lock()
+	defer db.Unlock()
+	db.anchor = &anchor
+	return nil
+}
+
+func (db *MemMetaDB) Anchor() (anchor HotAnchor, ok bool, err error) {
+	db.Lock()
+	defer db.Unlock()
+	if db.anchor == nil {
+		return HotAnchor{}, false, nil
+	}
+	return *db.anchor, true, nil
+}
+
+func (db *MemMetaDB) Close() error {
+	return nil
+}
+
+// cold index record: step, block root, state root
+const coldIndexRecordSize = 8 + 32 + 32
+
+// anchor record: finalized epoch and root, justified epoch and root, state root
+const anchorRecordSize = 8 + 32 + 8 + 32 + 32
+
+// FileMetaDB persists the chain metadata in a directory:
+//   - cold_index.log: append-only log of cold chain index entries. A torn record at the end is dropped on open.
+//   - anchor.dat: the hot chain anchor, replaced atomically on every update.
+type FileMetaDB struct {
+	sync.Mutex
+	basePath string
+	coldF    *os.File
+	coldEnd  int64
+}
+
+var _ MetaDB = (*FileMetaDB)(nil)
+
+// NewFileMetaDB opens the metadata DB in the given directory, or creates a new one if it does not exist yet.
+func NewFileMetaDB(basePath string) (*FileMetaDB, error) {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, err
+	}
+	coldF, err := os.OpenFile(path.Join(basePath, "cold_index.log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := coldF.Stat()
+	if err != nil {
+		_ = coldF.Close()
+		return nil, err
+	}
+	// drop any torn record at the end
+	end := info.Size() - (info.Size() % coldIndexRecordSize)
+	if err := coldF.Truncate(end); err != nil {
+		_ = coldF.Close()
+		return nil, err
+	}
+	if _, err := coldF.Seek(end, io.SeekStart); err != nil {
+		_ = coldF.Close()
+		return nil, err
+	}
+	return &FileMetaDB{basePath: basePath, coldF: coldF, coldEnd: end}, nil
+}
+
+func (db *FileMetaDB) AppendColdEntry(entry ColdIndexEntry) error {
+	db.Lock()
+	defer db.Unlock()
+	var rec [coldIndexRecordSize]byte
+	binary.LittleEndian.PutUint64(rec[0:8], uint64(entry.Step))
+	copy(rec[8:40], entry.BlockRoot[:])
+	copy(rec[40:72], entry.StateRoot[:])
+	_, err := db.coldF.Write(rec[:])
+	if err == nil {
+		err = db.coldF.Sync()
+	}
+	if err != nil {
+		// Drop any partially written record, to keep the next records aligned
+		if terr := db.coldF.Truncate(db.coldEnd); terr != nil {
+			return fmt.Errorf("failed to append cold index entry: %v, and failed to roll back: %v", err, terr)
+		}
+		if _, serr := db.coldF.Seek(db.coldEnd, io.SeekStart); serr != nil {
+			return fmt.Errorf("failed to append cold index entry: %v, and failed to roll back: %v", err, serr)
+		}
+		return fmt.Errorf("failed to append cold index entry: %v", err)
+	}
+	db.coldEnd += coldIndexRecordSize
+	return nil
+}
+
+func (db *FileMetaDB) ColdEntries() ([]ColdIndexEntry, error) {
+	db.Lock()
+	defer db.Unlock()
+	r := bufio.NewReader(io.NewSectionReader(db.coldF, 0, db.coldEnd))
+	out := make([]ColdIndexEntry, 0, db.coldEnd/coldIndexRecordSize)
+	var rec [coldIndexRecordSize]byte
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var entry ColdIndexEntry
+		entry.Step = Step(binary.LittleEndian.Uint64(rec[0:8]))
+		copy(entry.BlockRoot[:], rec[8:40])
+		copy(entry.StateRoot[:], rec[40:72])
+		out = append(out, entry)
+	}
+	return out, nil
+}
+
+func (db *FileMetaDB) TruncateCold(end Step) error {
+	db.Lock()
+	defer db.Unlock()
+	// the entries are ordered by step, search for the first entry to drop
+	var rec [8]byte
+	newEnd := db.coldEnd
+	for off := int64(0); off < db.coldEnd; off += coldIndexRecordSize {
+		if _, err := db.coldF.ReadAt(rec[:], off); err != nil {
+			return err
+		}
+		if Step(binary.LittleEndian.Uint64(rec[:])) >= end {
+			newEnd = off
+			break
+		}
+	}
+	if newEnd == db.coldEnd {
+		return nil
+	}
+	if err := db.coldF.Truncate(newEnd); err != nil {
+		return err
+	}
+	if err := db.coldF.Sync(); err != nil {
+		return err
+	}
+	if _, err := db.coldF.Seek(newEnd, io.SeekStart); err != nil {
+		return err
+	}
+	db.coldEnd = newEnd
+	return nil
+}
+
+func (db *FileMetaDB) StoreAnchor(anchor HotAnchor) error {
+	db.Lock()
+	defer db.Unlock()
+	var rec [anchorRecordSize]byte
+	binary.LittleEndian.PutUint64(rec[0:8], uint64(anchor.Finalized.Epoch))
+	copy(rec[8:40], anchor.Finalized.Root[:])
+	binary.LittleEndian.PutUint64(rec[40:48], uint64(anchor.Justified.Epoch))
+	copy(rec[48:80], anchor.Justified.Root[:])
+	copy(rec[80:112], anchor.StateRoot[:])
+
+	// write to a temporary file first, and then move it, to never leave a partially written anchor behind.
+	tmpPath := path.Join(db.basePath, "anchor.dat.tmp")
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(rec[:]); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path.Join(db.basePath, "anchor.dat")); err != nil {
+		return err
+	}
+	// the rename is only durable once the directory entry is synced
+	return syncDir(db.basePath)
+}
+
+// syncDir flushes the entries of the directory to disk, e.g. to persist a rename.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func (db *FileMetaDB) Anchor() (anchor HotAnchor, ok bool, err error) {
+	db.Lock()
+	defer db.Unlock()
+	rec, err := ioutil.ReadFile(path.Join(db.basePath, "anchor.dat"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return HotAnchor{}, false, nil
+		}
+		return HotAnchor{}, false, err
+	}
+	if len(rec) != anchorRecordSize {
+		return HotAnchor{}, false, fmt.Errorf("corrupt anchor record, unexpected size %d", len(rec))
+	}
+	anchor.Finalized.Epoch = Epoch(binary.LittleEndian.Uint64(rec[0:8]))
+	copy(anchor.Finalized.Root[:], rec[8:40])
+	anchor.Justified.Epoch = Epoch(binary.LittleEndian.Uint64(rec[40:48]))
+	copy(anchor.Justified.Root[:], rec[48:80])
+	copy(anchor.StateRoot[:], rec[80:112])
+	return anchor, true, nil
+}
+
+func (db *FileMetaDB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	return db.coldF.Close()
+}
@@ -0,0 +1,392 @@
+package chain
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"github.com/protolambda/zrnt/eth2/util/bls"
+	"github.com/protolambda/ztyp/tree"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func signTestRoot(t *testing.T, key *bls.BLSSecretKey, root common.Root) common.BLSSignature {
+	sig, err := bls.Sign(key, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// buildTestBlock creates a signed empty phase0 block at the given slot, on top of the given parent block.
+func buildTestBlock(t *testing.T, ch Chain, spec *common.Spec, keys []bls.BLSSecretKey,
+	parentRoot Root, slot Slot) *common.BeaconBlockEnvelope {
+	return buildTestBlockWith(t, ch, spec, keys, parentRoot, slot, nil)
+}
+
+// addTimelyTestBlock adds the block as arriving at the start of its slot, like a block received on time,
+// to receive the proposer score boost.
+func addTimelyTestBlock(t *testing.T, ch *HotColdChain, benv *common.BeaconBlockEnvelope) error {
+	ctx := context.Background()
+	parent, ok := ch.ByBlock(benv.ParentRoot)
+	if !ok {
+		t.Fatalf("unknown parent block %s", benv.ParentRoot)
+	}
+	state, err := parent.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisTime, err := state.GenesisTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrival, err := ch.Spec.TimeAtSlot(benv.Slot, genesisTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch.AddBlockAt(ctx, benv, arrival)
+}
+
+// buildTestBlockWith creates a signed phase0 block like buildTestBlock, with the operations added by the body function.
+func buildTestBlockWith(t *testing.T, ch Chain, spec *common.Spec, keys []bls.BLSSecretKey,
+	parentRoot Root, slot Slot, body func(pre common.BeaconState, body *phase0.BeaconBlockBody)) *common.BeaconBlockEnvelope {
+	ctx := context.Background()
+	parent, ok := ch.ByBlock(parentRoot)
+	if !ok {
+		t.Fatalf("unknown parent block %s", parentRoot)
+	}
+	parentState, err := parent.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentEpc, err := parent.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pre, err := parentState.CopyState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc := parentEpc.Clone()
+	if err := common.ProcessSlots(ctx, spec, epc, &beacon.StandardUpgradeableBeaconState{BeaconState: pre}, slot); err != nil {
+		t.Fatal(err)
+	}
+	proposer, err := epc.GetBeaconProposer(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth1Data, err := pre.Eth1Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := spec.SlotToEpoch(slot)
+	randaoDom, err := common.GetDomain(pre, common.DOMAIN_RANDAO, epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genValRoot, err := pre.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &phase0.SignedBeaconBlock{
+		Message: phase0.BeaconBlock{
+			Slot:          slot,
+			ProposerIndex: proposer,
+			ParentRoot:    parentRoot,
+			Body: phase0.BeaconBlockBody{
+				RandaoReveal: signTestRoot(t, &keys[proposer],
+					common.ComputeSigningRoot(epoch.HashTreeRoot(tree.GetHashFn()), randaoDom)),
+				Eth1Data: eth1Data,
+			},
+		},
+	}
+	if body != nil {
+		body(pre, &block.Message.Body)
+	}
+	digest := common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genValRoot)
+	if err := pre.ProcessBlock(ctx, spec, epc, block.Envelope(spec, digest)); err != nil {
+		t.Fatal(err)
+	}
+	block.Message.StateRoot = pre.HashTreeRoot(tree.GetHashFn())
+	proposerDom := common.ComputeDomain(common.DOMAIN_BEACON_PROPOSER, spec.GENESIS_FORK_VERSION, genValRoot)
+	block.Signature = signTestRoot(t, &keys[proposer],
+		common.ComputeSigningRoot(block.Message.HashTreeRoot(spec, tree.GetHashFn()), proposerDom))
+	return block.Envelope(spec, digest)
+}
+
+func openTestStorage(t *testing.T, spec *common.Spec, dec *beacon.ForkDecoder, dir string) ChainStorage {
+	blocksPath := path.Join(dir, "blocks")
+	if err := os.MkdirAll(blocksPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stateDB, err := states.NewFileDB(spec, dec, path.Join(dir, "states"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaDB, err := NewFileMetaDB(path.Join(dir, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ChainStorage{
+		Blocks: blocks.NewFileDB(spec, dec, blocksPath),
+		States: stateDB,
+		Meta:   metaDB,
+	}
+}
+
+func closeTestStorage(t *testing.T, storage ChainStorage) {
+	if err := storage.States.(*states.FileDB).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Meta.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadHotColdChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	genValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(&spec, genValRoot)
+	ctx := context.Background()
+
+	storage := openTestStorage(t, &spec, dec, dir)
+	ch, err := NewPersistentHotColdChain(ctx, anchor, &spec, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a chain with a gap slot, and a competing fork
+	b1 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := ch.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	b2 := buildTestBlock(t, ch, &spec, keys, b1.BlockRoot, 2)
+	if err := ch.AddBlock(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	b4 := buildTestBlock(t, ch, &spec, keys, b2.BlockRoot, 4)
+	if err := ch.AddBlock(ctx, b4); err != nil {
+		t.Fatal(err)
+	}
+	fork3 := buildTestBlock(t, ch, &spec, keys, b1.BlockRoot, 3)
+	if err := ch.AddBlock(ctx, fork3); err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeTestStorage(t, storage)
+
+	storage = openTestStorage(t, &spec, dec, dir)
+	defer closeTestStorage(t, storage)
+	if _, err := NewPersistentHotColdChain(ctx, anchor, &spec, storage); err == nil {
+		t.Fatal("expected existing chain storage to be rejected for a new chain")
+	}
+	loaded, err := LoadHotColdChain(ctx, &spec, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Genesis() != ch.Genesis() {
+		t.Fatal("genesis info does not match after restart")
+	}
+	for _, b := range []*common.BeaconBlockEnvelope{b1, b2, b4, fork3} {
+		entry, ok := loaded.ByBlock(b.BlockRoot)
+		if !ok {
+			t.Fatalf("block %s at slot %d is missing after restart", b.BlockRoot, b.Slot)
+		}
+		if entry.StateRoot() != b.StateRoot {
+			t.Fatalf("block %s has state root %s after restart, expected %s", b.BlockRoot, entry.StateRoot(), b.StateRoot)
+		}
+	}
+	loadedHead, err := loaded.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedHead.BlockRoot() != head.BlockRoot() {
+		t.Fatalf("head changed after restart: %s <> %s", loadedHead.BlockRoot(), head.BlockRoot())
+	}
+
+	// the restarted chain continues to build on the restored blocks
+	b5 := buildTestBlock(t, loaded, &spec, keys, b4.BlockRoot, 5)
+	if err := loaded.AddBlock(ctx, b5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadHotColdChainColdPastAnchor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := *configs.Minimal
+	anchor, _, keys := kickstarttest.StateWithKeys(t, &spec, 64)
+	genValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(&spec, genValRoot)
+	ctx := context.Background()
+
+	storage := openTestStorage(t, &spec, dec, dir)
+	ch, err := NewPersistentHotColdChain(ctx, anchor, &spec, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := buildTestBlock(t, ch, &spec, keys, genesis.BlockRoot(), 1)
+	if err := ch.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	b2 := buildTestBlock(t, ch, &spec, keys, b1.BlockRoot, 2)
+	if err := ch.AddBlock(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash during finalization: the pruned entries made it to the cold index,
+	// but the anchor was not moved forward yet.
+	for _, e := range []ColdIndexEntry{
+		{Step: genesis.Step(), BlockRoot: genesis.BlockRoot(), StateRoot: genesis.StateRoot()},
+		{Step: AsStep(1, true), BlockRoot: b1.BlockRoot, StateRoot: b1.StateRoot},
+	} {
+		if err := storage.Meta.AppendColdEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestStorage(t, storage)
+
+	storage = openTestStorage(t, &spec, dec, dir)
+	defer closeTestStorage(t, storage)
+	loaded, err := LoadHotColdChain(ctx, &spec, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := storage.Meta.ColdEntries(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatalf("expected the cold index to be truncated to the anchor, got %d entries", len(entries))
+	}
+	for _, b := range []*common.BeaconBlockEnvelope{b1, b2} {
+		if _, ok := loaded.HotChain.ByBlock(b.BlockRoot); !ok {
+			t.Fatalf("block %s at slot %d is missing from the hot chain after restart", b.BlockRoot, b.Slot)
+		}
+	}
+	b3 := buildTestBlock(t, loaded, &spec, keys, b2.BlockRoot, 3)
+	if err := loaded.AddBlock(ctx, b3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileMetaDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileMetaDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := db.Anchor(); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected no anchor in new DB")
+	}
+	entries := []ColdIndexEntry{
+		{Step: AsStep(0, true), BlockRoot: Root{1}, StateRoot: Root{2}},
+		{Step: AsStep(1, false), BlockRoot: Root{1}, StateRoot: Root{3}},
+	}
+	for _, e := range entries {
+		if err := db.AppendColdEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	anchor := HotAnchor{
+		Finalized: Checkpoint{Epoch: 1, Root: Root{4}},
+		Justified: Checkpoint{Epoch: 2, Root: Root{5}},
+		StateRoot: Root{6},
+	}
+	if err := db.StoreAnchor(anchor); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn record at the end is dropped when opening the DB again
+	f, err := os.OpenFile(path.Join(dir, "cold_index.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewFileMetaDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	got, err := db.ColdEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("expected %d entries, got %d", len(entries), len(got))
+	}
+	for i := range entries {
+		if got[i] != entries[i] {
+			t.Fatalf("entry %d does not match: %v <> %v", i, got[i], entries[i])
+		}
+	}
+	if gotAnchor, ok, err := db.Anchor(); err != nil {
+		t.Fatal(err)
+	} else if !ok || gotAnchor != anchor {
+		t.Fatalf("anchor does not match: %v <> %v", gotAnchor, anchor)
+	}
+	if err := db.TruncateCold(AsStep(1, false)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.ColdEntries(); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 || got[0] != entries[0] {
+		t.Fatalf("expected only the first entry after truncation, got %v", got)
+	}
+	// appending continues after the truncated entries
+	if err := db.AppendColdEntry(entries[1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.ColdEntries(); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 2 || got[1] != entries[1] {
+		t.Fatalf("expected the entry to be appended after truncation, got %v", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"io"
 	"sync"
 )
@@ -13,17 +14,25 @@ type DBStats struct {
 	LastWrite common.Root
 }
 
+// BlockSlotRoot identifies a block by slot and root.
+type BlockSlotRoot struct {
+	Slot common.Slot
+	Root common.Root
+}
+
 type DB interface {
 	// Store, only for trusted blocks, to persist a block in the DB.
 	// The block is stored in serialized form, so the original instance may be mutated after storing it.
 	// This is an efficient convenience method for using Import.
 	// Returns exists=true if the block exists (previously), false otherwise. If error, it may not be accurate.
-	// Returns slashable=true if exists=true, but the signatures are different. The existing block is kept.
-	Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (exists bool, err error)
+	// If the block exists, but the signatures are different, an error is returned. The existing block is kept.
+	// If a different block of the same proposer and slot is stored already, the new block is still stored,
+	// and a slashing of the proposer with the two block headers is returned.
+	Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (exists bool, slashing *phase0.ProposerSlashing, err error)
 	// Import inserts a SignedBeaconBlock, read directly from the reader stream.
 	// Returns exists=true if the block exists (previously), false otherwise. If error, it may not be accurate.
-	// Returns slashable=true if exists=true, but the signatures are different. The existing block is kept.
-	Import(digest common.ForkDigest, r io.Reader) (exists bool, err error)
+	// Conflicting blocks are handled like with Store.
+	Import(digest common.ForkDigest, r io.Reader) (exists bool, slashing *phase0.ProposerSlashing, err error)
 	// Get, a convenience method for getting a block. The block is safe to modify.
 	// Returns the envelope if the block exists, nil otherwise. If error, exists-check may not be accurate.
 	Get(ctx context.Context, root common.Root) (envelope *common.BeaconBlockEnvelope, err error)
@@ -39,6 +48,15 @@ type DB interface {
 	Stats() DBStats
 	// List all known block roots
 	List() []common.Root
+	// BySlot lists the roots of the blocks of the given slot.
+	BySlot(ctx context.Context, slot common.Slot) ([]common.Root, error)
+	// ByParent lists the roots of the blocks with the given parent root, ordered by slot.
+	ByParent(ctx context.Context, parent common.Root) ([]common.Root, error)
+	// ByProposer lists the roots of the blocks of the given proposer, ordered by slot.
+	ByProposer(ctx context.Context, proposer common.ValidatorIndex) ([]common.Root, error)
+	// Range calls fn for each of the blocks in the slot range [start, end), ordered by slot, until fn returns false.
+	// The blocks are listed before iterating, fn may use the DB, changes do not affect the iteration.
+	Range(ctx context.Context, start common.Slot, end common.Slot, fn func(slot common.Slot, root common.Root) bool) error
 	// Get Path
 	Path() string
 	// Spec of blocks
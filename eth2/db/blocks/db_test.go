@@ -0,0 +1,268 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/ztyp/tree"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDoubleProposal(t *testing.T) {
+	spec := configs.Minimal
+	genValRoot := common.Root{0x42}
+	dec := beacon.NewForkDecoder(spec, genValRoot)
+	digest := common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genValRoot)
+	block := func(graffiti byte, proposer common.ValidatorIndex) *common.BeaconBlockEnvelope {
+		b := &phase0.SignedBeaconBlock{
+			Message: phase0.BeaconBlock{
+				Slot:          3,
+				ProposerIndex: proposer,
+				ParentRoot:    common.Root{0x01},
+				Body:          phase0.BeaconBlockBody{Graffiti: common.Root{graffiti}},
+			},
+			Signature: common.BLSSignature{graffiti},
+		}
+		return b.Envelope(spec, digest)
+	}
+
+	dir, err := ioutil.TempDir("", "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segments, err := OpenSegmentDB(spec, dec, path.Join(dir, "segments"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segments.Close()
+
+	for name, db := range map[string]DB{
+		"mem":     NewMemDB(spec, dec),
+		"file":    NewFileDB(spec, dec, dir),
+		"segment": segments,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			first := block(1, 7)
+			if exists, slashing, err := db.Store(ctx, first); err != nil {
+				t.Fatal(err)
+			} else if exists || slashing != nil {
+				t.Fatal("expected new block without slashing")
+			}
+			// a block of another proposer in the same slot is fine
+			if _, slashing, err := db.Store(ctx, block(2, 8)); err != nil {
+				t.Fatal(err)
+			} else if slashing != nil {
+				t.Fatal("unexpected slashing of a different proposer")
+			}
+			// storing the same block again is fine
+			if exists, slashing, err := db.Store(ctx, first); err != nil {
+				t.Fatal(err)
+			} else if !exists || slashing != nil {
+				t.Fatal("expected existing block without slashing")
+			}
+			// the same block with a different signature is rejected
+			changed := *first
+			changed.Signature = common.BLSSignature{0xff}
+			if _, _, err := db.Store(ctx, &changed); err == nil {
+				t.Fatal("expected error for a different signature")
+			}
+			second := block(3, 7)
+			exists, slashing, err := db.Store(ctx, second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists || slashing == nil {
+				t.Fatal("expected slashing of the double proposal")
+			}
+			if root := slashing.SignedHeader1.Message.HashTreeRoot(tree.GetHashFn()); root != first.BlockRoot {
+				t.Fatalf("unexpected first header: %s", root)
+			}
+			if root := slashing.SignedHeader2.Message.HashTreeRoot(tree.GetHashFn()); root != second.BlockRoot {
+				t.Fatalf("unexpected second header: %s", root)
+			}
+			if slashing.SignedHeader1.Signature != first.Signature || slashing.SignedHeader2.Signature != second.Signature {
+				t.Fatal("unexpected header signatures")
+			}
+			if got, err := db.Get(ctx, second.BlockRoot); err != nil || got == nil {
+				t.Fatal("expected the second block to be stored")
+			}
+			// after removing the first block, there is nothing to conflict with
+			if _, err := db.Remove(first.BlockRoot); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Remove(second.BlockRoot); err != nil {
+				t.Fatal(err)
+			}
+			if _, slashing, err := db.Store(ctx, block(4, 7)); err != nil {
+				t.Fatal(err)
+			} else if slashing != nil {
+				t.Fatal("unexpected slashing with removed blocks")
+			}
+		})
+	}
+}
+
+func TestIndices(t *testing.T) {
+	spec := configs.Minimal
+	genValRoot := common.Root{0x42}
+	dec := beacon.NewForkDecoder(spec, genValRoot)
+	digest := common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genValRoot)
+	block := func(slot common.Slot, proposer common.ValidatorIndex, parent common.Root) *common.BeaconBlockEnvelope {
+		b := &phase0.SignedBeaconBlock{
+			Message: phase0.BeaconBlock{Slot: slot, ProposerIndex: proposer, ParentRoot: parent},
+		}
+		return b.Envelope(spec, digest)
+	}
+	a := block(1, 3, common.Root{0x01})
+	b := block(2, 4, a.BlockRoot)
+	c := block(2, 5, a.BlockRoot)
+	d := block(5, 3, b.BlockRoot)
+
+	dir, err := ioutil.TempDir("", "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	check := func(t *testing.T, db DB) {
+		ctx := context.Background()
+		expectRoots := func(name string, got []common.Root, err error, expected ...*common.BeaconBlockEnvelope) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(expected) {
+				t.Fatalf("%s: expected %d blocks, got %d", name, len(expected), len(got))
+			}
+			for i, root := range got {
+				if root != expected[i].BlockRoot {
+					t.Fatalf("%s: unexpected block %d: %s", name, i, root)
+				}
+			}
+		}
+		roots, err := db.BySlot(ctx, 2)
+		if bytes.Compare(b.BlockRoot[:], c.BlockRoot[:]) < 0 {
+			expectRoots("slot", roots, err, b, c)
+		} else {
+			expectRoots("slot", roots, err, c, b)
+		}
+		roots, err = db.ByProposer(ctx, 3)
+		expectRoots("proposer", roots, err, a, d)
+		roots, err = db.ByParent(ctx, b.BlockRoot)
+		expectRoots("parent", roots, err, d)
+
+		var slots []common.Slot
+		if err := db.Range(ctx, 2, 6, func(slot common.Slot, root common.Root) bool {
+			slots = append(slots, slot)
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(slots) != 3 || slots[0] != 2 || slots[1] != 2 || slots[2] != 5 {
+			t.Fatalf("unexpected range: %v", slots)
+		}
+		count := 0
+		if err := db.Range(ctx, 0, 10, func(slot common.Slot, root common.Root) bool {
+			count++
+			return count < 2
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Fatalf("expected range iteration to stop, got %d blocks", count)
+		}
+	}
+
+	segments, err := OpenSegmentDB(spec, dec, path.Join(dir, "segments"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segments.Close()
+
+	for name, db := range map[string]DB{
+		"mem":     NewMemDB(spec, dec),
+		"file":    NewFileDB(spec, dec, dir),
+		"segment": segments,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, benv := range []*common.BeaconBlockEnvelope{a, b, c, d, block(7, 1, d.BlockRoot)} {
+				if _, _, err := db.Store(ctx, benv); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.Remove(block(7, 1, d.BlockRoot).BlockRoot); err != nil {
+				t.Fatal(err)
+			}
+			check(t, db)
+		})
+	}
+	t.Run("reopen", func(t *testing.T) {
+		db, err := OpenFileDB(context.Background(), spec, dec, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+}
+
+func TestFileDBCorrupt(t *testing.T) {
+	spec := configs.Minimal
+	genValRoot := common.Root{0x42}
+	dec := beacon.NewForkDecoder(spec, genValRoot)
+	digest := common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genValRoot)
+	b := (&phase0.SignedBeaconBlock{
+		Message: phase0.BeaconBlock{Slot: 3, ProposerIndex: 1, ParentRoot: common.Root{0x01}},
+	}).Envelope(spec, digest)
+
+	dir, err := ioutil.TempDir("", "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	if _, _, err := NewFileDB(spec, dec, dir).Store(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	// a torn block, and the temporary file of a block that was never moved into place
+	corruptPath := path.Join(dir, "0x"+strings.Repeat("ab", 32)+".ssz")
+	if err := ioutil.WriteFile(corruptPath, []byte{1, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpPath := path.Join(dir, "0x"+strings.Repeat("cd", 32)+".ssz.123.tmp")
+	if err := ioutil.WriteFile(tmpPath, []byte{1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenFileDB(ctx, spec, dec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roots, err := db.BySlot(ctx, 3); err != nil {
+		t.Fatal(err)
+	} else if len(roots) != 1 || roots[0] != b.BlockRoot {
+		t.Fatalf("expected the valid block to be indexed, got %v", roots)
+	}
+	if _, err := os.Stat(corruptPath + ".corrupt"); err != nil {
+		t.Fatalf("expected the corrupt block to be quarantined: %v", err)
+	}
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Fatal("expected the temporary file to be removed")
+	}
+	if roots := db.List(); len(roots) != 1 || roots[0] != b.BlockRoot {
+		t.Fatalf("expected only the valid block to be listed, got %v", roots)
+	}
+	if exists, _, err := db.Store(ctx, b); err != nil || !exists {
+		t.Fatalf("expected the stored block to exist: %v", err)
+	}
+}
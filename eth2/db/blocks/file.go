@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"github.com/protolambda/ztyp/codec"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,49 +23,172 @@ type FileDB struct {
 	spec     *common.Spec
 	dec      *beacon.ForkDecoder
 	basePath string
+
+	// The index is loaded from the stored blocks when first needed.
+	indexLock sync.Mutex
+	index     *blockIndex
 }
 
 var _ DB = (*FileDB)(nil)
 
+// NewFileDB creates a FileDB in the given directory. The index of the stored blocks is rebuilt when first needed.
 // TODO: refactor to use new Go 1.16 FS type
 func NewFileDB(spec *common.Spec, dec *beacon.ForkDecoder, basePath string) *FileDB {
-	return &FileDB{spec, dec, basePath}
+	return &FileDB{spec: spec, dec: dec, basePath: basePath}
+}
+
+// OpenFileDB opens a FileDB in the given directory, and rebuilds the index of the stored blocks right away.
+func OpenFileDB(ctx context.Context, spec *common.Spec, dec *beacon.ForkDecoder, basePath string) (*FileDB, error) {
+	db := NewFileDB(spec, dec, basePath)
+	if _, err := db.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// loadIndex returns the index of the blocks, and indexes all stored blocks if it is not loaded yet.
+// Blocks that cannot be decoded are quarantined: renamed with a .corrupt extension, and left out of the index.
+func (db *FileDB) loadIndex(ctx context.Context) (*blockIndex, error) {
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+	if db.index != nil {
+		return db.index, nil
+	}
+	if err := db.removeTempFiles(); err != nil {
+		return nil, err
+	}
+	index := newBlockIndex()
+	for _, root := range db.List() {
+		benv, err := db.Get(ctx, root)
+		if err != nil {
+			p := db.rootToPath(root)
+			if err := os.Rename(p, p+".corrupt"); err != nil {
+				return nil, fmt.Errorf("failed to quarantine corrupt block %s: %v", root, err)
+			}
+			continue
+		}
+		// may have been removed in the meantime
+		if benv != nil {
+			index.add(benv)
+		}
+	}
+	db.index = index
+	return index, nil
 }
 
 func (db *FileDB) rootToPath(root common.Root) string {
 	return path.Join(db.basePath, "0x"+hex.EncodeToString(root[:])+".ssz")
 }
 
+// removeTempFiles removes the temporary files of blocks that were never moved into place, e.g. after a crash.
+func (db *FileDB) removeTempFiles() error {
+	files, err := ioutil.ReadDir(db.basePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			if err := os.Remove(path.Join(db.basePath, f.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // does not overwrite if the file already exists
-func (db *FileDB) Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (exists bool, err error) {
+func (db *FileDB) Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (exists bool, slashing *phase0.ProposerSlashing, err error) {
+	// load the index before storing the block, to not index the new block twice.
+	index, err := db.loadIndex(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	existing, err := db.Get(ctx, benv.BlockRoot)
+	if err != nil {
+		return true, nil, fmt.Errorf("failed to get existing block %s: %v", benv.BlockRoot, err)
+	}
+	if existing != nil {
+		if existing.Signature != benv.Signature {
+			return true, nil, fmt.Errorf("block %s already exists, but its signature %s does not match new signature %s",
+				benv.BlockRoot, existing.Signature, benv.Signature)
+		}
+		return true, nil, nil
+	}
+	// write to a temporary file first, and then move it, to never leave a partially written block behind.
 	outPath := db.rootToPath(benv.BlockRoot)
-	f, err := os.OpenFile(outPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0755)
-	defer f.Close()
+	f, err := ioutil.TempFile(db.basePath, path.Base(outPath)+".*.tmp")
 	if err != nil {
-		if os.IsExist(err) {
-			return true, nil
+		return false, nil, err
+	}
+	tmpPath := f.Name()
+	if err := f.Chmod(0644); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return false, nil, err
+	}
+	if err := db.writeBlock(f, benv); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return false, nil, fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return false, nil, err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return false, nil, err
+	}
+	// the rename is only durable once the directory entry is synced
+	if err := syncDir(db.basePath); err != nil {
+		return false, nil, err
+	}
+	if conflict, ok := index.add(benv); ok {
+		slashing, err = proposerSlashing(ctx, db, conflict, benv)
+		if err != nil {
+			return false, nil, err
 		}
-		return false, err
 	}
+	return false, slashing, nil
+}
+
+// writeBlock writes the fork digest and the block, and flushes them to disk.
+func (db *FileDB) writeBlock(f *os.File, benv *common.BeaconBlockEnvelope) error {
 	// TODO: add db version byte
 	if _, err := f.Write(benv.ForkDigest[:]); err != nil {
-		return false, err
+		return err
 	}
 	if err := benv.SignedBlock.Serialize(db.spec, codec.NewEncodingWriter(f)); err != nil {
-		return false, fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+		return err
 	}
-	return false, nil
+	return f.Sync()
 }
 
-func (db *FileDB) Import(digest common.ForkDigest, r io.Reader) (exists bool, err error) {
+// syncDir flushes the entries of the directory to disk, e.g. to persist a rename.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func (db *FileDB) Import(digest common.ForkDigest, r io.Reader) (exists bool, slashing *phase0.ProposerSlashing, err error) {
 	buf := getPoolBlockBuf()
 	defer dbBlockPool.Put(buf)
 	if _, err := buf.ReadFrom(r); err != nil {
-		return false, err
+		return false, nil, err
 	}
 	benv, err := db.dec.DecodeBlock(digest, uint64(len(buf.Bytes())), buf)
 	if err != nil {
-		return false, fmt.Errorf("failed to decode block, nee valid block to get block root. Err: %v", err)
+		return false, nil, fmt.Errorf("failed to decode block, nee valid block to get block root. Err: %v", err)
 	}
 	return db.Store(context.Background(), benv)
 }
@@ -82,11 +207,14 @@ func (db *FileDB) Get(ctx context.Context, root common.Root) (envelope *common.B
 	if err != nil {
 		return nil, err
 	}
+	if info.Size() < 4 {
+		return nil, fmt.Errorf("block %s is corrupt, expected fork digest", root)
+	}
 	var digest common.ForkDigest
-	if _, err := f.Read(digest[:]); err != nil {
+	if _, err := io.ReadFull(f, digest[:]); err != nil {
 		return nil, err
 	}
-	return db.dec.DecodeBlock(digest, uint64(info.Size()), f)
+	return db.dec.DecodeBlock(digest, uint64(info.Size())-4, f)
 }
 
 func (db *FileDB) Size(root common.Root) (size uint64, exists bool) {
@@ -119,10 +247,15 @@ func (db *FileDB) Stream(root common.Root) (digest common.ForkDigest, r io.ReadC
 	if err != nil {
 		return common.ForkDigest{}, nil, 0, false, err
 	}
-	if _, err := f.Read(digest[:]); err != nil {
+	if info.Size() < 4 {
+		_ = f.Close()
+		return common.ForkDigest{}, nil, 0, false, fmt.Errorf("block %s is corrupt, expected fork digest", root)
+	}
+	if _, err := io.ReadFull(f, digest[:]); err != nil {
+		_ = f.Close()
 		return common.ForkDigest{}, nil, 0, false, err
 	}
-	return digest, f, uint64(info.Size()), true, nil
+	return digest, f, uint64(info.Size()) - 4, true, nil
 }
 
 func (db *FileDB) Remove(root common.Root) (exists bool, err error) {
@@ -131,6 +264,13 @@ func (db *FileDB) Remove(root common.Root) (exists bool, err error) {
 	if os.IsNotExist(err) {
 		return false, nil
 	}
+	if err == nil {
+		db.indexLock.Lock()
+		if db.index != nil {
+			db.index.remove(root)
+		}
+		db.indexLock.Unlock()
+	}
 	return true, err
 }
 
@@ -187,6 +327,38 @@ func (db *FileDB) List() (out []common.Root) {
 	return out
 }
 
+func (db *FileDB) BySlot(ctx context.Context, slot common.Slot) ([]common.Root, error) {
+	index, err := db.loadIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return index.bySlotRoots(slot), nil
+}
+
+func (db *FileDB) ByParent(ctx context.Context, parent common.Root) ([]common.Root, error) {
+	index, err := db.loadIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return index.byParentRoots(parent), nil
+}
+
+func (db *FileDB) ByProposer(ctx context.Context, proposer common.ValidatorIndex) ([]common.Root, error) {
+	index, err := db.loadIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return index.byProposerRoots(proposer), nil
+}
+
+func (db *FileDB) Range(ctx context.Context, start common.Slot, end common.Slot, fn func(slot common.Slot, root common.Root) bool) error {
+	index, err := db.loadIndex(ctx)
+	if err != nil {
+		return err
+	}
+	return iterRange(ctx, index.rangeRoots(start, end), fn)
+}
+
 func (db *FileDB) Path() string {
 	return db.basePath
 }
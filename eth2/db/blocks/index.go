@@ -0,0 +1,215 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"sort"
+	"sync"
+)
+
+// slotProposer identifies the proposal of a validator for a slot. There should be at most one block for each.
+type slotProposer struct {
+	Slot     common.Slot
+	Proposer common.ValidatorIndex
+}
+
+// blockMeta is the indexed data of a block.
+type blockMeta struct {
+	Slot     common.Slot
+	Proposer common.ValidatorIndex
+	Parent   common.Root
+}
+
+// blockIndex indexes the blocks of a DB by slot, parent and proposer, and detects double proposals.
+type blockIndex struct {
+	sync.Mutex
+	blocks     map[common.Root]blockMeta
+	proposals  map[slotProposer][]common.Root
+	bySlot     map[common.Slot][]common.Root
+	byParent   map[common.Root][]common.Root
+	byProposer map[common.ValidatorIndex][]common.Root
+	// The slots that have blocks, in ascending order, to iterate over ranges.
+	slots []common.Slot
+}
+
+func newBlockIndex() *blockIndex {
+	return &blockIndex{
+		blocks:     make(map[common.Root]blockMeta),
+		proposals:  make(map[slotProposer][]common.Root),
+		bySlot:     make(map[common.Slot][]common.Root),
+		byParent:   make(map[common.Root][]common.Root),
+		byProposer: make(map[common.ValidatorIndex][]common.Root),
+	}
+}
+
+// add indexes the block, and returns another block of the same proposer and slot, if any.
+func (idx *blockIndex) add(benv *common.BeaconBlockEnvelope) (conflict common.Root, ok bool) {
+	idx.Lock()
+	defer idx.Unlock()
+	if _, exists := idx.blocks[benv.BlockRoot]; exists {
+		return common.Root{}, false
+	}
+	root := benv.BlockRoot
+	idx.blocks[root] = blockMeta{Slot: benv.Slot, Proposer: benv.ProposerIndex, Parent: benv.ParentRoot}
+	key := slotProposer{Slot: benv.Slot, Proposer: benv.ProposerIndex}
+	roots := idx.proposals[key]
+	if len(roots) > 0 {
+		conflict, ok = roots[0], true
+	}
+	idx.proposals[key] = append(roots, root)
+	if len(idx.bySlot[benv.Slot]) == 0 {
+		i := sort.Search(len(idx.slots), func(i int) bool {
+			return idx.slots[i] >= benv.Slot
+		})
+		idx.slots = append(idx.slots, 0)
+		copy(idx.slots[i+1:], idx.slots[i:])
+		idx.slots[i] = benv.Slot
+	}
+	idx.bySlot[benv.Slot] = append(idx.bySlot[benv.Slot], root)
+	idx.byParent[benv.ParentRoot] = append(idx.byParent[benv.ParentRoot], root)
+	idx.byProposer[benv.ProposerIndex] = append(idx.byProposer[benv.ProposerIndex], root)
+	return conflict, ok
+}
+
+// withoutRoot returns the roots without the given root, without modifying the original roots.
+func withoutRoot(roots []common.Root, root common.Root) []common.Root {
+	for i, r := range roots {
+		if r == root {
+			return append(roots[:i:i], roots[i+1:]...)
+		}
+	}
+	return roots
+}
+
+// remove removes the block from the index. Removing a block that is not indexed is safe.
+func (idx *blockIndex) remove(root common.Root) {
+	idx.Lock()
+	defer idx.Unlock()
+	meta, ok := idx.blocks[root]
+	if !ok {
+		return
+	}
+	delete(idx.blocks, root)
+	key := slotProposer{Slot: meta.Slot, Proposer: meta.Proposer}
+	if roots := withoutRoot(idx.proposals[key], root); len(roots) == 0 {
+		delete(idx.proposals, key)
+	} else {
+		idx.proposals[key] = roots
+	}
+	if roots := withoutRoot(idx.bySlot[meta.Slot], root); len(roots) == 0 {
+		delete(idx.bySlot, meta.Slot)
+		i := sort.Search(len(idx.slots), func(i int) bool {
+			return idx.slots[i] >= meta.Slot
+		})
+		idx.slots = append(idx.slots[:i], idx.slots[i+1:]...)
+	} else {
+		idx.bySlot[meta.Slot] = roots
+	}
+	if roots := withoutRoot(idx.byParent[meta.Parent], root); len(roots) == 0 {
+		delete(idx.byParent, meta.Parent)
+	} else {
+		idx.byParent[meta.Parent] = roots
+	}
+	if roots := withoutRoot(idx.byProposer[meta.Proposer], root); len(roots) == 0 {
+		delete(idx.byProposer, meta.Proposer)
+	} else {
+		idx.byProposer[meta.Proposer] = roots
+	}
+}
+
+// sortRoots sorts the roots by slot, and then by root, for a deterministic order.
+func (idx *blockIndex) sortRoots(roots []common.Root) []common.Root {
+	out := append([]common.Root(nil), roots...)
+	sort.Slice(out, func(i, j int) bool {
+		a, b := idx.blocks[out[i]].Slot, idx.blocks[out[j]].Slot
+		if a == b {
+			return bytes.Compare(out[i][:], out[j][:]) < 0
+		}
+		return a < b
+	})
+	return out
+}
+
+func (idx *blockIndex) bySlotRoots(slot common.Slot) []common.Root {
+	idx.Lock()
+	defer idx.Unlock()
+	return idx.sortRoots(idx.bySlot[slot])
+}
+
+func (idx *blockIndex) byParentRoots(parent common.Root) []common.Root {
+	idx.Lock()
+	defer idx.Unlock()
+	return idx.sortRoots(idx.byParent[parent])
+}
+
+func (idx *blockIndex) byProposerRoots(proposer common.ValidatorIndex) []common.Root {
+	idx.Lock()
+	defer idx.Unlock()
+	return idx.sortRoots(idx.byProposer[proposer])
+}
+
+// rangeRoots lists the blocks in the slot range [start, end), ordered by slot, and then by root.
+func (idx *blockIndex) rangeRoots(start common.Slot, end common.Slot) (out []BlockSlotRoot) {
+	idx.Lock()
+	defer idx.Unlock()
+	i := sort.Search(len(idx.slots), func(i int) bool {
+		return idx.slots[i] >= start
+	})
+	for ; i < len(idx.slots) && idx.slots[i] < end; i++ {
+		slot := idx.slots[i]
+		for _, root := range idx.sortRoots(idx.bySlot[slot]) {
+			out = append(out, BlockSlotRoot{Slot: slot, Root: root})
+		}
+	}
+	return out
+}
+
+// iterRange calls fn for each of the blocks, until fn returns false or the context is done.
+// The index is not locked while calling fn, fn may use the DB.
+func iterRange(ctx context.Context, blocks []BlockSlotRoot, fn func(slot common.Slot, root common.Root) bool) error {
+	for _, b := range blocks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fn(b.Slot, b.Root) {
+			return nil
+		}
+	}
+	return nil
+}
+
+type signedHeaderBlock interface {
+	SignedHeader(spec *common.Spec) *common.SignedBeaconBlockHeader
+}
+
+func signedHeader(spec *common.Spec, benv *common.BeaconBlockEnvelope) (*common.SignedBeaconBlockHeader, error) {
+	b, ok := benv.SignedBlock.(signedHeaderBlock)
+	if !ok {
+		return nil, fmt.Errorf("cannot get header of block %s of type %T", benv.BlockRoot, benv.SignedBlock)
+	}
+	return b.SignedHeader(spec), nil
+}
+
+// proposerSlashing creates a slashing of the proposer of the new block, with the existing conflicting block.
+// Nil if the existing block is not in the DB anymore.
+func proposerSlashing(ctx context.Context, db DB, existingRoot common.Root, benv *common.BeaconBlockEnvelope) (*phase0.ProposerSlashing, error) {
+	existing, err := db.Get(ctx, existingRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block %s that conflicts with block %s: %v", existingRoot, benv.BlockRoot, err)
+	}
+	if existing == nil {
+		return nil, nil
+	}
+	header1, err := signedHeader(db.Spec(), existing)
+	if err != nil {
+		return nil, err
+	}
+	header2, err := signedHeader(db.Spec(), benv)
+	if err != nil {
+		return nil, err
+	}
+	return &phase0.ProposerSlashing{SignedHeader1: *header1, SignedHeader2: *header2}, nil
+}
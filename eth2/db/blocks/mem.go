@@ -14,10 +14,11 @@ import (
 )
 
 type MemDB struct {
-	// beacon.Root -> []byte (fork digest ++ serialized SignedBeaconBlock)
+	// beacon.Root -> *bytes.Buffer (fork digest ++ serialized SignedBeaconBlock)
 	data        sync.Map
 	removalLock sync.Mutex
 	stats       DBStats
+	index       *blockIndex
 	dec         *beacon.ForkDecoder
 	spec        *common.Spec
 }
@@ -25,44 +26,52 @@ type MemDB struct {
 var _ DB = (*MemDB)(nil)
 
 func NewMemDB(spec *common.Spec, dec *beacon.ForkDecoder) *MemDB {
-	return &MemDB{spec: spec, dec: dec}
+	return &MemDB{spec: spec, dec: dec, index: newBlockIndex()}
 }
 
-func (db *MemDB) Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (exists bool, err error) {
+func (db *MemDB) Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (exists bool, slashing *phase0.ProposerSlashing, err error) {
 	// Released when the block is removed from the DB
 	buf := getPoolBlockBuf()
 	if _, err := buf.Write(benv.ForkDigest[:]); err != nil {
-		return false, err
+		return false, nil, err
 	}
 	err = benv.SignedBlock.Serialize(db.spec, codec.NewEncodingWriter(buf))
 	if err != nil {
-		return false, fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+		return false, nil, fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
 	}
-	existing, loaded := db.data.LoadOrStore(benv.BlockRoot, buf.Bytes())
+	existing, loaded := db.data.LoadOrStore(benv.BlockRoot, buf)
 	if loaded {
-		existingBlock := existing.(*phase0.SignedBeaconBlock)
-		sigDifference := existingBlock.Signature != benv.Signature
 		dbBlockPool.Put(buf) // put it back, we didn't store it
-		if sigDifference {
-			return true, fmt.Errorf("block %s already exists, but its signature %x does not match new signature %s",
+		existingBlock, err := db.decode(existing.(*bytes.Buffer))
+		if err != nil {
+			return true, nil, fmt.Errorf("failed to decode existing block %s: %v", benv.BlockRoot, err)
+		}
+		if existingBlock.Signature != benv.Signature {
+			return true, nil, fmt.Errorf("block %s already exists, but its signature %x does not match new signature %s",
 				benv.BlockRoot, existingBlock.Signature, benv.Signature)
 		}
-	} else {
-		atomic.AddInt64(&db.stats.Count, 1)
-		db.stats.LastWrite = benv.BlockRoot
+		return true, nil, nil
+	}
+	atomic.AddInt64(&db.stats.Count, 1)
+	db.stats.LastWrite = benv.BlockRoot
+	if conflict, ok := db.index.add(benv); ok {
+		slashing, err = proposerSlashing(ctx, db, conflict, benv)
+		if err != nil {
+			return false, nil, err
+		}
 	}
-	return loaded, nil
+	return false, slashing, nil
 }
 
-func (db *MemDB) Import(digest common.ForkDigest, r io.Reader) (exists bool, err error) {
+func (db *MemDB) Import(digest common.ForkDigest, r io.Reader) (exists bool, slashing *phase0.ProposerSlashing, err error) {
 	buf := getPoolBlockBuf()
 	defer dbBlockPool.Put(buf)
 	if _, err := buf.ReadFrom(r); err != nil {
-		return false, err
+		return false, nil, err
 	}
 	benv, err := db.dec.DecodeBlock(digest, uint64(len(buf.Bytes())), buf)
 	if err != nil {
-		return false, fmt.Errorf("failed to decode block, nee valid block to get block root. Err: %v", err)
+		return false, nil, fmt.Errorf("failed to decode block, nee valid block to get block root. Err: %v", err)
 	}
 	return db.Store(context.Background(), benv)
 }
@@ -72,12 +81,18 @@ func (db *MemDB) Get(ctx context.Context, root common.Root) (envelope *common.Be
 	if !ok {
 		return nil, nil
 	}
-	buf := dat.(*bytes.Buffer)
-	var digest common.ForkDigest
-	if _, err := buf.Read(digest[:]); err != nil {
-		return nil, err
+	return db.decode(dat.(*bytes.Buffer))
+}
+
+// decode the stored block, without consuming the buffer.
+func (db *MemDB) decode(buf *bytes.Buffer) (*common.BeaconBlockEnvelope, error) {
+	data := buf.Bytes()
+	if len(data) < 4 {
+		return nil, fmt.Errorf("block is corrupt, expected fork digest")
 	}
-	return db.dec.DecodeBlock(digest, uint64(len(buf.Bytes())), buf)
+	var digest common.ForkDigest
+	copy(digest[:], data[:4])
+	return db.dec.DecodeBlock(digest, uint64(len(data)-4), bytes.NewReader(data[4:]))
 }
 
 func (db *MemDB) Size(root common.Root) (size uint64, exists bool) {
@@ -107,11 +122,12 @@ func (db *MemDB) Stream(root common.Root) (digest common.ForkDigest, r io.ReadCl
 	if !ok {
 		return common.ForkDigest{}, nil, 0, false, nil
 	}
-	buf := dat.(*bytes.Buffer)
-	if _, err := buf.Read(digest[:]); err != nil {
-		return common.ForkDigest{}, nil, 0, false, err
+	data := dat.(*bytes.Buffer).Bytes()
+	if len(data) < 4 {
+		return common.ForkDigest{}, nil, 0, false, fmt.Errorf("block %s is corrupt, expected fork digest", root)
 	}
-	return digest, noClose{buf}, uint64(buf.Len()), true, nil
+	copy(digest[:], data[:4])
+	return digest, noClose{bytes.NewReader(data[4:])}, uint64(len(data) - 4), true, nil
 }
 
 func (db *MemDB) Remove(root common.Root) (exists bool, err error) {
@@ -123,6 +139,7 @@ func (db *MemDB) Remove(root common.Root) (exists bool, err error) {
 		atomic.AddInt64(&db.stats.Count, -1)
 	}
 	db.data.Delete(root)
+	db.index.remove(root)
 	return ok, nil
 }
 
@@ -141,6 +158,22 @@ func (db *MemDB) List() (out []common.Root) {
 	return out
 }
 
+func (db *MemDB) BySlot(ctx context.Context, slot common.Slot) ([]common.Root, error) {
+	return db.index.bySlotRoots(slot), nil
+}
+
+func (db *MemDB) ByParent(ctx context.Context, parent common.Root) ([]common.Root, error) {
+	return db.index.byParentRoots(parent), nil
+}
+
+func (db *MemDB) ByProposer(ctx context.Context, proposer common.ValidatorIndex) ([]common.Root, error) {
+	return db.index.byProposerRoots(proposer), nil
+}
+
+func (db *MemDB) Range(ctx context.Context, start common.Slot, end common.Slot, fn func(slot common.Slot, root common.Root) bool) error {
+	return iterRange(ctx, db.index.rangeRoots(start, end), fn)
+}
+
 func (db *MemDB) Path() string {
 	return ""
 }
@@ -0,0 +1,740 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/ztyp/codec"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxSegmentSize is the size after which the SegmentDB starts a new segment file.
+const DefaultMaxSegmentSize int64 = 256 << 20
+
+const (
+	segmentVersion uint32 = 1
+	indexVersion   uint32 = 1
+
+	segmentRecordBlock   uint8 = 1
+	segmentRecordRemoval uint8 = 2
+
+	segmentFilePrefix = "segment-"
+	segmentFileSuffix = ".dat"
+	indexFileName     = "index.dat"
+)
+
+var (
+	segmentMagic = [4]byte{'Z', 'B', 'S', 'G'}
+	indexMagic   = [4]byte{'Z', 'B', 'I', 'X'}
+	crcTable     = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// The header at the start of every segment, and of the index file.
+type fileHeader struct {
+	Magic   [4]byte
+	Version uint32
+}
+
+var fileHeaderSize = int64(binary.Size(fileHeader{}))
+
+// The header of every record in a segment, followed by the payload.
+type recordHeader struct {
+	// Length of the payload
+	Length uint32
+	// CRC32 (Castagnoli) checksum of the payload
+	Checksum uint32
+}
+
+var recordHeaderSize = int64(binary.Size(recordHeader{}))
+
+// The start of the payload of every record. A block record is followed by the snappy-compressed block.
+// A removal record only has the Kind and Root set.
+type segmentBlockMeta struct {
+	Kind       uint8
+	Root       common.Root
+	Slot       common.Slot
+	Proposer   common.ValidatorIndex
+	Parent     common.Root
+	ForkDigest common.ForkDigest
+	Signature  common.BLSSignature
+	// Size of the uncompressed serialized block
+	Size uint64
+}
+
+var segmentBlockMetaSize = binary.Size(segmentBlockMeta{})
+
+// The location of a record in the segments.
+type segmentLocation struct {
+	Segment uint32
+	// Offset of the record header
+	Offset int64
+	// Length of the payload
+	Length uint32
+}
+
+type segmentEntry struct {
+	Meta segmentBlockMeta
+	Loc  segmentLocation
+}
+
+// The index file covers the records of the segments up to the checkpoint, the remaining records are replayed.
+type indexCheckpoint struct {
+	Segment uint32
+	Offset  int64
+	Count   uint64
+}
+
+// SegmentDB is a block database that appends snappy-compressed blocks to segment files.
+// Removals are appended as well, and only free up space with Compact.
+//
+// The index of the blocks is written to disk when closing, and after compacting. When opening,
+// the records after the index are replayed, and a torn record at the end of the last segment is truncated.
+type SegmentDB struct {
+	sync.RWMutex
+	spec     *common.Spec
+	dec      *beacon.ForkDecoder
+	basePath string
+
+	// MaxSegmentSize is the size after which a new segment file is started.
+	MaxSegmentSize int64
+
+	segments   map[uint32]*os.File
+	active     uint32
+	activeSize int64
+
+	entries map[common.Root]segmentEntry
+	index   *blockIndex
+	stats   DBStats
+}
+
+var _ DB = (*SegmentDB)(nil)
+
+// OpenSegmentDB opens the segments in the given directory, or starts a new database if there are none.
+func OpenSegmentDB(spec *common.Spec, dec *beacon.ForkDecoder, basePath string) (*SegmentDB, error) {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, err
+	}
+	db := &SegmentDB{
+		spec:           spec,
+		dec:            dec,
+		basePath:       basePath,
+		MaxSegmentSize: DefaultMaxSegmentSize,
+		segments:       make(map[uint32]*os.File),
+	}
+	ids, err := db.segmentIDs()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		db.resetEntries()
+		if err := db.createSegment(1); err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	for _, id := range ids {
+		if err := db.openSegment(id, id == ids[len(ids)-1]); err != nil {
+			db.closeSegments()
+			return nil, err
+		}
+	}
+	// Without a valid index, all the segments are replayed.
+	checkpoint, err := db.loadIndex()
+	if err != nil {
+		db.resetEntries()
+		checkpoint = indexCheckpoint{Segment: ids[0], Offset: fileHeaderSize}
+	}
+	for _, id := range ids {
+		if id < checkpoint.Segment {
+			continue
+		}
+		from := fileHeaderSize
+		if id == checkpoint.Segment {
+			from = checkpoint.Offset
+		}
+		if err := db.replaySegment(id, from, id == ids[len(ids)-1]); err != nil {
+			db.closeSegments()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (db *SegmentDB) segmentPath(id uint32) string {
+	return path.Join(db.basePath, fmt.Sprintf("%s%06d%s", segmentFilePrefix, id, segmentFileSuffix))
+}
+
+// segmentIDs lists the IDs of the segment files, in ascending order.
+func (db *SegmentDB) segmentIDs() ([]uint32, error) {
+	files, err := ioutil.ReadDir(db.basePath)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, segmentFilePrefix) || !strings.HasSuffix(name, segmentFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(name[len(segmentFilePrefix):len(name)-len(segmentFileSuffix)], 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+func (db *SegmentDB) resetEntries() {
+	db.entries = make(map[common.Root]segmentEntry)
+	db.index = newBlockIndex()
+	db.stats = DBStats{}
+}
+
+// createSegment creates a new segment, and makes it the active segment to append to.
+func (db *SegmentDB) createSegment(id uint32) error {
+	f, err := os.OpenFile(db.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(f, binary.LittleEndian, &fileHeader{Magic: segmentMagic, Version: segmentVersion}); err != nil {
+		_ = f.Close()
+		return err
+	}
+	db.segments[id] = f
+	db.active = id
+	db.activeSize = fileHeaderSize
+	return nil
+}
+
+// openSegment opens an existing segment, and checks the version. The last segment becomes the active segment.
+func (db *SegmentDB) openSegment(id uint32, last bool) error {
+	f, err := os.OpenFile(db.segmentPath(id), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	var header fileHeader
+	if info.Size() < fileHeaderSize {
+		if !last {
+			_ = f.Close()
+			return fmt.Errorf("segment %d is missing its header", id)
+		}
+		// a torn header of a new segment, write it again.
+		header = fileHeader{Magic: segmentMagic, Version: segmentVersion}
+		if err := f.Truncate(0); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if _, err := f.WriteAt(encodeFixed(&header), 0); err != nil {
+			_ = f.Close()
+			return err
+		}
+	} else if err := binary.Read(io.NewSectionReader(f, 0, fileHeaderSize), binary.LittleEndian, &header); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if header.Magic != segmentMagic {
+		_ = f.Close()
+		return fmt.Errorf("segment %d is not a block segment", id)
+	}
+	if header.Version != segmentVersion {
+		_ = f.Close()
+		return fmt.Errorf("segment %d has unsupported version %d, expected %d", id, header.Version, segmentVersion)
+	}
+	db.segments[id] = f
+	if last {
+		db.active = id
+		db.activeSize = info.Size()
+		if db.activeSize < fileHeaderSize {
+			db.activeSize = fileHeaderSize
+		}
+	}
+	return nil
+}
+
+func (db *SegmentDB) closeSegments() {
+	for _, f := range db.segments {
+		_ = f.Close()
+	}
+}
+
+// encodeFixed encodes a fixed-size value in little-endian.
+func encodeFixed(v interface{}) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, v)
+	return buf.Bytes()
+}
+
+var errTornRecord = errors.New("torn record")
+
+// readRecord reads the payload of the record at the given offset, and verifies the checksum.
+func readRecord(f *os.File, offset int64, size int64) (payload []byte, err error) {
+	if offset+recordHeaderSize > size {
+		return nil, errTornRecord
+	}
+	var header recordHeader
+	if err := binary.Read(io.NewSectionReader(f, offset, recordHeaderSize), binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if offset+recordHeaderSize+int64(header.Length) > size || int(header.Length) < segmentBlockMetaSize {
+		return nil, errTornRecord
+	}
+	payload = make([]byte, header.Length)
+	if _, err := f.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != header.Checksum {
+		return nil, errTornRecord
+	}
+	return payload, nil
+}
+
+func decodeMeta(payload []byte) (meta segmentBlockMeta, err error) {
+	err = binary.Read(bytes.NewReader(payload[:segmentBlockMetaSize]), binary.LittleEndian, &meta)
+	return
+}
+
+// replaySegment applies the records of the segment, starting at the given offset.
+// A torn record at the end of the last segment is truncated, in other segments it is an error.
+func (db *SegmentDB) replaySegment(id uint32, from int64, last bool) error {
+	f := db.segments[id]
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	for offset := from; offset < size; {
+		payload, err := readRecord(f, offset, size)
+		if err == errTornRecord {
+			if !last {
+				return fmt.Errorf("segment %d has a corrupt record at offset %d", id, offset)
+			}
+			if err := f.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate torn record of segment %d at offset %d: %v", id, offset, err)
+			}
+			db.activeSize = offset
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		meta, err := decodeMeta(payload)
+		if err != nil {
+			return err
+		}
+		switch meta.Kind {
+		case segmentRecordBlock:
+			db.addEntry(segmentEntry{Meta: meta, Loc: segmentLocation{Segment: id, Offset: offset, Length: uint32(len(payload))}})
+		case segmentRecordRemoval:
+			db.removeEntry(meta.Root)
+		default:
+			return fmt.Errorf("segment %d has a record of unknown kind %d at offset %d", id, meta.Kind, offset)
+		}
+		offset += recordHeaderSize + int64(len(payload))
+	}
+	return nil
+}
+
+func (db *SegmentDB) addEntry(entry segmentEntry) {
+	root := entry.Meta.Root
+	if _, ok := db.entries[root]; !ok {
+		db.stats.Count++
+	}
+	db.entries[root] = entry
+	db.stats.LastWrite = root
+	db.index.add(&common.BeaconBlockEnvelope{
+		Slot:          entry.Meta.Slot,
+		ProposerIndex: entry.Meta.Proposer,
+		ParentRoot:    entry.Meta.Parent,
+		BlockRoot:     root,
+	})
+}
+
+func (db *SegmentDB) removeEntry(root common.Root) {
+	if _, ok := db.entries[root]; !ok {
+		return
+	}
+	delete(db.entries, root)
+	db.stats.Count--
+	db.index.remove(root)
+}
+
+// appendRecord appends the payload to the active segment, and starts a new segment if the active one is full.
+func (db *SegmentDB) appendRecord(payload []byte) (segmentLocation, error) {
+	if db.activeSize >= db.MaxSegmentSize && db.activeSize > fileHeaderSize {
+		// the full segment will not change anymore, make sure it is persisted.
+		if err := db.segments[db.active].Sync(); err != nil {
+			return segmentLocation{}, err
+		}
+		if err := db.createSegment(db.active + 1); err != nil {
+			return segmentLocation{}, err
+		}
+	}
+	record := make([]byte, 0, recordHeaderSize+int64(len(payload)))
+	record = append(record, encodeFixed(&recordHeader{
+		Length:   uint32(len(payload)),
+		Checksum: crc32.Checksum(payload, crcTable),
+	})...)
+	record = append(record, payload...)
+	loc := segmentLocation{Segment: db.active, Offset: db.activeSize, Length: uint32(len(payload))}
+	if _, err := db.segments[db.active].WriteAt(record, db.activeSize); err != nil {
+		return segmentLocation{}, err
+	}
+	db.activeSize += int64(len(record))
+	return loc, nil
+}
+
+// readEntry reads and verifies the record of the entry. The DB must be locked.
+func (db *SegmentDB) readEntry(entry segmentEntry) ([]byte, error) {
+	f, ok := db.segments[entry.Loc.Segment]
+	if !ok {
+		return nil, fmt.Errorf("block %s is in missing segment %d", entry.Meta.Root, entry.Loc.Segment)
+	}
+	end := entry.Loc.Offset + recordHeaderSize + int64(entry.Loc.Length)
+	payload, err := readRecord(f, entry.Loc.Offset, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block %s: %v", entry.Meta.Root, err)
+	}
+	return payload, nil
+}
+
+func (db *SegmentDB) Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (exists bool, slashing *phase0.ProposerSlashing, err error) {
+	exists, conflict, ok, err := db.store(benv)
+	if err != nil || !ok {
+		return exists, nil, err
+	}
+	slashing, err = proposerSlashing(ctx, db, conflict, benv)
+	if err != nil {
+		return false, nil, err
+	}
+	return false, slashing, nil
+}
+
+// store appends the block, and returns a conflicting block of the same proposer and slot, if any.
+func (db *SegmentDB) store(benv *common.BeaconBlockEnvelope) (exists bool, conflict common.Root, ok bool, err error) {
+	buf := getPoolBlockBuf()
+	defer dbBlockPool.Put(buf)
+	if err := benv.SignedBlock.Serialize(db.spec, codec.NewEncodingWriter(buf)); err != nil {
+		return false, common.Root{}, false, fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+	}
+	meta := segmentBlockMeta{
+		Kind:       segmentRecordBlock,
+		Root:       benv.BlockRoot,
+		Slot:       benv.Slot,
+		Proposer:   benv.ProposerIndex,
+		Parent:     benv.ParentRoot,
+		ForkDigest: benv.ForkDigest,
+		Signature:  benv.Signature,
+		Size:       uint64(buf.Len()),
+	}
+	payload := append(encodeFixed(&meta), snappy.Encode(nil, buf.Bytes())...)
+
+	db.Lock()
+	defer db.Unlock()
+	if existing, ok := db.entries[benv.BlockRoot]; ok {
+		if existing.Meta.Signature != benv.Signature {
+			return true, common.Root{}, false, fmt.Errorf("block %s already exists, but its signature %s does not match new signature %s",
+				benv.BlockRoot, existing.Meta.Signature, benv.Signature)
+		}
+		return true, common.Root{}, false, nil
+	}
+	loc, err := db.appendRecord(payload)
+	if err != nil {
+		return false, common.Root{}, false, fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+	}
+	conflict, ok = db.index.add(benv)
+	db.entries[benv.BlockRoot] = segmentEntry{Meta: meta, Loc: loc}
+	db.stats.Count++
+	db.stats.LastWrite = benv.BlockRoot
+	return false, conflict, ok, nil
+}
+
+func (db *SegmentDB) Import(digest common.ForkDigest, r io.Reader) (exists bool, slashing *phase0.ProposerSlashing, err error) {
+	buf := getPoolBlockBuf()
+	defer dbBlockPool.Put(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return false, nil, err
+	}
+	benv, err := db.dec.DecodeBlock(digest, uint64(len(buf.Bytes())), buf)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to decode block, nee valid block to get block root. Err: %v", err)
+	}
+	return db.Store(context.Background(), benv)
+}
+
+// load reads and decompresses the serialized block.
+func (db *SegmentDB) load(root common.Root) (digest common.ForkDigest, data []byte, exists bool, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	entry, ok := db.entries[root]
+	if !ok {
+		return common.ForkDigest{}, nil, false, nil
+	}
+	payload, err := db.readEntry(entry)
+	if err != nil {
+		return common.ForkDigest{}, nil, true, err
+	}
+	data, err = snappy.Decode(nil, payload[segmentBlockMetaSize:])
+	if err != nil {
+		return common.ForkDigest{}, nil, true, fmt.Errorf("failed to decompress block %s: %v", root, err)
+	}
+	if uint64(len(data)) != entry.Meta.Size {
+		return common.ForkDigest{}, nil, true, fmt.Errorf("block %s has size %d, expected %d", root, len(data), entry.Meta.Size)
+	}
+	return entry.Meta.ForkDigest, data, true, nil
+}
+
+func (db *SegmentDB) Get(ctx context.Context, root common.Root) (envelope *common.BeaconBlockEnvelope, err error) {
+	digest, data, exists, err := db.load(root)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return db.dec.DecodeBlock(digest, uint64(len(data)), bytes.NewReader(data))
+}
+
+func (db *SegmentDB) Size(root common.Root) (size uint64, exists bool) {
+	db.RLock()
+	defer db.RUnlock()
+	entry, ok := db.entries[root]
+	if !ok {
+		return 0, false
+	}
+	return entry.Meta.Size, true
+}
+
+func (db *SegmentDB) Stream(root common.Root) (digest common.ForkDigest, r io.ReadCloser, size uint64, exists bool, err error) {
+	digest, data, exists, err := db.load(root)
+	if err != nil || !exists {
+		return common.ForkDigest{}, nil, 0, exists, err
+	}
+	return digest, noClose{bytes.NewReader(data)}, uint64(len(data)), true, nil
+}
+
+// Remove appends a removal record. The space of the block is freed up with Compact.
+func (db *SegmentDB) Remove(root common.Root) (exists bool, err error) {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.entries[root]; !ok {
+		return false, nil
+	}
+	payload := encodeFixed(&segmentBlockMeta{Kind: segmentRecordRemoval, Root: root})
+	if _, err := db.appendRecord(payload); err != nil {
+		return true, fmt.Errorf("failed to remove block %s: %v", root, err)
+	}
+	db.removeEntry(root)
+	return true, nil
+}
+
+func (db *SegmentDB) Stats() DBStats {
+	db.RLock()
+	defer db.RUnlock()
+	return db.stats
+}
+
+func (db *SegmentDB) List() []common.Root {
+	db.RLock()
+	defer db.RUnlock()
+	out := make([]common.Root, 0, len(db.entries))
+	for root := range db.entries {
+		out = append(out, root)
+	}
+	return out
+}
+
+func (db *SegmentDB) BySlot(ctx context.Context, slot common.Slot) ([]common.Root, error) {
+	return db.index.bySlotRoots(slot), nil
+}
+
+func (db *SegmentDB) ByParent(ctx context.Context, parent common.Root) ([]common.Root, error) {
+	return db.index.byParentRoots(parent), nil
+}
+
+func (db *SegmentDB) ByProposer(ctx context.Context, proposer common.ValidatorIndex) ([]common.Root, error) {
+	return db.index.byProposerRoots(proposer), nil
+}
+
+func (db *SegmentDB) Range(ctx context.Context, start common.Slot, end common.Slot, fn func(slot common.Slot, root common.Root) bool) error {
+	return iterRange(ctx, db.index.rangeRoots(start, end), fn)
+}
+
+func (db *SegmentDB) Path() string {
+	return db.basePath
+}
+
+func (db *SegmentDB) Spec() *common.Spec {
+	return db.spec
+}
+
+// Compact rewrites the blocks into new segments, and deletes the old segments, to drop the removed blocks.
+// If compaction is interrupted, the old and new segments are both replayed when opening the DB again.
+func (db *SegmentDB) Compact(ctx context.Context) error {
+	db.Lock()
+	defer db.Unlock()
+	entries := make([]segmentEntry, 0, len(db.entries))
+	for _, entry := range db.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Loc.Segment == entries[j].Loc.Segment {
+			return entries[i].Loc.Offset < entries[j].Loc.Offset
+		}
+		return entries[i].Loc.Segment < entries[j].Loc.Segment
+	})
+	if err := db.segments[db.active].Sync(); err != nil {
+		return err
+	}
+	oldSegments := make([]uint32, 0, len(db.segments))
+	for id := range db.segments {
+		oldSegments = append(oldSegments, id)
+	}
+	if err := db.createSegment(db.active + 1); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		payload, err := db.readEntry(entry)
+		if err != nil {
+			return err
+		}
+		loc, err := db.appendRecord(payload)
+		if err != nil {
+			return err
+		}
+		entry.Loc = loc
+		db.entries[entry.Meta.Root] = entry
+	}
+	// the index refers to the new segments only, the old segments are not needed anymore.
+	if err := db.writeIndex(); err != nil {
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+	for _, id := range oldSegments {
+		_ = db.segments[id].Close()
+		delete(db.segments, id)
+		if err := os.Remove(db.segmentPath(id)); err != nil {
+			return fmt.Errorf("failed to delete compacted segment %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// writeIndex syncs the active segment, and then atomically replaces the index file. The DB must be locked.
+func (db *SegmentDB) writeIndex() error {
+	if err := db.segments[db.active].Sync(); err != nil {
+		return err
+	}
+	tmpPath := path.Join(db.basePath, indexFileName+".tmp")
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	crc := crc32.New(crcTable)
+	w := io.MultiWriter(f, crc)
+	if err := binary.Write(w, binary.LittleEndian, &fileHeader{Magic: indexMagic, Version: indexVersion}); err != nil {
+		return err
+	}
+	checkpoint := indexCheckpoint{Segment: db.active, Offset: db.activeSize, Count: uint64(len(db.entries))}
+	if err := binary.Write(w, binary.LittleEndian, &checkpoint); err != nil {
+		return err
+	}
+	for _, entry := range db.entries {
+		if err := binary.Write(w, binary.LittleEndian, &entry); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(f, binary.LittleEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(db.basePath, indexFileName))
+}
+
+// loadIndex loads the index file, and returns the checkpoint to replay the remaining records from.
+// The index is checked against the segments. If the index is missing or invalid, an error is returned.
+func (db *SegmentDB) loadIndex() (indexCheckpoint, error) {
+	data, err := ioutil.ReadFile(path.Join(db.basePath, indexFileName))
+	if err != nil {
+		return indexCheckpoint{}, err
+	}
+	if len(data) < 4 {
+		return indexCheckpoint{}, errors.New("index is too short")
+	}
+	content, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(content, crcTable) != sum {
+		return indexCheckpoint{}, errors.New("index checksum mismatch")
+	}
+	r := bytes.NewReader(content)
+	var header fileHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return indexCheckpoint{}, err
+	}
+	if header.Magic != indexMagic || header.Version != indexVersion {
+		return indexCheckpoint{}, fmt.Errorf("unsupported index version %d", header.Version)
+	}
+	var checkpoint indexCheckpoint
+	if err := binary.Read(r, binary.LittleEndian, &checkpoint); err != nil {
+		return indexCheckpoint{}, err
+	}
+	if f, ok := db.segments[checkpoint.Segment]; !ok {
+		return indexCheckpoint{}, fmt.Errorf("index refers to missing segment %d", checkpoint.Segment)
+	} else if info, err := f.Stat(); err != nil {
+		return indexCheckpoint{}, err
+	} else if info.Size() < checkpoint.Offset {
+		return indexCheckpoint{}, fmt.Errorf("index refers to offset %d past the end of segment %d", checkpoint.Offset, checkpoint.Segment)
+	}
+	entrySize := uint64(binary.Size(segmentEntry{}))
+	if checkpoint.Count*entrySize != uint64(r.Len()) {
+		return indexCheckpoint{}, fmt.Errorf("index has %d bytes of entries, expected %d entries", r.Len(), checkpoint.Count)
+	}
+	db.resetEntries()
+	for i := uint64(0); i < checkpoint.Count; i++ {
+		var entry segmentEntry
+		if err := binary.Read(r, binary.LittleEndian, &entry); err != nil {
+			return indexCheckpoint{}, err
+		}
+		if _, ok := db.segments[entry.Loc.Segment]; !ok {
+			return indexCheckpoint{}, fmt.Errorf("index refers to missing segment %d", entry.Loc.Segment)
+		}
+		db.addEntry(entry)
+	}
+	return checkpoint, nil
+}
+
+// Close writes the index, and closes the segments.
+func (db *SegmentDB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	err := db.writeIndex()
+	db.closeSegments()
+	db.segments = make(map[uint32]*os.File)
+	return err
+}
@@ -0,0 +1,179 @@
+package blocks
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSegmentDB(t *testing.T) {
+	spec := configs.Minimal
+	genValRoot := common.Root{0x42}
+	dec := beacon.NewForkDecoder(spec, genValRoot)
+	digest := common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genValRoot)
+	var blocks []*common.BeaconBlockEnvelope
+	for i := 0; i < 20; i++ {
+		b := &phase0.SignedBeaconBlock{
+			Message: phase0.BeaconBlock{
+				Slot:          common.Slot(i),
+				ProposerIndex: common.ValidatorIndex(i % 4),
+				Body:          phase0.BeaconBlockBody{Graffiti: common.Root{byte(i)}},
+			},
+			Signature: common.BLSSignature{byte(i)},
+		}
+		blocks = append(blocks, b.Envelope(spec, digest))
+	}
+
+	dir, err := ioutil.TempDir("", "segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	open := func(t *testing.T) *SegmentDB {
+		db, err := OpenSegmentDB(spec, dec, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// small segments, to cover multiple segment files
+		db.MaxSegmentSize = 1000
+		return db
+	}
+	// check that exactly the blocks with the given indices are in the DB
+	check := func(t *testing.T, db *SegmentDB, expected ...int) {
+		if count := db.Stats().Count; count != int64(len(expected)) {
+			t.Fatalf("expected %d blocks, got %d", len(expected), count)
+		}
+		for _, i := range expected {
+			got, err := db.Get(ctx, blocks[i].BlockRoot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || got.BlockRoot != blocks[i].BlockRoot || got.Signature != blocks[i].Signature {
+				t.Fatalf("unexpected block %d", i)
+			}
+			if size, ok := db.Size(blocks[i].BlockRoot); !ok || size != blocks[i].SignedBlock.ByteLength(spec) {
+				t.Fatalf("unexpected size of block %d: %d", i, size)
+			}
+			if roots, err := db.BySlot(ctx, blocks[i].Slot); err != nil || len(roots) != 1 {
+				t.Fatalf("expected block %d in the slot index", i)
+			}
+		}
+	}
+	segmentCount := func(t *testing.T) int {
+		ids, err := (&SegmentDB{basePath: dir}).segmentIDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(ids)
+	}
+
+	db := open(t)
+	for _, benv := range blocks[:10] {
+		if _, _, err := db.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{1, 3} {
+		if exists, err := db.Remove(blocks[i].BlockRoot); err != nil || !exists {
+			t.Fatalf("failed to remove block %d: %v", i, err)
+		}
+	}
+	live := []int{0, 2, 4, 5, 6, 7, 8, 9}
+	check(t, db, live...)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if segmentCount(t) < 2 {
+		t.Fatal("expected multiple segments")
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		db := open(t)
+		check(t, db, live...)
+		// the blocks after the index are replayed
+		if _, _, err := db.Store(ctx, blocks[10]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Remove(blocks[0].BlockRoot); err != nil {
+			t.Fatal(err)
+		}
+		db.closeSegments()
+		live = append(live[1:], 10)
+	})
+
+	t.Run("rebuild index", func(t *testing.T) {
+		db := open(t)
+		check(t, db, live...)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(path.Join(dir, indexFileName)); err != nil {
+			t.Fatal(err)
+		}
+		db = open(t)
+		check(t, db, live...)
+		db.closeSegments()
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		db := open(t)
+		if _, _, err := db.Store(ctx, blocks[11]); err != nil {
+			t.Fatal(err)
+		}
+		// a write that was interrupted halfway
+		f := db.segments[db.active]
+		if err := f.Truncate(db.activeSize - 10); err != nil {
+			t.Fatal(err)
+		}
+		db.closeSegments()
+
+		db = open(t)
+		check(t, db, live...)
+		if _, _, err := db.Store(ctx, blocks[11]); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		live = append(live, 11)
+		db = open(t)
+		check(t, db, live...)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		db := open(t)
+		for _, i := range []int{2, 4, 5, 6, 7} {
+			if _, err := db.Remove(blocks[i].BlockRoot); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before := segmentCount(t)
+		if err := db.Compact(ctx); err != nil {
+			t.Fatal(err)
+		}
+		live = []int{8, 9, 10, 11}
+		check(t, db, live...)
+		if after := segmentCount(t); after >= before {
+			t.Fatalf("expected fewer segments after compaction, got %d, before %d", after, before)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = open(t)
+		check(t, db, live...)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
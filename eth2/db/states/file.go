@@ -0,0 +1,777 @@
+package states
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/ztyp/tree"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	nodeKindLeaf byte = 0
+	nodeKindPair byte = 1
+)
+
+// nodeKey identifies a tree node by kind and merkle root.
+// A leaf value may equal the root of a pair (e.g. a state root in the state roots vector), the kind tells them apart.
+type nodeKey [1 + 32]byte
+
+func toNodeKey(node tree.Node, hFn tree.HashFn) (key nodeKey, err error) {
+	switch n := node.(type) {
+	case *tree.Root:
+		key[0] = nodeKindLeaf
+		copy(key[1:], n[:])
+	case *tree.PairNode:
+		key[0] = nodeKindPair
+		root := n.MerkleRoot(hFn)
+		copy(key[1:], root[:])
+	default:
+		return nodeKey{}, fmt.Errorf("unsupported tree node type: %T", node)
+	}
+	return key, nil
+}
+
+const (
+	// leaf record: key
+	leafRecordSize = len(nodeKey{})
+	// pair record: key, left key, right key
+	pairRecordSize = 3 * len(nodeKey{})
+)
+
+const (
+	stateOpRemove byte = 0
+	stateOpStore  byte = 1
+)
+
+// state record: op, state root, fork digest
+const stateRecordSize = 1 + 32 + 4
+
+// current record: generation of the log files, size of the nodes log after the last compaction
+const currentRecordSize = 8 + 8
+
+// FileDB is a disk-backed states DB.
+//
+// States are stored as merkle trees: every tree node is written once, keyed by its merkle root,
+// and shared between all states that contain it. Consecutive states share most of their subtrees
+// (validators, balances, roots vectors), so only the changed nodes are written for every new state.
+//
+// The DB consists of these files in the base path:
+//   - nodes-<gen>.log: append-only log of leaf and pair node records. Children are always written before their parents.
+//   - nodes-<gen>.idx: on-disk hash index of the node records, see nodeIndex.
+//   - states-<gen>.log: append-only log of store and remove records of states,
+//     with the fork digest to load the state with.
+//   - CURRENT: the generation of the files in use, replaced atomically on every compaction.
+//
+// The node records of a state are synced to disk before the state record is written,
+// a torn record at the end of either log is dropped when the DB is opened.
+//
+// Removing a state does not free its nodes right away, other states may still use them.
+// Compact rewrites the logs with only the nodes of the remaining states, as a new generation.
+// Remove compacts the DB when the nodes log has doubled in size since the previous compaction.
+type FileDB struct {
+	sync.RWMutex
+	spec     *common.Spec
+	dec      *beacon.ForkDecoder
+	basePath string
+
+	// generation of the files in use, increased by every compaction
+	gen uint64
+	// size of the nodes log after the previous compaction
+	compactedEnd int64
+
+	nodes     *os.File
+	nodesW    *bufio.Writer
+	nodesEnd  int64
+	nodeIndex *nodeIndex
+	// node key -> offset, for the nodes of the Store in progress, which are not in the node index yet
+	pending map[nodeKey]int64
+
+	statesF   *os.File
+	statesEnd int64
+	// state root -> fork digest
+	stateIndex map[common.Root]common.ForkDigest
+}
+
+var _ DB = (*FileDB)(nil)
+
+// NewFileDB opens the DB in the given directory, or creates a new DB if it does not exist yet.
+// The fork decoder is used to load each state as the state type of its fork.
+func NewFileDB(spec *common.Spec, dec *beacon.ForkDecoder, basePath string) (*FileDB, error) {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, err
+	}
+	db := &FileDB{
+		spec:       spec,
+		dec:        dec,
+		basePath:   basePath,
+		stateIndex: make(map[common.Root]common.ForkDigest),
+	}
+	if err := db.loadCurrent(); err != nil {
+		return nil, fmt.Errorf("failed to load current generation: %v", err)
+	}
+	// files of other generations are left behind by an interrupted compaction
+	if err := db.removeStaleFiles(); err != nil {
+		return nil, err
+	}
+	nodes, err := os.OpenFile(db.nodesPath(db.gen), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db.nodes = nodes
+	idx, err := openNodeIndex(db.indexPath(db.gen))
+	if err != nil {
+		_ = nodes.Close()
+		return nil, err
+	}
+	db.nodeIndex = idx
+	statesF, err := os.OpenFile(db.statesPath(db.gen), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		_ = idx.close()
+		_ = nodes.Close()
+		return nil, err
+	}
+	db.statesF = statesF
+	if err := db.loadNodeIndex(); err != nil {
+		_ = db.close()
+		return nil, fmt.Errorf("failed to load node index: %v", err)
+	}
+	if err := db.loadStateIndex(); err != nil {
+		_ = db.close()
+		return nil, fmt.Errorf("failed to load state index: %v", err)
+	}
+	db.nodesW = bufio.NewWriter(nodes)
+	return db, nil
+}
+
+func (db *FileDB) nodesPath(gen uint64) string {
+	return path.Join(db.basePath, fmt.Sprintf("nodes-%d.log", gen))
+}
+
+func (db *FileDB) indexPath(gen uint64) string {
+	return path.Join(db.basePath, fmt.Sprintf("nodes-%d.idx", gen))
+}
+
+func (db *FileDB) statesPath(gen uint64) string {
+	return path.Join(db.basePath, fmt.Sprintf("states-%d.log", gen))
+}
+
+func (db *FileDB) loadCurrent() error {
+	rec, err := ioutil.ReadFile(path.Join(db.basePath, "CURRENT"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(rec) != currentRecordSize {
+		return fmt.Errorf("corrupt current record, unexpected size %d", len(rec))
+	}
+	db.gen = binary.LittleEndian.Uint64(rec[0:8])
+	db.compactedEnd = int64(binary.LittleEndian.Uint64(rec[8:16]))
+	return nil
+}
+
+// storeCurrent replaces the CURRENT file atomically, to switch to the files of the given generation.
+func (db *FileDB) storeCurrent(gen uint64, compactedEnd int64) error {
+	var rec [currentRecordSize]byte
+	binary.LittleEndian.PutUint64(rec[0:8], gen)
+	binary.LittleEndian.PutUint64(rec[8:16], uint64(compactedEnd))
+	tmpPath := path.Join(db.basePath, "CURRENT.tmp")
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(rec[:]); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path.Join(db.basePath, "CURRENT")); err != nil {
+		return err
+	}
+	return syncDir(db.basePath)
+}
+
+// syncDir makes the renames in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// removeStaleFiles removes the temporary files, and the files that are not of the current generation.
+func (db *FileDB) removeStaleFiles() error {
+	files, err := ioutil.ReadDir(db.basePath)
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{
+		"CURRENT":                        true,
+		path.Base(db.nodesPath(db.gen)):  true,
+		path.Base(db.indexPath(db.gen)):  true,
+		path.Base(db.statesPath(db.gen)): true,
+	}
+	for _, f := range files {
+		name := f.Name()
+		if keep[name] {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") || strings.HasPrefix(name, "nodes-") || strings.HasPrefix(name, "states-") {
+			if err := os.Remove(path.Join(db.basePath, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// truncateTail drops an incomplete record at the end of a log, and positions the file for appending.
+func truncateTail(f *os.File, end int64) error {
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+	_, err := f.Seek(end, io.SeekStart)
+	return err
+}
+
+// loadNodeIndex indexes the records of the nodes log after the indexed end of the node index,
+// and drops a torn record at the end of the log.
+func (db *FileDB) loadNodeIndex() error {
+	info, err := db.nodes.Stat()
+	if err != nil {
+		return err
+	}
+	if db.nodeIndex.indexed > info.Size() {
+		// the index does not match the log, index the log again
+		if err := db.nodeIndex.reset(); err != nil {
+			return err
+		}
+	}
+	offset := db.nodeIndex.indexed
+	r := bufio.NewReader(io.NewSectionReader(db.nodes, offset, info.Size()-offset))
+	var buf [pairRecordSize]byte
+	for {
+		if _, err := io.ReadFull(r, buf[:leafRecordSize]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		size := leafRecordSize
+		if buf[0] == nodeKindPair {
+			size = pairRecordSize
+		} else if buf[0] != nodeKindLeaf {
+			return fmt.Errorf("unknown node kind %d at offset %d", buf[0], offset)
+		}
+		if _, err := io.ReadFull(r, buf[leafRecordSize:size]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		var key nodeKey
+		copy(key[:], buf[:leafRecordSize])
+		if err := db.nodeIndex.insert(key, offset); err != nil {
+			return err
+		}
+		offset += int64(size)
+	}
+	db.nodesEnd = offset
+	if err := truncateTail(db.nodes, offset); err != nil {
+		return err
+	}
+	if offset != db.nodeIndex.indexed {
+		return db.nodeIndex.commit(offset)
+	}
+	return nil
+}
+
+func (db *FileDB) loadStateIndex() error {
+	r := bufio.NewReader(db.statesF)
+	var buf [stateRecordSize]byte
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		var root common.Root
+		copy(root[:], buf[1:33])
+		switch buf[0] {
+		case stateOpRemove:
+			delete(db.stateIndex, root)
+		case stateOpStore:
+			var digest common.ForkDigest
+			copy(digest[:], buf[33:37])
+			db.stateIndex[root] = digest
+		default:
+			return fmt.Errorf("unknown state record op %d at offset %d", buf[0], offset)
+		}
+		offset += stateRecordSize
+	}
+	db.statesEnd = offset
+	for root := range db.stateIndex {
+		if _, ok, err := db.lookupNode(stateNodeKey(root)); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("missing tree nodes of state %s", root)
+		}
+	}
+	return truncateTail(db.statesF, offset)
+}
+
+// stateNodeKey is the key of the root node of the state tree.
+func stateNodeKey(root common.Root) (key nodeKey) {
+	key[0] = nodeKindPair
+	copy(key[1:], root[:])
+	return key
+}
+
+// lookupNode returns the offset of the node record, in the node index or in the nodes of the Store in progress.
+func (db *FileDB) lookupNode(key nodeKey) (offset int64, ok bool, err error) {
+	if offset, ok := db.pending[key]; ok {
+		return offset, true, nil
+	}
+	return db.nodeIndex.lookup(key)
+}
+
+func (db *FileDB) Store(ctx context.Context, state common.BeaconState) error {
+	db.Lock()
+	defer db.Unlock()
+	hFn := tree.GetHashFn()
+	root := state.HashTreeRoot(hFn)
+	if _, ok := db.stateIndex[root]; ok {
+		return nil
+	}
+	fork, err := state.Fork()
+	if err != nil {
+		return err
+	}
+	genValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		return err
+	}
+	digest := common.ComputeForkDigest(fork.CurrentVersion, genValRoot)
+	if _, ok := db.dec.ForkByDigest(digest); !ok {
+		return fmt.Errorf("cannot store state %s with unrecognized fork digest %s", root, digest)
+	}
+
+	start := db.nodesEnd
+	db.pending = make(map[nodeKey]int64)
+	defer func() {
+		db.pending = nil
+	}()
+	_, err = db.storeNode(ctx, state.Backing(), hFn)
+	if err == nil {
+		err = db.nodesW.Flush()
+	}
+	if err == nil {
+		err = db.nodes.Sync()
+	}
+	if err != nil {
+		// Roll back to the previous consistent end of the nodes log
+		db.nodesW.Reset(db.nodes)
+		db.nodesEnd = start
+		if terr := truncateTail(db.nodes, start); terr != nil {
+			return fmt.Errorf("failed to store state %s: %v, and failed to roll back: %v", root, err, terr)
+		}
+		return fmt.Errorf("failed to store state %s: %v", root, err)
+	}
+	// The nodes are on disk, they can be indexed now.
+	for key, offset := range db.pending {
+		if err := db.nodeIndex.insert(key, offset); err != nil {
+			return fmt.Errorf("failed to index nodes of state %s: %v", root, err)
+		}
+	}
+	if err := db.nodeIndex.commit(db.nodesEnd); err != nil {
+		return fmt.Errorf("failed to index nodes of state %s: %v", root, err)
+	}
+
+	var rec [stateRecordSize]byte
+	rec[0] = stateOpStore
+	copy(rec[1:33], root[:])
+	copy(rec[33:37], digest[:])
+	if err := db.appendStateRecord(rec[:]); err != nil {
+		return fmt.Errorf("failed to store state %s: %v", root, err)
+	}
+	db.stateIndex[root] = digest
+	return nil
+}
+
+// storeNode writes the node and all its descendants that are not stored yet, children before parents.
+// A node that is already stored is not traversed: its descendants are stored already too.
+func (db *FileDB) storeNode(ctx context.Context, node tree.Node, hFn tree.HashFn) (nodeKey, error) {
+	key, err := toNodeKey(node, hFn)
+	if err != nil {
+		return nodeKey{}, err
+	}
+	if _, ok, err := db.lookupNode(key); err != nil {
+		return nodeKey{}, err
+	} else if ok {
+		return key, nil
+	}
+	// every 1024 new nodes, check if the context is done.
+	if len(db.pending)&((1<<10)-1) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nodeKey{}, err
+		}
+	}
+	var rec [pairRecordSize]byte
+	copy(rec[:], key[:])
+	size := leafRecordSize
+	if pair, ok := node.(*tree.PairNode); ok {
+		left, err := db.storeNode(ctx, pair.LeftChild, hFn)
+		if err != nil {
+			return nodeKey{}, err
+		}
+		right, err := db.storeNode(ctx, pair.RightChild, hFn)
+		if err != nil {
+			return nodeKey{}, err
+		}
+		copy(rec[leafRecordSize:], left[:])
+		copy(rec[2*leafRecordSize:], right[:])
+		size = pairRecordSize
+	}
+	if _, err := db.nodesW.Write(rec[:size]); err != nil {
+		return nodeKey{}, err
+	}
+	db.pending[key] = db.nodesEnd
+	db.nodesEnd += int64(size)
+	return key, nil
+}
+
+func (db *FileDB) appendStateRecord(rec []byte) error {
+	_, err := db.statesF.Write(rec)
+	if err == nil {
+		err = db.statesF.Sync()
+	}
+	if err != nil {
+		// Drop any partially written record, to keep the next records aligned
+		if terr := truncateTail(db.statesF, db.statesEnd); terr != nil {
+			return fmt.Errorf("%v, and failed to roll back: %v", err, terr)
+		}
+		return err
+	}
+	db.statesEnd += int64(len(rec))
+	return nil
+}
+
+func (db *FileDB) Get(ctx context.Context, root common.Root) (state common.BeaconState, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	digest, ok := db.stateIndex[root]
+	if !ok {
+		return nil, nil
+	}
+	// Nodes are loaded once, and shared between all the places in the tree that they are used in.
+	loaded := make(map[nodeKey]tree.Node)
+	backing, err := db.loadNode(ctx, stateNodeKey(root), loaded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state %s: %v", root, err)
+	}
+	return db.dec.StateFromBacking(digest, backing)
+}
+
+// readNode reads the record of the node from the nodes log, and returns the child keys if it is a pair node.
+func (db *FileDB) readNode(key nodeKey) (left nodeKey, right nodeKey, err error) {
+	offset, ok, err := db.lookupNode(key)
+	if err != nil {
+		return nodeKey{}, nodeKey{}, err
+	}
+	if !ok {
+		return nodeKey{}, nodeKey{}, fmt.Errorf("missing node %x", key[:])
+	}
+	size := leafRecordSize
+	if key[0] == nodeKindPair {
+		size = pairRecordSize
+	}
+	var rec [pairRecordSize]byte
+	if _, err := db.nodes.ReadAt(rec[:size], offset); err != nil {
+		return nodeKey{}, nodeKey{}, err
+	}
+	if !bytes.Equal(rec[:leafRecordSize], key[:]) {
+		return nodeKey{}, nodeKey{}, fmt.Errorf("corrupt node record at offset %d", offset)
+	}
+	copy(left[:], rec[leafRecordSize:2*leafRecordSize])
+	copy(right[:], rec[2*leafRecordSize:])
+	return left, right, nil
+}
+
+func (db *FileDB) loadNode(ctx context.Context, key nodeKey, loaded map[nodeKey]tree.Node) (tree.Node, error) {
+	if node, ok := loaded[key]; ok {
+		return node, nil
+	}
+	// every 1024 loaded nodes, check if the context is done.
+	if len(loaded)&((1<<10)-1) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	leftKey, rightKey, err := db.readNode(key)
+	if err != nil {
+		return nil, err
+	}
+	var root tree.Root
+	copy(root[:], key[1:])
+	var node tree.Node
+	if key[0] == nodeKindPair {
+		left, err := db.loadNode(ctx, leftKey, loaded)
+		if err != nil {
+			return nil, err
+		}
+		right, err := db.loadNode(ctx, rightKey, loaded)
+		if err != nil {
+			return nil, err
+		}
+		node = &tree.PairNode{Value: root, LeftChild: left, RightChild: right}
+	} else {
+		node = &root
+	}
+	loaded[key] = node
+	return node, nil
+}
+
+// Remove removes the state. The nodes of the state are freed by the next compaction,
+// which runs right away if the nodes log has doubled in size since the previous compaction.
+func (db *FileDB) Remove(root common.Root) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.stateIndex[root]; !ok {
+		return nil
+	}
+	var rec [stateRecordSize]byte
+	rec[0] = stateOpRemove
+	copy(rec[1:33], root[:])
+	if err := db.appendStateRecord(rec[:]); err != nil {
+		return fmt.Errorf("failed to remove state %s: %v", root, err)
+	}
+	delete(db.stateIndex, root)
+	if db.nodesEnd >= 2*db.compactedEnd {
+		if err := db.compact(context.Background()); err != nil {
+			return fmt.Errorf("removed state %s, but failed to compact: %v", root, err)
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the DB with only the stored states, and the nodes they use.
+// The files of the new generation replace the previous files atomically.
+func (db *FileDB) Compact(ctx context.Context) error {
+	db.Lock()
+	defer db.Unlock()
+	return db.compact(ctx)
+}
+
+func (db *FileDB) compact(ctx context.Context) error {
+	gen := db.gen + 1
+	c := &compaction{src: db}
+	err := c.run(ctx, db.nodesPath(gen), db.indexPath(gen), db.statesPath(gen))
+	if err == nil {
+		err = db.storeCurrent(gen, c.nodesEnd)
+	}
+	if err != nil {
+		_ = c.close()
+		for _, p := range []string{db.nodesPath(gen), db.indexPath(gen), db.statesPath(gen)} {
+			_ = os.Remove(p)
+		}
+		return err
+	}
+	// Switched to the new generation, the files of the previous generation can be removed.
+	prev := db.gen
+	_ = db.close()
+	db.gen = gen
+	db.compactedEnd = c.nodesEnd
+	db.nodes, db.nodesW, db.nodesEnd = c.nodes, bufio.NewWriter(c.nodes), c.nodesEnd
+	db.nodeIndex = c.index
+	db.statesF, db.statesEnd = c.states, c.statesEnd
+	for _, p := range []string{db.nodesPath(prev), db.indexPath(prev), db.statesPath(prev)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// compaction copies the stored states of the DB, and the nodes they use, to the files of a new generation.
+type compaction struct {
+	src       *FileDB
+	nodes     *os.File
+	nodesW    *bufio.Writer
+	nodesEnd  int64
+	index     *nodeIndex
+	states    *os.File
+	statesEnd int64
+	copied    int
+}
+
+func (c *compaction) run(ctx context.Context, nodesPath string, indexPath string, statesPath string) (err error) {
+	if c.nodes, err = os.OpenFile(nodesPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return err
+	}
+	c.nodesW = bufio.NewWriter(c.nodes)
+	_ = os.Remove(indexPath)
+	if c.index, err = openNodeIndex(indexPath); err != nil {
+		return err
+	}
+	if c.states, err = os.OpenFile(statesPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return err
+	}
+	statesW := bufio.NewWriter(c.states)
+	for root, digest := range c.src.stateIndex {
+		if err := c.copyNode(ctx, stateNodeKey(root)); err != nil {
+			return fmt.Errorf("failed to copy state %s: %v", root, err)
+		}
+		var rec [stateRecordSize]byte
+		rec[0] = stateOpStore
+		copy(rec[1:33], root[:])
+		copy(rec[33:37], digest[:])
+		if _, err := statesW.Write(rec[:]); err != nil {
+			return err
+		}
+		c.statesEnd += stateRecordSize
+	}
+	if err := c.nodesW.Flush(); err != nil {
+		return err
+	}
+	if err := c.nodes.Sync(); err != nil {
+		return err
+	}
+	if err := c.index.commit(c.nodesEnd); err != nil {
+		return err
+	}
+	if err := statesW.Flush(); err != nil {
+		return err
+	}
+	return c.states.Sync()
+}
+
+// copyNode copies the node and all its descendants that are not copied yet, children before parents.
+func (c *compaction) copyNode(ctx context.Context, key nodeKey) error {
+	if _, ok, err := c.index.lookup(key); err != nil || ok {
+		return err
+	}
+	// every 1024 copied nodes, check if the context is done.
+	if c.copied&((1<<10)-1) == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	left, right, err := c.src.readNode(key)
+	if err != nil {
+		return err
+	}
+	var rec [pairRecordSize]byte
+	copy(rec[:], key[:])
+	size := leafRecordSize
+	if key[0] == nodeKindPair {
+		if err := c.copyNode(ctx, left); err != nil {
+			return err
+		}
+		if err := c.copyNode(ctx, right); err != nil {
+			return err
+		}
+		copy(rec[leafRecordSize:], left[:])
+		copy(rec[2*leafRecordSize:], right[:])
+		size = pairRecordSize
+	}
+	if _, err := c.nodesW.Write(rec[:size]); err != nil {
+		return err
+	}
+	if err := c.index.insert(key, c.nodesEnd); err != nil {
+		return err
+	}
+	c.nodesEnd += int64(size)
+	c.copied++
+	return nil
+}
+
+func (c *compaction) close() error {
+	var errs []error
+	if c.nodes != nil {
+		if err := c.nodes.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.index != nil {
+		if err := c.index.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.states != nil {
+		if err := c.states.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(fmt.Sprint(errs))
+	}
+	return nil
+}
+
+// List all stored state roots
+func (db *FileDB) List() (out []common.Root) {
+	db.RLock()
+	defer db.RUnlock()
+	out = make([]common.Root, 0, len(db.stateIndex))
+	for root := range db.stateIndex {
+		out = append(out, root)
+	}
+	return out
+}
+
+func (db *FileDB) Path() string {
+	return db.basePath
+}
+
+func (db *FileDB) close() error {
+	var errs []error
+	if db.nodesW != nil {
+		if err := db.nodesW.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := db.nodes.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := db.nodeIndex.close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := db.statesF.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.New(fmt.Sprint(errs))
+	}
+	return nil
+}
+
+func (db *FileDB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	return db.close()
+}
@@ -0,0 +1,166 @@
+package states
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"github.com/protolambda/ztyp/tree"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func fileSize(t *testing.T, p string) int64 {
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestFileDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "states")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	pre, epc := kickstarttest.State(t, &spec, 64)
+	genValRoot, err := pre.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(&spec, genValRoot)
+	db, err := NewFileDB(&spec, dec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	genesisRoot := pre.HashTreeRoot(tree.GetHashFn())
+	if err := db.Store(ctx, pre); err != nil {
+		t.Fatal(err)
+	}
+	genesisSize := fileSize(t, db.nodesPath(0))
+
+	// process a slot on a copy, most of the tree is shared with the genesis state
+	next, err := pre.CopyState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &beacon.StandardUpgradeableBeaconState{BeaconState: next}
+	if err := common.ProcessSlots(ctx, &spec, epc, state, 1); err != nil {
+		t.Fatal(err)
+	}
+	nextRoot := state.HashTreeRoot(tree.GetHashFn())
+	if err := db.Store(ctx, state.BeaconState); err != nil {
+		t.Fatal(err)
+	}
+	if delta := fileSize(t, db.nodesPath(0)) - genesisSize; delta*10 > genesisSize {
+		t.Fatalf("expected shared nodes to be deduplicated, second state added %d bytes to %d bytes", delta, genesisSize)
+	}
+
+	// cross the fork, the altair state is reloaded as altair state
+	forkSlot := common.Slot(spec.ALTAIR_FORK_EPOCH) * spec.SLOTS_PER_EPOCH
+	if err := common.ProcessSlots(ctx, &spec, epc, state, forkSlot); err != nil {
+		t.Fatal(err)
+	}
+	altairRoot := state.HashTreeRoot(tree.GetHashFn())
+	if err := db.Store(ctx, state.BeaconState); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn record at the end is dropped when opening the DB again
+	f, err := os.OpenFile(db.nodesPath(0), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{nodeKindPair, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the node index is derived from the nodes log, a lost index is rebuilt
+	if err := os.Remove(db.indexPath(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewFileDB(&spec, dec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		root   common.Root
+		altair bool
+	}{{genesisRoot, false}, {nextRoot, false}, {altairRoot, true}} {
+		got, err := db.Get(ctx, c.root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil {
+			t.Fatalf("missing state %s", c.root)
+		}
+		if got.HashTreeRoot(tree.GetHashFn()) != c.root {
+			t.Fatalf("loaded state does not match root %s", c.root)
+		}
+		if _, ok := got.(*altair.BeaconStateView); ok != c.altair {
+			t.Fatalf("unexpected state type %T for state %s", got, c.root)
+		}
+	}
+
+	// removing a state compacts the DB: the nodes that only the removed state used are freed
+	beforeRemove := fileSize(t, db.nodesPath(0))
+	if err := db.Remove(genesisRoot); err != nil {
+		t.Fatal(err)
+	}
+	if db.gen != 1 {
+		t.Fatalf("expected the DB to be compacted into generation 1, got %d", db.gen)
+	}
+	if _, err := os.Stat(db.nodesPath(0)); !os.IsNotExist(err) {
+		t.Fatal("expected the nodes log of the previous generation to be removed")
+	}
+	if afterRemove := fileSize(t, db.nodesPath(1)); afterRemove >= beforeRemove {
+		t.Fatalf("expected compaction to free storage, nodes log is %d bytes, was %d bytes", afterRemove, beforeRemove)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewFileDB(&spec, dec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get(ctx, genesisRoot); err != nil {
+		t.Fatal(err)
+	} else if got != nil {
+		t.Fatal("expected removed state to be gone after reopening the DB")
+	}
+	for _, root := range []common.Root{nextRoot, altairRoot} {
+		if got, err := db.Get(ctx, root); err != nil {
+			t.Fatal(err)
+		} else if got == nil || got.HashTreeRoot(tree.GetHashFn()) != root {
+			t.Fatal("expected state to still be available after removing another state")
+		}
+	}
+	// new states can still be stored after compaction
+	if err := common.ProcessSlots(ctx, &spec, epc, state, forkSlot+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Store(ctx, state.BeaconState); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get(ctx, state.HashTreeRoot(tree.GetHashFn())); err != nil {
+		t.Fatal(err)
+	} else if got == nil {
+		t.Fatal("expected state stored after compaction to be available")
+	}
+}
@@ -33,7 +33,8 @@ func (db *MemDB) Get(ctx context.Context, root common.Root) (state common.Beacon
 	if !ok {
 		panic("in-memory db was corrupted with unexpected state type")
 	}
-	return
+	// Return a copy, the stored state itself may not be modified
+	return state.CopyState()
 }
 
 func (db *MemDB) Remove(root common.Root) error {
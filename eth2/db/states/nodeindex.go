@@ -0,0 +1,222 @@
+package states
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+var nodeIndexMagic = [8]byte{'z', 'r', 'n', 't', 'n', 'i', 'd', 'x'}
+
+const (
+	// index header: magic, capacity, count, indexed end of the nodes log
+	nodeIndexHeaderSize = 8 + 8 + 8 + 8
+	// index slot: node key, offset of the node record + 1 (0 if the slot is empty)
+	nodeIndexSlotSize = len(nodeKey{}) + 8
+	// initial number of slots of a new index
+	nodeIndexMinCapacity = 1 << 12
+)
+
+// nodeIndex is a hash table on disk, to look up the offset of node records in the nodes log by node key.
+// It uses open addressing with linear probing, and doubles its capacity when it is half full.
+//
+// The index is derived from the nodes log: it covers the log up to the indexed end in its header,
+// the records after that are indexed again when the DB is opened. Inserts are idempotent.
+type nodeIndex struct {
+	path     string
+	f        *os.File
+	capacity uint64
+	count    uint64
+	indexed  int64
+}
+
+// openNodeIndex opens the index file, or creates a new empty index if it does not exist or is not valid.
+func openNodeIndex(p string) (*nodeIndex, error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	idx := &nodeIndex{path: p, f: f}
+	if ok, err := idx.readHeader(); err != nil {
+		_ = f.Close()
+		return nil, err
+	} else if !ok {
+		if err := idx.reset(); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+func (idx *nodeIndex) readHeader() (ok bool, err error) {
+	info, err := idx.f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() < nodeIndexHeaderSize {
+		return false, nil
+	}
+	var header [nodeIndexHeaderSize]byte
+	if _, err := idx.f.ReadAt(header[:], 0); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(header[:8], nodeIndexMagic[:]) {
+		return false, nil
+	}
+	capacity := binary.LittleEndian.Uint64(header[8:16])
+	if capacity == 0 || capacity&(capacity-1) != 0 ||
+		info.Size() != nodeIndexHeaderSize+int64(capacity)*int64(nodeIndexSlotSize) {
+		return false, nil
+	}
+	idx.capacity = capacity
+	idx.count = binary.LittleEndian.Uint64(header[16:24])
+	idx.indexed = int64(binary.LittleEndian.Uint64(header[24:32]))
+	return true, nil
+}
+
+func (idx *nodeIndex) writeHeader() error {
+	var header [nodeIndexHeaderSize]byte
+	copy(header[:8], nodeIndexMagic[:])
+	binary.LittleEndian.PutUint64(header[8:16], idx.capacity)
+	binary.LittleEndian.PutUint64(header[16:24], idx.count)
+	binary.LittleEndian.PutUint64(header[24:32], uint64(idx.indexed))
+	_, err := idx.f.WriteAt(header[:], 0)
+	return err
+}
+
+// reset empties the index, the nodes log has to be indexed again from the start.
+func (idx *nodeIndex) reset() error {
+	idx.capacity = nodeIndexMinCapacity
+	idx.count = 0
+	idx.indexed = 0
+	if err := idx.f.Truncate(0); err != nil {
+		return err
+	}
+	if err := idx.f.Truncate(nodeIndexHeaderSize + int64(idx.capacity)*int64(nodeIndexSlotSize)); err != nil {
+		return err
+	}
+	return idx.writeHeader()
+}
+
+func (idx *nodeIndex) home(key nodeKey) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key[:])
+	return h.Sum64() & (idx.capacity - 1)
+}
+
+func (idx *nodeIndex) slotOffset(i uint64) int64 {
+	return nodeIndexHeaderSize + int64(i)*int64(nodeIndexSlotSize)
+}
+
+// probe finds the slot of the key, or the empty slot to insert the key in.
+func (idx *nodeIndex) probe(key nodeKey) (slot uint64, offset int64, ok bool, err error) {
+	var rec [nodeIndexSlotSize]byte
+	for i, n := idx.home(key), uint64(0); n < idx.capacity; i, n = (i+1)&(idx.capacity-1), n+1 {
+		if _, err := idx.f.ReadAt(rec[:], idx.slotOffset(i)); err != nil {
+			return 0, 0, false, err
+		}
+		v := binary.LittleEndian.Uint64(rec[len(nodeKey{}):])
+		if v == 0 {
+			return i, 0, false, nil
+		}
+		if bytes.Equal(rec[:len(nodeKey{})], key[:]) {
+			return i, int64(v - 1), true, nil
+		}
+	}
+	return 0, 0, false, fmt.Errorf("node index is full")
+}
+
+// lookup returns the offset of the node record in the nodes log.
+func (idx *nodeIndex) lookup(key nodeKey) (offset int64, ok bool, err error) {
+	_, offset, ok, err = idx.probe(key)
+	return
+}
+
+// insert adds the offset of the node record, if the node is not indexed yet.
+func (idx *nodeIndex) insert(key nodeKey, offset int64) error {
+	slot, _, ok, err := idx.probe(key)
+	if err != nil || ok {
+		return err
+	}
+	var rec [nodeIndexSlotSize]byte
+	copy(rec[:], key[:])
+	binary.LittleEndian.PutUint64(rec[len(nodeKey{}):], uint64(offset)+1)
+	if _, err := idx.f.WriteAt(rec[:], idx.slotOffset(slot)); err != nil {
+		return err
+	}
+	idx.count++
+	if idx.count*2 > idx.capacity {
+		return idx.grow()
+	}
+	return nil
+}
+
+// grow rebuilds the index with double the capacity, in a new file that then replaces the old file.
+func (idx *nodeIndex) grow() error {
+	tmpPath := idx.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	grown := &nodeIndex{path: idx.path, f: f, capacity: idx.capacity * 2, indexed: idx.indexed}
+	if err := f.Truncate(nodeIndexHeaderSize + int64(grown.capacity)*int64(nodeIndexSlotSize)); err != nil {
+		_ = f.Close()
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(idx.f, nodeIndexHeaderSize, int64(idx.capacity)*int64(nodeIndexSlotSize)))
+	var rec [nodeIndexSlotSize]byte
+	for i := uint64(0); i < idx.capacity; i++ {
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			_ = f.Close()
+			return err
+		}
+		v := binary.LittleEndian.Uint64(rec[len(nodeKey{}):])
+		if v == 0 {
+			continue
+		}
+		var key nodeKey
+		copy(key[:], rec[:len(nodeKey{})])
+		// the grown index is at most a quarter full, it never grows again here
+		if err := grown.insert(key, int64(v-1)); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := grown.sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, idx.path); err != nil {
+		_ = f.Close()
+		return err
+	}
+	_ = idx.f.Close()
+	*idx = *grown
+	return nil
+}
+
+// commit marks the nodes log as indexed up to the given end, after flushing the inserted nodes to disk.
+func (idx *nodeIndex) commit(indexed int64) error {
+	if err := idx.f.Sync(); err != nil {
+		return err
+	}
+	idx.indexed = indexed
+	return idx.writeHeader()
+}
+
+// sync writes the header and flushes the index to disk.
+func (idx *nodeIndex) sync() error {
+	if err := idx.writeHeader(); err != nil {
+		return err
+	}
+	return idx.f.Sync()
+}
+
+func (idx *nodeIndex) close() error {
+	return idx.f.Close()
+}
@@ -0,0 +1,69 @@
+package states
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestNodeIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodeindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := func(i int) (key nodeKey) {
+		key[0] = byte(i & 1)
+		binary.LittleEndian.PutUint64(key[1:], uint64(i>>1))
+		return key
+	}
+	p := path.Join(dir, "nodes.idx")
+	idx, err := openNodeIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough nodes to grow the index a few times
+	n := nodeIndexMinCapacity * 3
+	for i := 0; i < n; i++ {
+		if err := idx.insert(key(i), int64(i)*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// inserts are idempotent, the first offset is kept
+	if err := idx.insert(key(3), 12345); err != nil {
+		t.Fatal(err)
+	}
+	if idx.count != uint64(n) || idx.capacity != nodeIndexMinCapacity*8 {
+		t.Fatalf("unexpected index size: count %d, capacity %d", idx.count, idx.capacity)
+	}
+	if err := idx.commit(int64(n) * 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = openNodeIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.close()
+	if idx.indexed != int64(n)*10 {
+		t.Fatalf("unexpected indexed end %d", idx.indexed)
+	}
+	for i := 0; i < n; i++ {
+		if offset, ok, err := idx.lookup(key(i)); err != nil {
+			t.Fatal(err)
+		} else if !ok || offset != int64(i)*10 {
+			t.Fatalf("unexpected lookup of node %d: %d %v", i, offset, ok)
+		}
+	}
+	if _, ok, err := idx.lookup(key(n)); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected unknown node to be missing")
+	}
+}
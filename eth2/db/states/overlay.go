@@ -0,0 +1,41 @@
+package states
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// OverlayDB keeps new states in memory, and reads through to the base DB for the states it does not have.
+// The base DB is never modified, e.g. to simulate a copy of a chain without affecting the DB of the original.
+type OverlayDB struct {
+	mem  *MemDB
+	base DB
+}
+
+var _ DB = (*OverlayDB)(nil)
+
+func NewOverlayDB(spec *common.Spec, base DB) *OverlayDB {
+	return &OverlayDB{mem: NewMemDB(spec), base: base}
+}
+
+func (db *OverlayDB) Store(ctx context.Context, state common.BeaconState) error {
+	return db.mem.Store(ctx, state)
+}
+
+func (db *OverlayDB) Get(ctx context.Context, root common.Root) (state common.BeaconState, err error) {
+	state, err = db.mem.Get(ctx, root)
+	if err != nil || state != nil {
+		return state, err
+	}
+	return db.base.Get(ctx, root)
+}
+
+// Remove removes the state from the overlay. The states of the base DB stay available.
+func (db *OverlayDB) Remove(root common.Root) error {
+	return db.mem.Remove(root)
+}
+
+// Close closes the overlay, the base DB is left open.
+func (db *OverlayDB) Close() error {
+	return db.mem.Close()
+}
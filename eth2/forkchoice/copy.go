@@ -0,0 +1,40 @@
+package forkchoice
+
+import "fmt"
+
+// Copy creates a copy of the forkchoice, that can be modified independently of the original.
+// The graph and votes are copied with the given functions, the remaining state is immutable or copied.
+func (fc *ProtoForkChoice) Copy(copyGraph func(graph ForkchoiceGraph) (ForkchoiceGraph, error),
+	copyVotes func(votes VoteStore) (VoteStore, error)) (Forkchoice, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	graph, err := copyGraph(fc.protoArray)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy forkchoice graph: %v", err)
+	}
+	votes, err := copyVotes(fc.voteStore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy votes: %v", err)
+	}
+	out := &ProtoForkChoice{
+		protoArray: graph,
+		voteStore:  votes,
+		// the balances are replaced as a whole when updated, never modified, and can be shared.
+		balances:              fc.balances,
+		justified:             fc.justified,
+		finalized:             fc.finalized,
+		bestJustified:         fc.bestJustified,
+		bestJustifiedBalances: fc.bestJustifiedBalances,
+		genesisTime:           fc.genesisTime,
+		time:                  fc.time,
+		proposerBoostRoot:     fc.proposerBoostRoot,
+		appliedBoost:          fc.appliedBoost,
+		appliedBoostScore:     fc.appliedBoostScore,
+		spec:                  fc.spec,
+	}
+	if fc.pin != nil {
+		pin := *fc.pin
+		out.pin = &pin
+	}
+	return out, nil
+}
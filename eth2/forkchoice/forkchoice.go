@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"sync"
 )
 
@@ -18,28 +19,51 @@ type ProtoForkChoice struct {
 	pin       *NodeRef
 	justified Checkpoint
 	finalized Checkpoint
-	spec      *common.Spec
+	// The best justified checkpoint seen so far, to apply at the start of the next epoch.
+	// Along with the lazy-loaded balances of the state that justified it.
+	bestJustified         Checkpoint
+	bestJustifiedBalances func() ([]Gwei, error)
+	genesisTime           common.Timestamp
+	time                  common.Timestamp
+	// The timely block that receives the proposer score boost, zero if none.
+	proposerBoostRoot Root
+	// The node and score of the proposer boost as currently applied to the node weights.
+	appliedBoost      NodeRef
+	appliedBoostScore SignedGwei
+	spec              *common.Spec
 }
 
 var _ Forkchoice = (*ProtoForkChoice)(nil)
 
-func NewForkChoice(spec *common.Spec, finalized Checkpoint, justified Checkpoint,
+func NewForkChoice(spec *common.Spec, genesisTime common.Timestamp, finalized Checkpoint, justified Checkpoint,
 	anchorRoot Root, anchorSlot Slot, graph ForkchoiceGraph, votes VoteStore,
 	initialBalances []Gwei) (Forkchoice, error) {
+	if justified.Epoch < finalized.Epoch {
+		return nil, fmt.Errorf("justified epoch %d lower than finalized epoch %d", justified.Epoch, finalized.Epoch)
+	}
+	anchorTime, err := spec.TimeAtSlot(anchorSlot, genesisTime)
+	if err != nil {
+		return nil, err
+	}
+	balances := func() ([]Gwei, error) {
+		return initialBalances, nil
+	}
 	fc := &ProtoForkChoice{
-		protoArray: graph,
-		voteStore:  votes,
-		balances:   nil,
-		justified:  justified,
-		finalized:  finalized,
-		spec:       spec,
+		protoArray:            graph,
+		voteStore:             votes,
+		balances:              nil,
+		justified:             justified,
+		finalized:             finalized,
+		bestJustified:         justified,
+		bestJustifiedBalances: balances,
+		genesisTime:           genesisTime,
+		time:                  anchorTime,
+		spec:                  spec,
 	}
 	if err := fc.SetPin(anchorRoot, anchorSlot); err != nil {
 		return nil, err
 	}
-	if err := fc.updateJustified(finalized, justified, func() ([]Gwei, error) {
-		return initialBalances, nil
-	}); err != nil {
+	if err := fc.updateScores(balances); err != nil {
 		return nil, err
 	}
 	return fc, nil
@@ -66,8 +90,73 @@ func (fc *ProtoForkChoice) SetPin(root Root, slot Slot) error {
 	return nil
 }
 
-// UpdateJustified updates what is recognized as justified and finalized checkpoint,
+func (fc *ProtoForkChoice) currentSlot() Slot {
+	return fc.spec.TimeToSlot(fc.time, fc.genesisTime)
+}
+
+func (fc *ProtoForkChoice) Time() common.Timestamp {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.time
+}
+
+func (fc *ProtoForkChoice) CurrentSlot() Slot {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.currentSlot()
+}
+
+// OnTick updates the time. Time cannot go backwards, older times are ignored.
+// When the time enters a new slot, the proposer boost is removed.
+// When the time enters the first slot of a new epoch, the best justified checkpoint is applied,
+// if it is better than the current justified checkpoint.
+func (fc *ProtoForkChoice) OnTick(ctx context.Context, time common.Timestamp) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if time <= fc.time {
+		return nil
+	}
+	prevSlot := fc.currentSlot()
+	fc.time = time
+	slot := fc.currentSlot()
+	if slot <= prevSlot {
+		return nil
+	}
+	fc.proposerBoostRoot = Root{}
+	if fc.spec.SlotToEpoch(slot) == fc.spec.SlotToEpoch(prevSlot) {
+		return nil
+	}
+	if fc.bestJustified.Epoch > fc.justified.Epoch {
+		// Only promote the best justified checkpoint if it builds on the finalized checkpoint.
+		finalizedSlot, _ := fc.spec.EpochStartSlot(fc.finalized.Epoch)
+		if ancestor, ok := fc.protoArray.GetAncestor(fc.bestJustified.Root, finalizedSlot); !ok || ancestor != fc.finalized.Root {
+			return nil
+		}
+		if err := fc.setJustified(fc.bestJustified, fc.bestJustifiedBalances); err != nil {
+			return fmt.Errorf("failed to apply best justified checkpoint %s: %v", fc.bestJustified, err)
+		}
+	}
+	return nil
+}
+
+// shouldUpdateJustified implements the bouncing-attack mitigation:
+// justification is only updated immediately within the first SAFE_SLOTS_TO_UPDATE_JUSTIFIED slots of the epoch,
+// or when the new justified checkpoint is a descendant of the current justified checkpoint.
+func (fc *ProtoForkChoice) shouldUpdateJustified(justified Checkpoint) bool {
+	slot := fc.currentSlot()
+	epochStart, _ := fc.spec.EpochStartSlot(fc.spec.SlotToEpoch(slot))
+	if uint64(slot-epochStart) < fc.spec.SAFE_SLOTS_TO_UPDATE_JUSTIFIED {
+		return true
+	}
+	justifiedSlot, _ := fc.spec.EpochStartSlot(fc.justified.Epoch)
+	ancestor, ok := fc.protoArray.GetAncestor(justified.Root, justifiedSlot)
+	return ok && ancestor == fc.justified.Root
+}
+
+// UpdateJustified processes the justified and finalized checkpoint of the post-state of the trigger,
 // and adjusts justified balances for vote weights.
+// Following the spec, a later justified checkpoint is tracked as best justified checkpoint,
+// but only applied immediately if it is safe to do so, see OnTick for the delayed update.
 // If the finalized checkpoint changes, it triggers pruning.
 // Note that pruning can prune the pre-block node of the start slot of the finalized epoch, if it is not a gap slot.
 // And the finalizing node with the block will remain.
@@ -80,93 +169,179 @@ func (fc *ProtoForkChoice) UpdateJustified(ctx context.Context, trigger Root, ju
 	if fc.justified.Epoch >= justified.Epoch && fc.finalized.Epoch >= finalized.Epoch {
 		return nil
 	}
+	if justified.Epoch < finalized.Epoch {
+		return fmt.Errorf("justified epoch %d lower than finalized epoch %d", justified.Epoch, finalized.Epoch)
+	}
 	if fc.pin != nil && trigger != fc.pin.Root {
 		// check trigger against pin, to ensure no justification/finalization of data that conflicts with the pin.
-		if unknown, inSubtree := fc.InSubtree(fc.pin.Root, trigger); unknown {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.pin.Root, trigger); unknown {
 			return fmt.Errorf("cannot justify/finalize with unknown trigger when forkchoice is pinned")
 		} else if !inSubtree {
 			return fmt.Errorf("cannot justify/finalize outside of pinned forkchoice tree")
 		}
 	}
+	// check if the new checkpoints are valid
+	if finalized.Epoch > fc.finalized.Epoch {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.finalized.Root, finalized.Root); unknown {
+			return fmt.Errorf("unknown finalized checkpoint: %s", finalized)
+		} else if !inSubtree {
+			return fmt.Errorf("new finalized checkpoint %s is outside of finalized subtree: %s",
+				finalized, fc.finalized)
+		}
+	}
+	if justified.Epoch > fc.justified.Epoch {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.finalized.Root, justified.Root); unknown {
+			return fmt.Errorf("unknown justified checkpoint: %s", justified)
+		} else if !inSubtree {
+			return fmt.Errorf("new justified checkpoint %s is outside of finalized subtree: %s",
+				justified, fc.finalized)
+		}
+	}
 
-	prevFinalized := fc.finalized
-
-	if err := fc.updateJustified(justified, finalized, justifiedStateBalances); err != nil {
-		return err
+	newJustified := fc.justified
+	newJustifiedBalances := justifiedStateBalances
+	if justified.Epoch > fc.justified.Epoch {
+		if justified.Epoch > fc.bestJustified.Epoch {
+			fc.bestJustified = justified
+			fc.bestJustifiedBalances = justifiedStateBalances
+		}
+		if fc.shouldUpdateJustified(justified) {
+			newJustified = justified
+		}
+	}
+	finalizing := finalized.Epoch > fc.finalized.Epoch
+	if finalizing && newJustified != justified {
+		// Update justified if it is later, or if the current justified checkpoint conflicts with finality.
+		finSlot, _ := fc.spec.EpochStartSlot(finalized.Epoch)
+		if ancestor, ok := fc.protoArray.GetAncestor(newJustified.Root, finSlot); justified.Epoch > newJustified.Epoch ||
+			!ok || ancestor != finalized.Root {
+			newJustified = justified
+		}
+	}
+	if finalizing {
+		fc.finalized = finalized
+	}
+	if newJustified != fc.justified {
+		if err := fc.setJustified(newJustified, newJustifiedBalances); err != nil {
+			return err
+		}
+	} else if finalizing {
+		// the viability of nodes depends on the finalized epoch
+		if err := fc.updateScores(func() ([]Gwei, error) { return fc.balances, nil }); err != nil {
+			return err
+		}
 	}
 
 	// prune if we finalized something, and undo the pin.
-	if prevFinalized != finalized {
+	if finalizing {
 		fc.pin = nil
 		finSlot, _ := fc.spec.EpochStartSlot(finalized.Epoch)
 		if err := fc.protoArray.OnPrune(ctx, finalized.Root, finSlot); err != nil {
 			return err
 		}
+		fc.voteStore.PruneConflicts(finalized.Epoch)
 	}
 	return nil
 }
 
-func (fc *ProtoForkChoice) updateJustified(finalized Checkpoint, justified Checkpoint,
-	justifiedStateBalances func() ([]Gwei, error)) error {
-	if justified.Epoch < finalized.Epoch {
-		return fmt.Errorf("justified epoch %d lower than finalized epoch %d", justified.Epoch, finalized.Epoch)
-	}
-
-	// check if new finalized checkpoint is valid
-	if fc.finalized != finalized {
-		if unknown, inSubtree := fc.InSubtree(fc.finalized.Root, finalized.Root); unknown {
-			return fmt.Errorf("unknown finalized checkpoint: %s", finalized)
-		} else if !inSubtree || fc.finalized.Epoch > finalized.Epoch {
-			return fmt.Errorf("new finalized checkpoint %s is outside of finalized subtree: %s",
-				finalized, fc.finalized)
-		}
-	}
-	if fc.justified != justified {
-		if unknown, inSubtree := fc.InSubtree(fc.finalized.Root, justified.Root); unknown {
-			return fmt.Errorf("unknown justified checkpoint: %s", justified)
-		} else if !inSubtree || fc.finalized.Epoch > justified.Epoch {
-			return fmt.Errorf("new justified checkpoint %s is outside of finalized subtree: %s",
-				justified, fc.finalized)
-		}
+// setJustified changes the justified checkpoint, and re-weights the votes with the new justified balances.
+func (fc *ProtoForkChoice) setJustified(justified Checkpoint, justifiedStateBalances func() ([]Gwei, error)) error {
+	prev := fc.justified
+	fc.justified = justified
+	if err := fc.updateScores(justifiedStateBalances); err != nil {
+		fc.justified = prev
+		return err
 	}
+	return nil
+}
 
+// updateScores applies the vote changes and the change from the old to the new balances,
+// along with any proposer boost change,
+// with the current justified and finalized epochs to filter viable nodes.
+func (fc *ProtoForkChoice) updateScores(newBalances func() ([]Gwei, error)) error {
 	oldBals := fc.balances
-	newBals, err := justifiedStateBalances()
+	newBals, err := newBalances()
 	if err != nil {
 		return err
 	}
 
-	deltas := fc.voteStore.ComputeDeltas(fc.protoArray.Indices(), oldBals, newBals)
+	indices := fc.protoArray.Indices()
+	deltas := fc.voteStore.ComputeDeltas(indices, oldBals, newBals)
+	fc.applyProposerBoost(indices, deltas, newBals)
 
-	if err := fc.protoArray.ApplyScoreChanges(deltas, justified.Epoch, finalized.Epoch); err != nil {
+	if err := fc.protoArray.ApplyScoreChanges(deltas, fc.justified.Epoch, fc.finalized.Epoch); err != nil {
 		return err
 	}
 
 	fc.balances = newBals
-	fc.justified = justified
-	fc.finalized = finalized
-
 	return nil
 }
 
 // TODO: skip based on time (like rate limiting) or based on amount of changes
 //  (if not bigger than previous difference between head-node contenders)
 func (fc *ProtoForkChoice) updateVotesMaybe() error {
-	if !fc.voteStore.HasChanges() {
+	if !fc.voteStore.HasChanges() && fc.appliedBoost.Root == fc.proposerBoostRoot {
 		return nil
 	}
 
-	deltas := fc.voteStore.ComputeDeltas(fc.protoArray.Indices(), fc.balances, fc.balances)
+	indices := fc.protoArray.Indices()
+	deltas := fc.voteStore.ComputeDeltas(indices, fc.balances, fc.balances)
+	fc.applyProposerBoost(indices, deltas, fc.balances)
 
 	return fc.protoArray.ApplyScoreChanges(deltas, fc.justified.Epoch, fc.finalized.Epoch)
 }
 
+// proposerScore computes the proposer boost: a fraction of the weight of a single slot committee.
+func (fc *ProtoForkChoice) proposerScore(balances []Gwei) SignedGwei {
+	total := Gwei(0)
+	for _, b := range balances {
+		total += b
+	}
+	committeeWeight := total / Gwei(fc.spec.SLOTS_PER_EPOCH)
+	return SignedGwei(committeeWeight / 100 * Gwei(fc.spec.PROPOSER_SCORE_BOOST))
+}
+
+// applyProposerBoost adds the removal of the previously applied proposer boost to the deltas,
+// and the boost of the current proposer boost root, if any.
+func (fc *ProtoForkChoice) applyProposerBoost(indices map[NodeRef]NodeIndex, deltas []SignedGwei, balances []Gwei) {
+	if fc.appliedBoost != (NodeRef{}) {
+		// if the node was pruned, then so was its weight.
+		if i, ok := indices[fc.appliedBoost]; ok {
+			deltas[i] -= fc.appliedBoostScore
+		}
+		fc.appliedBoost = NodeRef{}
+		fc.appliedBoostScore = 0
+	}
+	if fc.proposerBoostRoot == (Root{}) {
+		return
+	}
+	slot, ok := fc.protoArray.GetSlot(fc.proposerBoostRoot)
+	if !ok {
+		return
+	}
+	ref := NodeRef{Root: fc.proposerBoostRoot, Slot: slot}
+	i, ok := indices[ref]
+	if !ok {
+		return
+	}
+	score := fc.proposerScore(balances)
+	deltas[i] += score
+	fc.appliedBoost = ref
+	fc.appliedBoostScore = score
+}
+
 func (fc *ProtoForkChoice) Justified() Checkpoint {
 	fc.mu.RLock()
 	defer fc.mu.RUnlock()
 	return fc.justified
 }
 
+func (fc *ProtoForkChoice) BestJustified() Checkpoint {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.bestJustified
+}
+
 func (fc *ProtoForkChoice) Finalized() Checkpoint {
 	fc.mu.RLock()
 	defer fc.mu.RUnlock()
@@ -175,7 +350,7 @@ func (fc *ProtoForkChoice) Finalized() Checkpoint {
 
 func (fc *ProtoForkChoice) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool) {
 	fc.mu.Lock()
-	fc.mu.Unlock()
+	defer fc.mu.Unlock()
 	// only add the vote if we can. Don't add if it's not within view.
 	blockSlot, ok := fc.protoArray.GetSlot(blockRoot)
 	if !ok || blockSlot < headSlot {
@@ -184,10 +359,33 @@ func (fc *ProtoForkChoice) ProcessAttestation(index ValidatorIndex, blockRoot Ro
 	return fc.voteStore.ProcessAttestation(index, blockRoot, headSlot)
 }
 
+func (fc *ProtoForkChoice) ProcessIndexedAttestation(att *phase0.IndexedAttestation) (ok bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	// only add the votes if we can. Don't add if it's not within view.
+	blockSlot, ok := fc.protoArray.GetSlot(att.Data.BeaconBlockRoot)
+	if !ok || blockSlot < att.Data.Slot {
+		return false
+	}
+	return fc.voteStore.ProcessIndexedAttestation(att)
+}
+
+func (fc *ProtoForkChoice) ProcessEquivocation(indices []ValidatorIndex) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.voteStore.ProcessEquivocation(indices)
+}
+
+func (fc *ProtoForkChoice) Conflicts() []ConflictingVotes {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.voteStore.Conflicts()
+}
+
 func (fc *ProtoForkChoice) CanonicalChain(anchorRoot Root, anchorSlot Slot) ([]ExtendedNodeRef, error) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
-	return fc.CanonicalChain(anchorRoot, anchorSlot)
+	return fc.protoArray.CanonicalChain(anchorRoot, anchorSlot)
 }
 
 func (fc *ProtoForkChoice) ProcessSlot(parentRoot Root, slot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) {
@@ -196,10 +394,27 @@ func (fc *ProtoForkChoice) ProcessSlot(parentRoot Root, slot Slot, justifiedEpoc
 	fc.protoArray.ProcessSlot(parentRoot, slot, justifiedEpoch, finalizedEpoch)
 }
 
-func (fc *ProtoForkChoice) ProcessBlock(parentRoot Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool) {
+func (fc *ProtoForkChoice) ProcessBlock(parentRoot Root, blockRoot Root, blockSlot Slot,
+	justifiedEpoch Epoch, finalizedEpoch Epoch, arrival common.Timestamp) (ok bool) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
-	return fc.protoArray.ProcessBlock(parentRoot, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch)
+	if !fc.protoArray.ProcessBlock(parentRoot, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch) {
+		return false
+	}
+	// Boost the block if it is timely: it must arrive in its own slot, before the attesting interval.
+	if fc.currentSlot() == blockSlot && fc.spec.TimeToSlot(arrival, fc.genesisTime) == blockSlot {
+		slotStart, err := fc.spec.TimeAtSlot(blockSlot, fc.genesisTime)
+		if err == nil && arrival-slotStart < fc.spec.SECONDS_PER_SLOT/3 {
+			fc.proposerBoostRoot = blockRoot
+		}
+	}
+	return true
+}
+
+func (fc *ProtoForkChoice) ProposerBoostRoot() Root {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.proposerBoostRoot
 }
 
 func (fc *ProtoForkChoice) InSubtree(anchor Root, root Root) (unknown bool, inSubtree bool) {
@@ -232,6 +447,12 @@ func (fc *ProtoForkChoice) GetSlot(root Root) (slot Slot, ok bool) {
 	return fc.protoArray.GetSlot(root)
 }
 
+func (fc *ProtoForkChoice) GetAncestor(root Root, slot Slot) (ancestor Root, ok bool) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.protoArray.GetAncestor(root, slot)
+}
+
 func (fc *ProtoForkChoice) FindHead(anchorRoot Root, anchorSlot Slot) (NodeRef, error) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
@@ -241,6 +462,15 @@ func (fc *ProtoForkChoice) FindHead(anchorRoot Root, anchorSlot Slot) (NodeRef,
 	return fc.protoArray.FindHead(anchorRoot, anchorSlot)
 }
 
+func (fc *ProtoForkChoice) Graph(anchorRoot Root, anchorSlot Slot, minWeight Gwei) ([]GraphNode, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.updateVotesMaybe(); err != nil {
+		return nil, err
+	}
+	return fc.protoArray.Graph(anchorRoot, anchorSlot, minWeight)
+}
+
 func (fc *ProtoForkChoice) Head() (NodeRef, error) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
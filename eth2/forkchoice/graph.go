@@ -0,0 +1,74 @@
+package forkchoice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// GraphNode is a node of the forkchoice graph, as exported for debugging.
+type GraphNode struct {
+	Ref NodeRef `json:"ref"`
+	// The forkchoice parent, nil for the anchor of the export.
+	Parent *NodeRef `json:"parent,omitempty"`
+	// The parent root of the block, or of the latest block if the node is an empty slot.
+	ParentRoot Root `json:"parent_root"`
+	// Weight of the votes for the node and its descendants.
+	Weight         SignedGwei `json:"weight"`
+	BestChild      *NodeRef   `json:"best_child,omitempty"`
+	BestDescendant *NodeRef   `json:"best_descendant,omitempty"`
+	JustifiedEpoch Epoch      `json:"justified_epoch"`
+	FinalizedEpoch Epoch      `json:"finalized_epoch"`
+	// If the node matches the justified and finalized epochs of the forkchoice, and can be head.
+	Viable bool `json:"viable"`
+	// If the node is on the chain from the anchor to the head.
+	Canonical bool `json:"canonical"`
+}
+
+// WriteGraphJSON writes the graph nodes as an indented JSON list.
+func WriteGraphJSON(w io.Writer, nodes []GraphNode) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(nodes)
+}
+
+func dotNodeID(ref NodeRef) string {
+	return fmt.Sprintf("\"%s:%d\"", ref.Root, ref.Slot)
+}
+
+// WriteGraphDOT writes the graph nodes in the Graphviz DOT format.
+// Canonical nodes are highlighted, nodes that are not viable for head are dashed.
+// Empty slots are drawn as ellipses, nodes with a block as boxes.
+func WriteGraphDOT(w io.Writer, nodes []GraphNode) error {
+	if _, err := fmt.Fprintln(w, "digraph forkchoice {\n\trankdir=BT;"); err != nil {
+		return err
+	}
+	for i := range nodes {
+		n := &nodes[i]
+		shape := "box"
+		if n.Ref.Root == n.ParentRoot {
+			shape = "ellipse"
+		}
+		style := "solid"
+		if !n.Viable {
+			style = "dashed"
+		}
+		color := "black"
+		if n.Canonical {
+			color = "blue"
+		}
+		label := fmt.Sprintf("%s\\nslot %d\\nweight %d\\njustified %d finalized %d",
+			n.Ref.Root.String()[:10], n.Ref.Slot, n.Weight, n.JustifiedEpoch, n.FinalizedEpoch)
+		if _, err := fmt.Fprintf(w, "\t%s [label=\"%s\", shape=%s, style=%s, color=%s];\n",
+			dotNodeID(n.Ref), label, shape, style, color); err != nil {
+			return err
+		}
+		if n.Parent != nil {
+			if _, err := fmt.Fprintf(w, "\t%s -> %s [color=%s];\n", dotNodeID(n.Ref), dotNodeID(*n.Parent), color); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
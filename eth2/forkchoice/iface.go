@@ -3,6 +3,8 @@ package forkchoice
 import (
 	"context"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"io"
 )
 
 type Root = common.Root
@@ -16,14 +18,35 @@ type ExtendedNodeRef = common.ExtendedNodeRef
 type SignedGwei int64
 type NodeIndex uint64
 
+// ConflictingVotes is a pair of different votes of the same validator, for the same target epoch.
+type ConflictingVotes struct {
+	Index       ValidatorIndex
+	TargetEpoch Epoch
+	First       NodeRef
+	Second      NodeRef
+	// The attestations of the votes, to build an attester slashing with.
+	// Nil if the vote was processed without its attestation, see ProcessIndexedAttestation.
+	FirstAttestation  *phase0.IndexedAttestation
+	SecondAttestation *phase0.IndexedAttestation
+}
+
+// Snapshotter writes a versioned binary snapshot, to restore from after a restart.
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+}
+
 type ForkchoiceView interface {
 	CanonicalChain(anchorRoot Root, anchorSlot Slot) ([]ExtendedNodeRef, error)
 	ClosestToSlot(anchor Root, slot Slot) (closest NodeRef, err error)
 	CanonAtSlot(anchor Root, slot Slot, withBlock bool) (at NodeRef, err error)
 	GetSlot(blockRoot Root) (slot Slot, ok bool)
+	GetAncestor(root Root, slot Slot) (ancestor Root, ok bool)
 	FindHead(anchorRoot Root, anchorSlot Slot) (NodeRef, error)
 	InSubtree(anchor Root, root Root) (unknown bool, inSubtree bool)
 	Search(anchor NodeRef, parentRoot *Root, slot *Slot) (nonCanon []NodeRef, canon []NodeRef, err error)
+	// Graph exports the nodes in the subtree of the anchor, for debugging.
+	// Branches with a weight lower than minWeight are left out, the canonical chain is always included.
+	Graph(anchorRoot Root, anchorSlot Slot, minWeight Gwei) ([]GraphNode, error)
 }
 
 type ForkchoiceNodeInput interface {
@@ -37,6 +60,7 @@ type ForkchoiceGraph interface {
 	Indices() map[NodeRef]NodeIndex
 	ApplyScoreChanges(deltas []SignedGwei, justifiedEpoch Epoch, finalizedEpoch Epoch) error
 	OnPrune(ctx context.Context, anchorRoot Root, anchorSlot Slot) error
+	Snapshotter
 }
 
 type VoteInput interface {
@@ -44,23 +68,59 @@ type VoteInput interface {
 	// If the root/slot combination does not exist, no changes are made, and ok=false is returned.
 	// It is up to the caller if nodes should be added, to then process the attestation.
 	ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool)
+	// ProcessIndexedAttestation processes the vote of each of the attesting validators, like ProcessAttestation,
+	// and keeps the attestation with the votes, to report along with any conflicting vote.
+	ProcessIndexedAttestation(att *phase0.IndexedAttestation) (ok bool)
+	// ProcessEquivocation marks the validators as equivocating, e.g. the slashable validators of an attester slashing.
+	// The voting weight of equivocating validators is removed permanently, and their later votes are ignored.
+	ProcessEquivocation(indices []ValidatorIndex)
+}
+
+type VoteConflicts interface {
+	// Conflicts returns the conflicting votes that were detected, at most one pair per validator.
+	// A validator with conflicting votes is marked as equivocating.
+	// The attestations of the votes are included, to build an attester slashing with, if they are known.
+	Conflicts() []ConflictingVotes
 }
 
 type VoteStore interface {
 	VoteInput
+	VoteConflicts
 	HasChanges() bool
 	ComputeDeltas(indices map[NodeRef]NodeIndex, oldBalances []Gwei, newBalances []Gwei) []SignedGwei
+	// PruneConflicts drops the conflicting votes with a target epoch before the finalized epoch.
+	// The validators stay marked as equivocating.
+	PruneConflicts(finalized Epoch)
+	Snapshotter
 }
 
 type Forkchoice interface {
 	ForkchoiceView
-	ForkchoiceNodeInput
+	ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch)
+	// ProcessBlock adds the block to the forkchoice. A timely block, that arrived in the first third of its slot,
+	// receives the proposer score boost, until the next slot.
+	ProcessBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch,
+		arrival common.Timestamp) (ok bool)
+	// ProposerBoostRoot is the block root that receives the proposer score boost, zero if none.
+	ProposerBoostRoot() Root
 	VoteInput
+	VoteConflicts
+	// OnTick updates the time of the forkchoice. When the time enters a new epoch,
+	// the best justified checkpoint is promoted to justified checkpoint, if it is better.
+	OnTick(ctx context.Context, time common.Timestamp) error
+	// Time is the time of the forkchoice, as last updated by OnTick.
+	Time() common.Timestamp
+	// CurrentSlot is the slot of the time, as last updated by OnTick.
+	CurrentSlot() Slot
 	UpdateJustified(ctx context.Context, trigger Root, justified Checkpoint, finalized Checkpoint,
 		justifiedStateBalances func() ([]Gwei, error)) error
 	Pin() *NodeRef
 	SetPin(root Root, slot Slot) error
 	Justified() Checkpoint
+	// BestJustified is the best justified checkpoint that has been seen,
+	// which may not be applied yet to the justified checkpoint, see UpdateJustified.
+	BestJustified() Checkpoint
 	Finalized() Checkpoint
 	Head() (NodeRef, error)
+	Snapshotter
 }
@@ -184,10 +184,11 @@ type OpProcessBlock struct {
 	BlockSlot      forkchoice.Slot
 	JustifiedEpoch forkchoice.Epoch
 	FinalizedEpoch forkchoice.Epoch
+	Arrival        common.Timestamp
 }
 
 func (op *OpProcessBlock) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
-	fc.ProcessBlock(op.Parent, op.BlockRoot, op.BlockSlot, op.JustifiedEpoch, op.FinalizedEpoch)
+	fc.ProcessBlock(op.Parent, op.BlockRoot, op.BlockSlot, op.JustifiedEpoch, op.FinalizedEpoch, op.Arrival)
 	return nil
 }
 
@@ -225,7 +226,7 @@ type OpUpdateJustified struct {
 }
 
 func (op *OpUpdateJustified) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
-	err := fc.UpdateJustified(context.Background(), op.Trigger, op.Finalized, op.Justified, op.JustifiedStateBalances)
+	err := fc.UpdateJustified(context.Background(), op.Trigger, op.Justified, op.Finalized, op.JustifiedStateBalances)
 	if op.Ok && err != nil {
 		return fmt.Errorf("unexpected error: %v", err)
 	}
@@ -237,6 +238,7 @@ func (op *OpUpdateJustified) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkc
 
 type ForkChoiceTestInit struct {
 	Spec         *common.Spec
+	GenesisTime  common.Timestamp
 	Finalized    forkchoice.Checkpoint
 	Justified    forkchoice.Checkpoint
 	AnchorRoot   forkchoice.Root
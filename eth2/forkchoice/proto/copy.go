@@ -0,0 +1,81 @@
+package proto
+
+import (
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	. "github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+// Copy copies the nodes, to modify independently of the original. Pruned nodes of the copy go to the given sink.
+// The unfinalized part of the chain is small, the nodes are copied right away.
+func (pr *ProtoArray) Copy(sink NodeSink) *ProtoArray {
+	out := &ProtoArray{
+		sink:               sink,
+		indexOffset:        pr.indexOffset,
+		justifiedEpoch:     pr.justifiedEpoch,
+		finalizedEpoch:     pr.finalizedEpoch,
+		nodes:              append(make([]ProtoNode, 0, cap(pr.nodes)), pr.nodes...),
+		indices:            make(map[NodeRef]NodeIndex, len(pr.indices)),
+		blockSlots:         make(map[Root]Slot, len(pr.blockSlots)),
+		updatedConnections: pr.updatedConnections,
+	}
+	for ref, index := range pr.indices {
+		out.indices[ref] = index
+	}
+	for root, slot := range pr.blockSlots {
+		out.blockSlots[root] = slot
+	}
+	return out
+}
+
+// Copy copies the vote store, to modify independently of the original.
+// The votes of all validators are shared copy-on-write: copied by whichever of the two modifies them first.
+func (st *ProtoVoteStore) Copy() *ProtoVoteStore {
+	out := &ProtoVoteStore{
+		spec:         st.spec,
+		votes:        st.votes,
+		attestations: st.attestations,
+		sharedVotes:  true,
+		changed:      st.changed,
+		equivocating: make(map[ValidatorIndex]struct{}, len(st.equivocating)),
+		// appending to the capped slice allocates, the shared conflicts are not modified.
+		conflicts: st.conflicts[:len(st.conflicts):len(st.conflicts)],
+	}
+	for index := range st.equivocating {
+		out.equivocating[index] = struct{}{}
+	}
+	st.sharedVotes = true
+	return out
+}
+
+// ownVotes copies the votes before they are modified, if they are shared with a copy of the vote store.
+func (st *ProtoVoteStore) ownVotes() {
+	if st.sharedVotes {
+		st.votes = append(make([]VoteTracker, 0, cap(st.votes)), st.votes...)
+		st.attestations = append([]*phase0.IndexedAttestation(nil), st.attestations...)
+		st.sharedVotes = false
+	}
+}
+
+// CopyProtoForkChoice copies a forkchoice with a ProtoArray graph and ProtoVoteStore votes,
+// to modify independently of the original, e.g. to simulate blocks and attestations with.
+// Pruned nodes of the copy go to the given sink.
+func CopyProtoForkChoice(fc Forkchoice, sink NodeSink) (Forkchoice, error) {
+	pfc, ok := fc.(*ProtoForkChoice)
+	if !ok {
+		return nil, fmt.Errorf("cannot copy forkchoice of type %T", fc)
+	}
+	return pfc.Copy(func(graph ForkchoiceGraph) (ForkchoiceGraph, error) {
+		pr, ok := graph.(*ProtoArray)
+		if !ok {
+			return nil, fmt.Errorf("cannot copy forkchoice graph of type %T", graph)
+		}
+		return pr.Copy(sink), nil
+	}, func(votes VoteStore) (VoteStore, error) {
+		st, ok := votes.(*ProtoVoteStore)
+		if !ok {
+			return nil, fmt.Errorf("cannot copy votes of type %T", votes)
+		}
+		return st.Copy(), nil
+	})
+}
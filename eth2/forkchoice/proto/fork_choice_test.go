@@ -1,17 +1,24 @@
 package proto
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
 	"github.com/protolambda/zrnt/eth2/forkchoice"
 	"github.com/protolambda/zrnt/eth2/forkchoice/internal/fctest"
+	"strings"
 	"testing"
 )
 
 func TestProtoArray(t *testing.T) {
 	lhtest := fctest.LighthouseTestDef()
 	err := lhtest.Run(func(init *fctest.ForkChoiceTestInit, ft *fctest.ForkChoiceTestTarget) (forkchoice.Forkchoice, error) {
-		return NewProtoForkChoice(init.Spec, init.Finalized, init.Justified, init.AnchorRoot, init.AnchorSlot, init.AnchorParent, init.Balances,
+		return NewProtoForkChoice(init.Spec, init.GenesisTime, init.Finalized, init.Justified, init.AnchorRoot, init.AnchorSlot, init.AnchorParent, init.Balances,
 			NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
 				// whenever something is pruned, check if it was allowed to be pruned,
 				// and if it's marked as canonical correctly.
@@ -29,3 +36,529 @@ func TestProtoArray(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestProtoForkChoiceJustification(t *testing.T) {
+	spec := configs.Minimal
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0),
+		[]forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE},
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBlock := func(parent forkchoice.Root, root forkchoice.Root, slot forkchoice.Slot) {
+		parentSlot, ok := fc.GetSlot(parent)
+		if !ok {
+			t.Fatalf("unknown parent %s", parent)
+		}
+		for s := parentSlot + 1; s <= slot; s++ {
+			fc.ProcessSlot(parent, s, 0, 0)
+		}
+		if !fc.ProcessBlock(parent, root, slot, 0, 0, 0) {
+			t.Fatalf("failed to add block %s", root)
+		}
+	}
+	// chain A: a block every slot up to slot 9
+	for i := uint64(1); i <= 9; i++ {
+		addBlock(hash(i-1), hash(i), forkchoice.Slot(i))
+	}
+	// chain B: forks off after slot 1, up to the start of epoch 2
+	addBlock(hash(1), hash(102), 2)
+	addBlock(hash(102), hash(116), 16)
+
+	if anc, ok := fc.GetAncestor(hash(116), 8); !ok || anc != hash(102) {
+		t.Fatalf("unexpected ancestor: %s", anc)
+	}
+	ctx := context.Background()
+	tick := func(slot forkchoice.Slot) {
+		if err := fc.OnTick(ctx, common.Timestamp(slot)*spec.SECONDS_PER_SLOT); err != nil {
+			t.Fatal(err)
+		}
+		if fc.CurrentSlot() != slot {
+			t.Fatalf("expected current slot %d, got %d", slot, fc.CurrentSlot())
+		}
+	}
+	balances := func() ([]forkchoice.Gwei, error) {
+		return []forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE}, nil
+	}
+
+	// past the safe slots, but the new justified checkpoint descends from the current one.
+	tick(10)
+	justA := forkchoice.Checkpoint{Root: hash(8), Epoch: 1}
+	if err := fc.UpdateJustified(ctx, hash(9), justA, genesis, balances); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Justified() != justA {
+		t.Fatalf("expected justified checkpoint to update, got %s", fc.Justified())
+	}
+
+	// past the safe slots, and conflicting with the current justified checkpoint: delayed.
+	tick(18)
+	justB := forkchoice.Checkpoint{Root: hash(116), Epoch: 2}
+	if err := fc.UpdateJustified(ctx, hash(116), justB, genesis, balances); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Justified() != justA {
+		t.Fatalf("expected justified checkpoint update to be delayed, got %s", fc.Justified())
+	}
+	if fc.BestJustified() != justB {
+		t.Fatalf("expected best justified checkpoint %s, got %s", justB, fc.BestJustified())
+	}
+	tick(23)
+	if fc.Justified() != justA {
+		t.Fatal("expected best justified checkpoint to not be applied within the same epoch")
+	}
+	// the best justified checkpoint is applied at the start of the next epoch
+	tick(24)
+	if fc.Justified() != justB {
+		t.Fatalf("expected best justified checkpoint to be applied, got %s", fc.Justified())
+	}
+}
+
+func TestProtoForkChoiceBestJustifiedFinalized(t *testing.T) {
+	spec := configs.Minimal
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0),
+		[]forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE},
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBlock := func(parent forkchoice.Root, root forkchoice.Root, slot forkchoice.Slot, checkpoints forkchoice.Epoch) {
+		parentSlot, _ := fc.GetSlot(parent)
+		for s := parentSlot + 1; s <= slot; s++ {
+			fc.ProcessSlot(parent, s, 0, 0)
+		}
+		if !fc.ProcessBlock(parent, root, slot, checkpoints, checkpoints, 0) {
+			t.Fatalf("failed to add block %s", root)
+		}
+	}
+	// chain A: a block every slot up to slot 9, which finalizes epoch 1. Chain B: forks off after slot 1
+	for i := uint64(1); i <= 8; i++ {
+		addBlock(hash(i-1), hash(i), forkchoice.Slot(i), 0)
+	}
+	addBlock(hash(8), hash(9), 9, 1)
+	addBlock(hash(1), hash(102), 2, 0)
+	addBlock(hash(102), hash(116), 16, 0)
+
+	ctx := context.Background()
+	balances := func() ([]forkchoice.Gwei, error) {
+		return []forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE}, nil
+	}
+	if err := fc.OnTick(ctx, 18*spec.SECONDS_PER_SLOT); err != nil {
+		t.Fatal(err)
+	}
+	// chain B is justified, but too late in the epoch to apply it right away
+	justB := forkchoice.Checkpoint{Root: hash(116), Epoch: 2}
+	if err := fc.UpdateJustified(ctx, hash(116), justB, genesis, balances); err != nil {
+		t.Fatal(err)
+	}
+	// and then chain A is finalized
+	finA := forkchoice.Checkpoint{Root: hash(8), Epoch: 1}
+	if err := fc.UpdateJustified(ctx, hash(9), finA, finA, balances); err != nil {
+		t.Fatal(err)
+	}
+	if fc.BestJustified() != justB || fc.Justified() != finA {
+		t.Fatalf("unexpected checkpoints: best justified %s, justified %s", fc.BestJustified(), fc.Justified())
+	}
+	// the best justified checkpoint does not descend from the finalized checkpoint, it is not applied
+	if err := fc.OnTick(ctx, 24*spec.SECONDS_PER_SLOT); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Justified() != finA {
+		t.Fatalf("expected the justified checkpoint to stay on the finalized chain, got %s", fc.Justified())
+	}
+}
+
+func TestProtoForkChoiceProposerBoost(t *testing.T) {
+	spec := configs.Minimal
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	balances := make([]forkchoice.Gwei, 64)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0), balances,
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	slotTime := func(slot forkchoice.Slot) common.Timestamp {
+		return common.Timestamp(slot) * spec.SECONDS_PER_SLOT
+	}
+	if err := fc.OnTick(ctx, slotTime(1)); err != nil {
+		t.Fatal(err)
+	}
+	fc.ProcessSlot(hash(0), 1, 0, 0)
+	// timely block
+	if !fc.ProcessBlock(hash(0), hash(1), 1, 0, 0, slotTime(1)+1) {
+		t.Fatal("failed to add block")
+	}
+	// late block, competing for the same slot
+	if !fc.ProcessBlock(hash(0), hash(2), 1, 0, 0, slotTime(1)+spec.SECONDS_PER_SLOT/3) {
+		t.Fatal("failed to add block")
+	}
+	if fc.ProposerBoostRoot() != hash(1) {
+		t.Fatalf("expected timely block to be boosted, got %s", fc.ProposerBoostRoot())
+	}
+	// a single vote weighs less than the boost
+	if !fc.ProcessAttestation(0, hash(2), 1) {
+		t.Fatal("failed to process attestation")
+	}
+	if head, err := fc.Head(); err != nil {
+		t.Fatal(err)
+	} else if head != (forkchoice.NodeRef{Root: hash(1), Slot: 1}) {
+		t.Fatalf("expected boosted block to be head, got %s", head)
+	}
+	// the boost is removed in the next slot
+	if err := fc.OnTick(ctx, slotTime(2)); err != nil {
+		t.Fatal(err)
+	}
+	if fc.ProposerBoostRoot() != (forkchoice.Root{}) {
+		t.Fatal("expected proposer boost to be reset")
+	}
+	if head, err := fc.Head(); err != nil {
+		t.Fatal(err)
+	} else if head != (forkchoice.NodeRef{Root: hash(2), Slot: 1}) {
+		t.Fatalf("expected attested block to be head, got %s", head)
+	}
+}
+
+func TestProtoForkChoiceEquivocation(t *testing.T) {
+	spec := configs.Minimal
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	balances := []forkchoice.Gwei{32, 16, 8}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0), balances,
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.ProcessSlot(hash(0), 1, 0, 0)
+	for _, root := range []forkchoice.Root{hash(1), hash(2)} {
+		if !fc.ProcessBlock(hash(0), root, 1, 0, 0, 0) {
+			t.Fatal("failed to add block")
+		}
+	}
+	expectHead := func(root forkchoice.Root) {
+		t.Helper()
+		if head, err := fc.Head(); err != nil {
+			t.Fatal(err)
+		} else if head != (forkchoice.NodeRef{Root: root, Slot: 1}) {
+			t.Fatalf("expected head %s, got %s", root, head)
+		}
+	}
+	fc.ProcessAttestation(0, hash(1), 1)
+	fc.ProcessAttestation(1, hash(2), 1)
+	fc.ProcessAttestation(2, hash(2), 1)
+	expectHead(hash(1))
+
+	// validator 0 is slashed
+	fc.ProcessEquivocation([]forkchoice.ValidatorIndex{0})
+	expectHead(hash(2))
+
+	// validator 1 switches vote within the same target epoch
+	fc.ProcessAttestation(1, hash(1), 1)
+	expectHead(hash(2))
+	conflicts := fc.Conflicts()
+	expected := forkchoice.ConflictingVotes{
+		Index:       1,
+		TargetEpoch: 0,
+		First:       forkchoice.NodeRef{Root: hash(2), Slot: 1},
+		Second:      forkchoice.NodeRef{Root: hash(1), Slot: 1},
+	}
+	if len(conflicts) != 1 || conflicts[0] != expected {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+
+	// the attestations of conflicting votes are kept, to build an attester slashing with
+	first := &phase0.IndexedAttestation{
+		AttestingIndices: []forkchoice.ValidatorIndex{3},
+		Data:             phase0.AttestationData{Slot: 1, BeaconBlockRoot: hash(2)},
+		Signature:        common.BLSSignature{0x01},
+	}
+	second := &phase0.IndexedAttestation{
+		AttestingIndices: []forkchoice.ValidatorIndex{3},
+		Data:             phase0.AttestationData{Slot: 1, BeaconBlockRoot: hash(1)},
+		Signature:        common.BLSSignature{0x02},
+	}
+	if !fc.ProcessIndexedAttestation(first) || !fc.ProcessIndexedAttestation(second) {
+		t.Fatal("failed to process attestation")
+	}
+	conflicts = fc.Conflicts()
+	if len(conflicts) != 2 || conflicts[1].FirstAttestation != first || conflicts[1].SecondAttestation != second {
+		t.Fatalf("expected the attestations of the conflicting votes, got %v", conflicts)
+	}
+	var buf bytes.Buffer
+	if err := fc.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreProtoForkChoice(spec, &buf, nil, func(nodes map[forkchoice.NodeRef]forkchoice.NodeIndex) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredConflicts := restored.Conflicts()
+	if len(restoredConflicts) != 2 || restoredConflicts[0] != conflicts[0] {
+		t.Fatalf("restored conflicts differ: %v", restoredConflicts)
+	}
+	if got := restoredConflicts[1]; got.FirstAttestation == nil || got.SecondAttestation == nil ||
+		got.FirstAttestation.Signature != first.Signature || got.SecondAttestation.Data != second.Data {
+		t.Fatal("expected the attestations of the conflicting votes to be restored")
+	}
+
+	// conflicts before the finalized epoch are pruned
+	votes := NewProtoVoteStore(spec)
+	votes.ProcessAttestation(0, hash(1), 1)
+	votes.ProcessAttestation(0, hash(2), 1)
+	votes.ProcessAttestation(1, hash(1), forkchoice.Slot(spec.SLOTS_PER_EPOCH))
+	votes.ProcessAttestation(1, hash(2), forkchoice.Slot(spec.SLOTS_PER_EPOCH))
+	votes.PruneConflicts(1)
+	if conflicts := votes.Conflicts(); len(conflicts) != 1 || conflicts[0].Index != 1 {
+		t.Fatalf("expected only the conflict of epoch 1 to be kept, got %v", conflicts)
+	}
+}
+
+func TestProtoForkChoiceSnapshot(t *testing.T) {
+	spec := configs.Minimal
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0), []forkchoice.Gwei{32, 16, 8},
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.ProcessSlot(hash(0), 1, 0, 0)
+	for _, root := range []forkchoice.Root{hash(1), hash(2)} {
+		if !fc.ProcessBlock(hash(0), root, 1, 0, 0, 0) {
+			t.Fatal("failed to add block")
+		}
+	}
+	fc.ProcessSlot(hash(2), 3, 0, 0)
+	fc.ProcessAttestation(0, hash(1), 1)
+	fc.ProcessAttestation(1, hash(2), 1)
+	fc.ProcessAttestation(1, hash(1), 1)
+	fc.ProcessAttestation(2, hash(2), 1)
+	head, err := fc.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := fc.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+	restored, err := RestoreProtoForkChoice(spec, bytes.NewReader(snapshot), nil, func(nodes map[forkchoice.NodeRef]forkchoice.NodeIndex) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredHead, err := restored.Head(); err != nil {
+		t.Fatal(err)
+	} else if restoredHead != head {
+		t.Fatalf("restored head %s differs from %s", restoredHead, head)
+	}
+	if restored.Justified() != fc.Justified() || restored.Finalized() != fc.Finalized() {
+		t.Fatal("restored checkpoints differ")
+	}
+	if conflicts := restored.Conflicts(); len(conflicts) != 1 || conflicts[0] != fc.Conflicts()[0] {
+		t.Fatalf("restored conflicts differ: %v", conflicts)
+	}
+	var again bytes.Buffer
+	if err := restored.Snapshot(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), snapshot) {
+		t.Fatal("snapshot of restored forkchoice differs")
+	}
+	// vote weights keep working after restoring
+	restored.ProcessEquivocation([]forkchoice.ValidatorIndex{0})
+	if restoredHead, err := restored.Head(); err != nil {
+		t.Fatal(err)
+	} else if restoredHead != (forkchoice.NodeRef{Root: hash(2), Slot: 3}) {
+		t.Fatalf("unexpected head after equivocation: %s", restoredHead)
+	}
+
+	if _, err := RestoreProtoForkChoice(spec, bytes.NewReader(snapshot), nil, func(nodes map[forkchoice.NodeRef]forkchoice.NodeIndex) error {
+		if _, ok := nodes[forkchoice.NodeRef{Root: hash(2), Slot: 1}]; ok {
+			return fmt.Errorf("unknown block %s", hash(2))
+		}
+		return nil
+	}); err == nil {
+		t.Fatal("expected snapshot with unknown block to be rejected")
+	}
+	if _, err := RestoreProtoForkChoice(spec, bytes.NewReader(snapshot[:len(snapshot)-1]), nil, func(nodes map[forkchoice.NodeRef]forkchoice.NodeIndex) error {
+		return nil
+	}); err == nil {
+		t.Fatal("expected truncated snapshot to be rejected")
+	}
+}
+
+func TestProtoForkChoiceGraph(t *testing.T) {
+	spec := configs.Minimal
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	// not the zero root, that is an alias for the genesis block, for votes that are not set.
+	genesis := forkchoice.Checkpoint{Root: hash(10), Epoch: 0}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(10), 0, hash(10), []forkchoice.Gwei{32, 16, 8},
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []forkchoice.Root{hash(1), hash(2), hash(3)} {
+		if !fc.ProcessBlock(hash(10), root, 1, 0, 0, 0) {
+			t.Fatal("failed to add block")
+		}
+	}
+	fc.ProcessAttestation(0, hash(1), 1)
+	fc.ProcessAttestation(1, hash(2), 1)
+
+	nodes, err := fc.Graph(hash(10), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byRef := make(map[forkchoice.NodeRef]forkchoice.GraphNode)
+	for _, n := range nodes {
+		byRef[n.Ref] = n
+	}
+	if len(byRef) != len(nodes) {
+		t.Fatal("duplicate nodes")
+	}
+	anchor, ok := byRef[forkchoice.NodeRef{Root: hash(10), Slot: 0}]
+	if !ok || anchor.Parent != nil || !anchor.Canonical || anchor.Weight != 48 {
+		t.Fatalf("unexpected anchor node: %+v", anchor)
+	}
+	if anchor.BestDescendant == nil || *anchor.BestDescendant != (forkchoice.NodeRef{Root: hash(1), Slot: 1}) {
+		t.Fatal("expected best descendant of anchor to be the head")
+	}
+	if head, ok := byRef[forkchoice.NodeRef{Root: hash(1), Slot: 1}]; !ok || !head.Canonical || head.Weight != 32 || !head.Viable {
+		t.Fatalf("unexpected head node: %+v", head)
+	}
+	if other, ok := byRef[forkchoice.NodeRef{Root: hash(2), Slot: 1}]; !ok || other.Canonical || other.Weight != 16 {
+		t.Fatalf("unexpected non-canonical node: %+v", other)
+	}
+	// the branch without votes, and the empty slot, are pruned
+	if len(nodes) != 3 {
+		t.Fatalf("expected low weight nodes to be pruned, got %d nodes", len(nodes))
+	}
+	if all, err := fc.Graph(hash(10), 0, 0); err != nil {
+		t.Fatal(err)
+	} else if len(all) != 5 {
+		t.Fatalf("expected all nodes without pruning, got %d nodes", len(all))
+	}
+
+	var jsonOut bytes.Buffer
+	if err := forkchoice.WriteGraphJSON(&jsonOut, nodes); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []forkchoice.GraphNode
+	if err := json.Unmarshal(jsonOut.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(nodes) || decoded[1].Ref != nodes[1].Ref || *decoded[1].Parent != *nodes[1].Parent {
+		t.Fatal("JSON export does not round-trip")
+	}
+	var dotOut bytes.Buffer
+	if err := forkchoice.WriteGraphDOT(&dotOut, nodes); err != nil {
+		t.Fatal(err)
+	}
+	dot := dotOut.String()
+	edge := fmt.Sprintf("\"%s:1\" -> \"%s:0\" [color=blue];", hash(1), hash(10))
+	if !strings.HasPrefix(dot, "digraph forkchoice {") || !strings.Contains(dot, edge) {
+		t.Fatalf("unexpected DOT output:\n%s", dot)
+	}
+}
+
+func TestProtoForkChoiceCopy(t *testing.T) {
+	spec := configs.Minimal
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(10), Epoch: 0}
+	balances := []forkchoice.Gwei{32, 16, 8}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(10), 0, hash(10), balances,
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.ProcessSlot(hash(10), 1, 0, 0)
+	for _, root := range []forkchoice.Root{hash(1), hash(2)} {
+		if !fc.ProcessBlock(hash(10), root, 1, 0, 0, 0) {
+			t.Fatal("failed to add block")
+		}
+	}
+	cp, err := CopyProtoForkChoice(fc, NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same validator votes differently in the original and the copy
+	if !fc.ProcessAttestation(0, hash(1), 1) {
+		t.Fatal("failed to process attestation")
+	}
+	if head, err := fc.Head(); err != nil {
+		t.Fatal(err)
+	} else if head.Root != hash(1) {
+		t.Fatalf("unexpected head of original: %s", head)
+	}
+	if !cp.ProcessAttestation(0, hash(2), 1) {
+		t.Fatal("failed to process attestation")
+	}
+	if head, err := cp.Head(); err != nil {
+		t.Fatal(err)
+	} else if head.Root != hash(2) {
+		t.Fatalf("unexpected head of copy: %s", head)
+	}
+	if head, err := fc.Head(); err != nil {
+		t.Fatal(err)
+	} else if head.Root != hash(1) {
+		t.Fatalf("copy changed head of original: %s", head)
+	}
+	// blocks of the copy are not added to the original
+	cp.ProcessSlot(hash(2), 2, 0, 0)
+	if !cp.ProcessBlock(hash(2), hash(3), 2, 0, 0, 0) {
+		t.Fatal("failed to add block")
+	}
+	if _, ok := fc.GetSlot(hash(3)); ok {
+		t.Fatal("block of copy was added to the original")
+	}
+}
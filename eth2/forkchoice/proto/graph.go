@@ -0,0 +1,70 @@
+package proto
+
+import (
+	. "github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+// Graph exports the subtree of the anchor, for debugging.
+// Branches with a weight lower than minWeight are left out, the canonical chain is always included.
+// The nodes are ordered such that parents come before their children.
+func (pr *ProtoArray) Graph(anchorRoot Root, anchorSlot Slot, minWeight Gwei) ([]GraphNode, error) {
+	head, err := pr.FindHead(anchorRoot, anchorSlot)
+	if err != nil {
+		return nil, err
+	}
+	anchorIndex := pr.indices[NodeRef{Root: anchorRoot, Slot: anchorSlot}]
+	canonical := make(map[NodeIndex]struct{})
+	for i := pr.indices[head]; i != NONE && i >= anchorIndex; {
+		canonical[i] = struct{}{}
+		node, err := pr.getNode(i)
+		if err != nil {
+			return nil, err
+		}
+		i = node.ForkchoiceParent
+	}
+	refOf := func(index NodeIndex) *NodeRef {
+		if index == NONE || index < pr.indexOffset {
+			return nil
+		}
+		node, err := pr.getNode(index)
+		if err != nil {
+			return nil
+		}
+		ref := node.Ref
+		return &ref
+	}
+	included := make(map[NodeIndex]struct{})
+	var out []GraphNode
+	for i := anchorIndex; i < pr.indexOffset+NodeIndex(len(pr.nodes)); i++ {
+		node, err := pr.getNode(i)
+		if err != nil {
+			return nil, err
+		}
+		_, isCanon := canonical[i]
+		if i != anchorIndex {
+			if _, ok := included[node.ForkchoiceParent]; !ok {
+				continue
+			}
+			if !isCanon && node.Weight < SignedGwei(minWeight) {
+				continue
+			}
+		}
+		included[i] = struct{}{}
+		gn := GraphNode{
+			Ref:            node.Ref,
+			ParentRoot:     node.ParentRoot,
+			Weight:         node.Weight,
+			BestChild:      refOf(node.BestChild),
+			BestDescendant: refOf(node.BestDescendant),
+			JustifiedEpoch: node.JustifiedEpoch,
+			FinalizedEpoch: node.FinalizedEpoch,
+			Viable:         pr.isNodeViableForHead(node),
+			Canonical:      isCanon,
+		}
+		if i != anchorIndex {
+			gn.Parent = refOf(node.ForkchoiceParent)
+		}
+		out = append(out, gn)
+	}
+	return out, nil
+}
@@ -231,6 +231,33 @@ func (pr *ProtoArray) GetSlot(blockRoot Root) (Slot, bool) {
 	return slot, ok
 }
 
+// GetAncestor returns the root of the block at or before the given slot, in the chain of the given block root.
+// Returns ok=false if the block root is unknown, or if the slot is before the known (i.e. unpruned) part of the chain.
+func (pr *ProtoArray) GetAncestor(root Root, slot Slot) (ancestor Root, ok bool) {
+	blockSlot, ok := pr.blockSlots[root]
+	if !ok {
+		return Root{}, false
+	}
+	if blockSlot <= slot {
+		return root, true
+	}
+	index, ok := pr.indices[NodeRef{Root: root, Slot: blockSlot}]
+	if !ok {
+		return Root{}, false
+	}
+	for index != NONE {
+		node, err := pr.getNode(index)
+		if err != nil {
+			return Root{}, false
+		}
+		if node.Ref.Slot <= slot {
+			return node.Ref.Root, true
+		}
+		index = node.TransitionParent
+	}
+	return Root{}, false
+}
+
 // Searches the available nodes for blocks with a matching parent root and/or matching slot.
 // If no options are specified, the
 func (pr *ProtoArray) Search(anchor NodeRef, parentRoot *Root, slot *Slot) (nonCanon []NodeRef, canon []NodeRef, err error) {
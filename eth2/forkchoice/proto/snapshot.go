@@ -0,0 +1,350 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	. "github.com/protolambda/zrnt/eth2/forkchoice"
+	"github.com/protolambda/ztyp/codec"
+	"io"
+	"sort"
+)
+
+// The versions of the snapshot formats, written at the start of each snapshot.
+const (
+	protoArraySnapshotVersion uint64 = 1
+	voteStoreSnapshotVersion  uint64 = 2
+)
+
+type protoArrayRecord struct {
+	IndexOffset        NodeIndex
+	JustifiedEpoch     Epoch
+	FinalizedEpoch     Epoch
+	UpdatedConnections bool
+}
+
+type conflictRecord struct {
+	Index       ValidatorIndex
+	TargetEpoch Epoch
+	First       NodeRef
+	Second      NodeRef
+}
+
+// writeAttestation writes a presence flag, and the length and SSZ of the attestation if it is present.
+func writeAttestation(w io.Writer, spec *common.Spec, att *phase0.IndexedAttestation) error {
+	if err := binary.Write(w, binary.LittleEndian, att != nil); err != nil || att == nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := att.Serialize(spec, codec.NewEncodingWriter(&buf)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(buf.Len())); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readAttestation reads an attestation as written by writeAttestation, nil if not present.
+func readAttestation(r io.Reader, spec *common.Spec) (*phase0.IndexedAttestation, error) {
+	var present bool
+	if err := binary.Read(r, binary.LittleEndian, &present); err != nil || !present {
+		return nil, err
+	}
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	var att phase0.IndexedAttestation
+	if length > att.ByteLength(spec)+uint64(spec.MAX_VALIDATORS_PER_COMMITTEE)*8 {
+		return nil, fmt.Errorf("attestation length %d too large", length)
+	}
+	if err := att.Deserialize(spec, codec.NewDecodingReader(r, length)); err != nil {
+		return nil, err
+	}
+	return &att, nil
+}
+
+type blockSlotRecord struct {
+	Root Root
+	Slot Slot
+}
+
+func writeVersion(w io.Writer, version uint64) error {
+	return binary.Write(w, binary.LittleEndian, version)
+}
+
+func readVersion(r io.Reader, version uint64) error {
+	var v uint64
+	if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+		return err
+	}
+	if v != version {
+		return fmt.Errorf("unsupported snapshot version %d, expected %d", v, version)
+	}
+	return nil
+}
+
+// writeList writes the length, followed by each of the elements.
+func writeList(w io.Writer, length int, elem func(i int) interface{}) error {
+	if err := binary.Write(w, binary.LittleEndian, uint64(length)); err != nil {
+		return err
+	}
+	for i := 0; i < length; i++ {
+		if err := binary.Write(w, binary.LittleEndian, elem(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readList reads the length, and then each of the elements.
+// Elements are read one by one, to not allocate for a corrupt length before the data is there.
+func readList(r io.Reader, readElem func() error) error {
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return err
+	}
+	for i := uint64(0); i < length; i++ {
+		if err := readElem(); err != nil {
+			return fmt.Errorf("failed to read list element %d of %d: %v", i, length, err)
+		}
+	}
+	return nil
+}
+
+// Snapshot writes the nodes, with their weights and best child/descendant links, and the known block slots.
+func (pr *ProtoArray) Snapshot(w io.Writer) error {
+	if err := writeVersion(w, protoArraySnapshotVersion); err != nil {
+		return err
+	}
+	rec := protoArrayRecord{
+		IndexOffset:        pr.indexOffset,
+		JustifiedEpoch:     pr.justifiedEpoch,
+		FinalizedEpoch:     pr.finalizedEpoch,
+		UpdatedConnections: pr.updatedConnections,
+	}
+	if err := binary.Write(w, binary.LittleEndian, &rec); err != nil {
+		return err
+	}
+	if err := writeList(w, len(pr.nodes), func(i int) interface{} {
+		return &pr.nodes[i]
+	}); err != nil {
+		return err
+	}
+	// sorted, to keep the snapshot deterministic
+	blockSlots := make([]blockSlotRecord, 0, len(pr.blockSlots))
+	for root, slot := range pr.blockSlots {
+		blockSlots = append(blockSlots, blockSlotRecord{Root: root, Slot: slot})
+	}
+	sort.Slice(blockSlots, func(i, j int) bool {
+		if blockSlots[i].Slot == blockSlots[j].Slot {
+			return bytes.Compare(blockSlots[i].Root[:], blockSlots[j].Root[:]) < 0
+		}
+		return blockSlots[i].Slot < blockSlots[j].Slot
+	})
+	return writeList(w, len(blockSlots), func(i int) interface{} {
+		return &blockSlots[i]
+	})
+}
+
+// RestoreProtoArray reads a snapshot, as written by ProtoArray.Snapshot, and checks the consistency of the nodes.
+func RestoreProtoArray(r io.Reader, sink NodeSink) (*ProtoArray, error) {
+	if err := readVersion(r, protoArraySnapshotVersion); err != nil {
+		return nil, err
+	}
+	var rec protoArrayRecord
+	if err := binary.Read(r, binary.LittleEndian, &rec); err != nil {
+		return nil, err
+	}
+	pr := &ProtoArray{
+		sink:               sink,
+		indexOffset:        rec.IndexOffset,
+		justifiedEpoch:     rec.JustifiedEpoch,
+		finalizedEpoch:     rec.FinalizedEpoch,
+		nodes:              make([]ProtoNode, 0, 100),
+		indices:            make(map[NodeRef]NodeIndex, 100),
+		blockSlots:         make(map[Root]Slot, 100),
+		updatedConnections: rec.UpdatedConnections,
+	}
+	if err := readList(r, func() error {
+		var node ProtoNode
+		if err := binary.Read(r, binary.LittleEndian, &node); err != nil {
+			return err
+		}
+		index := pr.indexOffset + NodeIndex(len(pr.nodes))
+		if _, ok := pr.indices[node.Ref]; ok {
+			return fmt.Errorf("duplicate node %s", node.Ref)
+		}
+		// links can only go back to earlier nodes
+		if node.TransitionParent != NONE && (node.TransitionParent < pr.indexOffset || node.TransitionParent >= index) {
+			return fmt.Errorf("node %s has invalid transition parent %d", node.Ref, node.TransitionParent)
+		}
+		if node.ForkchoiceParent != NONE && (node.ForkchoiceParent < pr.indexOffset || node.ForkchoiceParent >= index) {
+			return fmt.Errorf("node %s has invalid forkchoice parent %d", node.Ref, node.ForkchoiceParent)
+		}
+		pr.indices[node.Ref] = index
+		pr.nodes = append(pr.nodes, node)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read nodes: %v", err)
+	}
+	if len(pr.nodes) == 0 {
+		return nil, fmt.Errorf("snapshot has no nodes")
+	}
+	end := pr.indexOffset + NodeIndex(len(pr.nodes))
+	for i := range pr.nodes {
+		node := &pr.nodes[i]
+		if node.BestChild != NONE && (node.BestChild < pr.indexOffset || node.BestChild >= end) {
+			return nil, fmt.Errorf("node %s has invalid best child %d", node.Ref, node.BestChild)
+		}
+		if node.BestDescendant != NONE && (node.BestDescendant < pr.indexOffset || node.BestDescendant >= end) {
+			return nil, fmt.Errorf("node %s has invalid best descendant %d", node.Ref, node.BestDescendant)
+		}
+	}
+	if err := readList(r, func() error {
+		var bs blockSlotRecord
+		if err := binary.Read(r, binary.LittleEndian, &bs); err != nil {
+			return err
+		}
+		if _, ok := pr.indices[NodeRef{Root: bs.Root, Slot: bs.Slot}]; !ok {
+			return fmt.Errorf("block %s at slot %d has no node", bs.Root, bs.Slot)
+		}
+		pr.blockSlots[bs.Root] = bs.Slot
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read block slots: %v", err)
+	}
+	return pr, nil
+}
+
+// Snapshot writes the votes, equivocating validators and detected vote conflicts, with their attestations.
+// The attestations of the votes that did not conflict (yet) are not included.
+func (st *ProtoVoteStore) Snapshot(w io.Writer) error {
+	if err := writeVersion(w, voteStoreSnapshotVersion); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, st.changed); err != nil {
+		return err
+	}
+	if err := writeList(w, len(st.votes), func(i int) interface{} {
+		return &st.votes[i]
+	}); err != nil {
+		return err
+	}
+	equivocating := make([]ValidatorIndex, 0, len(st.equivocating))
+	for index := range st.equivocating {
+		equivocating = append(equivocating, index)
+	}
+	sort.Slice(equivocating, func(i, j int) bool {
+		return equivocating[i] < equivocating[j]
+	})
+	if err := writeList(w, len(equivocating), func(i int) interface{} {
+		return equivocating[i]
+	}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(st.conflicts))); err != nil {
+		return err
+	}
+	for i := range st.conflicts {
+		c := &st.conflicts[i]
+		if err := binary.Write(w, binary.LittleEndian, &conflictRecord{
+			Index:       c.Index,
+			TargetEpoch: c.TargetEpoch,
+			First:       c.First,
+			Second:      c.Second,
+		}); err != nil {
+			return err
+		}
+		if err := writeAttestation(w, st.spec, c.FirstAttestation); err != nil {
+			return err
+		}
+		if err := writeAttestation(w, st.spec, c.SecondAttestation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreProtoVoteStore reads a snapshot, as written by ProtoVoteStore.Snapshot.
+func RestoreProtoVoteStore(spec *common.Spec, r io.Reader) (*ProtoVoteStore, error) {
+	if err := readVersion(r, voteStoreSnapshotVersion); err != nil {
+		return nil, err
+	}
+	st := &ProtoVoteStore{spec: spec, equivocating: make(map[ValidatorIndex]struct{})}
+	if err := binary.Read(r, binary.LittleEndian, &st.changed); err != nil {
+		return nil, err
+	}
+	if err := readList(r, func() error {
+		if uint64(len(st.votes)) >= spec.VALIDATOR_REGISTRY_LIMIT {
+			return fmt.Errorf("too many votes")
+		}
+		var vote VoteTracker
+		if err := binary.Read(r, binary.LittleEndian, &vote); err != nil {
+			return err
+		}
+		st.votes = append(st.votes, vote)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read votes: %v", err)
+	}
+	if err := readList(r, func() error {
+		var index ValidatorIndex
+		if err := binary.Read(r, binary.LittleEndian, &index); err != nil {
+			return err
+		}
+		st.equivocating[index] = struct{}{}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read equivocating validators: %v", err)
+	}
+	if err := readList(r, func() error {
+		var rec conflictRecord
+		if err := binary.Read(r, binary.LittleEndian, &rec); err != nil {
+			return err
+		}
+		first, err := readAttestation(r, spec)
+		if err != nil {
+			return fmt.Errorf("failed to read first attestation: %v", err)
+		}
+		second, err := readAttestation(r, spec)
+		if err != nil {
+			return fmt.Errorf("failed to read second attestation: %v", err)
+		}
+		st.conflicts = append(st.conflicts, ConflictingVotes{
+			Index:             rec.Index,
+			TargetEpoch:       rec.TargetEpoch,
+			First:             rec.First,
+			Second:            rec.Second,
+			FirstAttestation:  first,
+			SecondAttestation: second,
+		})
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read vote conflicts: %v", err)
+	}
+	return st, nil
+}
+
+// RestoreProtoForkChoice restores a forkchoice from a snapshot, as written by ProtoForkChoice.Snapshot.
+// The nodes of the restored graph are checked with the checkNodes function,
+// e.g. to check that they match the nodes of the hot chain.
+func RestoreProtoForkChoice(spec *common.Spec, r io.Reader, sink NodeSink,
+	checkNodes func(nodes map[NodeRef]NodeIndex) error) (Forkchoice, error) {
+	return RestoreForkChoice(spec, r, func(r io.Reader) (ForkchoiceGraph, error) {
+		pr, err := RestoreProtoArray(r, sink)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkNodes(pr.Indices()); err != nil {
+			return nil, err
+		}
+		return pr, nil
+	}, func(r io.Reader) (VoteStore, error) {
+		return RestoreProtoVoteStore(spec, r)
+	})
+}
@@ -2,6 +2,7 @@ package proto
 
 import (
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	. "github.com/protolambda/zrnt/eth2/forkchoice"
 )
 
@@ -13,19 +14,49 @@ type VoteTracker struct {
 }
 
 type ProtoVoteStore struct {
-	spec    *common.Spec
-	votes   []VoteTracker
-	changed bool
+	spec  *common.Spec
+	votes []VoteTracker
+	// The attestations of the next votes, by validator, if processed with ProcessIndexedAttestation.
+	// Shared between the validators of the same attestation.
+	attestations []*phase0.IndexedAttestation
+	changed      bool
+	// Validators that equivocated. Their votes are removed and ignored.
+	equivocating map[ValidatorIndex]struct{}
+	conflicts    []ConflictingVotes
+	// If the votes are shared with a copy of the vote store, and must be copied before modifying them.
+	sharedVotes bool
 }
 
 var _ VoteStore = (*ProtoVoteStore)(nil)
 
 func NewProtoVoteStore(spec *common.Spec) VoteStore {
-	return &ProtoVoteStore{spec: spec, changed: true}
+	return &ProtoVoteStore{spec: spec, changed: true, equivocating: make(map[ValidatorIndex]struct{})}
 }
 
 // Process an attestation. (Note that the head slot may be for a gap slot after the block root)
+// A different vote for the same target epoch as the latest vote is a conflict, and marks the validator as equivocating.
+// Only the latest vote is compared against, earlier conflicting votes are not detected.
 func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool) {
+	st.ownVotes()
+	st.processVote(index, blockRoot, headSlot, nil)
+	return true
+}
+
+// ProcessIndexedAttestation processes the vote of each attesting validator, see ProcessAttestation.
+// The attestation is kept with the votes, and included in the conflicting votes.
+func (st *ProtoVoteStore) ProcessIndexedAttestation(att *phase0.IndexedAttestation) (ok bool) {
+	st.ownVotes()
+	for _, index := range att.AttestingIndices {
+		st.processVote(index, att.Data.BeaconBlockRoot, att.Data.Slot, att)
+	}
+	return true
+}
+
+// processVote processes the vote of a single validator. The votes must be owned, see ownVotes.
+func (st *ProtoVoteStore) processVote(index ValidatorIndex, blockRoot Root, headSlot Slot, att *phase0.IndexedAttestation) {
+	if _, ok := st.equivocating[index]; ok {
+		return
+	}
 	if index >= ValidatorIndex(len(st.votes)) {
 		if index < ValidatorIndex(cap(st.votes)) {
 			st.votes = st.votes[:index+1]
@@ -36,14 +67,70 @@ func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Roo
 	}
 	vote := &st.votes[index]
 	targetEpoch := st.spec.SlotToEpoch(headSlot)
+	ref := NodeRef{Root: blockRoot, Slot: headSlot}
+	if vote.Next != (NodeRef{}) && targetEpoch == vote.NextTargetEpoch && vote.Next != ref {
+		st.conflicts = append(st.conflicts, ConflictingVotes{
+			Index:             index,
+			TargetEpoch:       targetEpoch,
+			First:             vote.Next,
+			Second:            ref,
+			FirstAttestation:  st.voteAttestation(index),
+			SecondAttestation: att,
+		})
+		st.equivocating[index] = struct{}{}
+		st.changed = true
+		return
+	}
 	// only update if it's a newer vote, or if it's genesis and no vote has happened yet.
 	if targetEpoch > vote.NextTargetEpoch || (targetEpoch == 0 && *vote == (VoteTracker{})) {
 		vote.NextTargetEpoch = targetEpoch
-		vote.Next = NodeRef{Root: blockRoot, Slot: headSlot}
+		vote.Next = ref
+		st.setVoteAttestation(index, att)
 		st.changed = true
 	}
-	// TODO: maybe help detect slashable votes on the fly?
-	return true
+}
+
+// voteAttestation returns the attestation of the next vote of the validator, nil if unknown.
+func (st *ProtoVoteStore) voteAttestation(index ValidatorIndex) *phase0.IndexedAttestation {
+	if index < ValidatorIndex(len(st.attestations)) {
+		return st.attestations[index]
+	}
+	return nil
+}
+
+// setVoteAttestation keeps the attestation of the next vote of the validator. The votes must be owned.
+func (st *ProtoVoteStore) setVoteAttestation(index ValidatorIndex, att *phase0.IndexedAttestation) {
+	if index >= ValidatorIndex(len(st.attestations)) {
+		if att == nil {
+			return
+		}
+		st.attestations = append(st.attestations, make([]*phase0.IndexedAttestation, index+1-ValidatorIndex(len(st.attestations)))...)
+	}
+	st.attestations[index] = att
+}
+
+func (st *ProtoVoteStore) ProcessEquivocation(indices []ValidatorIndex) {
+	for _, index := range indices {
+		if _, ok := st.equivocating[index]; !ok {
+			st.equivocating[index] = struct{}{}
+			st.changed = true
+		}
+	}
+}
+
+func (st *ProtoVoteStore) Conflicts() []ConflictingVotes {
+	return append([]ConflictingVotes(nil), st.conflicts...)
+}
+
+func (st *ProtoVoteStore) PruneConflicts(finalized Epoch) {
+	// a new slice, the conflicts may be shared with a copy of the vote store.
+	var kept []ConflictingVotes
+	for _, c := range st.conflicts {
+		if c.TargetEpoch >= finalized {
+			kept = append(kept, c)
+		}
+	}
+	st.conflicts = kept
 }
 
 func (st *ProtoVoteStore) HasChanges() bool {
@@ -55,6 +142,7 @@ func (st *ProtoVoteStore) HasChanges() bool {
 // The votestore is updated, the next deltas will be 0 if ProcessAttestation is not changing any vote.
 func (st *ProtoVoteStore) ComputeDeltas(indices map[NodeRef]NodeIndex, oldBalances []Gwei, newBalances []Gwei) []SignedGwei {
 	deltas := make([]SignedGwei, len(indices), len(indices))
+	st.ownVotes()
 	for i := 0; i < len(st.votes); i++ {
 		vote := &st.votes[i]
 		// There is no need to create a score change if the validator has never voted (may not be active)
@@ -62,6 +150,17 @@ func (st *ProtoVoteStore) ComputeDeltas(indices map[NodeRef]NodeIndex, oldBalanc
 		if vote.Current == (NodeRef{}) && vote.Next == (NodeRef{}) {
 			continue
 		}
+		// Remove the weight of equivocating validators, once. Their votes are cleared, and not updated anymore.
+		if _, ok := st.equivocating[ValidatorIndex(i)]; ok {
+			if i < len(oldBalances) {
+				if currentIndex, ok := indices[vote.Current]; ok {
+					deltas[currentIndex] -= SignedGwei(oldBalances[i])
+				}
+			}
+			*vote = VoteTracker{}
+			st.setVoteAttestation(ValidatorIndex(i), nil)
+			continue
+		}
 
 		// Validator sets may have different sizes (but attesters are not different, activation only under finality)
 		oldBal := Gwei(0)
@@ -0,0 +1,171 @@
+package forkchoice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"io"
+)
+
+// The version of the forkchoice snapshot format, written at the start of the snapshot.
+const forkChoiceSnapshotVersion uint64 = 1
+
+// The fixed-size part of the forkchoice snapshot, encoded in little-endian.
+type forkChoiceRecord struct {
+	HasPin            bool
+	Pin               NodeRef
+	Justified         Checkpoint
+	Finalized         Checkpoint
+	BestJustified     Checkpoint
+	GenesisTime       common.Timestamp
+	Time              common.Timestamp
+	ProposerBoostRoot Root
+	AppliedBoost      NodeRef
+	AppliedBoostScore SignedGwei
+}
+
+// writeGweiList writes the length-prefixed list of balances.
+func writeGweiList(w io.Writer, list []Gwei) error {
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(list))); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, list)
+}
+
+// readGweiList reads a length-prefixed list of balances, of at most the given length.
+func readGweiList(r io.Reader, max uint64) ([]Gwei, error) {
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > max {
+		return nil, fmt.Errorf("list length %d exceeds limit %d", length, max)
+	}
+	// read in chunks, to not allocate the full length before the data is there.
+	list := make([]Gwei, 0, 1024)
+	for uint64(len(list)) < length {
+		n := length - uint64(len(list))
+		if n > 1024 {
+			n = 1024
+		}
+		chunk := make([]Gwei, n, n)
+		if err := binary.Read(r, binary.LittleEndian, chunk); err != nil {
+			return nil, err
+		}
+		list = append(list, chunk...)
+	}
+	return list, nil
+}
+
+// Snapshot writes the forkchoice state, followed by the snapshot of the graph and votes.
+// The best justified balances are loaded, to include them in the snapshot.
+func (fc *ProtoForkChoice) Snapshot(w io.Writer) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	bestBalances, err := fc.bestJustifiedBalances()
+	if err != nil {
+		return fmt.Errorf("failed to load best justified balances: %v", err)
+	}
+	rec := forkChoiceRecord{
+		Justified:         fc.justified,
+		Finalized:         fc.finalized,
+		BestJustified:     fc.bestJustified,
+		GenesisTime:       fc.genesisTime,
+		Time:              fc.time,
+		ProposerBoostRoot: fc.proposerBoostRoot,
+		AppliedBoost:      fc.appliedBoost,
+		AppliedBoostScore: fc.appliedBoostScore,
+	}
+	if fc.pin != nil {
+		rec.HasPin = true
+		rec.Pin = *fc.pin
+	}
+	if err := binary.Write(w, binary.LittleEndian, forkChoiceSnapshotVersion); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, &rec); err != nil {
+		return err
+	}
+	if err := writeGweiList(w, fc.balances); err != nil {
+		return err
+	}
+	if err := writeGweiList(w, bestBalances); err != nil {
+		return err
+	}
+	if err := fc.protoArray.Snapshot(w); err != nil {
+		return fmt.Errorf("failed to snapshot forkchoice graph: %v", err)
+	}
+	if err := fc.voteStore.Snapshot(w); err != nil {
+		return fmt.Errorf("failed to snapshot votes: %v", err)
+	}
+	return nil
+}
+
+// RestoreForkChoice reads a forkchoice snapshot, as written by ProtoForkChoice.Snapshot.
+// The graph and votes are restored from the remainder of the snapshot with the given functions.
+// The justified and finalized checkpoints are checked to be known in the restored graph.
+func RestoreForkChoice(spec *common.Spec, r io.Reader,
+	restoreGraph func(r io.Reader) (ForkchoiceGraph, error),
+	restoreVotes func(r io.Reader) (VoteStore, error)) (Forkchoice, error) {
+	var version uint64
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != forkChoiceSnapshotVersion {
+		return nil, fmt.Errorf("unsupported forkchoice snapshot version %d", version)
+	}
+	var rec forkChoiceRecord
+	if err := binary.Read(r, binary.LittleEndian, &rec); err != nil {
+		return nil, err
+	}
+	if rec.Justified.Epoch < rec.Finalized.Epoch {
+		return nil, fmt.Errorf("justified epoch %d lower than finalized epoch %d", rec.Justified.Epoch, rec.Finalized.Epoch)
+	}
+	balances, err := readGweiList(r, spec.VALIDATOR_REGISTRY_LIMIT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read balances: %v", err)
+	}
+	bestBalances, err := readGweiList(r, spec.VALIDATOR_REGISTRY_LIMIT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read best justified balances: %v", err)
+	}
+	graph, err := restoreGraph(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore forkchoice graph: %v", err)
+	}
+	votes, err := restoreVotes(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore votes: %v", err)
+	}
+	for _, ch := range []Checkpoint{rec.Justified, rec.Finalized} {
+		// the zero root is an alias for the genesis block
+		if ch.Root == (Root{}) {
+			continue
+		}
+		if _, ok := graph.GetSlot(ch.Root); !ok {
+			return nil, fmt.Errorf("checkpoint %s is not in the restored graph", ch)
+		}
+	}
+	fc := &ProtoForkChoice{
+		protoArray:    graph,
+		voteStore:     votes,
+		balances:      balances,
+		justified:     rec.Justified,
+		finalized:     rec.Finalized,
+		bestJustified: rec.BestJustified,
+		bestJustifiedBalances: func() ([]Gwei, error) {
+			return bestBalances, nil
+		},
+		genesisTime:       rec.GenesisTime,
+		time:              rec.Time,
+		proposerBoostRoot: rec.ProposerBoostRoot,
+		appliedBoost:      rec.AppliedBoost,
+		appliedBoostScore: rec.AppliedBoostScore,
+		spec:              spec,
+	}
+	if rec.HasPin {
+		pin := rec.Pin
+		fc.pin = &pin
+	}
+	return fc, nil
+}
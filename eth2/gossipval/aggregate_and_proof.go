@@ -151,7 +151,7 @@ func ValidateAggregateAndProof(ctx context.Context, signedAgg *phase0.SignedAggr
 		// it should always convert.
 		// Something is very wrong if not, e.g. bad bitfield length.
 		return GossipValidatorResult{REJECT, err}
-	} else if err := phase0.ValidateIndexedAttestation(spec, epc, state, indexedAtt); err != nil {
+	} else if err := phase0.ValidateIndexedAttestation(ctx, spec, epc, state, indexedAtt); err != nil {
 		return GossipValidatorResult{REJECT, err}
 	}
 
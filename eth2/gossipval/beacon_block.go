@@ -12,6 +12,7 @@ type BeaconBlockValBackend interface {
 	SlotAfter
 	Chain
 	GenesisValidatorsRoot
+	PendingBlocks
 
 	// Checks if the (slot, proposer) pair was seen, does not do any tracking.
 	Seen(slot common.Slot, proposer common.ValidatorIndex) bool
@@ -40,8 +41,13 @@ func ValidateBeaconBlock(ctx context.Context, block *common.BeaconBlockEnvelope,
 	ch := blockVal.Chain()
 	// [IGNORE] The block's parent (defined by block.parent_root) has been seen
 	// (via both gossip and non-gossip sources)
+	// The block is kept as pending block until the parent is imported, unless it is too old to import.
 	parentRef, ok := ch.ByBlock(block.ParentRoot)
 	if !ok {
+		fin := ch.FinalizedCheckpoint()
+		if finSlot, _ := spec.EpochStartSlot(fin.Epoch); block.Slot > finSlot {
+			blockVal.PendingBlock(block)
+		}
 		return GossipValidatorResult{IGNORE, fmt.Errorf("block has unavailable parent block %s", block.ParentRoot)}
 	}
 	// Sanity check, implied condition
@@ -32,7 +32,7 @@ func ValidateProposerSlashing(ctx context.Context, propSl *phase0.ProposerSlashi
 	if err != nil {
 		return GossipValidatorResult{IGNORE, err}
 	}
-	if err := phase0.ValidateProposerSlashing(spec, epc, state, propSl); err != nil {
+	if err := phase0.ValidateProposerSlashing(ctx, spec, epc, state, propSl); err != nil {
 		return GossipValidatorResult{REJECT, err}
 	}
 	return GossipValidatorResult{ACCEPT, nil}
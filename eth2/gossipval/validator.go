@@ -74,6 +74,12 @@ type Chain interface {
 	Chain() chain.FullChain
 }
 
+type PendingBlocks interface {
+	// PendingBlock keeps a block of which the parent is not known yet, to import when the parent is,
+	// e.g. by adding it to a chain.PendingBlocks.
+	PendingBlock(block *common.BeaconBlockEnvelope)
+}
+
 // RetrieveHeadInfo is a util to implement the HeadInfo interface
 func RetrieveHeadInfo(ctx context.Context, ch chain.FullChain) (chain.ChainEntry, *common.EpochsContext, common.BeaconState, error) {
 	headRef, err := ch.Head()
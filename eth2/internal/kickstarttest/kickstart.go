@@ -0,0 +1,38 @@
+// Package kickstarttest creates genesis states for tests, with deterministic validator keys to sign with.
+package kickstarttest
+
+import (
+	"encoding/binary"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/util/bls"
+	"testing"
+)
+
+// State creates a phase0 genesis state with count validators, each with a max effective balance.
+func State(t *testing.T, spec *common.Spec, count uint64) (*phase0.BeaconStateView, *common.EpochsContext) {
+	state, epc, _ := StateWithKeys(t, spec, count)
+	return state, epc
+}
+
+// StateWithKeys creates a genesis state like State, and returns the validator keys along with it.
+// The key of validator i is i+1.
+func StateWithKeys(t *testing.T, spec *common.Spec, count uint64) (*phase0.BeaconStateView, *common.EpochsContext, []bls.BLSSecretKey) {
+	keys := make([]bls.BLSSecretKey, count, count)
+	validators := make([]phase0.KickstartValidatorData, count, count)
+	for i := range validators {
+		binary.BigEndian.PutUint64(keys[i][24:], uint64(i)+1)
+		pub, err := bls.Pubkey(&keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		validators[i].Pubkey = pub
+		validators[i].WithdrawalCredentials[0] = common.BLS_WITHDRAWAL_PREFIX
+		validators[i].Balance = spec.MAX_EFFECTIVE_BALANCE
+	}
+	state, epc, err := phase0.KickStartState(spec, common.Root{0x42}, 1234, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, epc, keys
+}
@@ -0,0 +1,477 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/util/bls"
+	"github.com/protolambda/zrnt/eth2/util/math"
+	"sort"
+)
+
+// The reward components of an attestation: source, target and head.
+// For altair states these are the timely participation flags. For phase0 states the matching components.
+type rewardFlags = altair.ParticipationFlags
+
+type participationBeaconState interface {
+	common.BeaconState
+	PreviousEpochParticipation() (*altair.ParticipationRegistryView, error)
+	CurrentEpochParticipation() (*altair.ParticipationRegistryView, error)
+}
+
+// packingRewards estimates the proposer-relevant reward of including attestations in a block on top of a pre-state,
+// and tracks which reward components validators have already earned in the state, or earlier in the packing.
+type packingRewards struct {
+	spec  *common.Spec
+	epc   *common.EpochsContext
+	state common.BeaconState
+	slot  common.Slot
+
+	currentEpoch  common.Epoch
+	previousEpoch common.Epoch
+
+	// nil if the state does not track participation flags
+	participation participationBeaconState
+	// earned flags of the previous and current epoch
+	earned [2]map[common.ValidatorIndex]rewardFlags
+	// altair
+	baseRewardPerIncrement common.Gwei
+}
+
+func newPackingRewards(spec *common.Spec, epc *common.EpochsContext, state common.BeaconState) (*packingRewards, error) {
+	slot, err := state.Slot()
+	if err != nil {
+		return nil, err
+	}
+	currentEpoch := spec.SlotToEpoch(slot)
+	pr := &packingRewards{
+		spec:          spec,
+		epc:           epc,
+		state:         state,
+		slot:          slot,
+		currentEpoch:  currentEpoch,
+		previousEpoch: currentEpoch.Previous(),
+		earned: [2]map[common.ValidatorIndex]rewardFlags{
+			make(map[common.ValidatorIndex]rewardFlags),
+			make(map[common.ValidatorIndex]rewardFlags),
+		},
+	}
+	switch st := state.(type) {
+	case participationBeaconState:
+		pr.participation = st
+		pr.baseRewardPerIncrement = spec.EFFECTIVE_BALANCE_INCREMENT * common.Gwei(spec.BASE_REWARD_FACTOR) / epc.TotalActiveStakeSqRoot
+	case phase0.Phase0PendingAttestationsBeaconState:
+		prev, err := st.PreviousEpochAttestations()
+		if err != nil {
+			return nil, err
+		}
+		if err := pr.loadPendingAttestations(prev); err != nil {
+			return nil, fmt.Errorf("failed to load previous epoch attestations: %v", err)
+		}
+		curr, err := st.CurrentEpochAttestations()
+		if err != nil {
+			return nil, err
+		}
+		if err := pr.loadPendingAttestations(curr); err != nil {
+			return nil, fmt.Errorf("failed to load current epoch attestations: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported state type for attestation packing: %T", state)
+	}
+	return pr, nil
+}
+
+// loadPendingAttestations marks the matching components of the already included attestations as earned.
+func (pr *packingRewards) loadPendingAttestations(atts *phase0.PendingAttestationsView) error {
+	iter := atts.ReadonlyIter()
+	for {
+		el, ok, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		attView, err := phase0.AsPendingAttestation(el, nil)
+		if err != nil {
+			return err
+		}
+		att, err := attView.Raw()
+		if err != nil {
+			return err
+		}
+		flags, err := pr.matchingFlags(&att.Data)
+		if err != nil {
+			return err
+		}
+		committee, err := pr.epc.GetBeaconCommittee(att.Data.Slot, att.Data.Index)
+		if err != nil {
+			return err
+		}
+		if err := pr.earn(att.Data.Target.Epoch, att.AggregationBits, committee, flags); err != nil {
+			return err
+		}
+	}
+}
+
+func (pr *packingRewards) epochIndex(epoch common.Epoch) int {
+	if epoch == pr.currentEpoch {
+		return 1
+	}
+	return 0
+}
+
+// earnedFlags returns the flags the validator already earned in the given epoch.
+func (pr *packingRewards) earnedFlags(epoch common.Epoch, index common.ValidatorIndex) (rewardFlags, error) {
+	earned := pr.earned[pr.epochIndex(epoch)]
+	if flags, ok := earned[index]; ok {
+		return flags, nil
+	}
+	if pr.participation == nil {
+		return 0, nil
+	}
+	var reg *altair.ParticipationRegistryView
+	var err error
+	if epoch == pr.currentEpoch {
+		reg, err = pr.participation.CurrentEpochParticipation()
+	} else {
+		reg, err = pr.participation.PreviousEpochParticipation()
+	}
+	if err != nil {
+		return 0, err
+	}
+	flags, err := reg.GetFlags(index)
+	if err != nil {
+		return 0, err
+	}
+	earned[index] = flags
+	return flags, nil
+}
+
+// earn marks the flags as earned for the participants.
+func (pr *packingRewards) earn(epoch common.Epoch, bits phase0.AttestationBits,
+	committee common.CommitteeIndices, flags rewardFlags) error {
+	if bits.BitLen() != uint64(len(committee)) {
+		return fmt.Errorf("committee mismatch, bitfield length %d does not match committee size %d", bits.BitLen(), len(committee))
+	}
+	for i, vi := range committee {
+		if !bits.GetBit(uint64(i)) {
+			continue
+		}
+		existing, err := pr.earnedFlags(epoch, vi)
+		if err != nil {
+			return err
+		}
+		pr.earned[pr.epochIndex(epoch)][vi] = existing | flags
+	}
+	return nil
+}
+
+// matchingFlags checks which components of the attestation data match the chain of the state.
+// An error is returned if the source does not match, the attestation is invalid then.
+func (pr *packingRewards) matchingFlags(data *phase0.AttestationData) (out rewardFlags, err error) {
+	var justified common.Checkpoint
+	if data.Target.Epoch == pr.currentEpoch {
+		justified, err = pr.state.CurrentJustifiedCheckpoint()
+	} else {
+		justified, err = pr.state.PreviousJustifiedCheckpoint()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if data.Source != justified {
+		return 0, fmt.Errorf("source %s does not match justified checkpoint %s", data.Source, justified)
+	}
+	out |= altair.TIMELY_SOURCE_FLAG
+	expectedTarget, err := common.GetBlockRoot(pr.spec, pr.state, data.Target.Epoch)
+	if err != nil {
+		return 0, err
+	}
+	if data.Target.Root != expectedTarget {
+		return out, nil
+	}
+	out |= altair.TIMELY_TARGET_FLAG
+	expectedHead, err := common.GetBlockRootAtSlot(pr.spec, pr.state, data.Slot)
+	if err != nil {
+		return 0, err
+	}
+	if data.BeaconBlockRoot == expectedHead {
+		out |= altair.TIMELY_HEAD_FLAG
+	}
+	return out, nil
+}
+
+// applicableFlags checks if the attestation data can be included in the block,
+// and returns the reward components it is applicable for. Zero if it cannot be included.
+func (pr *packingRewards) applicableFlags(data *phase0.AttestationData) (rewardFlags, error) {
+	if data.Target.Epoch != pr.currentEpoch && data.Target.Epoch != pr.previousEpoch {
+		return 0, nil
+	}
+	if data.Target.Epoch != pr.spec.SlotToEpoch(data.Slot) {
+		return 0, nil
+	}
+	// the inclusion window
+	if !(data.Slot+pr.spec.MIN_ATTESTATION_INCLUSION_DELAY <= pr.slot && pr.slot <= data.Slot+pr.spec.SLOTS_PER_EPOCH) {
+		return 0, nil
+	}
+	if commCount, err := pr.epc.GetCommitteeCountPerSlot(data.Target.Epoch); err != nil {
+		return 0, err
+	} else if uint64(data.Index) >= commCount {
+		return 0, nil
+	}
+	flags, err := pr.matchingFlags(data)
+	if err != nil {
+		// wrong source, cannot be included
+		return 0, nil
+	}
+	if pr.participation == nil {
+		return flags, nil
+	}
+	// altair: the flags are only earned if the attestation is timely
+	delay := pr.slot - data.Slot
+	if delay > common.Slot(math.IntegerSquareroot(uint64(pr.spec.SLOTS_PER_EPOCH))) {
+		flags &^= altair.TIMELY_SOURCE_FLAG
+	}
+	if delay > pr.spec.SLOTS_PER_EPOCH {
+		flags &^= altair.TIMELY_TARGET_FLAG
+	}
+	if delay != pr.spec.MIN_ATTESTATION_INCLUSION_DELAY {
+		flags &^= altair.TIMELY_HEAD_FLAG
+	}
+	return flags, nil
+}
+
+// value estimates the reward of the flags that the participants have not earned yet.
+func (pr *packingRewards) value(c *packCandidate) (common.Gwei, error) {
+	total := common.Gwei(0)
+	delay := pr.slot - c.data.Data.Slot
+	for i, vi := range c.data.Committee {
+		if !c.bits.GetBit(uint64(i)) {
+			continue
+		}
+		existing, err := pr.earnedFlags(c.epoch, vi)
+		if err != nil {
+			return 0, err
+		}
+		newFlags := c.flags &^ existing
+		if newFlags == 0 {
+			continue
+		}
+		eff := pr.epc.EffectiveBalances[vi]
+		if pr.participation != nil {
+			baseReward := (eff / pr.spec.EFFECTIVE_BALANCE_INCREMENT) * pr.baseRewardPerIncrement
+			if newFlags&altair.TIMELY_SOURCE_FLAG != 0 {
+				total += baseReward * altair.TIMELY_SOURCE_WEIGHT
+			}
+			if newFlags&altair.TIMELY_TARGET_FLAG != 0 {
+				total += baseReward * altair.TIMELY_TARGET_WEIGHT
+			}
+			if newFlags&altair.TIMELY_HEAD_FLAG != 0 {
+				total += baseReward * altair.TIMELY_HEAD_WEIGHT
+			}
+		} else {
+			baseReward := eff * common.Gwei(pr.spec.BASE_REWARD_FACTOR) /
+				pr.epc.TotalActiveStakeSqRoot / common.BASE_REWARDS_PER_EPOCH
+			for _, f := range []rewardFlags{altair.TIMELY_SOURCE_FLAG, altair.TIMELY_TARGET_FLAG, altair.TIMELY_HEAD_FLAG} {
+				if newFlags&f != 0 {
+					total += baseReward
+				}
+			}
+			// the first inclusion earns the inclusion-delay reward, for both the proposer and attester
+			if newFlags&altair.TIMELY_SOURCE_FLAG != 0 {
+				proposerReward := baseReward / common.Gwei(pr.spec.PROPOSER_REWARD_QUOTIENT)
+				total += proposerReward + (baseReward-proposerReward)/common.Gwei(delay)
+			}
+		}
+	}
+	return total, nil
+}
+
+// packCandidate is an aggregate that can be packed, possibly merged from multiple disjoint aggregates.
+type packCandidate struct {
+	data  *IndexedAttData
+	epoch common.Epoch
+	flags rewardFlags
+	bits  phase0.AttestationBits
+	sigs  []common.BLSSignature
+}
+
+// disjoint checks if the bitfields of equal length have no participants in common.
+func disjoint(a, b phase0.AttestationBits) bool {
+	n := len(a)
+	for i := 0; i < n-1; i++ {
+		if a[i]&b[i] != 0 {
+			return false
+		}
+	}
+	// The last byte includes the delimiter bit, set in both.
+	// Any other bit in common would be a lower bit.
+	last := a[n-1] & b[n-1]
+	return last&(last-1) == 0
+}
+
+// emptyBits creates an empty bitlist of the committee size, packed in bytes, with delimiter bit.
+func emptyBits(committeeSize int) phase0.AttestationBits {
+	bits := make(phase0.AttestationBits, (committeeSize/8)+1)
+	bits[len(bits)-1] = 1 << (uint8(committeeSize) & 7)
+	return bits
+}
+
+// mergeAggregates merges disjoint aggregates of the same data into larger aggregates.
+// Aggregates that are covered by the earlier merged aggregates are dropped.
+// An error is returned if an aggregate does not match the committee size.
+func mergeAggregates(committeeSize int, parts []Aggregate) (out []Aggregate, sigs [][]common.BLSSignature, err error) {
+	// larger aggregates first
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].Participants.OnesCount() > parts[j].Participants.OnesCount()
+	})
+	covered := emptyBits(committeeSize)
+	used := make([]bool, len(parts), len(parts))
+	for {
+		var merged phase0.AttestationBits
+		var mergedSigs []common.BLSSignature
+		for i, p := range parts {
+			if used[i] {
+				continue
+			}
+			ok, err := covered.Covers(p.Participants)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				used[i] = true
+				continue
+			}
+			if merged == nil {
+				merged = p.Participants.Copy()
+			} else if disjoint(merged, p.Participants) {
+				merged.Or(p.Participants)
+			} else {
+				continue
+			}
+			used[i] = true
+			mergedSigs = append(mergedSigs, p.Sig)
+		}
+		if merged == nil {
+			return out, sigs, nil
+		}
+		covered.Or(merged)
+		out = append(out, Aggregate{Participants: merged})
+		sigs = append(sigs, mergedSigs)
+	}
+}
+
+// Packing selects the attestations to include in a block, to maximize the reward of the proposer,
+// and the attesters that have not been included yet.
+//
+// The state is the pre-state of the block, processed up to the slot of the block, and epc is its EpochsContext.
+// Attestations are only selected if they can be included at the slot of the state,
+// and have a correct source. For altair states, rewards are estimated with the timely participation flags.
+// For phase0 states, the matching components and the inclusion-delay reward are estimated.
+// Disjoint aggregates of the same data are merged, with BLS signature aggregation.
+//
+// At most MAX_ATTESTATIONS are selected. If the context is done before the packing completes,
+// the attestations selected so far are returned.
+func (ap *AttestationPool) Packing(ctx context.Context, epc *common.EpochsContext, state common.BeaconState) ([]phase0.Attestation, error) {
+	ap.RLock()
+	defer ap.RUnlock()
+
+	pr, err := newPackingRewards(ap.spec, epc, state)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect the aggregates and individual attestations per data
+	parts := make(map[common.Root][]Aggregate)
+	for root, agg := range ap.aggregate {
+		parts[root] = append(parts[root], agg.Aggregates...)
+		parts[root] = append(parts[root], agg.Extra...)
+	}
+	for key, ref := range ap.individual {
+		data, ok := ap.datas[ref.DataRoot]
+		if !ok {
+			continue
+		}
+		for i, vi := range data.Committee {
+			if vi == key.Index {
+				bits := emptyBits(len(data.Committee))
+				bits.SetBit(uint64(i), true)
+				parts[ref.DataRoot] = append(parts[ref.DataRoot], Aggregate{Participants: bits, Sig: ref.Sig})
+				break
+			}
+		}
+	}
+
+	var candidates []*packCandidate
+	for root, dataParts := range parts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data := ap.datas[root]
+		flags, err := pr.applicableFlags(&data.Data)
+		if err != nil {
+			return nil, err
+		}
+		if flags == 0 {
+			continue
+		}
+		merged, sigs, err := mergeAggregates(len(data.Committee), dataParts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge aggregates of attestation data %s: %v", root, err)
+		}
+		for i, agg := range merged {
+			candidates = append(candidates, &packCandidate{
+				data:  data,
+				epoch: data.Data.Target.Epoch,
+				flags: flags,
+				bits:  agg.Participants,
+				sigs:  sigs[i],
+			})
+		}
+	}
+
+	maxCount := ap.spec.MAX_ATTESTATIONS
+	out := make([]phase0.Attestation, 0, maxCount)
+	used := make([]bool, len(candidates), len(candidates))
+	// Greedy: select the candidate with the best additional reward, until the block is full
+	for uint64(len(out)) < maxCount && ctx.Err() == nil {
+		best := -1
+		bestValue := common.Gwei(0)
+		for i, c := range candidates {
+			if used[i] {
+				continue
+			}
+			v, err := pr.value(c)
+			if err != nil {
+				return nil, err
+			}
+			if v > bestValue {
+				best, bestValue = i, v
+			}
+		}
+		if best < 0 {
+			break
+		}
+		used[best] = true
+		c := candidates[best]
+		sig := c.sigs[0]
+		if len(c.sigs) > 1 {
+			sig, err = bls.AggregateSignatures(c.sigs)
+			if err != nil {
+				// a bad signature in the pool should not prevent the rest from being packed
+				continue
+			}
+		}
+		if err := pr.earn(c.epoch, c.bits, c.data.Committee, c.flags); err != nil {
+			return nil, err
+		}
+		out = append(out, phase0.Attestation{
+			AggregationBits: c.bits,
+			Data:            c.data.Data,
+			Signature:       sig,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,121 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"github.com/protolambda/zrnt/eth2/util/bls"
+	"github.com/protolambda/ztyp/tree"
+	"testing"
+)
+
+func TestAttestationPoolPacking(t *testing.T) {
+	// committees of 8, and of 13, which is not a multiple of 8
+	for _, count := range []uint64{256, 416} {
+		t.Run(fmt.Sprintf("%d validators", count), func(t *testing.T) {
+			testAttestationPoolPacking(t, count)
+		})
+	}
+}
+
+func testAttestationPoolPacking(t *testing.T, count uint64) {
+	spec := *configs.Minimal
+	state, epc, keys := kickstarttest.StateWithKeys(t, &spec, count)
+	ctx := context.Background()
+	if err := common.ProcessSlots(ctx, &spec, epc, &beacon.StandardUpgradeableBeaconState{BeaconState: state}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := state.CurrentJustifiedCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetRoot, err := common.GetBlockRoot(&spec, state, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headRoot, err := common.GetBlockRootAtSlot(&spec, state, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := epc.GetBeaconCommittee(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain, err := common.GetDomain(state, common.DOMAIN_BEACON_ATTESTER, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeAtt := func(data phase0.AttestationData, members ...uint64) *phase0.Attestation {
+		bits := make(phase0.AttestationBits, (len(committee)/8)+1)
+		bits[len(bits)-1] = 1 << (uint8(len(committee)) & 7)
+		root := common.ComputeSigningRoot(data.HashTreeRoot(tree.GetHashFn()), domain)
+		var sigs []common.BLSSignature
+		for _, m := range members {
+			bits.SetBit(m, true)
+			sig, err := bls.Sign(&keys[committee[m]], root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sigs = append(sigs, sig)
+		}
+		agg, err := bls.AggregateSignatures(sigs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		att := &phase0.Attestation{AggregationBits: bits, Data: data, Signature: agg}
+		return att
+	}
+	data := phase0.AttestationData{
+		Slot:            1,
+		Index:           0,
+		BeaconBlockRoot: headRoot,
+		Source:          source,
+		Target:          common.Checkpoint{Epoch: 0, Root: targetRoot},
+	}
+	badSource := data
+	badSource.Source.Root = common.Root{0xff}
+
+	ap := NewAttestationPool(&spec)
+	for _, att := range []*phase0.Attestation{
+		makeAtt(data, 0, 1, 2),
+		makeAtt(data, 3, 4),
+		makeAtt(data, 1, 2, 3), // covered by the above, kept as extra
+		makeAtt(data, 5),
+		makeAtt(badSource, 6, 7),
+	} {
+		if err := ap.AddAttestation(att, committee); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packed, err := ap.Packing(ctx, epc, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed) != 1 {
+		t.Fatalf("expected a single merged attestation, got %d", len(packed))
+	}
+	if packed[0].Data != data {
+		t.Fatal("packed attestation with wrong source")
+	}
+	if packed[0].AggregationBits.OnesCount() != 6 {
+		t.Fatalf("expected 6 merged participants, got %d", packed[0].AggregationBits.OnesCount())
+	}
+	if err := phase0.ProcessAttestation(ctx, &spec, epc, state, &packed[0]); err != nil {
+		t.Fatalf("packed attestation is invalid: %v", err)
+	}
+
+	// once included, the attestations do not add any reward anymore
+	packed, err = ap.Packing(ctx, epc, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed) != 0 {
+		t.Fatalf("expected no attestations to pack on top of the included attestations, got %d", len(packed))
+	}
+}
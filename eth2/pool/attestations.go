@@ -1,14 +1,12 @@
 package pool
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"github.com/protolambda/ztyp/tree"
 	"sync"
-	"time"
 )
 
 type Assignment struct {
@@ -63,6 +61,7 @@ func NewAttestationPool(spec *common.Spec) *AttestationPool {
 		datas:              make(map[common.Root]*IndexedAttData),
 		individual:         make(map[Assignment]*AttRef),
 		aggregate:          make(map[common.Root]*MinAggregates),
+		aggPerValidator:    make(map[Assignment]common.Root),
 		maxExtraAggregates: 10, // TODO: worth tuning
 	}
 }
@@ -182,6 +181,8 @@ func WithCommittee(index common.CommitteeIndex) AttSearchOption {
 }
 
 func (ap *AttestationPool) Search(opts ...AttSearchOption) (out []*phase0.Attestation) {
+	ap.RLock()
+	defer ap.RUnlock()
 	var conf attSearch
 	for _, opt := range opts {
 		opt(&conf)
@@ -193,7 +194,10 @@ func (ap *AttestationPool) Search(opts ...AttSearchOption) (out []*phase0.Attest
 		if conf.comm != nil && d.Data.Index != *conf.comm {
 			continue
 		}
-		agg := ap.aggregate[k]
+		agg, ok := ap.aggregate[k]
+		if !ok {
+			continue
+		}
 		for _, a := range agg.Aggregates {
 			out = append(out, &phase0.Attestation{AggregationBits: a.Participants, Data: d.Data, Signature: a.Sig})
 		}
@@ -204,6 +208,8 @@ func (ap *AttestationPool) Search(opts ...AttSearchOption) (out []*phase0.Attest
 
 // Prune pool based on current epoch, attestations which cannot be included anymore will get pruned.
 func (ap *AttestationPool) Prune(epoch common.Epoch) {
+	ap.Lock()
+	defer ap.Unlock()
 	min := epoch.Previous()
 	for k, v := range ap.datas {
 		if v.Data.Target.Epoch < min {
@@ -222,17 +228,3 @@ func (ap *AttestationPool) Prune(epoch common.Epoch) {
 		}
 	}
 }
-
-// Approximation of the optimal attestation packing.
-// Attestations must match source, get prioritized if the target is correct, and more if the head is correct.
-// Attestations may not be included if they already are (checked via included func).
-// Maximum attestation output and packing-time constraints apply.
-func (ap *AttestationPool) Packing(ctx context.Context,
-	source common.Checkpoint, target common.Checkpoint,
-	headRoot common.Root, headSlot common.Slot,
-	maxCount uint64, maxTime time.Duration,
-	included func(epoch common.Epoch, index common.ValidatorIndex)) ([]phase0.Attestation, error) {
-
-	// TODO find best attestations to pack for profit.
-	return nil, nil
-}
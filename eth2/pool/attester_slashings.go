@@ -4,6 +4,7 @@ import (
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"github.com/protolambda/ztyp/tree"
+	"sort"
 	"sync"
 )
 
@@ -49,9 +50,128 @@ func (asp *AttesterSlashingPool) All() []*phase0.AttesterSlashing {
 	return out
 }
 
-// Pack n slashings, removes the slashings from the pool. A reward estimator is used to pick the best slashings.
-// Slashings with negative rewards will not be packed.
-func (asp *AttesterSlashingPool) Pack(estReward func(sl *phase0.AttesterSlashing) int, n uint) []*phase0.AttesterSlashing {
-	// TODO
+// slashableIndices returns the indices that attested to both attestations of a slashing.
+// Nil if the attestations are not slashable, or not sorted.
+func slashableIndices(sl *phase0.AttesterSlashing) (out []common.ValidatorIndex) {
+	if !phase0.IsSlashableAttestationData(&sl.Attestation1.Data, &sl.Attestation2.Data) {
+		return nil
+	}
+	a := common.ValidatorSet(sl.Attestation1.AttestingIndices)
+	b := common.ValidatorSet(sl.Attestation2.AttestingIndices)
+	if !sort.IsSorted(a) || !sort.IsSorted(b) {
+		return nil
+	}
+	a.ZigZagJoin(b, func(i common.ValidatorIndex) {
+		out = append(out, i)
+	}, nil)
+	return out
+}
+
+// Pack up to n slashings that are valid on top of the given state, the pre-state of the block, processed to its slot.
+// Slashings are ranked by the whistleblower reward of the proposer of the block,
+// for the validators that are not slashed by the chosen slashings yet.
+// The signatures are not checked again, these are expected to be verified before being added to the pool.
+//
+// The chosen indices are skipped, and the indices of the packed slashings are added, to pack other operations with.
+// Packing does not remove the slashings from the pool, included slashings are removed by Prune.
+func (asp *AttesterSlashingPool) Pack(state common.BeaconState, n uint,
+	chosen map[common.ValidatorIndex]struct{}) ([]*phase0.AttesterSlashing, error) {
+	asp.RLock()
+	defer asp.RUnlock()
+	epoch, err := stateEpoch(asp.spec, state)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := state.Validators()
+	if err != nil {
+		return nil, err
+	}
+	if chosen == nil {
+		chosen = make(map[common.ValidatorIndex]struct{})
+	}
+	type candidate struct {
+		key     VersionedRoot
+		sl      *phase0.AttesterSlashing
+		indices []common.ValidatorIndex
+	}
+	var candidates []*candidate
+	for key, sl := range asp.slashings {
+		if indices := slashableIndices(sl); len(indices) > 0 {
+			candidates = append(candidates, &candidate{key: key, sl: sl, indices: indices})
+		}
+	}
+	// deterministic tie-breaks
+	sort.Slice(candidates, func(i, j int) bool {
+		return string(candidates[i].key.Root[:]) < string(candidates[j].key.Root[:])
+	})
+	// Greedy: every pick changes the reward of the overlapping slashings.
+	var out []*phase0.AttesterSlashing
+	for uint(len(out)) < n {
+		best := -1
+		bestReward := common.Gwei(0)
+		for i, c := range candidates {
+			if c == nil {
+				continue
+			}
+			total := common.Gwei(0)
+			for _, index := range c.indices {
+				if _, ok := chosen[index]; ok {
+					continue
+				}
+				reward, err := slashingReward(asp.spec, vals, index, epoch)
+				if err != nil {
+					return nil, err
+				}
+				total += reward
+			}
+			if total == 0 {
+				// not effective, and hence invalid
+				candidates[i] = nil
+				continue
+			}
+			if total > bestReward {
+				best, bestReward = i, total
+			}
+		}
+		if best < 0 {
+			break
+		}
+		c := candidates[best]
+		candidates[best] = nil
+		for _, index := range c.indices {
+			chosen[index] = struct{}{}
+		}
+		out = append(out, c.sl)
+	}
+	return out, nil
+}
+
+// Prune removes the slashings that can never be included anymore, given the finalized state:
+// all the slashable validators are already slashed, or withdrawable.
+func (asp *AttesterSlashingPool) Prune(finalized common.BeaconState) error {
+	asp.Lock()
+	defer asp.Unlock()
+	epoch, err := stateEpoch(asp.spec, finalized)
+	if err != nil {
+		return err
+	}
+	vals, err := finalized.Validators()
+	if err != nil {
+		return err
+	}
+	for key, sl := range asp.slashings {
+		keep := false
+		for _, index := range slashableIndices(sl) {
+			if ok, err := mayBeSlashable(vals, index, epoch); err != nil {
+				return err
+			} else if ok {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			delete(asp.slashings, key)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,63 @@
+package pool
+
+import (
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+func stateEpoch(spec *common.Spec, state common.BeaconState) (common.Epoch, error) {
+	slot, err := state.Slot()
+	if err != nil {
+		return 0, err
+	}
+	return spec.SlotToEpoch(slot), nil
+}
+
+// slashingReward estimates the whistleblower reward for slashing the validator, as received by the block proposer.
+// Zero if the validator is not slashable.
+func slashingReward(spec *common.Spec, vals common.ValidatorRegistry, index common.ValidatorIndex, epoch common.Epoch) (common.Gwei, error) {
+	if valid, err := vals.IsValidIndex(index); err != nil {
+		return 0, err
+	} else if !valid {
+		return 0, nil
+	}
+	v, err := vals.Validator(index)
+	if err != nil {
+		return 0, err
+	}
+	if slashable, err := phase0.IsSlashable(v, epoch); err != nil {
+		return 0, err
+	} else if !slashable {
+		return 0, nil
+	}
+	eff, err := v.EffectiveBalance()
+	if err != nil {
+		return 0, err
+	}
+	// The proposer is the whistleblower, and receives the full reward.
+	return eff / common.Gwei(spec.WHISTLEBLOWER_REWARD_QUOTIENT), nil
+}
+
+// mayBeSlashable checks if the validator is slashable now, or may be slashable in a later epoch.
+func mayBeSlashable(vals common.ValidatorRegistry, index common.ValidatorIndex, epoch common.Epoch) (bool, error) {
+	if valid, err := vals.IsValidIndex(index); err != nil {
+		return false, err
+	} else if !valid {
+		// may be a deposit that is not processed yet
+		return true, nil
+	}
+	v, err := vals.Validator(index)
+	if err != nil {
+		return false, err
+	}
+	if slashed, err := v.Slashed(); err != nil {
+		return false, err
+	} else if slashed {
+		return false, nil
+	}
+	withdrawableEpoch, err := v.WithdrawableEpoch()
+	if err != nil {
+		return false, err
+	}
+	return withdrawableEpoch > epoch, nil
+}
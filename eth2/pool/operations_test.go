@@ -0,0 +1,111 @@
+package pool
+
+import (
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/internal/kickstarttest"
+	"testing"
+)
+
+func TestOperationPoolsPack(t *testing.T) {
+	spec := *configs.Minimal
+	spec.SHARD_COMMITTEE_PERIOD = 0
+	state, _ := kickstarttest.State(t, &spec, 64)
+	vals, err := state.Validators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a smaller balance, for a smaller whistleblower reward
+	if v, err := vals.Validator(2); err != nil {
+		t.Fatal(err)
+	} else if err := v.SetEffectiveBalance(spec.MAX_EFFECTIVE_BALANCE / 2); err != nil {
+		t.Fatal(err)
+	}
+
+	proposerSlashing := func(index common.ValidatorIndex) *phase0.ProposerSlashing {
+		var sl phase0.ProposerSlashing
+		sl.SignedHeader1.Message.ProposerIndex = index
+		sl.SignedHeader2.Message.ProposerIndex = index
+		sl.SignedHeader2.Message.BodyRoot = common.Root{1}
+		return &sl
+	}
+	psp := NewProposerSlashingPool(&spec)
+	for _, index := range []common.ValidatorIndex{2, 1} {
+		psp.AddProposerSlashing(proposerSlashing(index))
+	}
+
+	attesterSlashing := func(indices ...common.ValidatorIndex) *phase0.AttesterSlashing {
+		var sl phase0.AttesterSlashing
+		sl.Attestation1.AttestingIndices = indices
+		sl.Attestation2.AttestingIndices = indices
+		sl.Attestation2.Data.BeaconBlockRoot = common.Root{1}
+		return &sl
+	}
+	asp := NewAttesterSlashingPool(&spec)
+	covered := attesterSlashing(1)
+	effective := attesterSlashing(1, 3, 4)
+	asp.AddAttesterSlashing(covered, common.Version{})
+	asp.AddAttesterSlashing(effective, common.Version{})
+
+	exit := func(index common.ValidatorIndex, epoch common.Epoch) *phase0.SignedVoluntaryExit {
+		return &phase0.SignedVoluntaryExit{Message: phase0.VoluntaryExit{Epoch: epoch, ValidatorIndex: index}}
+	}
+	vep := NewVoluntaryExitPool(&spec)
+	vep.AddVoluntaryExit(exit(3, 0))
+	vep.AddVoluntaryExit(exit(5, 0))
+	vep.AddVoluntaryExit(exit(6, 10))
+
+	chosen := make(map[common.ValidatorIndex]struct{})
+	ps, err := psp.Pack(state, 1, chosen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].SignedHeader1.Message.ProposerIndex != 1 {
+		t.Fatal("expected the proposer slashing with the largest reward")
+	}
+	as, err := asp.Pack(state, 2, chosen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 1 || as[0] != effective {
+		t.Fatal("expected only the effective attester slashing")
+	}
+	exits, err := vep.Pack(state, 2, chosen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exits) != 1 || exits[0].Message.ValidatorIndex != 5 {
+		t.Fatal("expected only the exit of the validator that is not slashed, with a valid epoch")
+	}
+
+	// after finalization of the slashing of 1 and the exit of 5
+	if v, err := vals.Validator(1); err != nil {
+		t.Fatal(err)
+	} else if err := v.MakeSlashed(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := vals.Validator(5); err != nil {
+		t.Fatal(err)
+	} else if err := v.SetExitEpoch(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := psp.Prune(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := asp.Prune(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := vep.Prune(state); err != nil {
+		t.Fatal(err)
+	}
+	if all := psp.All(); len(all) != 1 || all[0].SignedHeader1.Message.ProposerIndex != 2 {
+		t.Fatal("expected proposer slashing of slashed validator to be pruned")
+	}
+	if all := asp.All(); len(all) != 1 || all[0] != effective {
+		t.Fatal("expected attester slashing of only slashed validators to be pruned")
+	}
+	if all := vep.All(); len(all) != 2 {
+		t.Fatal("expected exit of exited validator to be pruned")
+	}
+}
@@ -3,6 +3,7 @@ package pool
 import (
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"sort"
 	"sync"
 )
 
@@ -41,9 +42,83 @@ func (psp *ProposerSlashingPool) All() []*phase0.ProposerSlashing {
 	return out
 }
 
-// Pack n slashings, removes the slashings from the pool. A reward estimator is used to pick the best slashings.
-// Slashings with negative rewards will not be packed.
-func (psp *ProposerSlashingPool) Pack(estReward func(sl *phase0.ProposerSlashing) int, n uint) []*phase0.ProposerSlashing {
-	// TODO
+// Pack up to n slashings that are valid on top of the given state, the pre-state of the block, processed to its slot.
+// Slashings are ranked by the whistleblower reward of the proposer of the block.
+// The signatures are not checked again, these are expected to be verified before being added to the pool.
+//
+// The chosen indices are skipped, and the indices of the packed slashings are added, to pack other operations with.
+// Packing does not remove the slashings from the pool, included slashings are removed by Prune.
+func (psp *ProposerSlashingPool) Pack(state common.BeaconState, n uint,
+	chosen map[common.ValidatorIndex]struct{}) ([]*phase0.ProposerSlashing, error) {
+	psp.RLock()
+	defer psp.RUnlock()
+	epoch, err := stateEpoch(psp.spec, state)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := state.Validators()
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		sl     *phase0.ProposerSlashing
+		reward common.Gwei
+	}
+	var candidates []candidate
+	for index, sl := range psp.slashings {
+		if _, ok := chosen[index]; ok {
+			continue
+		}
+		if err := phase0.ValidateProposerSlashingNoSignature(psp.spec, sl); err != nil {
+			continue
+		}
+		reward, err := slashingReward(psp.spec, vals, index, epoch)
+		if err != nil {
+			return nil, err
+		}
+		if reward == 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{sl: sl, reward: reward})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].reward == candidates[j].reward {
+			return candidates[i].sl.SignedHeader1.Message.ProposerIndex < candidates[j].sl.SignedHeader1.Message.ProposerIndex
+		}
+		return candidates[i].reward > candidates[j].reward
+	})
+	if uint(len(candidates)) > n {
+		candidates = candidates[:n]
+	}
+	out := make([]*phase0.ProposerSlashing, 0, len(candidates))
+	for _, c := range candidates {
+		if chosen != nil {
+			chosen[c.sl.SignedHeader1.Message.ProposerIndex] = struct{}{}
+		}
+		out = append(out, c.sl)
+	}
+	return out, nil
+}
+
+// Prune removes the slashings that can never be included anymore, given the finalized state:
+// the proposer is already slashed, or withdrawable.
+func (psp *ProposerSlashingPool) Prune(finalized common.BeaconState) error {
+	psp.Lock()
+	defer psp.Unlock()
+	epoch, err := stateEpoch(psp.spec, finalized)
+	if err != nil {
+		return err
+	}
+	vals, err := finalized.Validators()
+	if err != nil {
+		return err
+	}
+	for index := range psp.slashings {
+		if ok, err := mayBeSlashable(vals, index, epoch); err != nil {
+			return err
+		} else if !ok {
+			delete(psp.slashings, index)
+		}
+	}
 	return nil
 }
@@ -3,6 +3,7 @@ package pool
 import (
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"sort"
 	"sync"
 )
 
@@ -40,9 +41,109 @@ func (vep *VoluntaryExitPool) All() []*phase0.SignedVoluntaryExit {
 	return out
 }
 
-// Pack n exits, removes the exits from the pool. A ranking function is used to pick the best exits.
-// Exits with negative rank function outputs will not be packed.
-func (vep *VoluntaryExitPool) Pack(rank func(sl *phase0.SignedVoluntaryExit) int, n uint) []*phase0.SignedVoluntaryExit {
-	// TODO
+// Pack up to n exits that are valid on top of the given state, the pre-state of the block, processed to its slot.
+// Exits do not provide rewards, the exits that became valid the earliest are packed first.
+// The signatures are not checked again, these are expected to be verified before being added to the pool.
+//
+// The chosen indices, e.g. of validators exiting by slashings in the same block, are skipped,
+// and the indices of the packed exits are added.
+// Packing does not remove the exits from the pool, included exits are removed by Prune.
+func (vep *VoluntaryExitPool) Pack(state common.BeaconState, n uint,
+	chosen map[common.ValidatorIndex]struct{}) ([]*phase0.SignedVoluntaryExit, error) {
+	vep.RLock()
+	defer vep.RUnlock()
+	epoch, err := stateEpoch(vep.spec, state)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := state.Validators()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*phase0.SignedVoluntaryExit
+	for index, exit := range vep.exits {
+		if _, ok := chosen[index]; ok {
+			continue
+		}
+		if ok, err := canExit(vep.spec, vals, exit, epoch); err != nil {
+			return nil, err
+		} else if ok {
+			candidates = append(candidates, exit)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := &candidates[i].Message, &candidates[j].Message
+		if a.Epoch == b.Epoch {
+			return a.ValidatorIndex < b.ValidatorIndex
+		}
+		return a.Epoch < b.Epoch
+	})
+	if uint(len(candidates)) > n {
+		candidates = candidates[:n]
+	}
+	if chosen != nil {
+		for _, exit := range candidates {
+			chosen[exit.Message.ValidatorIndex] = struct{}{}
+		}
+	}
+	return candidates, nil
+}
+
+// canExit checks the exit against the validator in the state, except the signature.
+func canExit(spec *common.Spec, vals common.ValidatorRegistry, exit *phase0.SignedVoluntaryExit, epoch common.Epoch) (bool, error) {
+	if epoch < exit.Message.Epoch {
+		return false, nil
+	}
+	if valid, err := vals.IsValidIndex(exit.Message.ValidatorIndex); err != nil {
+		return false, err
+	} else if !valid {
+		return false, nil
+	}
+	v, err := vals.Validator(exit.Message.ValidatorIndex)
+	if err != nil {
+		return false, err
+	}
+	if active, err := phase0.IsActive(v, epoch); err != nil {
+		return false, err
+	} else if !active {
+		return false, nil
+	}
+	if exitEpoch, err := v.ExitEpoch(); err != nil {
+		return false, err
+	} else if exitEpoch != common.FAR_FUTURE_EPOCH {
+		return false, nil
+	}
+	activationEpoch, err := v.ActivationEpoch()
+	if err != nil {
+		return false, err
+	}
+	return epoch >= activationEpoch+spec.SHARD_COMMITTEE_PERIOD, nil
+}
+
+// Prune removes the exits that can never be included anymore, given the finalized state:
+// the validator already initiated an exit, e.g. by a previous inclusion of the exit, or by slashing.
+func (vep *VoluntaryExitPool) Prune(finalized common.BeaconState) error {
+	vep.Lock()
+	defer vep.Unlock()
+	vals, err := finalized.Validators()
+	if err != nil {
+		return err
+	}
+	for index := range vep.exits {
+		if valid, err := vals.IsValidIndex(index); err != nil {
+			return err
+		} else if !valid {
+			continue
+		}
+		v, err := vals.Validator(index)
+		if err != nil {
+			return err
+		}
+		if exitEpoch, err := v.ExitEpoch(); err != nil {
+			return err
+		} else if exitEpoch != common.FAR_FUTURE_EPOCH {
+			delete(vep.exits, index)
+		}
+	}
 	return nil
 }
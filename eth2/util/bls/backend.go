@@ -0,0 +1,83 @@
+package bls
+
+import (
+	"sync/atomic"
+)
+
+// BLSSecretKey is a serialized (big-endian) secret key, used to sign with.
+type BLSSecretKey [32]byte
+
+var G2_POINT_AT_INFINITY = BLSSignature{0: 0xc0}
+
+// Backend implements the BLS signature scheme.
+// The backend can be changed at runtime with SetBackend, the default depends on the bls_off build tag.
+type Backend interface {
+	// Name of the backend, for logging and debugging.
+	Name() string
+	// Pubkey derives the pubkey of the secret key.
+	Pubkey(secret *BLSSecretKey) (BLSPubkey, error)
+	// Sign the message with the secret key.
+	Sign(secret *BLSSecretKey, message [32]byte) (BLSSignature, error)
+	// Verify the signature of a single pubkey.
+	Verify(pubkey *CachedPubkey, message [32]byte, signature BLSSignature) bool
+	// FastAggregateVerify verifies the aggregate signature of the pubkeys, all signing the same message.
+	// With the eth2 exception: no pubkeys are valid with the G2 point at infinity as signature.
+	FastAggregateVerify(pubkeys []*CachedPubkey, message [32]byte, signature BLSSignature) bool
+	// AggregateSignatures combines the signatures into a single aggregate signature.
+	AggregateSignatures(signatures []BLSSignature) (BLSSignature, error)
+	// AggregatePubkeys combines the pubkeys into a single aggregate pubkey.
+	AggregatePubkeys(pubkeys []*CachedPubkey) (BLSPubkey, error)
+	// VerifyBatch verifies the signature sets all at once.
+	VerifyBatch(sets []SignatureSet) bool
+}
+
+type backendHolder struct {
+	Backend
+}
+
+var currentBackend atomic.Value
+
+func init() {
+	currentBackend.Store(backendHolder{defaultBackend})
+}
+
+// SetBackend changes the BLS backend used by the package-level functions.
+func SetBackend(b Backend) {
+	currentBackend.Store(backendHolder{b})
+}
+
+// CurrentBackend returns the BLS backend used by the package-level functions.
+func CurrentBackend() Backend {
+	return currentBackend.Load().(backendHolder).Backend
+}
+
+func Pubkey(secret *BLSSecretKey) (BLSPubkey, error) {
+	return CurrentBackend().Pubkey(secret)
+}
+
+func Sign(secret *BLSSecretKey, message [32]byte) (BLSSignature, error) {
+	return CurrentBackend().Sign(secret, message)
+}
+
+func Verify(pubkey *CachedPubkey, message [32]byte, signature BLSSignature) bool {
+	return CurrentBackend().Verify(pubkey, message, signature)
+}
+
+func Eth2FastAggregateVerify(pubkeys []*CachedPubkey, message [32]byte, signature BLSSignature) bool {
+	return CurrentBackend().FastAggregateVerify(pubkeys, message, signature)
+}
+
+// AggregateSignatures combines the signatures into a single aggregate signature.
+func AggregateSignatures(signatures []BLSSignature) (BLSSignature, error) {
+	return CurrentBackend().AggregateSignatures(signatures)
+}
+
+// AggregatePubkeys combines the pubkeys into a single aggregate pubkey.
+func AggregatePubkeys(pubkeys []*CachedPubkey) (BLSPubkey, error) {
+	return CurrentBackend().AggregatePubkeys(pubkeys)
+}
+
+// VerifyBatch verifies the signature sets all at once.
+func VerifyBatch(sets []SignatureSet) bool {
+	return CurrentBackend().VerifyBatch(sets)
+}
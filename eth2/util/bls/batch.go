@@ -0,0 +1,93 @@
+package bls
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// SignatureSet is a signature, with the pubkeys and the message it is expected to sign.
+// A single pubkey is verified as a regular signature, multiple pubkeys as a fast-aggregate signature.
+type SignatureSet struct {
+	Pubkeys   []*CachedPubkey
+	Message   [32]byte
+	Signature BLSSignature
+	// Description of the signed object, to report an invalid set with.
+	Description string
+}
+
+// Verify verifies the signature set by itself.
+func (s *SignatureSet) Verify() bool {
+	if len(s.Pubkeys) == 1 {
+		return Verify(s.Pubkeys[0], s.Message, s.Signature)
+	}
+	return Eth2FastAggregateVerify(s.Pubkeys, s.Message, s.Signature)
+}
+
+// SignatureBatch collects signature sets, to verify them all at once with a single randomized batch verification.
+// A batch is safe for concurrent use.
+type SignatureBatch struct {
+	sync.Mutex
+	sets []SignatureSet
+}
+
+func NewSignatureBatch() *SignatureBatch {
+	return &SignatureBatch{}
+}
+
+// Add defers the verification of the signature set to the verification of the batch.
+func (b *SignatureBatch) Add(set SignatureSet) {
+	b.Lock()
+	defer b.Unlock()
+	b.sets = append(b.sets, set)
+}
+
+// Len returns the number of collected signature sets.
+func (b *SignatureBatch) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.sets)
+}
+
+// Verify verifies all collected signature sets, and resets the batch.
+// If the batch verification fails, the sets are verified one by one, to report the first invalid set.
+func (b *SignatureBatch) Verify() error {
+	b.Lock()
+	sets := b.sets
+	b.sets = nil
+	b.Unlock()
+	if len(sets) == 0 || VerifyBatch(sets) {
+		return nil
+	}
+	for i := range sets {
+		if !sets[i].Verify() {
+			return fmt.Errorf("invalid signature for %s", sets[i].Description)
+		}
+	}
+	// Each set is valid, while the batch is not. Unlikely, but the batch is invalid all the same.
+	return fmt.Errorf("invalid signature batch of %d sets", len(sets))
+}
+
+type signatureBatchKey struct{}
+
+// WithSignatureBatch returns a context that makes VerifySet defer signature verification to the given batch.
+func WithSignatureBatch(ctx context.Context, b *SignatureBatch) context.Context {
+	return context.WithValue(ctx, signatureBatchKey{}, b)
+}
+
+// SignatureBatchFromContext returns the signature batch of the context, or nil if there is none.
+func SignatureBatchFromContext(ctx context.Context) *SignatureBatch {
+	b, _ := ctx.Value(signatureBatchKey{}).(*SignatureBatch)
+	return b
+}
+
+// VerifySet verifies the signature set, or defers the verification to the signature batch of the context.
+// When deferred, the set is considered valid until the batch is verified.
+func VerifySet(ctx context.Context, set SignatureSet) bool {
+	// Sets without pubkeys are only valid with the point at infinity, and cannot be batched.
+	if b := SignatureBatchFromContext(ctx); b != nil && len(set.Pubkeys) > 0 {
+		b.Add(set)
+		return true
+	}
+	return set.Verify()
+}
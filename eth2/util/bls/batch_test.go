@@ -0,0 +1,121 @@
+package bls
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSignatureBatch(t *testing.T) {
+	for _, b := range []Backend{HerumiBackend, MockBackend} {
+		t.Run(b.Name(), func(t *testing.T) {
+			prev := CurrentBackend()
+			SetBackend(b)
+			defer SetBackend(prev)
+			testSignatureBatch(t)
+		})
+	}
+}
+
+func testSignatureBatch(t *testing.T) {
+	keys := make([]BLSSecretKey, 4, 4)
+	pubs := make([]*CachedPubkey, 4, 4)
+	for i := range keys {
+		keys[i][31] = byte(i + 1)
+		pub, err := Pubkey(&keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs[i] = &CachedPubkey{Compressed: pub}
+	}
+	sign := func(msg [32]byte, signers ...int) BLSSignature {
+		sigs := make([]BLSSignature, 0, len(signers))
+		for _, s := range signers {
+			sig, err := Sign(&keys[s], msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sigs = append(sigs, sig)
+		}
+		agg, err := AggregateSignatures(sigs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return agg
+	}
+	msgA := [32]byte{1}
+	msgB := [32]byte{2}
+	sets := []SignatureSet{
+		{Pubkeys: pubs[:1], Message: msgA, Signature: sign(msgA, 0), Description: "single"},
+		// same message, different signer
+		{Pubkeys: pubs[1:2], Message: msgA, Signature: sign(msgA, 1), Description: "same message"},
+		{Pubkeys: pubs[1:4], Message: msgB, Signature: sign(msgB, 1, 2, 3), Description: "aggregate"},
+	}
+
+	batch := NewSignatureBatch()
+	ctx := WithSignatureBatch(context.Background(), batch)
+	for _, set := range sets {
+		if !VerifySet(ctx, set) {
+			t.Fatal("expected set to be deferred to the batch")
+		}
+	}
+	if batch.Len() != len(sets) {
+		t.Fatalf("expected %d sets in batch, got %d", len(sets), batch.Len())
+	}
+	if err := batch.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Len() != 0 {
+		t.Fatal("expected batch to be reset after verification")
+	}
+
+	// the valid sets cannot make up for the invalid set
+	bad := SignatureSet{Pubkeys: pubs[2:3], Message: msgB, Signature: sign(msgA, 2), Description: "bad"}
+	for _, set := range append(sets, bad) {
+		batch.Add(set)
+	}
+	if err := batch.Verify(); err == nil {
+		t.Fatal("expected invalid batch")
+	} else if err.Error() != "invalid signature for bad" {
+		t.Fatalf("expected the invalid set to be reported, got: %v", err)
+	}
+
+	// without batch the set is verified immediately
+	if VerifySet(context.Background(), bad) {
+		t.Fatal("expected invalid signature")
+	}
+}
+
+func TestMockBackend(t *testing.T) {
+	var secret BLSSecretKey
+	secret[31] = 1
+	pub, err := MockBackend.Pubkey(&secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := &CachedPubkey{Compressed: pub}
+	msg := [32]byte{1}
+	sig, err := MockBackend.Sign(&secret, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := MockBackend.Sign(&secret, msg); again != sig {
+		t.Fatal("expected deterministic signature")
+	}
+	if !MockBackend.Verify(cached, msg, sig) {
+		t.Fatal("expected valid signature")
+	}
+	if MockBackend.Verify(cached, [32]byte{2}, sig) {
+		t.Fatal("expected signature of other message to be rejected")
+	}
+	secret[31] = 2
+	other, err := MockBackend.Pubkey(&secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if MockBackend.Verify(&CachedPubkey{Compressed: other}, msg, sig) {
+		t.Fatal("expected signature of other key to be rejected")
+	}
+	if !MockBackend.FastAggregateVerify(nil, msg, G2_POINT_AT_INFINITY) {
+		t.Fatal("expected point at infinity to be valid without pubkeys")
+	}
+}
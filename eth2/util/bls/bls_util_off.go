@@ -2,16 +2,8 @@
 
 package bls
 
+// BLS_ACTIVE is false, signatures are not checked with real BLS by default.
 const BLS_ACTIVE = false
 
-func Verify(pubkey *CachedPubkey, message [32]byte, signature BLSSignature) bool {
-	// TODO BLS verify single
-	// Temporary: just allow it.
-	return true
-}
-
-func FastAggregateVerify(pubkeys []*CachedPubkey, message [32]byte, signature BLSSignature) bool {
-	// TODO BLS verify multiple
-	// Temporary: just allow it.
-	return true
-}
+// The mock scheme is fast, and still rejects wrong signatures, for tests to sign with.
+var defaultBackend Backend = MockBackend
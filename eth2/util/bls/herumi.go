@@ -0,0 +1,190 @@
+package bls
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	hbls "github.com/herumi/bls-eth-go-binary/bls"
+)
+
+func init() {
+	if err := hbls.Init(hbls.BLS12_381); err != nil {
+		panic(err)
+	}
+	if err := hbls.SetETHmode(3); err != nil { // draft 7
+		panic(err)
+	}
+}
+
+// HerumiBackend implements BLS with the Herumi BLS library.
+var HerumiBackend Backend = herumiBackend{}
+
+type herumiBackend struct{}
+
+func (herumiBackend) Name() string {
+	return "herumi"
+}
+
+func parseSecretKey(secret *BLSSecretKey) (*hbls.SecretKey, error) {
+	var sk hbls.SecretKey
+	tmp := make([]byte, 32, 32)
+	copy(tmp, secret[:])
+	if err := sk.Deserialize(tmp); err != nil {
+		return nil, err
+	}
+	return &sk, nil
+}
+
+func (herumiBackend) Pubkey(secret *BLSSecretKey) (out BLSPubkey, err error) {
+	sk, err := parseSecretKey(secret)
+	if err != nil {
+		return BLSPubkey{}, err
+	}
+	copy(out[:], sk.GetPublicKey().Serialize())
+	return out, nil
+}
+
+func (herumiBackend) Sign(secret *BLSSecretKey, message [32]byte) (out BLSSignature, err error) {
+	sk, err := parseSecretKey(secret)
+	if err != nil {
+		return BLSSignature{}, err
+	}
+	copy(out[:], sk.SignByte(message[:]).Serialize())
+	return out, nil
+}
+
+func (herumiBackend) Verify(pubkey *CachedPubkey, message [32]byte, signature BLSSignature) bool {
+	parsedPubkey, err := pubkey.Pubkey()
+	if err != nil {
+		return false
+	}
+	var parsedSig hbls.Sign
+	if err := parsedSig.Deserialize(signature[:]); err != nil {
+		return false
+	}
+
+	return parsedSig.VerifyHash(parsedPubkey, message[:])
+}
+
+func parsePubkeys(pubkeys []*CachedPubkey) ([]hbls.PublicKey, error) {
+	pubs := make([]hbls.PublicKey, len(pubkeys), len(pubkeys))
+	for i, p := range pubkeys {
+		pub, err := p.Pubkey()
+		if err != nil {
+			return nil, err
+		}
+		pubs[i] = *pub
+	}
+	return pubs, nil
+}
+
+func (herumiBackend) FastAggregateVerify(pubkeys []*CachedPubkey, message [32]byte, signature BLSSignature) bool {
+	pubs, err := parsePubkeys(pubkeys)
+	if err != nil {
+		return false
+	}
+	if len(pubs) == 0 {
+		if signature == G2_POINT_AT_INFINITY {
+			return true
+		} else {
+			// If it's not G2_POINT_AT_INFINITY,
+			// then don't use Herumi BLS to verify something unnecessarily.
+			// And the 0 length pubkeys would panic in Herumi BLS.
+			return false
+		}
+	}
+
+	var parsedSig hbls.Sign
+	if err := parsedSig.Deserialize(signature[:]); err != nil {
+		return false
+	}
+
+	return parsedSig.FastAggregateVerify(pubs, message[:])
+}
+
+func (herumiBackend) AggregateSignatures(signatures []BLSSignature) (BLSSignature, error) {
+	if len(signatures) == 0 {
+		return BLSSignature{}, errors.New("no signatures to aggregate")
+	}
+	parsed := make([]hbls.Sign, len(signatures), len(signatures))
+	for i := range signatures {
+		if err := parsed[i].Deserialize(signatures[i][:]); err != nil {
+			return BLSSignature{}, fmt.Errorf("failed to deserialize signature %d: %v", i, err)
+		}
+	}
+	var agg hbls.Sign
+	agg.Aggregate(parsed)
+	var out BLSSignature
+	copy(out[:], agg.Serialize())
+	return out, nil
+}
+
+func (herumiBackend) AggregatePubkeys(pubkeys []*CachedPubkey) (BLSPubkey, error) {
+	var agg hbls.PublicKey
+	for i, p := range pubkeys {
+		pub, err := p.Pubkey()
+		if err != nil {
+			return BLSPubkey{}, fmt.Errorf("invalid pubkey %d: %v", i, err)
+		}
+		agg.Add(pub)
+	}
+	var out BLSPubkey
+	copy(out[:], agg.Serialize())
+	return out, nil
+}
+
+// VerifyBatch weighs each set with a random scalar, for the signatures not to be able to cancel each other out.
+func (herumiBackend) VerifyBatch(sets []SignatureSet) bool {
+	if len(sets) == 0 {
+		return true
+	}
+	pubs := make([]hbls.PublicKey, len(sets), len(sets))
+	msgs := make([]byte, 0, len(sets)*32)
+	var aggSig hbls.G2
+	var r hbls.Fr
+	var randBytes [8]byte
+	for i := range sets {
+		set := &sets[i]
+		if len(set.Pubkeys) == 0 {
+			return false
+		}
+		var aggPub hbls.PublicKey
+		for j, p := range set.Pubkeys {
+			pub, err := p.Pubkey()
+			if err != nil {
+				return false
+			}
+			if j == 0 {
+				aggPub = *pub
+			} else {
+				aggPub.Add(pub)
+			}
+		}
+		var sig hbls.Sign
+		if err := sig.Deserialize(set.Signature[:]); err != nil {
+			return false
+		}
+		// A non-zero 64 bit random scalar
+		for {
+			if _, err := rand.Read(randBytes[:]); err != nil {
+				return false
+			}
+			if err := r.SetLittleEndian(randBytes[:]); err != nil {
+				return false
+			}
+			if !r.IsZero() {
+				break
+			}
+		}
+		hbls.G1Mul(hbls.CastFromPublicKey(&pubs[i]), hbls.CastFromPublicKey(&aggPub), &r)
+		var weighted hbls.G2
+		hbls.G2Mul(&weighted, hbls.CastFromSign(&sig), &r)
+		if i == 0 {
+			aggSig = weighted
+		} else {
+			hbls.G2Add(&aggSig, &aggSig, &weighted)
+		}
+		msgs = append(msgs, set.Message[:]...)
+	}
+	return hbls.CastToSign(&aggSig).AggregateVerifyNoCheck(pubs, msgs)
+}
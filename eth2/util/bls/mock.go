@@ -0,0 +1,143 @@
+package bls
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// MockBackend is a fast deterministic signature scheme, for testing only: it is NOT secure.
+//
+// A mock signature is a hash of the pubkey and the message, and aggregates are the sum of the signatures.
+// Anyone can forge signatures, but signatures of the wrong key, message or domain are still rejected,
+// so tests that sign can run quickly while still checking what is signed.
+// The pubkeys and signatures are not valid BLS12-381 points, and cannot be mixed with other backends.
+var MockBackend Backend = mockBackend{}
+
+type mockBackend struct{}
+
+func (mockBackend) Name() string {
+	return "mock"
+}
+
+func (mockBackend) Pubkey(secret *BLSSecretKey) (out BLSPubkey, err error) {
+	if *secret == (BLSSecretKey{}) {
+		return BLSPubkey{}, errors.New("zero secret key")
+	}
+	h := sha256.New()
+	h.Write([]byte("mock pubkey"))
+	h.Write(secret[:])
+	copy(out[:], h.Sum(nil))
+	h.Write(out[:32])
+	copy(out[32:], h.Sum(nil))
+	return out, nil
+}
+
+// mockSign computes the mock signature of the pubkey for the message.
+func mockSign(pubkey *BLSPubkey, message [32]byte) (out BLSSignature) {
+	for i := 0; i < 3; i++ {
+		h := sha256.New()
+		h.Write([]byte{byte(i)})
+		h.Write(pubkey[:])
+		h.Write(message[:])
+		copy(out[i*32:(i+1)*32], h.Sum(nil))
+	}
+	return out
+}
+
+// mockAdd adds b to a, as little-endian numbers of equal length, modulo the size.
+func mockAdd(a []byte, b []byte) {
+	carry := uint16(0)
+	for i := range a {
+		v := uint16(a[i]) + uint16(b[i]) + carry
+		a[i] = byte(v)
+		carry = v >> 8
+	}
+}
+
+func (m mockBackend) Sign(secret *BLSSecretKey, message [32]byte) (BLSSignature, error) {
+	pub, err := m.Pubkey(secret)
+	if err != nil {
+		return BLSSignature{}, err
+	}
+	return mockSign(&pub, message), nil
+}
+
+func (mockBackend) Verify(pubkey *CachedPubkey, message [32]byte, signature BLSSignature) bool {
+	return mockSign(&pubkey.Compressed, message) == signature
+}
+
+func (mockBackend) FastAggregateVerify(pubkeys []*CachedPubkey, message [32]byte, signature BLSSignature) bool {
+	if len(pubkeys) == 0 {
+		return signature == G2_POINT_AT_INFINITY
+	}
+	var agg BLSSignature
+	for _, p := range pubkeys {
+		sig := mockSign(&p.Compressed, message)
+		mockAdd(agg[:], sig[:])
+	}
+	return agg == signature
+}
+
+func (mockBackend) AggregateSignatures(signatures []BLSSignature) (out BLSSignature, err error) {
+	if len(signatures) == 0 {
+		return BLSSignature{}, errors.New("no signatures to aggregate")
+	}
+	for i := range signatures {
+		mockAdd(out[:], signatures[i][:])
+	}
+	return out, nil
+}
+
+func (mockBackend) AggregatePubkeys(pubkeys []*CachedPubkey) (out BLSPubkey, err error) {
+	for _, p := range pubkeys {
+		mockAdd(out[:], p.Compressed[:])
+	}
+	return out, nil
+}
+
+func (mockBackend) VerifyBatch(sets []SignatureSet) bool {
+	for i := range sets {
+		if !sets[i].Verify() {
+			return false
+		}
+	}
+	return true
+}
+
+// NoopBackend accepts any signature, for testing only.
+// Signing, pubkey derivation and aggregation produce zero values.
+var NoopBackend Backend = noopBackend{}
+
+type noopBackend struct{}
+
+func (noopBackend) Name() string {
+	return "noop"
+}
+
+func (noopBackend) Pubkey(secret *BLSSecretKey) (BLSPubkey, error) {
+	return BLSPubkey{}, nil
+}
+
+func (noopBackend) Sign(secret *BLSSecretKey, message [32]byte) (BLSSignature, error) {
+	return BLSSignature{}, nil
+}
+
+func (noopBackend) Verify(pubkey *CachedPubkey, message [32]byte, signature BLSSignature) bool {
+	return true
+}
+
+func (noopBackend) FastAggregateVerify(pubkeys []*CachedPubkey, message [32]byte, signature BLSSignature) bool {
+	return true
+}
+
+func (noopBackend) AggregateSignatures(signatures []BLSSignature) (BLSSignature, error) {
+	return BLSSignature{}, nil
+}
+
+func (noopBackend) AggregatePubkeys(pubkeys []*CachedPubkey) (BLSPubkey, error) {
+	return BLSPubkey{}, nil
+}
+
+func (noopBackend) VerifyBatch(sets []SignatureSet) bool {
+	return true
+}
@@ -0,0 +1,206 @@
+package fork_choice
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/chain"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/tests/spec/test_util"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+type HeadCheck struct {
+	Slot common.Slot `yaml:"slot"`
+	Root common.Root `yaml:"root"`
+}
+
+type Checks struct {
+	Time                    *common.Timestamp  `yaml:"time"`
+	GenesisTime             *common.Timestamp  `yaml:"genesis_time"`
+	Head                    *HeadCheck         `yaml:"head"`
+	JustifiedCheckpoint     *common.Checkpoint `yaml:"justified_checkpoint"`
+	FinalizedCheckpoint     *common.Checkpoint `yaml:"finalized_checkpoint"`
+	BestJustifiedCheckpoint *common.Checkpoint `yaml:"best_justified_checkpoint"`
+	ProposerBoostRoot       *common.Root       `yaml:"proposer_boost_root"`
+}
+
+type Step struct {
+	Tick        *common.Timestamp `yaml:"tick"`
+	Block       string            `yaml:"block"`
+	Attestation string            `yaml:"attestation"`
+	PowBlock    string            `yaml:"pow_block"`
+	// Valid is false if the block or attestation of the step is expected to be rejected.
+	Valid  *bool   `yaml:"valid"`
+	Checks *Checks `yaml:"checks"`
+}
+
+type ForkChoiceTestCase struct {
+	Spec   *common.Spec
+	Fork   test_util.ForkName
+	Anchor common.BeaconState
+	Steps  []Step
+	// Objects of the steps, by name
+	Blocks       map[string]*common.BeaconBlockEnvelope
+	Attestations map[string]*phase0.Attestation
+}
+
+func (c *ForkChoiceTestCase) loadBlock(t *testing.T, name string, readPart test_util.TestPartReader) *common.BeaconBlockEnvelope {
+	valRoot, err := c.Anchor.GenesisValidatorsRoot()
+	test_util.Check(t, err)
+	var block interface {
+		common.SpecObj
+		Envelope(spec *common.Spec, digest common.ForkDigest) *common.BeaconBlockEnvelope
+	}
+	var version common.Version
+	switch c.Fork {
+	case "phase0":
+		block, version = new(phase0.SignedBeaconBlock), c.Spec.GENESIS_FORK_VERSION
+	case "altair":
+		block, version = new(altair.SignedBeaconBlock), c.Spec.ALTAIR_FORK_VERSION
+	case "merge":
+		block, version = new(merge.SignedBeaconBlock), c.Spec.MERGE_FORK_VERSION
+	default:
+		t.Fatalf("unrecognized fork name: %s", c.Fork)
+	}
+	if !test_util.LoadSpecObj(t, name, block, readPart) {
+		t.Fatalf("missing block %s", name)
+	}
+	return block.Envelope(c.Spec, common.ComputeForkDigest(version, valRoot))
+}
+
+func (c *ForkChoiceTestCase) Load(t *testing.T, forkName test_util.ForkName, readPart test_util.TestPartReader) {
+	c.Spec = readPart.Spec()
+	c.Fork = forkName
+	c.Anchor = test_util.LoadState(t, forkName, "anchor_state", readPart)
+	if c.Anchor == nil {
+		t.Fatalf("failed to load anchor state")
+	}
+	p := readPart.Part("steps.yaml")
+	dec := yaml.NewDecoder(p)
+	test_util.Check(t, dec.Decode(&c.Steps))
+	test_util.Check(t, p.Close())
+	c.Blocks = make(map[string]*common.BeaconBlockEnvelope)
+	c.Attestations = make(map[string]*phase0.Attestation)
+	for _, step := range c.Steps {
+		if step.PowBlock != "" {
+			t.Skip("pow block steps are not supported")
+		}
+		if step.Block != "" {
+			c.Blocks[step.Block] = c.loadBlock(t, step.Block, readPart)
+		}
+		if step.Attestation != "" {
+			if step.Valid != nil && !*step.Valid {
+				t.Skip("attestations are not validated by the chain, invalid attestation steps are not supported")
+			}
+			att := new(phase0.Attestation)
+			if !test_util.LoadSpecObj(t, step.Attestation, att, readPart) {
+				t.Fatalf("missing attestation %s", step.Attestation)
+			}
+			c.Attestations[step.Attestation] = att
+		}
+	}
+}
+
+func (c *ForkChoiceTestCase) Run(t *testing.T) {
+	ctx := context.Background()
+	hc, err := chain.NewHotColdChain(c.Anchor, c.Spec, states.NewMemDB(c.Spec))
+	test_util.Check(t, err)
+	fc := hc.HotChain.(*chain.UnfinalizedChain).ForkChoice
+	for i, step := range c.Steps {
+		switch {
+		case step.Tick != nil:
+			test_util.Check(t, hc.OnTick(ctx, *step.Tick))
+		case step.Block != "":
+			err := hc.AddBlockAt(ctx, c.Blocks[step.Block], fc.Time())
+			if step.Valid != nil && !*step.Valid {
+				if err == nil {
+					t.Fatalf("step %d: expected block %s to be rejected", i, step.Block)
+				}
+			} else if err != nil {
+				t.Fatalf("step %d: failed to add block %s: %v", i, step.Block, err)
+			}
+		case step.Attestation != "":
+			if err := hc.AddAttestation(c.Attestations[step.Attestation]); err != nil {
+				t.Fatalf("step %d: failed to add attestation %s: %v", i, step.Attestation, err)
+			}
+		case step.Checks != nil:
+			if err := c.check(hc, fc, step.Checks); err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+		}
+	}
+}
+
+func (c *ForkChoiceTestCase) check(hc *chain.HotColdChain, fc interface {
+	Time() common.Timestamp
+	GetSlot(blockRoot common.Root) (slot common.Slot, ok bool)
+	Justified() common.Checkpoint
+	Finalized() common.Checkpoint
+	BestJustified() common.Checkpoint
+	ProposerBoostRoot() common.Root
+}, checks *Checks) error {
+	if checks.Time != nil && fc.Time() != *checks.Time {
+		return fmt.Errorf("expected time %d, got %d", *checks.Time, fc.Time())
+	}
+	if checks.GenesisTime != nil && hc.Genesis().Time != *checks.GenesisTime {
+		return fmt.Errorf("expected genesis time %d, got %d", *checks.GenesisTime, hc.Genesis().Time)
+	}
+	if checks.Head != nil {
+		head, err := hc.Head()
+		if err != nil {
+			return err
+		}
+		slot, _ := fc.GetSlot(head.BlockRoot())
+		if got := (HeadCheck{Slot: slot, Root: head.BlockRoot()}); got != *checks.Head {
+			return fmt.Errorf("expected head %s at slot %d, got %s at slot %d",
+				checks.Head.Root, checks.Head.Slot, got.Root, got.Slot)
+		}
+	}
+	if checks.JustifiedCheckpoint != nil && fc.Justified() != *checks.JustifiedCheckpoint {
+		return fmt.Errorf("expected justified checkpoint %s, got %s", *checks.JustifiedCheckpoint, fc.Justified())
+	}
+	if checks.FinalizedCheckpoint != nil && fc.Finalized() != *checks.FinalizedCheckpoint {
+		return fmt.Errorf("expected finalized checkpoint %s, got %s", *checks.FinalizedCheckpoint, fc.Finalized())
+	}
+	if checks.BestJustifiedCheckpoint != nil && fc.BestJustified() != *checks.BestJustifiedCheckpoint {
+		return fmt.Errorf("expected best justified checkpoint %s, got %s",
+			*checks.BestJustifiedCheckpoint, fc.BestJustified())
+	}
+	if checks.ProposerBoostRoot != nil && fc.ProposerBoostRoot() != *checks.ProposerBoostRoot {
+		return fmt.Errorf("expected proposer boost root %s, got %s", *checks.ProposerBoostRoot, fc.ProposerBoostRoot())
+	}
+	return nil
+}
+
+func runForkChoiceTest(t *testing.T, handlerName string) {
+	caseRunner := test_util.HandleBLS(func(t *testing.T, forkName test_util.ForkName, readPart test_util.TestPartReader) {
+		c := new(ForkChoiceTestCase)
+		c.Load(t, forkName, readPart)
+		c.Run(t)
+	})
+	for _, preset := range []*common.Spec{configs.Minimal, configs.Mainnet} {
+		spec := *preset
+		spec.ExecutionEngine = &test_util.NoOpExecutionEngine{}
+		t.Run(spec.PRESET_BASE, func(t *testing.T) {
+			for _, fork := range test_util.AllForks {
+				t.Run(string(fork), func(t *testing.T) {
+					test_util.RunHandler(t, "fork_choice/"+handlerName, caseRunner, &spec, fork)
+				})
+			}
+		})
+	}
+}
+
+func TestGetHead(t *testing.T) {
+	runForkChoiceTest(t, "get_head")
+}
+
+func TestOnBlock(t *testing.T) {
+	runForkChoiceTest(t, "on_block")
+}
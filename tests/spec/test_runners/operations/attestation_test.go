@@ -1,6 +1,7 @@
 package operations
 
 import (
+	"context"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/altair"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
@@ -25,9 +26,9 @@ func (c *AttestationTestCase) Run() error {
 		return err
 	}
 	if s, ok := c.Pre.(phase0.Phase0PendingAttestationsBeaconState); ok {
-		return phase0.ProcessAttestation(c.Spec, epc, s, &c.Attestation)
+		return phase0.ProcessAttestation(context.Background(), c.Spec, epc, s, &c.Attestation)
 	} else if s, ok := c.Pre.(*altair.BeaconStateView); ok {
-		return altair.ProcessAttestation(c.Spec, epc, s, &c.Attestation)
+		return altair.ProcessAttestation(context.Background(), c.Spec, epc, s, &c.Attestation)
 	} else {
 		return fmt.Errorf("unrecognized state type: %T", s)
 	}
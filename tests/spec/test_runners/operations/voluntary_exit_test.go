@@ -1,6 +1,7 @@
 package operations
 
 import (
+	"context"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"github.com/protolambda/zrnt/tests/spec/test_util"
@@ -22,7 +23,7 @@ func (c *VoluntaryExitTestCase) Run() error {
 	if err != nil {
 		return err
 	}
-	return phase0.ProcessVoluntaryExit(c.Spec, epc, c.Pre, &c.VoluntaryExit)
+	return phase0.ProcessVoluntaryExit(context.Background(), c.Spec, epc, c.Pre, &c.VoluntaryExit)
 }
 
 func TestVoluntaryExit(t *testing.T) {